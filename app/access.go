@@ -0,0 +1,115 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "slices"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// An API key with tags only has access to the contacts carrying at least one
+// of them: the "partners" integration key of {"tags": ["partner"]} sees,
+// changes and counts partner contacts only. The contacts collection enforces
+// this on every operation made with the key's request context, so handlers
+// don't have to remember to.
+
+// keyTags are the tags the caller's key is limited to, none if it isn't
+func keyTags(ctx context.Context) []string {
+    if ctx.Value(unscopedKey) != nil {
+        return nil
+    }
+    p, _ := ctx.Value(principalKey).(Principal)
+    return p.Tags
+}
+
+// unscoped lifts the caller's tag limits from ctx, for bookkeeping that must
+// see all of the tenant's contacts, such as counting them against quotas
+func unscoped(ctx context.Context) context.Context {
+    return context.WithValue(ctx, unscopedKey, true)
+}
+
+// maySee reports whether the caller's key has access to a contact with tags
+func maySee(r *http.Request, tags []string) bool {
+    limit := keyTags(r.Context())
+    return len(limit) == 0 || slices.ContainsFunc(tags, func(t string) bool { return slices.Contains(limit, t) })
+}
+
+// withKeyTags gives a new contact the first of the caller's key tags if it
+// has none of them, so a tag-limited key can see what it creates
+func withKeyTags(r *http.Request, tags []string) []string {
+    if maySee(r, tags) {
+        return tags
+    }
+    return append(tags, keyTags(r.Context())[0])
+}
+
+// restrict narrows filter to the contacts the caller's key has access to
+func (c collection) restrict(ctx context.Context, filter any) any {
+    tags := keyTags(ctx)
+    if !c.tagScoped || len(tags) == 0 {
+        return filter
+    }
+    limit := bson.M{"tags": bson.M{"$in": tags}}
+    if filter == nil {
+        return limit
+    }
+    return bson.M{"$and": bson.A{filter, limit}}
+}
+
+// restrictPipeline starts pipeline with a $match on the contacts the
+// caller's key has access to
+func (c collection) restrictPipeline(ctx context.Context, pipeline any) (any, error) {
+    tags := keyTags(ctx)
+    if !c.tagScoped || len(tags) == 0 {
+        return pipeline, nil
+    }
+    match := bson.M{"$match": bson.M{"tags": bson.M{"$in": tags}}}
+    switch p := pipeline.(type) {
+    case mongo.Pipeline:
+        return append(mongo.Pipeline{{{Key: "$match", Value: match["$match"]}}}, p...), nil
+    case bson.A:
+        return append(bson.A{match}, p...), nil
+    case []bson.M:
+        return append([]bson.M{match}, p...), nil
+    }
+    return nil, fmt.Errorf("can't limit a %T pipeline to the key's tags", pipeline)
+}
+
+// restrictModels narrows the filters of the write models to the contacts the
+// caller's key has access to; the models passed in are left as they are
+func (c collection) restrictModels(ctx context.Context, models []mongo.WriteModel) []mongo.WriteModel {
+    if !c.tagScoped || len(keyTags(ctx)) == 0 {
+        return models
+    }
+    out := make([]mongo.WriteModel, len(models))
+    for i, m := range models {
+        switch m := m.(type) {
+        case *mongo.UpdateOneModel:
+            scoped := *m
+            scoped.Filter = c.restrict(ctx, m.Filter)
+            out[i] = &scoped
+        case *mongo.UpdateManyModel:
+            scoped := *m
+            scoped.Filter = c.restrict(ctx, m.Filter)
+            out[i] = &scoped
+        case *mongo.ReplaceOneModel:
+            scoped := *m
+            scoped.Filter = c.restrict(ctx, m.Filter)
+            out[i] = &scoped
+        case *mongo.DeleteOneModel:
+            scoped := *m
+            scoped.Filter = c.restrict(ctx, m.Filter)
+            out[i] = &scoped
+        case *mongo.DeleteManyModel:
+            scoped := *m
+            scoped.Filter = c.restrict(ctx, m.Filter)
+            out[i] = &scoped
+        default:
+            out[i] = m
+        }
+    }
+    return out
+}
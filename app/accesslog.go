@@ -0,0 +1,255 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "os"
+    "strconv"
+    "sync"
+    "text/template"
+    "time"
+)
+
+// AccessLogConfig selects the access log format and where it is written.
+// Output is "stdout" or a file path; files are rotated once they reach MaxSizeMB.
+type AccessLogConfig struct {
+    Format     string `json:"format"` // off, common, combined, json or template
+    Template   string `json:"template"`
+    Output     string `json:"output"`
+    MaxSizeMB  int    `json:"max_size_mb"`
+    MaxBackups int    `json:"max_backups"`
+}
+
+// AccessLogEntry is one request as seen by the access log; its fields are
+// available to custom templates, e.g. {{.Method}} {{.Status}} {{.Duration}}
+type AccessLogEntry struct {
+    Time      time.Time     `json:"time"`
+    RequestID string        `json:"request_id"`
+    RemoteIP  string        `json:"remote_ip"`
+    User      string        `json:"user,omitempty"`
+    Method    string        `json:"method"`
+    URI       string        `json:"uri"`
+    Proto     string        `json:"proto"`
+    Route     string        `json:"route"`
+    Status    int           `json:"status"`
+    Bytes     int           `json:"bytes"`
+    Duration  time.Duration `json:"-"`
+    Referer   string        `json:"referer,omitempty"`
+    UserAgent string        `json:"user_agent,omitempty"`
+    TraceID   string        `json:"trace_id,omitempty"`
+}
+
+// accessLogger writes entries in the configured format; it is rebuilt by
+// applyConfig whenever access_log changes
+type accessLogger struct {
+    mu     sync.Mutex
+    format string
+    tmpl   *template.Template
+    out    io.Writer
+    file   *rotatingFile
+}
+
+var accessLog = &accessLogger{format: "off"}
+
+// validate checks the format and parses a custom template
+func (c AccessLogConfig) validate() (*template.Template, error) {
+    switch c.Format {
+    case "", "off", "common", "combined", "json":
+        return nil, nil
+    case "template":
+        if c.Template == "" {
+            return nil, fmt.Errorf("access_log.template is required for the template format")
+        }
+        tmpl, err := template.New("access_log").Parse(c.Template)
+        if err != nil {
+            return nil, fmt.Errorf("access_log.template: %w", err)
+        }
+        return tmpl, nil
+    default:
+        return nil, fmt.Errorf("access_log.format must be off, common, combined, json or template")
+    }
+}
+
+// configure switches to c, falling back to stdout when the file cannot be opened
+func (l *accessLogger) configure(c AccessLogConfig) {
+    tmpl, _ := c.validate()
+
+    var out io.Writer = os.Stdout
+    var file *rotatingFile
+    if c.Output != "" && c.Output != "stdout" {
+        f, err := openRotatingFile(c.Output, int64(c.MaxSizeMB)<<20, c.MaxBackups)
+        if err != nil {
+            logError("cannot open access log %s, writing to stdout: %v", c.Output, err)
+        } else {
+            out, file = f, f
+        }
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    if l.file != nil {
+        l.file.Close()
+    }
+    l.format, l.tmpl, l.out, l.file = c.Format, tmpl, out, file
+}
+
+func (l *accessLogger) write(e *AccessLogEntry) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    var buf bytes.Buffer
+    switch l.format {
+    case "", "off":
+        return
+    case "common", "combined":
+        size := "-"
+        if e.Bytes > 0 {
+            size = strconv.Itoa(e.Bytes)
+        }
+        user := e.User
+        if user == "" {
+            user = "-"
+        }
+        fmt.Fprintf(&buf, "%s - %s [%s] %q %d %s", e.RemoteIP, user, e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+            e.Method+" "+e.URI+" "+e.Proto, e.Status, size)
+        if l.format == "combined" {
+            fmt.Fprintf(&buf, " %q %q", e.Referer, e.UserAgent)
+        }
+        buf.WriteByte('\n')
+    case "json":
+        json.NewEncoder(&buf).Encode(struct {
+            *AccessLogEntry
+            DurationMs float64 `json:"duration_ms"`
+        }{e, float64(e.Duration.Microseconds()) / 1000})
+    case "template":
+        if err := l.tmpl.Execute(&buf, e); err != nil {
+            logError("access log template: %v", err)
+            return
+        }
+        if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+            buf.WriteByte('\n')
+        }
+    }
+    l.out.Write(buf.Bytes())
+}
+
+// noteUser records the authenticated key for the access log entry
+func noteUser(r *http.Request, keyID string) {
+    if e, ok := r.Context().Value(accessLogKey).(*AccessLogEntry); ok {
+        e.User = keyID
+    }
+}
+
+// AccessLog middleware writes one line per request in the configured format.
+// It wraps the whole chain so rejected requests are logged too.
+func AccessLog(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        entry := &AccessLogEntry{
+            Time:      start.UTC(),
+            RequestID: requestIDFrom(r.Context()),
+            RemoteIP:  clientIP(r),
+            Method:    r.Method,
+            URI:       r.RequestURI,
+            Proto:     r.Proto,
+            Route:     routeLabel(r.URL.Path),
+            Referer:   r.Referer(),
+            UserAgent: r.UserAgent(),
+        }
+        if tc, ok := traceFrom(r); ok {
+            entry.TraceID = tc.TraceID
+        }
+
+        rec := newStatusRecorder(w)
+        next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessLogKey, entry)))
+
+        entry.Status, entry.Bytes, entry.Duration = rec.status, rec.bytes, time.Since(start)
+        accessLog.write(entry)
+    })
+}
+
+// rotatingFile appends to path and, once it would grow past maxBytes, renames
+// it to path.1 (shifting older backups up to path.<maxBackups>) and starts a new file
+type rotatingFile struct {
+    path       string
+    maxBytes   int64
+    maxBackups int
+
+    mu   sync.Mutex
+    f    *os.File
+    size int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxBackups int) (*rotatingFile, error) {
+    rf := &rotatingFile{path: path, maxBytes: maxBytes, maxBackups: maxBackups}
+    if err := rf.open(); err != nil {
+        return nil, err
+    }
+    return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+    f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+    if err != nil {
+        return err
+    }
+    info, err := f.Stat()
+    if err != nil {
+        f.Close()
+        return err
+    }
+    rf.f, rf.size = f, info.Size()
+    return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+    rf.mu.Lock()
+    defer rf.mu.Unlock()
+
+    if rf.maxBytes > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+        if err := rf.rotate(); err != nil {
+            logError("access log rotation failed: %v", err)
+        }
+    }
+    if rf.f == nil {
+        return 0, os.ErrClosed
+    }
+    n, err := rf.f.Write(p)
+    rf.size += int64(n)
+    return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+    rf.f.Close()
+    rf.f = nil
+
+    if rf.maxBackups > 0 {
+        os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+        for i := rf.maxBackups - 1; i >= 1; i-- {
+            os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+        }
+        if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+            rf.open()
+            return err
+        }
+    } else if err := os.Truncate(rf.path, 0); err != nil {
+        rf.open()
+        return err
+    }
+    return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+    rf.mu.Lock()
+    defer rf.mu.Unlock()
+    if rf.f == nil {
+        return nil
+    }
+    err := rf.f.Close()
+    rf.f = nil
+    return err
+}
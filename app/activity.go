@@ -0,0 +1,105 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    defaultActivityLimit = 50
+    maxActivityLimit     = 200
+)
+
+// ActivityEvent is one entry of a contact's activity timeline
+type ActivityEvent struct {
+    ID      string    `json:"id"`
+    At      time.Time `json:"at"`
+    Source  string    `json:"source"`
+    Type    string    `json:"type"`
+    Actor   string    `json:"actor"`
+    Details bson.M    `json:"details,omitempty"`
+}
+
+// ContactActivity is the response of GET /contacts/{id}/activity; Next is the
+// cursor for the following (older) page, empty on the last one
+type ContactActivity struct {
+    ContactID string          `json:"contact_id"`
+    Events    []ActivityEvent `json:"events"`
+    Next      string          `json:"next,omitempty"`
+}
+
+// getContactActivity handles GET /contacts/{id}/activity[?limit=&before=],
+// newest first. Events are read from the audit log, so the history of a deleted
+// contact stays available; before is the next cursor of the previous page.
+func getContactActivity(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    objID, ok := contactIDFromPath(w, r)
+    if !ok {
+        return
+    }
+    id := objID.Hex()
+    limit, ok := queryInt(r, "limit", defaultActivityLimit, maxActivityLimit)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "limit must be a positive number")
+        return
+    }
+
+    // a key limited to tags only sees the history of contacts it has access
+    // to, so not that of deleted ones
+    if len(keyTags(r.Context())) > 0 {
+        n, err := contactsCollection.CountDocuments(r.Context(), scopeFilter(r, bson.M{"_id": objID}))
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve activity")
+            return
+        }
+        if n == 0 {
+            writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+            return
+        }
+    }
+
+    filter := scopeFilter(r, bson.M{"target": id, "action": bson.M{"$regex": `^contact\.`}})
+    if before := r.URL.Query().Get("before"); before != "" {
+        cursorID, err := primitive.ObjectIDFromHex(before)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "Invalid before cursor")
+            return
+        }
+        filter["_id"] = bson.M{"$lt": cursorID}
+    }
+
+    opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit) + 1)
+    cursor, err := collectionOf("audit_log").Find(r.Context(), filter, opts)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve activity")
+        return
+    }
+    var entries []AuditEntry
+    if err := cursor.All(r.Context(), &entries); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    res := ContactActivity{ContactID: id, Events: []ActivityEvent{}}
+    if len(entries) > limit {
+        entries = entries[:limit]
+        res.Next = entries[limit-1].ID.Hex()
+    }
+    for _, e := range entries {
+        res.Events = append(res.Events, ActivityEvent{
+            ID:      e.ID.Hex(),
+            At:      e.At,
+            Source:  "audit",
+            Type:    e.Action,
+            Actor:   e.Actor,
+            Details: e.Details,
+        })
+    }
+    json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+    "crypto/subtle"
+    "net/http"
+    "strings"
+)
+
+// requireAdmin guards /admin routes with the bearer token in ADMIN_TOKEN and
+// reports every admin change to the SIEM. Admin endpoints are disabled
+// entirely when no token is configured.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+    return func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+
+        token, err := envSecret("ADMIN_TOKEN")
+        if err != nil {
+            logError("%v", err)
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to load the admin token")
+            return
+        }
+        if token == "" {
+            writeError(w, http.StatusForbidden, codeAdminDisabled, "Admin API is disabled")
+            return
+        }
+
+        given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+        if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+            rejectAuth(w, r, "admin_token", "Unauthorized")
+            return
+        }
+
+        if r.Method == "GET" {
+            next(w, r)
+            return
+        }
+
+        rec := newStatusRecorder(w)
+        next(rec, r)
+        outcome := "success"
+        if rec.status >= 400 {
+            outcome = "failure"
+        }
+        emitSecurityEvent(r, "admin", r.Method+" "+r.URL.Path, outcome, "", map[string]any{"status": rec.status})
+    }
+}
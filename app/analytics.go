@@ -0,0 +1,290 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+    defaultAnalyticsTop   = 10
+    maxAnalyticsTop       = 100
+    defaultAnalyticsWeeks = 12
+    maxAnalyticsWeeks     = 104
+    maxTimeseriesBuckets  = 366
+)
+
+// timeseriesGranularities are the bucket sizes of the growth time series, with
+// the number of buckets returned when from isn't given
+var timeseriesGranularities = map[string]int{"hour": 48, "day": 30, "week": 12, "month": 12}
+
+// areaCodePattern captures the first digit group of a phone number, after a
+// country code when one is written with a separator ("+49 30 ...", "(415) 555-...")
+const areaCodePattern = `^\s*(?:\+\d{1,3}[\s.-]+)?\(?(\d{2,4})\)?`
+
+// AnalyticsBucket is one group in an analytics breakdown
+type AnalyticsBucket struct {
+    Key   string `bson:"_id" json:"key"`
+    Count int64  `bson:"count" json:"count"`
+}
+
+// ContactAnalytics is the response of GET /contacts/analytics
+type ContactAnalytics struct {
+    Total       int64             `bson:"total" json:"total"`
+    ByTag       []AnalyticsBucket `bson:"by_tag" json:"by_tag"`
+    ByOwner     []AnalyticsBucket `bson:"by_owner" json:"by_owner"`
+    WeeklyTrend []AnalyticsBucket `bson:"weekly_trend" json:"weekly_trend"`
+    AreaCodes   []AnalyticsBucket `bson:"top_area_codes" json:"top_area_codes"`
+}
+
+// queryInt reads a positive integer query parameter, clamped to max
+func queryInt(r *http.Request, name string, def, max int) (int, bool) {
+    v := r.URL.Query().Get(name)
+    if v == "" {
+        return def, true
+    }
+    n, err := strconv.Atoi(v)
+    if err != nil || n < 1 {
+        return 0, false
+    }
+    if n > max {
+        n = max
+    }
+    return n, true
+}
+
+// countBy groups the faceted documents by expr and keeps the top n
+func countBy(expr any, n int) bson.A {
+    return bson.A{
+        bson.M{"$group": bson.M{"_id": expr, "count": bson.M{"$sum": 1}}},
+        bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+        bson.M{"$limit": n},
+    }
+}
+
+// getContactAnalytics handles GET /contacts/analytics?top=10&weeks=12. Every
+// breakdown is computed by one $facet aggregation over the caller's tenant.
+func getContactAnalytics(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    top, ok := queryInt(r, "top", defaultAnalyticsTop, maxAnalyticsTop)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "top must be a positive number")
+        return
+    }
+    weeks, ok := queryInt(r, "weeks", defaultAnalyticsWeeks, maxAnalyticsWeeks)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "weeks must be a positive number")
+        return
+    }
+
+    // contacts created before timestamps existed are dated by their ObjectID
+    createdAt := bson.M{"$ifNull": bson.A{"$created_at", bson.M{"$toDate": "$_id"}}}
+
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: scopeFilter(r, bson.M{})}},
+        {{Key: "$facet", Value: bson.M{
+            "total": bson.A{bson.M{"$count": "count"}},
+            "by_tag": append(bson.A{
+                bson.M{"$unwind": "$tags"},
+            }, countBy("$tags", top)...),
+            "by_owner": countBy(bson.M{"$ifNull": bson.A{"$owner", ""}}, top),
+            "weekly_trend": bson.A{
+                bson.M{"$group": bson.M{
+                    "_id":   bson.M{"$dateToString": bson.M{"format": "%G-W%V", "date": createdAt}},
+                    "count": bson.M{"$sum": 1},
+                }},
+                bson.M{"$sort": bson.M{"_id": -1}},
+                bson.M{"$limit": weeks},
+                bson.M{"$sort": bson.M{"_id": 1}},
+            },
+            "top_area_codes": append(bson.A{
+                bson.M{"$project": bson.M{"m": bson.M{"$regexFind": bson.M{"input": "$phone", "regex": areaCodePattern}}}},
+                bson.M{"$match": bson.M{"m": bson.M{"$ne": nil}}},
+            }, countBy(bson.M{"$arrayElemAt": bson.A{"$m.captures", 0}}, top)...),
+        }}},
+        {{Key: "$project", Value: bson.M{
+            "total":          bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$total.count", 0}}, 0}},
+            "by_tag":         1,
+            "by_owner":       1,
+            "weekly_trend":   1,
+            "top_area_codes": 1,
+        }}},
+    }
+
+    cursor, err := contactsCollection.Aggregate(r.Context(), pipeline)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to compute analytics")
+        return
+    }
+    var results []ContactAnalytics
+    if err := cursor.All(r.Context(), &results); err != nil || len(results) != 1 {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    json.NewEncoder(w).Encode(results[0])
+}
+
+// TimeseriesBucket counts the contacts created and deleted in [Start, next Start)
+type TimeseriesBucket struct {
+    Start   time.Time `json:"start"`
+    Created int64     `json:"created"`
+    Deleted int64     `json:"deleted"`
+}
+
+// ContactTimeseries is the response of GET /contacts/analytics/timeseries
+type ContactTimeseries struct {
+    Granularity string             `json:"granularity"`
+    Timezone    string             `json:"timezone"`
+    From        time.Time          `json:"from"`
+    To          time.Time          `json:"to"`
+    Buckets     []TimeseriesBucket `json:"buckets"`
+}
+
+// truncateTime is the Go side of $dateTrunc (weeks start on Monday)
+func truncateTime(t time.Time, unit string, loc *time.Location) time.Time {
+    t = t.In(loc)
+    y, m, d := t.Date()
+    switch unit {
+    case "hour":
+        return time.Date(y, m, d, t.Hour(), 0, 0, 0, loc)
+    case "week":
+        return time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, loc)
+    case "month":
+        return time.Date(y, m, 1, 0, 0, 0, 0, loc)
+    }
+    return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// nextBucket is the start of the bucket after start
+func nextBucket(start time.Time, unit string) time.Time {
+    switch unit {
+    case "hour":
+        return start.Add(time.Hour)
+    case "week":
+        return start.AddDate(0, 0, 7)
+    case "month":
+        return start.AddDate(0, 1, 0)
+    }
+    return start.AddDate(0, 0, 1)
+}
+
+// bucketCounts runs pipeline, which groups by a truncated date into "count"
+func bucketCounts(ctx context.Context, coll collection, pipeline mongo.Pipeline) (map[time.Time]int64, error) {
+    cursor, err := coll.Aggregate(ctx, pipeline)
+    if err != nil {
+        return nil, err
+    }
+    var rows []struct {
+        Start time.Time `bson:"_id"`
+        Count int64     `bson:"count"`
+    }
+    if err := cursor.All(ctx, &rows); err != nil {
+        return nil, err
+    }
+    counts := make(map[time.Time]int64, len(rows))
+    for _, row := range rows {
+        counts[row.Start.UTC()] = row.Count
+    }
+    return counts, nil
+}
+
+// getContactTimeseries handles GET /contacts/analytics/timeseries
+// ?granularity=day&from=&to=&tz=. Creations are counted from the contacts'
+// created_at, so contacts deleted since no longer show up there; deletions
+// come from the audit log (single deletes and retention purges).
+func getContactTimeseries(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    q := r.URL.Query()
+    unit := q.Get("granularity")
+    if unit == "" {
+        unit = "day"
+    }
+    defaultBuckets, ok := timeseriesGranularities[unit]
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "granularity must be hour, day, week or month")
+        return
+    }
+    loc, err := requestLocation(r)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, err.Error())
+        return
+    }
+    tz := loc.String()
+
+    to := utcNow()
+    if v := q.Get("to"); v != "" {
+        if to, err = parseTimestamp(v); err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "to must be an RFC 3339 time")
+            return
+        }
+    }
+    var from time.Time
+    if v := q.Get("from"); v != "" {
+        if from, err = parseTimestamp(v); err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "from must be an RFC 3339 time")
+            return
+        }
+    } else {
+        from = truncateTime(to, unit, loc)
+        for i := 1; i < defaultBuckets; i++ {
+            from = truncateTime(from.Add(-time.Nanosecond), unit, loc)
+        }
+    }
+    if !from.Before(to) {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "from must be before to")
+        return
+    }
+
+    var starts []time.Time
+    for t := truncateTime(from, unit, loc); t.Before(to); t = nextBucket(t, unit) {
+        if len(starts) == maxTimeseriesBuckets {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "too many buckets, narrow the range or use a coarser granularity")
+            return
+        }
+        starts = append(starts, t)
+    }
+
+    trunc := func(field string) bson.M {
+        return bson.M{"$dateTrunc": bson.M{"date": field, "unit": unit, "timezone": tz, "startOfWeek": "monday"}}
+    }
+    created, err := bucketCounts(r.Context(), contactsCollection, mongo.Pipeline{
+        {{Key: "$match", Value: scopeFilter(r, bson.M{"created_at": bson.M{"$gte": from, "$lt": to}})}},
+        {{Key: "$group", Value: bson.M{"_id": trunc("$created_at"), "count": bson.M{"$sum": 1}}}},
+    })
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to compute analytics")
+        return
+    }
+    tenant := tenantFilter(tenantOf(r))["tenant"]
+    deleted, err := bucketCounts(r.Context(), collectionOf("audit_log"), mongo.Pipeline{
+        {{Key: "$match", Value: bson.M{
+            "at": bson.M{"$gte": from, "$lt": to},
+            "$or": bson.A{
+                bson.M{"action": "contact.delete", "tenant": tenant},
+                bson.M{"action": "retention.purge", "details.target": "contacts", "details.tenant": tenant},
+            },
+        }}},
+        {{Key: "$group", Value: bson.M{"_id": trunc("$at"), "count": bson.M{"$sum": bson.M{
+            "$cond": bson.A{bson.M{"$eq": bson.A{"$action", "retention.purge"}}, "$details.deleted", 1},
+        }}}}},
+    })
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to compute analytics")
+        return
+    }
+
+    series := ContactTimeseries{Granularity: unit, Timezone: tz, From: from, To: to, Buckets: make([]TimeseriesBucket, 0, len(starts))}
+    for _, start := range starts {
+        key := start.UTC()
+        series.Buckets = append(series.Buckets, TimeseriesBucket{Start: start, Created: created[key], Deleted: deleted[key]})
+    }
+    json.NewEncoder(w).Encode(series)
+}
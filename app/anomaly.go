@@ -0,0 +1,266 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxAnomalyAlerts is how many recent alerts GET /admin/anomalies keeps
+const maxAnomalyAlerts = 200
+
+// maxTrackedIDs bounds the distinct-ID set kept per client and window
+const maxTrackedIDs = 10000
+
+// AnomalyAlert records one client crossing one threshold within a window
+type AnomalyAlert struct {
+    At        time.Time `json:"at"`
+    Client    string    `json:"client"`
+    Kind      string    `json:"kind"`
+    Value     int       `json:"value"`
+    Threshold int       `json:"threshold"`
+    Throttled bool      `json:"throttled"`
+}
+
+type clientActivity struct {
+    windowStart    time.Time
+    requests       int
+    records        int
+    notFound       int
+    ids            map[string]struct{}
+    flagged        map[string]bool
+    throttledUntil time.Time
+}
+
+// anomalyDetector counts per-client activity in fixed windows and flags clients
+// that look like bulk exporters or ID scrapers
+type anomalyDetector struct {
+    mu        sync.Mutex
+    clients   map[string]*clientActivity
+    alerts    []AnomalyAlert
+    lastSweep time.Time
+}
+
+var anomalies = &anomalyDetector{clients: map[string]*clientActivity{}}
+
+var anomaliesDetected = newCounter("api_anomalies_detected_total", "Clients flagged for anomalous request patterns.", "kind")
+
+func init() {
+    gaugeFunc("api_throttled_clients", "Clients currently throttled after an anomaly.", func() float64 {
+        return float64(len(anomalies.throttled()))
+    })
+}
+
+// requestStats is filled in by handlers so middleware can see what a request returned
+type requestStats struct {
+    records int
+}
+
+// bulkExportThreshold is the response size reported to the SIEM as a bulk export
+const bulkExportThreshold = 1000
+
+// recordsServed notes that a handler returned n contacts
+func recordsServed(r *http.Request, n int) {
+    if s, ok := r.Context().Value(requestStatsKey).(*requestStats); ok {
+        s.records += n
+    }
+    if n >= bulkExportThreshold {
+        emitSecurityEvent(r, "data_access", "bulk_export", "success", r.URL.Path, map[string]any{"records": n})
+    }
+}
+
+// DetectAnomalies middleware tracks each client's request pattern and, when
+// auto_throttle is enabled, rejects flagged clients for throttle_for
+func DetectAnomalies(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if isInfraPath(r.URL.Path) || r.Method == "OPTIONS" {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        client := clientKey(r)
+        if until := anomalies.throttledUntil(client); time.Now().Before(until) {
+            w.Header().Set("Content-Type", "application/json")
+            w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(until).Seconds()))))
+            writeError(w, http.StatusTooManyRequests, codeRateLimited, "Too many requests")
+            return
+        }
+
+        stats, ok := r.Context().Value(requestStatsKey).(*requestStats)
+        if !ok {
+            stats = &requestStats{}
+            r = r.WithContext(context.WithValue(r.Context(), requestStatsKey, stats))
+        }
+        rec := newStatusRecorder(w)
+        next.ServeHTTP(rec, r)
+
+        var id string
+        if r.Method == "GET" {
+            id = contactIDInPath(r.URL.Path)
+        }
+        anomalies.observe(client, id, rec.status, stats.records)
+    })
+}
+
+// contactIDInPath returns the ID in a /contacts/{id} path, "" for any other
+// path, including /contacts/search and the like and the contact's
+// sub-resources, so only single-contact reads count as distinct IDs
+func contactIDInPath(path string) string {
+    id, ok := strings.CutPrefix(path, "/contacts/")
+    if !ok || strings.Contains(id, "/") {
+        return ""
+    }
+    if _, err := primitive.ObjectIDFromHex(id); err == nil || isShortID(id) {
+        return id
+    }
+    return ""
+}
+
+func (d *anomalyDetector) throttledUntil(client string) time.Time {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    if a, ok := d.clients[client]; ok {
+        return a.throttledUntil
+    }
+    return time.Time{}
+}
+
+func (d *anomalyDetector) observe(client, id string, status, records int) {
+    cfg := currentConfig().Anomaly
+    now := time.Now()
+
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    d.sweep(now, time.Duration(cfg.Window))
+
+    a, ok := d.clients[client]
+    if !ok {
+        a = &clientActivity{}
+        d.clients[client] = a
+    }
+    if now.Sub(a.windowStart) >= time.Duration(cfg.Window) {
+        a.windowStart = now
+        a.requests, a.records, a.notFound = 0, 0, 0
+        a.ids = map[string]struct{}{}
+        a.flagged = map[string]bool{}
+    }
+
+    a.requests++
+    a.records += records
+    if id != "" {
+        if status == http.StatusNotFound {
+            a.notFound++
+        }
+        if len(a.ids) < maxTrackedIDs {
+            a.ids[id] = struct{}{}
+        }
+    }
+
+    d.check(now, client, a, "request_rate", a.requests, cfg.MaxRequests, cfg)
+    d.check(now, client, a, "bulk_export", a.records, cfg.MaxRecords, cfg)
+    d.check(now, client, a, "id_enumeration", len(a.ids), cfg.MaxDistinctIDs, cfg)
+    d.check(now, client, a, "not_found_probing", a.notFound, cfg.MaxNotFound, cfg)
+}
+
+// check raises at most one alert per kind, client and window
+func (d *anomalyDetector) check(now time.Time, client string, a *clientActivity, kind string, value, threshold int, cfg AnomalyConfig) {
+    if threshold <= 0 || value <= threshold || a.flagged[kind] {
+        return
+    }
+    a.flagged[kind] = true
+
+    alert := AnomalyAlert{At: now.UTC(), Client: client, Kind: kind, Value: value, Threshold: threshold}
+    if cfg.AutoThrottle {
+        a.throttledUntil = now.Add(time.Duration(cfg.ThrottleFor))
+        alert.Throttled = true
+    }
+
+    d.alerts = append(d.alerts, alert)
+    if len(d.alerts) > maxAnomalyAlerts {
+        d.alerts = d.alerts[len(d.alerts)-maxAnomalyAlerts:]
+    }
+    anomaliesDetected.Inc(kind)
+    logWarn("anomaly %s from %s: %d exceeds %d (throttled=%t)", kind, client, value, threshold, alert.Throttled)
+}
+
+// sweep forgets clients that are idle and not throttled
+func (d *anomalyDetector) sweep(now time.Time, window time.Duration) {
+    if now.Sub(d.lastSweep) < window {
+        return
+    }
+    for k, a := range d.clients {
+        if now.Sub(a.windowStart) > 2*window && now.After(a.throttledUntil) {
+            delete(d.clients, k)
+        }
+    }
+    d.lastSweep = now
+}
+
+type throttledClient struct {
+    Client string    `json:"client"`
+    Until  time.Time `json:"until"`
+}
+
+func (d *anomalyDetector) throttled() []throttledClient {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+
+    now := time.Now()
+    list := []throttledClient{}
+    for k, a := range d.clients {
+        if now.Before(a.throttledUntil) {
+            list = append(list, throttledClient{Client: k, Until: a.throttledUntil.UTC()})
+        }
+    }
+    sort.Slice(list, func(i, j int) bool { return list[i].Client < list[j].Client })
+    return list
+}
+
+// listAnomalies handles GET /admin/anomalies
+func listAnomalies(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    anomalies.mu.Lock()
+    alerts := make([]AnomalyAlert, 0, len(anomalies.alerts))
+    for i := len(anomalies.alerts) - 1; i >= 0; i-- {
+        alerts = append(alerts, anomalies.alerts[i])
+    }
+    anomalies.mu.Unlock()
+
+    json.NewEncoder(w).Encode(map[string]any{
+        "alerts":    alerts,
+        "throttled": anomalies.throttled(),
+    })
+}
+
+// liftThrottle handles DELETE /admin/anomalies/throttles/{client}
+func liftThrottle(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    client := r.URL.Path[len("/admin/anomalies/throttles/"):]
+
+    anomalies.mu.Lock()
+    a, ok := anomalies.clients[client]
+    if ok {
+        a.throttledUntil = time.Time{}
+    }
+    anomalies.mu.Unlock()
+
+    if !ok {
+        writeError(w, http.StatusNotFound, codeClientNotFound, "Client not found")
+        return
+    }
+    recordAudit(r, "anomaly.unthrottle", client, nil)
+
+    json.NewEncoder(w).Encode(map[string]string{"message": "Throttle lifted"})
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "io"
+    "net/http"
+    "slices"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// changeRequestsListed caps GET /change-requests
+const changeRequestsListed = 100
+
+// ChangeApprovalConfig makes the contact edits of keys with one of Roles wait
+// for a key with one of ReviewerRoles to approve them
+type ChangeApprovalConfig struct {
+    Roles         []string `json:"roles"`
+    ReviewerRoles []string `json:"reviewer_roles"`
+}
+
+func (c ChangeApprovalConfig) validate() error {
+    if len(c.Roles) > 0 && len(c.ReviewerRoles) == 0 {
+        return fmt.Errorf("change_approval.reviewer_roles is required with change_approval.roles")
+    }
+    for _, role := range c.Roles {
+        if slices.Contains(c.ReviewerRoles, role) {
+            return fmt.Errorf("change_approval: role %q can't both need and give approval", role)
+        }
+    }
+    return nil
+}
+
+// actions of a change request
+const (
+    changeUpdate = "update"
+    changeDelete = "delete"
+)
+
+// statuses of a change request
+const (
+    changePending  = "pending"
+    changeApproved = "approved"
+    changeRejected = "rejected"
+)
+
+// ChangeRequest is an edit of a contact waiting for review, made by a key
+// whose role needs approval. Approving it applies it.
+type ChangeRequest struct {
+    ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    Tenant      string             `bson:"tenant" json:"-"`
+    ContactID   primitive.ObjectID `bson:"contact_id" json:"contact_id"`
+    Action      string             `bson:"action" json:"action"`
+    Changes     *contactChanges    `bson:"changes,omitempty" json:"changes,omitempty"`
+    Status      string             `bson:"status" json:"status"`
+    RequestedBy string             `bson:"requested_by" json:"requested_by"`
+    ReviewedBy  string             `bson:"reviewed_by,omitempty" json:"reviewed_by,omitempty"`
+    Reason      string             `bson:"reason,omitempty" json:"reason,omitempty"`
+    CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+    ReviewedAt  *time.Time         `bson:"reviewed_at,omitempty" json:"reviewed_at,omitempty"`
+}
+
+func changeRequestsCollection() collection {
+    return collectionOf("change_requests")
+}
+
+// needsApproval reports whether the caller's contact edits wait for review
+func needsApproval(r *http.Request) bool {
+    role := principalFrom(r).Role
+    return role != "" && slices.Contains(currentConfig().ChangeApproval.Roles, role)
+}
+
+// isReviewer reports whether the caller may approve and reject change requests
+func isReviewer(r *http.Request) bool {
+    role := principalFrom(r).Role
+    return role != "" && slices.Contains(currentConfig().ChangeApproval.ReviewerRoles, role)
+}
+
+// refuseUnreviewed answers 403 to the bulk edits of callers whose edits need
+// approval, which can only ask for changes one contact at a time
+func refuseUnreviewed(w http.ResponseWriter, r *http.Request) bool {
+    if !needsApproval(r) {
+        return false
+    }
+    writeError(w, http.StatusForbidden, codeApprovalRequired,
+        "Edits by this key need approval; change contacts one at a time with PUT or DELETE /contacts/{id}")
+    return true
+}
+
+// requestChange records the caller's edit of the contact objID for review
+// instead of making it, and answers 202 with the change request. Upserting a
+// contact that doesn't exist creates it at once, since only edits wait.
+func requestChange(w http.ResponseWriter, r *http.Request, objID primitive.ObjectID, action string, changes *contactChanges) {
+    err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"_id": objID}),
+        options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+    if err == mongo.ErrNoDocuments && action == changeUpdate && upsertRequested(r) {
+        createContactAt(w, r, objID, *changes)
+        return
+    }
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return
+    }
+
+    cr := ChangeRequest{
+        Tenant:      tenantOf(r),
+        ContactID:   objID,
+        Action:      action,
+        Changes:     changes,
+        Status:      changePending,
+        RequestedBy: principalFrom(r).KeyID,
+        CreatedAt:   utcNow(),
+    }
+    result, err := changeRequestsCollection().InsertOne(r.Context(), cr)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create change request")
+        return
+    }
+    cr.ID = result.InsertedID.(primitive.ObjectID)
+    recordAudit(r, "change_request.create", objID.Hex(), bson.M{"change_request": cr.ID.Hex(), "action": action})
+
+    w.Header().Set("Location", "/change-requests/"+cr.ID.Hex())
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(cr)
+}
+
+// listChangeRequests handles GET /change-requests[?status=pending&contact_id=],
+// newest first: all of the tenant's for reviewers, the caller's own otherwise
+func listChangeRequests(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    q := r.URL.Query()
+    filter := scopeFilter(r, bson.M{})
+    if !isReviewer(r) {
+        filter["requested_by"] = principalFrom(r).KeyID
+    }
+    if status := q.Get("status"); status != "" {
+        if status != changePending && status != changeApproved && status != changeRejected {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "status must be pending, approved or rejected")
+            return
+        }
+        filter["status"] = status
+    }
+    if id := q.Get("contact_id"); id != "" {
+        objID, err := resolveContactID(r, id)
+        if err == errInvalidContactID {
+            writeError(w, http.StatusBadRequest, codeInvalidContactID, "Invalid contact ID")
+            return
+        }
+        if err != nil && err != mongo.ErrNoDocuments {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+            return
+        }
+        filter["contact_id"] = objID
+    }
+    limit, ok := queryInt(r, "limit", changeRequestsListed, changeRequestsListed)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "limit must be a positive number")
+        return
+    }
+
+    cursor, err := changeRequestsCollection().Find(r.Context(), filter,
+        options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(limit)))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve change requests")
+        return
+    }
+    requests := []ChangeRequest{}
+    if err := cursor.All(r.Context(), &requests); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    json.NewEncoder(w).Encode(bson.M{"change_requests": requests})
+}
+
+// changeRequestByID loads the change request named in
+// /change-requests/{id}[/approve|/reject], if the caller may see it
+func changeRequestByID(w http.ResponseWriter, r *http.Request) (ChangeRequest, bool) {
+    var cr ChangeRequest
+    id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/change-requests/"), "/")
+    objID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid change request ID")
+        return cr, false
+    }
+    filter := scopeFilter(r, bson.M{"_id": objID})
+    if !isReviewer(r) {
+        filter["requested_by"] = principalFrom(r).KeyID
+    }
+    err = changeRequestsCollection().FindOne(r.Context(), filter).Decode(&cr)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeChangeNotFound, "Change request not found")
+        return cr, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return cr, false
+    }
+    return cr, true
+}
+
+// getChangeRequest handles GET /change-requests/{id}
+func getChangeRequest(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if cr, ok := changeRequestByID(w, r); ok {
+        json.NewEncoder(w).Encode(cr)
+    }
+}
+
+// reviewChangeRequest loads the change request a reviewer is deciding on and
+// marks it reviewed with status, unless someone got there first
+func reviewChangeRequest(w http.ResponseWriter, r *http.Request, status, reason string) (ChangeRequest, bool) {
+    if !isReviewer(r) {
+        writeError(w, http.StatusForbidden, codeForbidden, "Only keys with a reviewer role can review change requests")
+        return ChangeRequest{}, false
+    }
+    cr, ok := changeRequestByID(w, r)
+    if !ok {
+        return cr, false
+    }
+    if cr.RequestedBy == principalFrom(r).KeyID {
+        writeError(w, http.StatusForbidden, codeForbidden, "Change requests can't be reviewed by the key that made them")
+        return cr, false
+    }
+
+    now := utcNow()
+    set := bson.M{"status": status, "reviewed_by": principalFrom(r).KeyID, "reviewed_at": now}
+    if reason != "" {
+        set["reason"] = reason
+    }
+    result, err := changeRequestsCollection().UpdateOne(r.Context(),
+        bson.M{"_id": cr.ID, "status": changePending}, bson.M{"$set": set})
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to update change request")
+        return cr, false
+    }
+    if result.MatchedCount == 0 {
+        writeError(w, http.StatusConflict, codeChangeReviewed, "The change request has already been reviewed")
+        return cr, false
+    }
+    cr.Status, cr.ReviewedBy, cr.ReviewedAt, cr.Reason = status, principalFrom(r).KeyID, &now, reason
+    return cr, true
+}
+
+// reopenChangeRequest puts a change request that couldn't be applied back up
+// for review
+func reopenChangeRequest(r *http.Request, cr ChangeRequest) {
+    _, err := changeRequestsCollection().UpdateOne(r.Context(), bson.M{"_id": cr.ID},
+        bson.M{"$set": bson.M{"status": changePending}, "$unset": bson.M{"reviewed_by": "", "reviewed_at": "", "reason": ""}})
+    if err != nil {
+        logError("failed to reopen change request %s: %v", cr.ID.Hex(), err)
+    }
+}
+
+// approveChangeRequest handles POST /change-requests/{id}/approve, which
+// applies the change as the reviewer. A change that can no longer be made,
+// such as an update of a deleted contact, is answered with the error and
+// stays pending.
+func approveChangeRequest(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    cr, ok := reviewChangeRequest(w, r, changeApproved, "")
+    if !ok {
+        return
+    }
+
+    details := bson.M{"change_request": cr.ID.Hex(), "requested_by": cr.RequestedBy}
+    var found bool
+    switch cr.Action {
+    case changeUpdate:
+        changes := contactChanges{}
+        if cr.Changes != nil {
+            changes = *cr.Changes
+        }
+        // the reporting chain may have changed while the request waited
+        if status, code, msg := changes.resolveReportsTo(r, cr.ContactID); status != 0 {
+            reopenChangeRequest(r, cr)
+            writeError(w, status, code, msg)
+            return
+        }
+        found, ok = saveContactChanges(w, r, cr.ContactID, changes, versionUpdate, details)
+    case changeDelete:
+        found, ok = removeContact(w, r, cr.ContactID, details)
+    }
+    if !ok || !found {
+        reopenChangeRequest(r, cr)
+        if ok {
+            writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+        }
+        return
+    }
+    recordAudit(r, "change_request.approve", cr.ContactID.Hex(), bson.M{"change_request": cr.ID.Hex()})
+
+    json.NewEncoder(w).Encode(cr)
+}
+
+// rejectChangeRequest handles POST /change-requests/{id}/reject with an
+// optional {"reason": "..."}
+func rejectChangeRequest(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var in struct {
+        Reason string `json:"reason"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil && err != io.EOF {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    cr, ok := reviewChangeRequest(w, r, changeRejected, strings.TrimSpace(in.Reason))
+    if !ok {
+        return
+    }
+    recordAudit(r, "change_request.reject", cr.ContactID.Hex(), bson.M{"change_request": cr.ID.Hex()})
+
+    json.NewEncoder(w).Encode(cr)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "io"
+    "mime"
+    "net/http"
+    "path"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/gridfs"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    maxAttachmentSize = 10 << 20
+    // maxAttachments caps the attachments on one contact
+    maxAttachments = 50
+    // maxAttachmentName caps the characters of an attachment's file name
+    maxAttachmentName = 255
+)
+
+// attachmentTypes are the types attachments may have, as sniffed from their
+// first bytes rather than taken from the client
+var attachmentTypes = []string{"application/pdf", "image/jpeg", "image/png", "image/gif", "image/webp", "text/plain"}
+
+// Attachment is a small file kept with a contact, such as a contract or a
+// scanned business card. The file is in the attachments GridFS bucket under
+// the same ID; it is deleted with the contact.
+type Attachment struct {
+    ID          primitive.ObjectID `bson:"_id" json:"id"`
+    Tenant      string             `bson:"tenant" json:"-"`
+    ContactID   primitive.ObjectID `bson:"contact_id" json:"contact_id"`
+    Name        string             `bson:"name" json:"name"`
+    ContentType string             `bson:"content_type" json:"content_type"`
+    Size        int64              `bson:"size" json:"size"`
+    UploadedBy  string             `bson:"uploaded_by" json:"uploaded_by"`
+    CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func attachmentsCollection() collection {
+    return collectionOf("contact_attachments")
+}
+
+// attachmentFiles is the GridFS bucket holding attachments
+func attachmentFiles(ctx context.Context) (*gridfs.Bucket, error) {
+    return gridfs.NewBucket(databaseFor(ctx), options.GridFSBucket().SetName("attachments"))
+}
+
+// attachmentBytes sums the sizes of the tenant's attachments
+func attachmentBytes(ctx context.Context, tenant string) (int64, error) {
+    cursor, err := attachmentsCollection().Aggregate(ctx, mongo.Pipeline{
+        {{Key: "$match", Value: tenantFilter(tenant)}},
+        {{Key: "$group", Value: bson.M{"_id": nil, "bytes": bson.M{"$sum": "$size"}}}},
+    })
+    if err != nil {
+        return 0, err
+    }
+    var sums []struct {
+        Bytes int64 `bson:"bytes"`
+    }
+    if err := cursor.All(ctx, &sums); err != nil || len(sums) == 0 {
+        return 0, err
+    }
+    return sums[0].Bytes, nil
+}
+
+// checkAttachmentQuota reports the tenant quota that size more bytes of
+// attachments would exceed. Like contacts, concurrent uploads can overshoot
+// it by the uploads in flight.
+func checkAttachmentQuota(ctx context.Context, r *http.Request, size int64) (*QuotaUsage, error) {
+    usage, err := loadQuota(ctx, "tenant", tenantOf(r))
+    if err != nil || usage.MaxAttachmentBytes == nil {
+        return nil, err
+    }
+    if err := addAttachmentUsage(ctx, &usage); err != nil {
+        return nil, err
+    }
+    if *usage.AttachmentBytes+size <= *usage.MaxAttachmentBytes {
+        return nil, nil
+    }
+    return &usage, countUsage(ctx, &usage)
+}
+
+// attachmentName cleans up the file name a client sent, keeping only its last
+// path element
+func attachmentName(name string) string {
+    name = strings.TrimSpace(path.Base(strings.ReplaceAll(name, "\\", "/")))
+    if name == "." || name == "/" {
+        return ""
+    }
+    if utf8.RuneCountInString(name) > maxAttachmentName {
+        name = string([]rune(name)[:maxAttachmentName])
+    }
+    return name
+}
+
+// attachmentFromPath reads the attachment ID at the end of the path and loads
+// it from c's attachments, answering 400 or 404 if it can't
+func attachmentFromPath(w http.ResponseWriter, r *http.Request, c Contact) (Attachment, bool) {
+    var a Attachment
+    id, err := primitive.ObjectIDFromHex(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid attachment ID")
+        return a, false
+    }
+    err = attachmentsCollection().FindOne(r.Context(), scopeFilter(r, bson.M{"_id": id, "contact_id": c.ID})).Decode(&a)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeAttachmentNotFound, "Attachment not found")
+        return a, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return a, false
+    }
+    return a, true
+}
+
+// listAttachments handles GET /contacts/{id}/attachments, oldest first
+func listAttachments(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    cursor, err := attachmentsCollection().Find(r.Context(), scopeFilter(r, bson.M{"contact_id": c.ID}),
+        options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve attachments")
+        return
+    }
+    attachments := []Attachment{}
+    if err := cursor.All(r.Context(), &attachments); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    json.NewEncoder(w).Encode(bson.M{"contact_id": c.ID.Hex(), "attachments": attachments})
+}
+
+// createAttachment handles POST /contacts/{id}/attachments with a
+// multipart/form-data body holding the file in a "file" part
+func createAttachment(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if !isMultipart(r) {
+        writeError(w, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "Attachments must be uploaded as multipart/form-data")
+        return
+    }
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    mr, err := r.MultipartReader()
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid multipart body")
+        return
+    }
+    part, err := mr.NextPart()
+    if err == io.EOF || (err == nil && part.FormName() != "file") {
+        writeError(w, http.StatusBadRequest, codeMissingField, "Missing file part")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid multipart body")
+        return
+    }
+    name := attachmentName(part.FileName())
+    if name == "" {
+        writeError(w, http.StatusBadRequest, codeMissingField, "The file part needs a file name")
+        return
+    }
+    data, err := io.ReadAll(io.LimitReader(part, maxAttachmentSize+1))
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Failed to read the file")
+        return
+    }
+    if len(data) > maxAttachmentSize {
+        writeErrorWith(w, http.StatusBadRequest, codeValidationFailed, "file must be at most "+strconv.Itoa(maxAttachmentSize>>20)+" MiB",
+            map[string]any{"max_size": maxAttachmentSize})
+        return
+    }
+    contentType, _, _ := mime.ParseMediaType(http.DetectContentType(data))
+    if len(data) == 0 || !slices.Contains(attachmentTypes, contentType) {
+        writeErrorWith(w, http.StatusBadRequest, codeValidationFailed, "file must be a PDF, JPEG, PNG, GIF, WebP or plain text file",
+            map[string]any{"allowed_types": attachmentTypes})
+        return
+    }
+
+    count, err := attachmentsCollection().CountDocuments(r.Context(), scopeFilter(r, bson.M{"contact_id": c.ID}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to store attachment")
+        return
+    }
+    if count >= maxAttachments {
+        writeErrorWith(w, http.StatusForbidden, codeQuotaExceeded, "Too many attachments on this contact, delete some first",
+            map[string]any{"max_attachments": maxAttachments})
+        return
+    }
+    exceeded, err := checkAttachmentQuota(r.Context(), r, int64(len(data)))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to check quota")
+        return
+    }
+    if exceeded != nil {
+        writeErrorWith(w, http.StatusForbidden, codeQuotaExceeded, "Attachment storage quota exceeded", map[string]any{"quota": exceeded})
+        return
+    }
+
+    bucket, err := attachmentFiles(r.Context())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to store attachment")
+        return
+    }
+    a := Attachment{
+        ID:          primitive.NewObjectID(),
+        Tenant:      tenantOf(r),
+        ContactID:   c.ID,
+        Name:        name,
+        ContentType: contentType,
+        Size:        int64(len(data)),
+        UploadedBy:  clientKey(r),
+        CreatedAt:   utcNow(),
+    }
+    err = bucket.UploadFromStreamWithID(a.ID, name, bytes.NewReader(data),
+        options.GridFSUpload().SetMetadata(bson.M{"tenant": a.Tenant, "contact_id": a.ContactID, "content_type": contentType}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to store attachment")
+        return
+    }
+    if _, err := attachmentsCollection().InsertOne(r.Context(), a); err != nil {
+        deleteAttachmentFiles(context.WithoutCancel(r.Context()), a.ID)
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to store attachment")
+        return
+    }
+    recordAudit(r, "contact.attachment", c.ID.Hex(), bson.M{"attachment": a.ID.Hex(), "name": name, "size": a.Size})
+
+    w.Header().Set("Location", "/contacts/"+c.ID.Hex()+"/attachments/"+a.ID.Hex())
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(a)
+}
+
+// getAttachment handles GET /contacts/{id}/attachments/{attachment}, the file
+// as uploaded
+func getAttachment(w http.ResponseWriter, r *http.Request) {
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    a, ok := attachmentFromPath(w, r, c)
+    if !ok {
+        return
+    }
+    w.Header().Set("Cache-Control", "private, max-age=3600")
+    if notModified(w, r, a.CreatedAt) {
+        return
+    }
+    bucket, err := attachmentFiles(r.Context())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve attachment")
+        return
+    }
+    stream, err := bucket.OpenDownloadStream(a.ID)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve attachment")
+        return
+    }
+    defer stream.Close()
+
+    w.Header().Set("Content-Type", a.ContentType)
+    w.Header().Set("Content-Length", strconv.FormatInt(a.Size, 10))
+    w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Name}))
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    if _, err := io.Copy(w, stream); err != nil {
+        logWarn("attachment %s: stopped after an error: %v", a.ID.Hex(), err)
+    }
+}
+
+// deleteAttachment handles DELETE /contacts/{id}/attachments/{attachment}
+func deleteAttachment(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    a, ok := attachmentFromPath(w, r, c)
+    if !ok {
+        return
+    }
+    if _, err := attachmentsCollection().DeleteOne(r.Context(), bson.M{"_id": a.ID}); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete attachment")
+        return
+    }
+    deleteAttachmentFiles(context.WithoutCancel(r.Context()), a.ID)
+    recordAudit(r, "contact.attachment.delete", c.ID.Hex(), bson.M{"attachment": a.ID.Hex(), "name": a.Name})
+    json.NewEncoder(w).Encode(bson.M{"message": "Attachment deleted successfully"})
+}
+
+// deleteAttachmentFiles deletes attachment files
+func deleteAttachmentFiles(ctx context.Context, ids ...primitive.ObjectID) {
+    bucket, err := attachmentFiles(ctx)
+    if err != nil {
+        return
+    }
+    for _, id := range ids {
+        if err := bucket.DeleteContext(ctx, id); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+            logWarn("failed to delete attachment %s: %v", id.Hex(), err)
+        }
+    }
+}
+
+// deleteAttachments removes the attachments of deleted contacts
+func deleteAttachments(r *http.Request, ids ...primitive.ObjectID) {
+    filter := scopeFilter(r, bson.M{"contact_id": bson.M{"$in": ids}})
+    files, err := attachmentsCollection().Distinct(r.Context(), "_id", filter)
+    if err == nil {
+        _, err = attachmentsCollection().DeleteMany(r.Context(), filter)
+    }
+    if err != nil {
+        logError("failed to delete the attachments of deleted contacts: %v", err)
+        return
+    }
+    fileIDs := make([]primitive.ObjectID, 0, len(files))
+    for _, id := range files {
+        if id, ok := id.(primitive.ObjectID); ok {
+            fileIDs = append(fileIDs, id)
+        }
+    }
+    deleteAttachmentFiles(context.WithoutCancel(r.Context()), fileIDs...)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// AuditEntry is one record in the audit_log collection
+type AuditEntry struct {
+    ID      primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    At      time.Time          `bson:"at" json:"at"`
+    Tenant  string             `bson:"tenant,omitempty" json:"tenant,omitempty"`
+    Actor   string             `bson:"actor" json:"actor"`
+    Action  string             `bson:"action" json:"action"`
+    Target  string             `bson:"target,omitempty" json:"target,omitempty"`
+    Details bson.M             `bson:"details,omitempty" json:"details,omitempty"`
+}
+
+// recordAudit stores an audit entry; r is nil for actions taken by background jobs.
+// Failures are logged rather than failing the request that caused them.
+func recordAudit(r *http.Request, action, target string, details bson.M) {
+    entry := AuditEntry{
+        At:      utcNow(),
+        Actor:   "system",
+        Action:  action,
+        Target:  target,
+        Details: details,
+    }
+    if r != nil {
+        entry.Actor = clientKey(r)
+        entry.Tenant = principalFrom(r).Tenant
+    }
+
+    // the entry is written even if the request's own context is cancelled
+    parent := context.Background()
+    if r != nil {
+        parent = context.WithoutCancel(r.Context())
+    }
+    ctx, cancel := context.WithTimeout(parent, 5*time.Second)
+    defer cancel()
+
+    if _, err := collectionOf("audit_log").InsertOne(ctx, entry); err != nil {
+        logError("failed to record audit entry %s %s: %v", action, target, err)
+    }
+}
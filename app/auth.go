@@ -0,0 +1,135 @@
+package main
+
+import (
+    "context"
+    "crypto/subtle"
+    "net/http"
+    "strings"
+)
+
+// APIKeyConfig is one entry of api_keys in the config file. Key is sent as
+// X-API-Key; SigningSecret lets the client sign write requests instead.
+type APIKeyConfig struct {
+    ID            string `json:"id"`
+    Key           string `json:"key"`
+    SigningSecret string `json:"signing_secret"`
+    Tenant        string `json:"tenant"`
+    Tier          string `json:"tier"`
+    Role          string `json:"role"`
+    // Tags limit the key to the contacts carrying any of them
+    Tags []string `json:"tags"`
+}
+
+// Principal is the caller a request was authenticated as; KeyID is empty for
+// anonymous callers and Tenant is empty for the default tenant
+type Principal struct {
+    KeyID  string
+    Tenant string
+    Tier   string
+    Role   string
+    Tags   []string
+}
+
+type contextKey int
+
+const (
+    principalKey contextKey = iota
+    requestStatsKey
+    routeKey
+    accessLogKey
+    requestIDKey
+    traceKey
+    unscopedKey
+    contactFilterKey
+    regionKey
+    readOperationKey
+    causalKey
+    endpointKey
+)
+
+// principalFrom returns the principal stored by Authenticate
+func principalFrom(r *http.Request) Principal {
+    p, _ := r.Context().Value(principalKey).(Principal)
+    return p
+}
+
+// clientKey identifies the caller for per-client accounting: the API key if one
+// was presented, otherwise the client IP
+func clientKey(r *http.Request) string {
+    if p := principalFrom(r); p.KeyID != "" {
+        return "key:" + p.KeyID
+    }
+    return "ip:" + clientIP(r)
+}
+
+// isInfraPath reports whether path is served to operators rather than API clients
+func isInfraPath(path string) bool {
+    return isProbePath(path) || path == "/metrics" || path == "/version" || strings.HasPrefix(path, "/admin/")
+}
+
+// lookupAPIKey finds the configured key matching the presented value
+func lookupAPIKey(presented string) (APIKeyConfig, bool) {
+    var found APIKeyConfig
+    ok := false
+    for _, k := range currentConfig().APIKeys {
+        if k.Key != "" && subtle.ConstantTimeCompare([]byte(presented), []byte(k.Key)) == 1 {
+            found, ok = k, true
+        }
+    }
+    return found, ok
+}
+
+// Authenticate middleware resolves the X-API-Key header, or an HMAC signature on
+// write requests, into a Principal. Requests with neither stay anonymous unless
+// require_api_key is set; those for a valid signed URL always may.
+func Authenticate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var p Principal
+
+        if r.Header.Get("X-Signature") != "" && isWriteMethod(r.Method) {
+            key, msg := verifySignature(r)
+            if msg != "" {
+                rejectAuth(w, r, "signature", msg)
+                return
+            }
+            replayed, err := claimSignature(r)
+            if err != nil {
+                logError("failed to record the signature of key %s: %v", key.ID, err)
+                writeError(w, http.StatusInternalServerError, codeInternal, "Failed to check the signature")
+                return
+            }
+            if replayed {
+                rejectAuth(w, r, "signature", "Signature already used")
+                return
+            }
+            p.KeyID, p.Tenant, p.Tier, p.Role, p.Tags = key.ID, key.Tenant, key.Tier, key.Role, key.Tags
+        } else if presented := r.Header.Get("X-API-Key"); presented != "" {
+            key, ok := lookupAPIKey(presented)
+            if !ok {
+                rejectAuth(w, r, "api_key", "Invalid API key")
+                return
+            }
+            p.KeyID, p.Tenant, p.Tier, p.Role, p.Tags = key.ID, key.Tenant, key.Tier, key.Role, key.Tags
+        } else if currentConfig().RequireAPIKey && r.Method != "OPTIONS" && !isInfraPath(r.URL.Path) && !validSignedURL(r) {
+            rejectAuth(w, r, "api_key", "API key required")
+            return
+        }
+
+        noteUser(r, p.KeyID)
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey, p)))
+    })
+}
+
+// rejectAuth answers 401 and reports the failure to the SIEM
+func rejectAuth(w http.ResponseWriter, r *http.Request, method, msg string) {
+    emitSecurityEvent(r, "authentication", method, "failure", "", map[string]any{
+        "reason": msg,
+        "method": r.Method,
+        "path":   r.URL.Path,
+    })
+    code := codeUnauthorized
+    if method == "signature" {
+        code = codeInvalidSignature
+    }
+    writeError(w, http.StatusUnauthorized, code, msg)
+}
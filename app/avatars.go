@@ -0,0 +1,443 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "mime"
+    "net/http"
+    "net/url"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/gridfs"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    maxAvatarSize = 5 << 20
+    // maxAvatarPixels keeps small files that decode to huge images out
+    maxAvatarPixels = 40_000_000
+    // avatarSweepBatch is how many avatar files the sweep checks at once
+    avatarSweepBatch = 1000
+    // avatarGracePeriod keeps the sweep off avatars whose contact may still
+    // be being created
+    avatarGracePeriod = time.Hour
+)
+
+// avatarTypes are the image types avatars may have, as sniffed from their
+// first bytes rather than taken from the client
+var avatarTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// avatarSizes are the sizes avatars are scaled down to when uploaded, by the
+// name GET /contacts/{id}/avatar?size= asks for them with: the longest side
+// in pixels
+var avatarSizes = map[string]int{"thumbnail": 128, "medium": 512}
+
+// AvatarImage is one stored image of an avatar
+type AvatarImage struct {
+    File        primitive.ObjectID `bson:"file" json:"-"`
+    ContentType string             `bson:"content_type" json:"content_type"`
+    Size        int64              `bson:"size" json:"size"`
+    Width       int                `bson:"width,omitempty" json:"width,omitempty"`
+    Height      int                `bson:"height,omitempty" json:"height,omitempty"`
+}
+
+// Avatar is a contact's photo: the image as uploaded, and the avatarSizes it
+// was larger than scaled down and converted to JPEG (PNG if transparent).
+// The images are kept in the avatars GridFS bucket and served by
+// GET /contacts/{id}/avatar.
+type Avatar struct {
+    AvatarImage `bson:",inline"`
+    Sizes       map[string]AvatarImage `bson:"sizes,omitempty" json:"sizes,omitempty"`
+    UpdatedAt   time.Time              `bson:"updated_at" json:"updated_at"`
+    URL         string                 `bson:"-" json:"url,omitempty"`
+}
+
+// AvatarConfig controls the avatar URLs in contacts. With SignedURLs they are
+// signed (see signURL) so pages can embed them without the API key; BaseURL,
+// such as a CDN in front of the service, is put before their path.
+type AvatarConfig struct {
+    SignedURLs bool   `json:"signed_urls"`
+    BaseURL    string `json:"base_url"`
+}
+
+func (c AvatarConfig) validate() error {
+    if c.SignedURLs {
+        secret, err := envSecret("URL_SIGNING_SECRET")
+        if err != nil {
+            return err
+        }
+        if secret == "" {
+            return fmt.Errorf("avatars.signed_urls needs URL_SIGNING_SECRET")
+        }
+    }
+    if c.BaseURL != "" {
+        u, err := url.Parse(c.BaseURL)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" {
+            return fmt.Errorf("avatars.base_url must be an http(s) URL without a query")
+        }
+    }
+    return nil
+}
+
+// setAvatarURL fills in the URL of c's avatar. The avatar is copied first,
+// since c may be shared with the contact cache.
+func (c *Contact) setAvatarURL() {
+    if c.Avatar == nil {
+        return
+    }
+    cfg := currentConfig().Avatars
+    a := *c.Avatar
+    a.URL = "/contacts/" + c.ID.Hex() + "/avatar"
+    if cfg.SignedURLs {
+        if signed, _, ok := signStableURL(a.URL); ok {
+            a.URL = signed
+        }
+    }
+    a.URL = strings.TrimSuffix(cfg.BaseURL, "/") + a.URL
+    c.Avatar = &a
+}
+
+// files are the IDs of all the avatar's images
+func (a *Avatar) files() []primitive.ObjectID {
+    files := []primitive.ObjectID{a.File}
+    for _, img := range a.Sizes {
+        files = append(files, img.File)
+    }
+    return files
+}
+
+// sized is the avatar's image for a size name, the uploaded one for sizes it
+// wasn't larger than
+func (a *Avatar) sized(size string) AvatarImage {
+    if img, ok := a.Sizes[size]; ok {
+        return img
+    }
+    return a.AvatarImage
+}
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:      "avatar-sweep",
+        Schedule:  "@daily",
+        Timeout:   30 * time.Minute,
+        Singleton: true,
+        Run:       sweepAvatars,
+    })
+}
+
+// avatarFiles is the GridFS bucket holding avatars
+func avatarFiles(ctx context.Context) (*gridfs.Bucket, error) {
+    return gridfs.NewBucket(databaseFor(ctx), options.GridFSBucket().SetName("avatars"))
+}
+
+// isMultipart reports whether r's body is multipart/form-data
+func isMultipart(r *http.Request) bool {
+    mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    return err == nil && mt == "multipart/form-data"
+}
+
+// readContactMultipart reads a contact from a multipart/form-data body: a
+// "contact" part with its JSON and an optional "avatar" part with its image.
+// The avatar is stored as it is read; if the request is answered with an
+// error it is deleted again, otherwise the caller must delete it unless the
+// contact is created.
+func readContactMultipart(w http.ResponseWriter, r *http.Request) (Contact, *Avatar, bool) {
+    var contact Contact
+    var avatar *Avatar
+    fail := func(status int, code, msg string) (Contact, *Avatar, bool) {
+        if avatar != nil {
+            deleteAvatarFiles(context.WithoutCancel(r.Context()), avatar.files()...)
+        }
+        writeError(w, status, code, msg)
+        return contact, nil, false
+    }
+
+    mr, err := r.MultipartReader()
+    if err != nil {
+        return fail(http.StatusBadRequest, codeInvalidRequestBody, "Invalid multipart body")
+    }
+    seenContact := false
+    for {
+        part, err := mr.NextPart()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            return fail(http.StatusBadRequest, codeInvalidRequestBody, "Invalid multipart body")
+        }
+        switch part.FormName() {
+        case "contact":
+            if seenContact {
+                return fail(http.StatusBadRequest, codeInvalidRequestBody, "More than one contact part")
+            }
+            seenContact = true
+            if err := json.NewDecoder(part).Decode(&contact); err != nil {
+                return fail(http.StatusBadRequest, codeInvalidRequestBody, "Invalid contact part")
+            }
+        case "avatar":
+            if avatar != nil {
+                return fail(http.StatusBadRequest, codeInvalidRequestBody, "More than one avatar part")
+            }
+            a, status, msg := storeAvatar(r.Context(), part)
+            if a == nil {
+                code := codeValidationFailed
+                if status == http.StatusInternalServerError {
+                    code = codeInternal
+                }
+                return fail(status, code, msg)
+            }
+            avatar = a
+        default:
+            return fail(http.StatusBadRequest, codeInvalidRequestBody, "Unknown part "+strconv.Quote(part.FormName())+", expected contact and avatar")
+        }
+    }
+    if !seenContact {
+        return fail(http.StatusBadRequest, codeMissingField, "Missing contact part")
+    }
+    return contact, avatar, true
+}
+
+// storeAvatar stores the image in src along with its avatarSizes, or returns
+// the status and message to reject it with. WebP images are kept only as
+// uploaded, since the standard library can't decode them.
+func storeAvatar(ctx context.Context, src io.Reader) (*Avatar, int, string) {
+    data, err := io.ReadAll(io.LimitReader(src, maxAvatarSize+1))
+    if err != nil {
+        return nil, http.StatusBadRequest, "Failed to read the avatar"
+    }
+    if len(data) > maxAvatarSize {
+        return nil, http.StatusBadRequest, "avatar must be at most " + strconv.Itoa(maxAvatarSize>>20) + " MiB"
+    }
+    contentType := http.DetectContentType(data)
+    if len(data) == 0 || !slices.Contains(avatarTypes, contentType) {
+        return nil, http.StatusBadRequest, "avatar must be a JPEG, PNG, GIF or WebP image"
+    }
+    var cfg image.Config
+    if contentType != "image/webp" {
+        if cfg, _, err = image.DecodeConfig(bytes.NewReader(data)); err != nil {
+            return nil, http.StatusBadRequest, "avatar is not a valid image"
+        }
+        if cfg.Width*cfg.Height > maxAvatarPixels {
+            return nil, http.StatusBadRequest, "avatar has too many pixels"
+        }
+    }
+
+    bucket, err := avatarFiles(ctx)
+    if err != nil {
+        return nil, http.StatusInternalServerError, "Failed to store avatar"
+    }
+    avatar := &Avatar{UpdatedAt: utcNow()}
+    avatar.AvatarImage, err = putAvatarImage(bucket, data, contentType, cfg.Width, cfg.Height, nil)
+    if err != nil {
+        return nil, http.StatusInternalServerError, "Failed to store avatar"
+    }
+    if contentType == "image/webp" {
+        return avatar, 0, ""
+    }
+
+    img, _, err := image.Decode(bytes.NewReader(data))
+    if err != nil {
+        deleteAvatarFiles(ctx, avatar.File)
+        return nil, http.StatusBadRequest, "avatar is not a valid image"
+    }
+    for name, side := range avatarSizes {
+        if max(cfg.Width, cfg.Height) <= side {
+            continue
+        }
+        resized := resizeImage(img, side)
+        encoded, resizedType, err := encodeImage(resized)
+        var stored AvatarImage
+        if err == nil {
+            stored, err = putAvatarImage(bucket, encoded, resizedType, resized.Rect.Dx(), resized.Rect.Dy(), &avatar.File)
+        }
+        if err != nil {
+            logError("avatar %s: failed to store its %s size: %v", avatar.File.Hex(), name, err)
+            deleteAvatarFiles(ctx, avatar.files()...)
+            return nil, http.StatusInternalServerError, "Failed to store avatar"
+        }
+        if avatar.Sizes == nil {
+            avatar.Sizes = map[string]AvatarImage{}
+        }
+        avatar.Sizes[name] = stored
+    }
+    return avatar, 0, ""
+}
+
+// putAvatarImage stores an image in the avatars bucket. Scaled-down images
+// record the original they were made from, which the sweep goes by.
+func putAvatarImage(bucket *gridfs.Bucket, data []byte, contentType string, width, height int, original *primitive.ObjectID) (AvatarImage, error) {
+    metadata := bson.M{"content_type": contentType}
+    if original != nil {
+        metadata["original"] = *original
+    }
+    id, err := bucket.UploadFromStream("avatar", bytes.NewReader(data), options.GridFSUpload().SetMetadata(metadata))
+    return AvatarImage{File: id, ContentType: contentType, Size: int64(len(data)), Width: width, Height: height}, err
+}
+
+// deleteAvatarFiles deletes avatar images
+func deleteAvatarFiles(ctx context.Context, ids ...primitive.ObjectID) {
+    bucket, err := avatarFiles(ctx)
+    if err != nil {
+        return
+    }
+    for _, id := range ids {
+        if err := bucket.DeleteContext(ctx, id); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+            logWarn("failed to delete avatar %s: %v", id.Hex(), err)
+        }
+    }
+}
+
+// getContactAvatar handles GET /contacts/{id}/avatar[?size=], the contact's
+// image as uploaded or in one of the avatarSizes. Signed URLs are served to
+// anyone holding them, and may be cached publicly until they expire.
+func getContactAvatar(w http.ResponseWriter, r *http.Request) {
+    signed := validSignedURL(r)
+    var objID primitive.ObjectID
+    if signed {
+        // signed URLs always carry the full ID, and no tenant
+        id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/contacts/"), "/")
+        objID, _ = primitive.ObjectIDFromHex(id)
+    } else {
+        var ok bool
+        if objID, ok = contactIDFromPath(w, r); !ok {
+            return
+        }
+    }
+    size := r.URL.Query().Get("size")
+    if _, ok := avatarSizes[size]; !ok && size != "" && size != "original" {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "size must be one of thumbnail, medium, original")
+        return
+    }
+    filter := bson.M{"_id": objID}
+    if !signed {
+        filter = scopeFilter(r, filter)
+    }
+    var c Contact
+    err := contactsCollection.FindOne(r.Context(), filter,
+        options.FindOne().SetProjection(bson.M{"avatar": 1})).Decode(&c)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return
+    }
+    if c.Avatar == nil {
+        writeError(w, http.StatusNotFound, codeAvatarNotFound, "The contact has no avatar")
+        return
+    }
+
+    if signed {
+        expires, _ := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+        w.Header().Set("Cache-Control", "public, max-age="+strconv.FormatInt(max(expires-time.Now().Unix(), 0), 10))
+    } else {
+        w.Header().Set("Cache-Control", "private, max-age=3600")
+    }
+    if notModified(w, r, c.Avatar.UpdatedAt) {
+        return
+    }
+    bucket, err := avatarFiles(r.Context())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve avatar")
+        return
+    }
+    img := c.Avatar.sized(size)
+    stream, err := bucket.OpenDownloadStream(img.File)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve avatar")
+        return
+    }
+    defer stream.Close()
+
+    w.Header().Set("Content-Type", img.ContentType)
+    w.Header().Set("Content-Length", strconv.FormatInt(img.Size, 10))
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    if _, err := io.Copy(w, stream); err != nil {
+        logWarn("avatar %s: stopped after an error: %v", img.File.Hex(), err)
+    }
+}
+
+// sweepAvatars deletes avatar images no contact refers to any more, such as
+// those of deleted contacts or of creates that failed halfway. Scaled-down
+// images go with their original.
+func sweepAvatars(ctx context.Context) error {
+    bucket, err := avatarFiles(ctx)
+    if err != nil {
+        return err
+    }
+    cursor, err := bucket.FindContext(ctx, bson.M{"uploadDate": bson.M{"$lt": utcNow().Add(-avatarGracePeriod)}},
+        options.GridFSFind().SetBatchSize(avatarSweepBatch))
+    if err != nil {
+        return err
+    }
+    defer cursor.Close(ctx)
+
+    deleted := 0
+    type avatarFile struct {
+        ID       primitive.ObjectID `bson:"_id"`
+        Metadata struct {
+            Original primitive.ObjectID `bson:"original"`
+        } `bson:"metadata"`
+    }
+    // original is the uploaded image f belongs to, which contacts refer to
+    original := func(f avatarFile) primitive.ObjectID {
+        if f.Metadata.Original.IsZero() {
+            return f.ID
+        }
+        return f.Metadata.Original
+    }
+    sweep := func(files []avatarFile) error {
+        originals := make([]primitive.ObjectID, len(files))
+        for i, f := range files {
+            originals[i] = original(f)
+        }
+        used, err := contactsCollection.Distinct(ctx, "avatar.file", bson.M{"avatar.file": bson.M{"$in": originals}})
+        if err != nil {
+            return err
+        }
+        for _, f := range files {
+            if !slices.Contains(used, any(original(f))) {
+                deleteAvatarFiles(ctx, f.ID)
+                deleted++
+            }
+        }
+        return nil
+    }
+    var batch []avatarFile
+    for cursor.Next(ctx) {
+        var f avatarFile
+        if err := cursor.Decode(&f); err != nil {
+            return err
+        }
+        if batch = append(batch, f); len(batch) == avatarSweepBatch {
+            if err := sweep(batch); err != nil {
+                return err
+            }
+            batch = batch[:0]
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return err
+    }
+    if len(batch) > 0 {
+        if err := sweep(batch); err != nil {
+            return err
+        }
+    }
+    if deleted > 0 {
+        logInfo("avatar-sweep: deleted %d unused avatars", deleted)
+    }
+    return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// batchGetContacts handles GET /contacts/batch?ids=a,b,c. It returns the
+// caller's contacts among ids (ObjectIDs or short IDs) in the order asked for;
+// unknown IDs are left out. At most max_page_size IDs can be requested at once.
+func batchGetContacts(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var keys []string
+    objIDs, shortIDs := bson.A{}, bson.A{}
+    for _, id := range strings.Split(r.URL.Query().Get("ids"), ",") {
+        if id = strings.TrimSpace(id); id == "" {
+            continue
+        }
+        if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+            objIDs = append(objIDs, objID)
+            keys = append(keys, objID.Hex())
+        } else if isShortID(id) {
+            shortIDs = append(shortIDs, id)
+            keys = append(keys, id)
+        } else {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "ids must be contact IDs or short IDs")
+            return
+        }
+    }
+    if len(keys) == 0 {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "ids is required")
+        return
+    }
+    if max := queryLimitsFor(r).MaxPageSize; max > 0 && len(keys) > max {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("at most %d ids can be requested", max))
+        return
+    }
+
+    filter := bson.M{"$or": bson.A{
+        bson.M{"_id": bson.M{"$in": objIDs}},
+        bson.M{"short_id": bson.M{"$in": shortIDs}},
+    }}
+    cursor, err := contactsCollection.Find(r.Context(), scopeFilter(r, filter))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
+        return
+    }
+    var found []Contact
+    if err := cursor.All(r.Context(), &found); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    byKey := make(map[string]Contact, 2*len(found))
+    for _, c := range found {
+        byKey[c.ID.Hex()] = c
+        if c.ShortID != "" {
+            byKey[c.ShortID] = c
+        }
+    }
+    contacts := make([]Contact, 0, len(found))
+    served := map[primitive.ObjectID]bool{}
+    for _, key := range keys {
+        if c, ok := byKey[key]; ok && !served[c.ID] {
+            contacts = append(contacts, c)
+            served[c.ID] = true
+        }
+    }
+
+    recordsServed(r, len(contacts))
+    writeContacts(w, r, contacts)
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "slices"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Outcomes of the elements of a bulk request
+const (
+    outcomeCreated = "created"
+    outcomeUpdated = "updated"
+    outcomeDeleted = "deleted"
+    outcomeFailed  = "failed"
+)
+
+// BulkItemResult is what happened to one element of a bulk request. Status is
+// the HTTP status the element would have got on its own, and ID the contact it
+// concerned or created.
+type BulkItemResult struct {
+    Index   int    `json:"index"`
+    Outcome string `json:"outcome"`
+    Status  int    `json:"status"`
+    ID      string `json:"id,omitempty"`
+    Code    string `json:"code,omitempty"`
+    Error   string `json:"error,omitempty"`
+}
+
+// BulkResult is the response of the bulk endpoints, sent as 207 Multi-Status.
+// Callers retry the elements whose outcome is "failed".
+type BulkResult struct {
+    Succeeded int              `json:"succeeded"`
+    Failed    int              `json:"failed"`
+    Results   []BulkItemResult `json:"results"`
+}
+
+// newBulkResult returns the result of a bulk request of n elements, none of
+// which have an outcome yet
+func newBulkResult(n int) BulkResult {
+    res := BulkResult{Results: make([]BulkItemResult, n)}
+    for i := range res.Results {
+        res.Results[i].Index = i
+    }
+    return res
+}
+
+// pending reports whether element i has no outcome yet
+func (res *BulkResult) pending(i int) bool {
+    return res.Results[i].Outcome == ""
+}
+
+func (res *BulkResult) succeed(i int, outcome string, status int, id string) {
+    res.Results[i] = BulkItemResult{Index: i, Outcome: outcome, Status: status, ID: id}
+    res.Succeeded++
+}
+
+func (res *BulkResult) fail(i int, status int, code, msg string) {
+    res.Results[i] = BulkItemResult{Index: i, Outcome: outcomeFailed, Status: status, ID: res.Results[i].ID, Code: code, Error: msg}
+    res.Failed++
+}
+
+// reject records a failed element for requests that only list failures, such
+// as imports, whose elements aren't known up front
+func (res *BulkResult) reject(index int, status int, code, msg string) {
+    res.Results = append(res.Results, BulkItemResult{Index: index, Outcome: outcomeFailed, Status: status, Code: code, Error: msg})
+    res.Failed++
+}
+
+// writeBulkResult answers a bulk request with res
+func writeBulkResult(w http.ResponseWriter, res any) {
+    w.WriteHeader(http.StatusMultiStatus)
+    json.NewEncoder(w).Encode(res)
+}
+
+// bulkLimit answers 400 itself if a bulk request of n elements is empty or
+// larger than max_page_size
+func bulkLimit(w http.ResponseWriter, r *http.Request, n int) bool {
+    if n == 0 {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "A bulk request needs at least one element")
+        return false
+    }
+    if max := queryLimitsFor(r).MaxPageSize; max > 0 && n > max {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, fmt.Sprintf("at most %d elements can be sent at once", max))
+        return false
+    }
+    return true
+}
+
+// resolveBulkIDs looks up the contacts (ObjectIDs or short IDs) that elements
+// of a bulk request name in one query. Elements naming a malformed ID, a
+// contact the caller doesn't have, or one an earlier element already named
+// fail; an unordered bulk write could apply two writes to one contact in
+// either order.
+func resolveBulkIDs(r *http.Request, res *BulkResult, keys []string) ([]primitive.ObjectID, error) {
+    ids := make([]primitive.ObjectID, len(keys))
+    objIDs, shortIDs := bson.A{}, bson.A{}
+    for i, key := range keys {
+        res.Results[i].ID = key
+        if objID, err := primitive.ObjectIDFromHex(key); err == nil {
+            ids[i] = objID
+            objIDs = append(objIDs, objID)
+        } else if isShortID(key) {
+            shortIDs = append(shortIDs, key)
+        } else {
+            res.fail(i, http.StatusBadRequest, codeInvalidContactID, "Invalid contact ID")
+        }
+    }
+
+    filter := bson.M{"$or": bson.A{
+        bson.M{"_id": bson.M{"$in": objIDs}},
+        bson.M{"short_id": bson.M{"$in": shortIDs}},
+    }}
+    cursor, err := contactsCollection.Find(r.Context(), scopeFilter(r, filter),
+        options.Find().SetProjection(bson.M{"_id": 1, "short_id": 1}))
+    if err != nil {
+        return nil, err
+    }
+    var found []Contact
+    if err := cursor.All(r.Context(), &found); err != nil {
+        return nil, err
+    }
+    exists := make(map[primitive.ObjectID]bool, len(found))
+    byShortID := make(map[string]primitive.ObjectID, len(found))
+    for _, c := range found {
+        exists[c.ID] = true
+        if c.ShortID != "" {
+            byShortID[c.ShortID] = c.ID
+        }
+    }
+
+    seen := map[primitive.ObjectID]bool{}
+    for i, key := range keys {
+        if !res.pending(i) {
+            continue
+        }
+        if ids[i].IsZero() {
+            ids[i] = byShortID[key]
+        }
+        switch {
+        case !exists[ids[i]]:
+            res.fail(i, http.StatusNotFound, codeContactNotFound, "Contact not found")
+        case seen[ids[i]]:
+            res.fail(i, http.StatusBadRequest, codeValidationFailed, "Contact is named by an earlier element")
+        default:
+            seen[ids[i]] = true
+            res.Results[i].ID = ids[i].Hex()
+        }
+    }
+    return ids, nil
+}
+
+// bulkWrite runs models as one unordered BulkWrite, failing the elements of
+// res at modelIndexes whose write failed. It returns an error only if the
+// write as a whole failed.
+func bulkWrite(r *http.Request, res *BulkResult, models []mongo.WriteModel, modelIndexes []int) error {
+    if len(models) == 0 {
+        return nil
+    }
+    _, err := contactsCollection.BulkWrite(r.Context(), models, options.BulkWrite().SetOrdered(false))
+    var bulkErr mongo.BulkWriteException
+    if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil {
+        return err
+    }
+    for _, we := range bulkErr.WriteErrors {
+        i := modelIndexes[we.Index]
+        switch {
+        case isPhoneConflict(we):
+            res.fail(i, http.StatusConflict, codeDuplicatePhone, "Another contact already has this phone number")
+        default:
+            logError("bulk write: element %d: %v", i, we)
+            res.fail(i, http.StatusInternalServerError, codeInternal, "Failed to write contact")
+        }
+    }
+    return nil
+}
+
+// bulkCreateContacts handles POST /contacts/bulk. The body is a JSON array of
+// contacts as POST /contacts takes them, at most max_page_size of them, and
+// each created contact's ID is in its result. Contacts beyond the caller's
+// quota fail.
+func bulkCreateContacts(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var items []Contact
+    if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Body must be a JSON array of contacts")
+        return
+    }
+    if !bulkLimit(w, r, len(items)) {
+        return
+    }
+    capacity, _, err := importCapacity(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to check quota")
+        return
+    }
+    settings, err := callerSettings(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve settings")
+        return
+    }
+
+    phones := make([]string, len(items))
+    for i, c := range items {
+        phones[i] = c.Phone
+    }
+    suppressed, err := suppressedPhones(r, settings, phones...)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to check the suppression list")
+        return
+    }
+
+    res := newBulkResult(len(items))
+    var models []mongo.WriteModel
+    var modelIndexes []int
+    docs := make([]bson.M, len(items))
+    now := utcNow()
+    for i := range items {
+        c := &items[i]
+        c.DoNotContact = c.DoNotContact || suppressed[c.Phone]
+        if c.Name == "" || c.Phone == "" {
+            res.fail(i, http.StatusBadRequest, codeMissingField, "Missing name or phone")
+            continue
+        }
+        website, err := normalizeWebsite(c.Website)
+        if err != nil {
+            res.fail(i, http.StatusBadRequest, codeValidationFailed, err.Error())
+            continue
+        }
+        c.Website, c.WebsitePreview = website, nil
+        if c.Social, err = normalizeSocial(c.Social); err != nil {
+            res.fail(i, http.StatusBadRequest, codeValidationFailed, err.Error())
+            continue
+        }
+        if c.Dates, err = normalizeDates(c.Dates); err != nil {
+            res.fail(i, http.StatusBadRequest, codeValidationFailed, err.Error())
+            continue
+        }
+        if capacity >= 0 && int64(len(models)) >= capacity {
+            res.fail(i, http.StatusForbidden, codeQuotaExceeded, "Contact quota exceeded")
+            continue
+        }
+        if c.ReportsTo != nil {
+            if status, code, msg := checkManager(r, primitive.NilObjectID, *c.ReportsTo); status != 0 {
+                res.fail(i, status, code, msg)
+                continue
+            }
+        }
+
+        // the IDs are assigned here so results can name them
+        c.ID = primitive.NewObjectID()
+        c.ShortID = newShortID()
+        doc := newContactDoc(r, settings, *c, now)
+        doc["_id"], doc["short_id"] = c.ID, c.ShortID
+        docs[i] = doc
+        c.Name, c.Tags = doc["name"].(string), doc["tags"].([]string)
+        c.Company, c.JobTitle = normalizeLabel(c.Company), normalizeLabel(c.JobTitle)
+        c.Owner = principalFrom(r).KeyID
+        c.CreatedAt, c.UpdatedAt, c.Version = now, now, 1
+        models = append(models, mongo.NewInsertOneModel().SetDocument(doc))
+        modelIndexes = append(modelIndexes, i)
+    }
+    if err := bulkWrite(r, &res, models, modelIndexes); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create contacts")
+        return
+    }
+
+    var created []bson.M
+    for _, i := range modelIndexes {
+        if !res.pending(i) {
+            continue
+        }
+        c := items[i]
+        created = append(created, docs[i])
+        res.succeed(i, outcomeCreated, http.StatusCreated, c.ID.Hex())
+        recordAudit(r, "contact.create", c.ID.Hex(), bson.M{"bulk": true})
+        publishContactEvent(r, "contact.created", c)
+    }
+    recordCreated(r, versionCreate, created...)
+    writeBulkResult(w, res)
+}
+
+// BulkUpdate is one element of a bulk update: the contact (ObjectID or short
+// ID) and the changes to make to it
+type BulkUpdate struct {
+    ID      string         `json:"id"`
+    Changes contactChanges `json:"changes"`
+}
+
+// bulkUpdateContacts handles PATCH /contacts/bulk. The body is a JSON array of
+// {id, changes} pairs, at most max_page_size of them, where changes are what
+// PUT /contacts/{id} takes.
+func bulkUpdateContacts(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if refuseUnreviewed(w, r) {
+        return
+    }
+    var items []BulkUpdate
+    if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Body must be a JSON array of {id, changes} objects")
+        return
+    }
+    if !bulkLimit(w, r, len(items)) {
+        return
+    }
+    settings, err := callerSettings(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve settings")
+        return
+    }
+
+    res := newBulkResult(len(items))
+    keys := make([]string, len(items))
+    for i, item := range items {
+        keys[i] = item.ID
+    }
+    ids, err := resolveBulkIDs(r, &res, keys)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
+        return
+    }
+
+    var modelIndexes []int
+    updates := make([]bson.M, len(items))
+    sets := make([]bson.M, len(items))
+    for i := range items {
+        if !res.pending(i) {
+            continue
+        }
+        ch := &items[i].Changes
+        if ch.Name == nil && ch.Phone == nil && ch.Tags == nil && ch.Company == nil && ch.JobTitle == nil && ch.Website == nil && ch.Social == nil && ch.Dates == nil && ch.DoNotContact == nil && ch.ReportsTo == nil {
+            res.fail(i, http.StatusBadRequest, codeValidationFailed, "changes must set name, phone, tags, company, job_title, website, social, dates, do_not_contact or reports_to")
+            continue
+        }
+        if msg := ch.normalizeWebsite(); msg != "" {
+            res.fail(i, http.StatusBadRequest, codeValidationFailed, msg)
+            continue
+        }
+        if msg := ch.normalizeSocial(); msg != "" {
+            res.fail(i, http.StatusBadRequest, codeValidationFailed, msg)
+            continue
+        }
+        if msg := ch.normalizeDates(); msg != "" {
+            res.fail(i, http.StatusBadRequest, codeValidationFailed, msg)
+            continue
+        }
+        if ch.Version != nil {
+            res.fail(i, http.StatusBadRequest, codeValidationFailed, "version is only merged by PUT /contacts/{id}")
+            continue
+        }
+        if status, code, msg := ch.resolveReportsTo(r, ids[i]); status != 0 {
+            res.fail(i, status, code, msg)
+            continue
+        }
+        if err := ch.flagSuppressed(r, settings); err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to check the suppression list")
+            return
+        }
+        updates[i], sets[i] = ch.update(settings)
+        modelIndexes = append(modelIndexes, i)
+    }
+    // as in saveContactChanges, contacts another site wrote later than their
+    // update's stamp are updated again with a later one
+    for attempt, pending := 1, modelIndexes; len(pending) > 0; attempt++ {
+        models := make([]mongo.WriteModel, len(pending))
+        stamps := map[primitive.ObjectID]WriteStamp{}
+        for j, i := range pending {
+            models[j] = mongo.NewUpdateOneModel().
+                SetFilter(lastWriterFilter(scopeFilter(r, bson.M{"_id": ids[i]}), updates[i])).
+                SetUpdate(updates[i])
+            if stamp, ok := sets[i]["replication"].(WriteStamp); ok {
+                stamps[ids[i]] = stamp
+            }
+        }
+        if err := bulkWrite(r, &res, models, pending); err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to update contacts")
+            return
+        }
+        if len(stamps) == 0 {
+            break
+        }
+        later, err := writtenLaterThan(r.Context(), scopeFilter(r, bson.M{}), stamps)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to update contacts")
+            return
+        }
+        pending = slices.DeleteFunc(slices.Clone(pending), func(i int) bool {
+            return !res.pending(i) || !slices.Contains(later, ids[i])
+        })
+        if attempt == maxMergeAttempts {
+            for _, i := range pending {
+                res.fail(i, http.StatusConflict, codeVersionConflict, "The contact keeps changing; try again")
+            }
+            break
+        }
+        for _, i := range pending {
+            stampWrite(updates[i])
+        }
+    }
+
+    var updated []primitive.ObjectID
+    for _, i := range modelIndexes {
+        id := ids[i].Hex()
+        contactCache.Delete(tenantOf(r) + "/" + id)
+        if !res.pending(i) {
+            continue
+        }
+        updated = append(updated, ids[i])
+        res.succeed(i, outcomeUpdated, http.StatusOK, id)
+        recordAudit(r, "contact.update", id, bson.M{"bulk": true})
+        publishContactEvent(r, "contact.updated", bson.M{"id": id, "changes": publicChanges(sets[i])})
+    }
+    recordVersions(r, versionUpdate, updated...)
+    writeBulkResult(w, res)
+}
+
+// bulkDeleteContacts handles DELETE /contacts/bulk?ids=a,b,c, deleting at
+// most max_page_size contacts (ObjectIDs or short IDs)
+func bulkDeleteContacts(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if refuseUnreviewed(w, r) {
+        return
+    }
+    var keys []string
+    for _, key := range strings.Split(r.URL.Query().Get("ids"), ",") {
+        if key = strings.TrimSpace(key); key != "" {
+            keys = append(keys, key)
+        }
+    }
+    if len(keys) == 0 {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "ids is required")
+        return
+    }
+    if !bulkLimit(w, r, len(keys)) {
+        return
+    }
+
+    res := newBulkResult(len(keys))
+    ids, err := resolveBulkIDs(r, &res, keys)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
+        return
+    }
+
+    var models []mongo.WriteModel
+    var modelIndexes []int
+    var targets []primitive.ObjectID
+    for i := range keys {
+        if !res.pending(i) {
+            continue
+        }
+        models = append(models, mongo.NewDeleteOneModel().SetFilter(scopeFilter(r, bson.M{"_id": ids[i]})))
+        modelIndexes = append(modelIndexes, i)
+        targets = append(targets, ids[i])
+    }
+    // read before deleting, for the contacts' last versions
+    before := map[primitive.ObjectID]Contact{}
+    if len(targets) > 0 {
+        contacts, err := contactsByID(r, targets)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
+            return
+        }
+        for _, c := range contacts {
+            before[c.ID] = c
+        }
+    }
+    if err := bulkWrite(r, &res, models, modelIndexes); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete contacts")
+        return
+    }
+
+    var deleted []primitive.ObjectID
+    var last []Contact
+    for _, i := range modelIndexes {
+        id := ids[i].Hex()
+        contactCache.Delete(tenantOf(r) + "/" + id)
+        if !res.pending(i) {
+            continue
+        }
+        deleted = append(deleted, ids[i])
+        if c, ok := before[ids[i]]; ok {
+            last = append(last, c)
+        }
+        res.succeed(i, outcomeDeleted, http.StatusOK, id)
+        recordAudit(r, "contact.delete", id, bson.M{"bulk": true})
+        emitSecurityEvent(r, "erasure", "contact.delete", "success", id, nil)
+        publishContactEvent(r, "contact.deleted", bson.M{"id": id})
+    }
+    recordDeleted(r, last...)
+    if len(deleted) > 0 {
+        cleanUpDeleted(r, deleted...)
+    }
+    writeBulkResult(w, res)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+    "sync"
+    "time"
+)
+
+type cacheEntry[V any] struct {
+    value   V
+    expires time.Time
+}
+
+// ttlCache is a small in-memory map whose entries expire after a TTL
+type ttlCache[V any] struct {
+    mu        sync.RWMutex
+    entries   map[string]cacheEntry[V]
+    lastSweep time.Time
+}
+
+func newTTLCache[V any]() *ttlCache[V] {
+    return &ttlCache[V]{entries: map[string]cacheEntry[V]{}}
+}
+
+// contactCache holds contacts served by GET /contacts/{id}
+var contactCache = newTTLCache[Contact]()
+
+func (c *ttlCache[V]) Get(key string) (V, bool) {
+    c.mu.RLock()
+    e, ok := c.entries[key]
+    c.mu.RUnlock()
+
+    if !ok || time.Now().After(e.expires) {
+        var zero V
+        return zero, false
+    }
+    return e.value, true
+}
+
+func (c *ttlCache[V]) Set(key string, value V, ttl time.Duration) {
+    if ttl <= 0 {
+        return
+    }
+
+    c.mu.Lock()
+    defer c.mu.Unlock()
+
+    now := time.Now()
+    if now.Sub(c.lastSweep) > time.Minute {
+        for k, e := range c.entries {
+            if now.After(e.expires) {
+                delete(c.entries, k)
+            }
+        }
+        c.lastSweep = now
+    }
+    c.entries[key] = cacheEntry[V]{value: value, expires: now.Add(ttl)}
+}
+
+func (c *ttlCache[V]) Delete(key string) {
+    c.mu.Lock()
+    delete(c.entries, key)
+    c.mu.Unlock()
+}
+
+// Purge drops every entry, used when the TTL changes
+func (c *ttlCache[V]) Purge() {
+    c.mu.Lock()
+    c.entries = map[string]cacheEntry[V]{}
+    c.mu.Unlock()
+}
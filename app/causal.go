@@ -0,0 +1,187 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// With reads routed to secondaries, a client could list its contacts right
+// after creating one and miss it, the secondary not having caught up yet. So
+// while read_routing routes any reads, the operations of a request run in a
+// causally consistent session per cluster, which carries on from where the
+// previous writes of the same client session left off: reads wait until the
+// member they go to has the writes before them. A client session is an API
+// key, or IP for anonymous callers, and the caller's X-Client-Session header,
+// for clients sharing a key to keep apart.
+//
+// Where a client session left off is kept in causal_tokens, shared by the
+// replicas, and saved before the response of a write is sent, so the next
+// request finds it whichever replica serves it. Reads only see writes that a
+// majority of members have, should the primary fail over, with the "majority"
+// write concern; see write_concern.
+
+const (
+    // causalTokenTTL is how long a client session's place is remembered
+    causalTokenTTL = 10 * time.Minute
+    // maxClientSession is the longest X-Client-Session used; longer ones are cut
+    maxClientSession = 128
+)
+
+// causalToken is where a client session left off on a cluster
+type causalToken struct {
+    ID            string              `bson:"_id"`
+    ClusterTime   bson.Raw            `bson:"cluster_time"`
+    OperationTime primitive.Timestamp `bson:"operation_time"`
+    At            time.Time           `bson:"at"`
+}
+
+func causalTokensCollection() collection {
+    return sharedCollectionOf("causal_tokens")
+}
+
+// causalSessions are the sessions of a request, by region, started as its
+// operations need them
+type causalSessions struct {
+    key      string
+    mu       sync.Mutex
+    sessions map[string]mongo.Session
+}
+
+// causalWriter saves where the request's sessions left off before the
+// response starts
+type causalWriter struct {
+    http.ResponseWriter
+    cs    *causalSessions
+    saved bool
+}
+
+func (cw *causalWriter) WriteHeader(status int) {
+    cw.save()
+    cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *causalWriter) Write(b []byte) (int, error) {
+    cw.save()
+    return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (cw *causalWriter) Unwrap() http.ResponseWriter {
+    return cw.ResponseWriter
+}
+
+func (cw *causalWriter) save() {
+    if !cw.saved {
+        cw.saved = true
+        cw.cs.save()
+    }
+}
+
+// CausalReads middleware gives requests their client session's causally
+// consistent sessions while reads are routed to secondaries; the sessions end
+// with the request. Writes save where they left off.
+func CausalReads(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if len(currentConfig().ReadRouting.Operations) == 0 {
+            next.ServeHTTP(w, r)
+            return
+        }
+        cs := &causalSessions{key: clientSession(r), sessions: map[string]mongo.Session{}}
+        defer cs.end()
+        r = r.WithContext(context.WithValue(r.Context(), causalKey, cs))
+        if !isWriteMethod(r.Method) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        cw := &causalWriter{ResponseWriter: w, cs: cs}
+        next.ServeHTTP(cw, r)
+        // for handlers that wrote no response
+        cw.save()
+    })
+}
+
+// clientSession names the client session of a request
+func clientSession(r *http.Request) string {
+    session := r.Header.Get("X-Client-Session")
+    if len(session) > maxClientSession {
+        session = session[:maxClientSession]
+    }
+    return clientKey(r) + "|" + session
+}
+
+// session returns the request's session on client, the cluster of region,
+// starting it where the client session left off; nil if it can't be started
+func (cs *causalSessions) session(ctx context.Context, region string, client *mongo.Client) mongo.Session {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    if sess, ok := cs.sessions[region]; ok {
+        return sess
+    }
+    sess, err := client.StartSession(options.Session().SetCausalConsistency(true))
+    if err != nil {
+        logWarn("failed to start a causally consistent session: %v", err)
+        return nil
+    }
+    // straight on the driver's collection, which doesn't look for a session
+    var t causalToken
+    err = causalTokensCollection().Collection.FindOne(ctx, bson.M{"_id": cs.key + "|" + region}).Decode(&t)
+    switch {
+    case err == nil:
+        sess.AdvanceClusterTime(t.ClusterTime)
+        sess.AdvanceOperationTime(&t.OperationTime)
+    case err != mongo.ErrNoDocuments:
+        logWarn("failed to read where client session %s left off: %v", cs.key, err)
+    }
+    cs.sessions[region] = sess
+    return sess
+}
+
+// save stores where the sessions left off, unless a later request of the
+// client session got further
+func (cs *causalSessions) save() {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    for region, sess := range cs.sessions {
+        at := sess.OperationTime()
+        if at == nil {
+            continue
+        }
+        t := causalToken{ID: cs.key + "|" + region, ClusterTime: sess.ClusterTime(), OperationTime: *at, At: utcNow()}
+        _, err := causalTokensCollection().Collection.ReplaceOne(ctx,
+            bson.M{"_id": t.ID, "operation_time": bson.M{"$lt": t.OperationTime}}, t, options.Replace().SetUpsert(true))
+        if err != nil && !mongo.IsDuplicateKeyError(err) {
+            logWarn("failed to save where client session %s left off: %v", cs.key, err)
+        }
+    }
+}
+
+// end ends the sessions
+func (cs *causalSessions) end() {
+    cs.mu.Lock()
+    defer cs.mu.Unlock()
+    for _, sess := range cs.sessions {
+        sess.EndSession(context.Background())
+    }
+}
+
+// withCausalSession returns ctx with the request's session on the cluster of
+// coll, if the request has causally consistent sessions
+func withCausalSession(ctx context.Context, region string, coll *mongo.Collection) context.Context {
+    cs, ok := ctx.Value(causalKey).(*causalSessions)
+    if !ok {
+        return ctx
+    }
+    if sess := cs.session(ctx, region, coll.Database().Client()); sess != nil {
+        return mongo.NewSessionContext(ctx, sess)
+    }
+    return ctx
+}
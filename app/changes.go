@@ -0,0 +1,117 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxChangesRead caps the versions one GET /contacts/changes reads; beyond
+// it the response ends early and until says where to continue
+const maxChangesRead = 10000
+
+// ContactChanges is the response of GET /contacts/changes: the IDs of the
+// contacts created, updated and deleted from Since up to, not including,
+// Until. A contact is listed once, by what it ended up as: created if it
+// didn't exist before Since and still does, deleted if it is gone.
+type ContactChanges struct {
+    Since   time.Time `json:"since"`
+    Until   time.Time `json:"until"`
+    Created []string  `json:"created"`
+    Updated []string  `json:"updated"`
+    Deleted []string  `json:"deleted"`
+}
+
+// getContactChanges handles GET /contacts/changes?since=<RFC 3339>, for batch
+// consumers polling for what changed. Like GET /contacts/sync it reads the
+// contact versions, holding back the last syncSettle; calling again with
+// since set to until picks up where the response ended.
+func getContactChanges(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    v := r.URL.Query().Get("since")
+    if v == "" {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "since is required")
+        return
+    }
+    since, err := parseTimestamp(v)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "since must be an RFC 3339 time")
+        return
+    }
+    res := ContactChanges{Since: since, Until: utcNow().Add(-syncSettle), Created: []string{}, Updated: []string{}, Deleted: []string{}}
+    if !since.Before(res.Until) {
+        res.Until = since
+        json.NewEncoder(w).Encode(res)
+        return
+    }
+
+    filter := scopeFilter(r, bson.M{"at": bson.M{"$gte": since, "$lt": res.Until}})
+    if tags := keyTags(r.Context()); len(tags) > 0 {
+        filter["contact.tags"] = bson.M{"$in": tags}
+    }
+    versions, err := changedVersions(r, filter, maxChangesRead+1)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve changes")
+        return
+    }
+    // a response cut short ends before the first version left out, so the
+    // writes sharing its time are all in the next one. If they fill it, as a
+    // tag renamed on many contacts does, that time is returned on its own.
+    if len(versions) > maxChangesRead {
+        res.Until = versions[maxChangesRead].At
+        for len(versions) > 0 && !versions[len(versions)-1].At.Before(res.Until) {
+            versions = versions[:len(versions)-1]
+        }
+        if len(versions) == 0 {
+            filter["at"] = res.Until
+            if versions, err = changedVersions(r, filter, 0); err != nil {
+                writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve changes")
+                return
+            }
+            res.Until = res.Until.Add(time.Millisecond)
+        }
+    }
+
+    first := map[primitive.ObjectID]string{}
+    last := map[primitive.ObjectID]int{}
+    for i, v := range versions {
+        if _, ok := first[v.ContactID]; !ok {
+            first[v.ContactID] = v.Action
+        }
+        last[v.ContactID] = i
+    }
+    for i, v := range versions {
+        id := v.ContactID
+        switch {
+        case last[id] != i:
+        case v.Action == versionDelete:
+            res.Deleted = append(res.Deleted, id.Hex())
+        case first[id] == versionCreate:
+            res.Created = append(res.Created, id.Hex())
+        default:
+            res.Updated = append(res.Updated, id.Hex())
+        }
+    }
+    json.NewEncoder(w).Encode(res)
+}
+
+// changedVersions reads the contact, action and time of up to limit versions
+// (0 for all) matching filter, oldest first
+func changedVersions(r *http.Request, filter bson.M, limit int64) ([]ContactVersion, error) {
+    opts := options.Find().
+        SetSort(bson.D{{Key: "at", Value: 1}, {Key: "_id", Value: 1}}).
+        SetProjection(bson.M{"contact_id": 1, "action": 1, "at": 1}).
+        SetLimit(limit)
+    cursor, err := contactVersionsCollection().Find(r.Context(), filter, opts)
+    if err != nil {
+        return nil, err
+    }
+    var versions []ContactVersion
+    err = cursor.All(r.Context(), &versions)
+    return versions, err
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collationLocales are the locales MongoDB collations support
+var collationLocales = map[string]bool{}
+
+func init() {
+    for _, l := range strings.Fields(`af am ar as az be bg bn bo bs bs_Cyrl ca chr cs cy da de de_AT dsb
+        dz ee el en en_US_POSIX eo es et fa fa_AF fi fil fo fr fr_CA ga gl gu ha haw he hi hr hsb hu hy
+        id ig is it ja ka kk kl km kn ko kok ky lb lkt ln lo lt lv mk ml mn mr ms mt my nb ne nl nn om
+        or pa pl ps pt ro ru se si sk sl smn sq sr sr_Latn sv sw ta te th to tr ug uk ur vi wae yi yo
+        zh zh_Hant zu`) {
+        collationLocales[l] = true
+    }
+}
+
+// collationLocale maps a BCP 47 tag like "sv-SE" or "zh-Hant-TW" to the most
+// specific locale MongoDB supports, or "" if it supports none of it
+func collationLocale(tag string) string {
+    parts := strings.Split(strings.ReplaceAll(tag, "-", "_"), "_")
+    parts[0] = strings.ToLower(parts[0])
+    for n := len(parts); n > 0; n-- {
+        if l := strings.Join(parts[:n], "_"); collationLocales[l] {
+            return l
+        }
+    }
+    return ""
+}
+
+// contactSorts are the orders ?sort= can ask for; "-" sorts descending. Ties
+// are broken by ID so pages stay stable.
+var contactSorts = map[string]string{
+    "id":         "_id",
+    "name":       "name",
+    "created_at": "created_at",
+    "updated_at": "updated_at",
+    "manual":     "rank",
+}
+
+// sortMessage rejects an unknown sort
+const sortMessage = "sort must be id, name, created_at, updated_at or manual, optionally prefixed with -"
+
+// contactOrder reads ?sort= and, for names, the collation they are compared
+// with: that of ?locale= or else of the tenant's locale setting, or MongoDB's
+// binary order for tenants without one. It answers 400 for an unknown sort or
+// unsupported locale itself.
+func contactOrder(w http.ResponseWriter, r *http.Request) (bson.D, *options.Collation, bool) {
+    q := r.URL.Query()
+    sort := q.Get("sort")
+    if sort == "" {
+        sort = "id"
+    }
+    dir := 1
+    if strings.HasPrefix(sort, "-") {
+        sort, dir = sort[1:], -1
+    }
+    field, ok := contactSorts[sort]
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, sortMessage)
+        return nil, nil, false
+    }
+    if field == "rank" {
+        // pinned contacts first; pinned is true or missing, never false
+        return bson.D{{Key: "pinned", Value: -1}, {Key: "rank", Value: dir}, {Key: "_id", Value: dir}}, nil, true
+    }
+    order := bson.D{{Key: field, Value: dir}}
+    if field != "_id" {
+        order = append(order, bson.E{Key: "_id", Value: dir})
+    }
+    if field != "name" {
+        return order, nil, true
+    }
+
+    locale := ""
+    if tag := q.Get("locale"); tag != "" {
+        if locale = collationLocale(tag); locale == "" {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "locale is not supported for sorting")
+            return nil, nil, false
+        }
+    } else {
+        settings, err := callerSettings(r)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve settings")
+            return nil, nil, false
+        }
+        locale = settings.Locale
+    }
+    if locale == "" {
+        return order, nil, true
+    }
+    return order, &options.Collation{Locale: locale}, true
+}
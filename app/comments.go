@@ -0,0 +1,180 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+    "time"
+    "unicode/utf8"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    // maxCommentLength caps the characters of one comment
+    maxCommentLength = 2000
+    // maxComments caps the comments on one contact
+    maxComments         = 500
+    defaultCommentLimit = 50
+    maxCommentLimit     = 200
+)
+
+// Comment is a note an API key left on a contact for its colleagues. Only
+// its author can delete it, and it is deleted with the contact.
+type Comment struct {
+    ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    Tenant    string             `bson:"tenant" json:"-"`
+    ContactID primitive.ObjectID `bson:"contact_id" json:"contact_id"`
+    Author    string             `bson:"author" json:"author"`
+    Text      string             `bson:"text" json:"text"`
+    CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func commentsCollection() collection {
+    return collectionOf("contact_comments")
+}
+
+// listComments handles GET /contacts/{id}/comments[?limit=50&before=], the
+// contact's comments newest first; before is the next cursor of the previous
+// page
+func listComments(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    limit, ok := queryInt(r, "limit", defaultCommentLimit, maxCommentLimit)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "limit must be a positive number")
+        return
+    }
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    filter := scopeFilter(r, bson.M{"contact_id": c.ID})
+    if before := r.URL.Query().Get("before"); before != "" {
+        cursorID, err := primitive.ObjectIDFromHex(before)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "Invalid before cursor")
+            return
+        }
+        filter["_id"] = bson.M{"$lt": cursorID}
+    }
+
+    opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit) + 1)
+    cursor, err := commentsCollection().Find(r.Context(), filter, opts)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve comments")
+        return
+    }
+    comments := []Comment{}
+    if err := cursor.All(r.Context(), &comments); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    body := bson.M{"contact_id": c.ID.Hex(), "comments": comments}
+    if len(comments) > limit {
+        body["comments"] = comments[:limit]
+        body["next"] = comments[limit-1].ID.Hex()
+    }
+    json.NewEncoder(w).Encode(body)
+}
+
+// createComment handles POST /contacts/{id}/comments with {"text"}
+func createComment(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var in struct {
+        Text string `json:"text"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    defer r.Body.Close()
+    in.Text = strings.TrimSpace(in.Text)
+    if in.Text == "" {
+        writeError(w, http.StatusBadRequest, codeMissingField, "text is required")
+        return
+    }
+    if utf8.RuneCountInString(in.Text) > maxCommentLength {
+        writeErrorWith(w, http.StatusBadRequest, codeValidationFailed, "text must not be longer than 2000 characters",
+            map[string]any{"max_length": maxCommentLength})
+        return
+    }
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+
+    count, err := commentsCollection().CountDocuments(r.Context(), scopeFilter(r, bson.M{"contact_id": c.ID}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create comment")
+        return
+    }
+    if count >= maxComments {
+        writeErrorWith(w, http.StatusForbidden, codeQuotaExceeded, "Too many comments on this contact, delete some first",
+            map[string]any{"max_comments": maxComments})
+        return
+    }
+
+    comment := Comment{Tenant: tenantOf(r), ContactID: c.ID, Author: clientKey(r), Text: in.Text, CreatedAt: utcNow()}
+    result, err := commentsCollection().InsertOne(r.Context(), comment)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create comment")
+        return
+    }
+    comment.ID = result.InsertedID.(primitive.ObjectID)
+    recordAudit(r, "contact.comment", c.ID.Hex(), bson.M{"comment": comment.ID.Hex()})
+
+    w.Header().Set("Location", "/contacts/"+c.ID.Hex()+"/comments/"+comment.ID.Hex())
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(comment)
+}
+
+// deleteComment handles DELETE /contacts/{id}/comments/{comment}; callers can
+// only delete their own comments
+func deleteComment(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    commentID, err := primitive.ObjectIDFromHex(r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:])
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid comment ID")
+        return
+    }
+
+    var comment Comment
+    err = commentsCollection().FindOne(r.Context(), scopeFilter(r, bson.M{"_id": commentID, "contact_id": c.ID})).Decode(&comment)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeCommentNotFound, "Comment not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return
+    }
+    if comment.Author != clientKey(r) {
+        writeError(w, http.StatusForbidden, codeForbidden, "Only the author can delete a comment")
+        return
+    }
+    if _, err := commentsCollection().DeleteOne(r.Context(), bson.M{"_id": commentID}); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete comment")
+        return
+    }
+    recordAudit(r, "contact.comment.delete", c.ID.Hex(), bson.M{"comment": commentID.Hex()})
+    json.NewEncoder(w).Encode(bson.M{"message": "Comment deleted successfully"})
+}
+
+// deleteComments removes the comments on deleted contacts
+func deleteComments(r *http.Request, ids ...primitive.ObjectID) {
+    _, err := commentsCollection().DeleteMany(r.Context(), scopeFilter(r, bson.M{"contact_id": bson.M{"$in": ids}}))
+    if err != nil {
+        logError("failed to delete the comments on deleted contacts: %v", err)
+    }
+}
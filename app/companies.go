@@ -0,0 +1,70 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "golang.org/x/text/unicode/norm"
+)
+
+// normalizeLabel tidies a company name or job title: trimmed, with runs of
+// whitespace made one space, so one company isn't counted under two spellings
+// that only differ in spacing
+func normalizeLabel(s string) string {
+    return norm.NFC.String(strings.Join(strings.Fields(s), " "))
+}
+
+// CompanyCount is a company and how many of the tenant's contacts work there
+type CompanyCount struct {
+    Company string `bson:"_id" json:"company"`
+    Count   int64  `bson:"count" json:"count"`
+}
+
+// listCompanies handles GET /companies[?sort=count], the companies of the
+// caller's contacts with their contact counts, by name or largest first
+func listCompanies(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    order := bson.D{{Key: "_id", Value: 1}}
+    switch r.URL.Query().Get("sort") {
+    case "", "name":
+    case "count":
+        order = bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}
+    default:
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "sort must be name or count")
+        return
+    }
+
+    cursor, err := contactsCollection.Aggregate(r.Context(), mongo.Pipeline{
+        {{Key: "$match", Value: scopeFilter(r, bson.M{"company": bson.M{"$gt": ""}})}},
+        {{Key: "$group", Value: bson.M{"_id": "$company", "count": bson.M{"$sum": 1}}}},
+        {{Key: "$sort", Value: order}},
+    })
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve companies")
+        return
+    }
+    companies := []CompanyCount{}
+    if err := cursor.All(r.Context(), &companies); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    json.NewEncoder(w).Encode(companies)
+}
+
+// getCompanyContacts handles GET /companies/{name}/contacts, the contacts
+// working at the company, answered by listContactsMatching with the request's
+// other filters and sort order
+func getCompanyContacts(w http.ResponseWriter, r *http.Request) {
+    name := strings.TrimSuffix(r.URL.Path[len("/companies/"):], "/contacts")
+    cq := contactQueryFrom(r)
+    if cq.Company = normalizeLabel(name); cq.Company == "" {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "Missing company name")
+        return
+    }
+    listContactsMatching(w, r, cq, r.URL.Query().Get("sort"))
+}
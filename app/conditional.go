@@ -0,0 +1,97 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// contactLastModified is when c last changed; contacts stored before
+// timestamps existed are dated by their ObjectID
+func contactLastModified(c Contact) time.Time {
+    switch {
+    case !c.UpdatedAt.IsZero():
+        return c.UpdatedAt
+    case !c.CreatedAt.IsZero():
+        return c.CreatedAt
+    }
+    return c.ID.Timestamp()
+}
+
+// tenantLastModified is the caller's latest contact change: the newest
+// updated_at or the latest deletion in the audit log, whichever is later. A
+// list can change without any of its contacts changing (a deletion, or an
+// update moving a contact out of a filter), so lists are dated by the tenant.
+func tenantLastModified(ctx context.Context, r *http.Request) (time.Time, error) {
+    var latest time.Time
+
+    var c Contact
+    err := contactsCollection.FindOne(ctx, scopeFilter(r, bson.M{}),
+        options.FindOne().SetSort(bson.D{{Key: "updated_at", Value: -1}}).SetProjection(bson.M{"updated_at": 1})).Decode(&c)
+    if err != nil && err != mongo.ErrNoDocuments {
+        return latest, err
+    }
+    latest = c.UpdatedAt
+
+    tenant := tenantFilter(tenantOf(r))["tenant"]
+    var e AuditEntry
+    err = collectionOf("audit_log").FindOne(ctx, bson.M{"$or": bson.A{
+        bson.M{"action": "contact.delete", "tenant": tenant},
+        bson.M{"action": "retention.purge", "details.target": "contacts", "details.tenant": tenant},
+    }}, options.FindOne().SetSort(bson.D{{Key: "at", Value: -1}}).SetProjection(bson.M{"at": 1})).Decode(&e)
+    if err != nil && err != mongo.ErrNoDocuments {
+        return latest, err
+    }
+    if e.At.After(latest) {
+        latest = e.At
+    }
+    return latest, nil
+}
+
+// notModified sets Last-Modified and, if the request's If-Modified-Since is
+// no older, answers 304 and reports true. HTTP dates have whole seconds.
+func notModified(w http.ResponseWriter, r *http.Request, lastModified time.Time) bool {
+    if lastModified.IsZero() {
+        return false
+    }
+    lastModified = lastModified.UTC().Truncate(time.Second)
+    w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+    if r.Method != "GET" && r.Method != "HEAD" {
+        return false
+    }
+    since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+    if err != nil || lastModified.After(since) {
+        return false
+    }
+    w.Header().Del("Content-Type")
+    w.WriteHeader(http.StatusNotModified)
+    return true
+}
+
+// createOnly reports whether a PUT or POST carries If-None-Match: *, asking
+// to create the contact only if it doesn't exist yet. Entity tags aren't
+// supported there, so any other If-None-Match is answered with a 400.
+func createOnly(w http.ResponseWriter, r *http.Request) (only, ok bool) {
+    v := strings.TrimSpace(r.Header.Get("If-None-Match"))
+    switch v {
+    case "":
+        return false, true
+    case "*":
+        return true, true
+    }
+    writeError(w, http.StatusBadRequest, codeInvalidHeader, "If-None-Match must be * on writes")
+    return false, false
+}
+
+// writeAlreadyExists answers 412 for a create-only write whose contact exists
+func writeAlreadyExists(w http.ResponseWriter, id primitive.ObjectID) {
+    writeErrorWith(w, http.StatusPreconditionFailed, codePreconditionFailed, "The contact already exists",
+        map[string]any{"existing_id": id.Hex()})
+}
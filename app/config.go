@@ -0,0 +1,313 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "os"
+    "os/signal"
+    "reflect"
+    "strings"
+    "sync/atomic"
+    "syscall"
+    "time"
+)
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 10 * time.Second
+
+// Config holds the settings that can be changed without restarting the process
+type Config struct {
+    LogLevel      string            `json:"log_level"`
+    CORSOrigins   []string          `json:"cors_origins"`
+    RateLimit     RateLimitConfig   `json:"rate_limit"`
+    Cache         CacheConfig       `json:"cache"`
+    APIKeys       []APIKeyConfig    `json:"api_keys" log:"redact"`
+    RequireAPIKey bool              `json:"require_api_key"`
+    Anomaly       AnomalyConfig     `json:"anomaly"`
+    IPFilter      IPFilterConfig    `json:"ip_filter"`
+    Signing       SigningConfig     `json:"signing"`
+    AccessLog     AccessLogConfig   `json:"access_log"`
+    Timeouts      TimeoutConfig     `json:"timeouts"`
+    QueryLimits   QueryLimitsConfig `json:"query_limits"`
+    Avatars       AvatarConfig      `json:"avatars"`
+    Websites      WebsiteConfig     `json:"websites"`
+    ReadRouting   ReadRoutingConfig `json:"read_routing"`
+
+    WriteConcern WriteConcernConfig `json:"write_concern"`
+
+    ChangeApproval ChangeApprovalConfig `json:"change_approval"`
+
+    FieldRedaction map[string]map[string]string `json:"field_redaction"`
+
+    SlowQueryThreshold Duration `json:"slow_query_threshold"`
+}
+
+// RateLimitConfig controls the per-client token buckets (0 disables limiting).
+// Routes overrides the rate per route class and Tiers per API key tier.
+type RateLimitConfig struct {
+    RequestsPerSecond float64                             `json:"requests_per_second"`
+    Burst             int                                 `json:"burst"`
+    Routes            map[string]RateLimitRule            `json:"routes"`
+    Tiers             map[string]map[string]RateLimitRule `json:"tiers"`
+}
+
+// CacheConfig holds the TTLs of the in-memory caches (0 disables a cache)
+type CacheConfig struct {
+    ContactTTL Duration `json:"contact_ttl"`
+}
+
+// AnomalyConfig sets per-client thresholds counted over each window (0 disables a check)
+type AnomalyConfig struct {
+    Window         Duration `json:"window"`
+    MaxRequests    int      `json:"max_requests"`
+    MaxRecords     int      `json:"max_records"`
+    MaxDistinctIDs int      `json:"max_distinct_ids"`
+    MaxNotFound    int      `json:"max_not_found"`
+    AutoThrottle   bool     `json:"auto_throttle"`
+    ThrottleFor    Duration `json:"throttle_for"`
+}
+
+// Duration is a time.Duration that reads and writes as "30s" in JSON
+type Duration time.Duration
+
+func (d Duration) String() string {
+    return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+    return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+    var s string
+    if err := json.Unmarshal(data, &s); err != nil {
+        return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+    }
+    parsed, err := time.ParseDuration(s)
+    if err != nil {
+        return err
+    }
+    *d = Duration(parsed)
+    return nil
+}
+
+var runtimeConfig atomic.Pointer[Config]
+
+// currentConfig returns the active configuration
+func currentConfig() *Config {
+    if c := runtimeConfig.Load(); c != nil {
+        return c
+    }
+    return defaultConfig()
+}
+
+// defaultConfig matches the behaviour of the service before it had a config file
+func defaultConfig() *Config {
+    return &Config{
+        LogLevel:    "info",
+        CORSOrigins: []string{"*"},
+        Anomaly: AnomalyConfig{
+            Window:      Duration(time.Minute),
+            ThrottleFor: Duration(5 * time.Minute),
+        },
+        Signing:            SigningConfig{MaxSkew: Duration(5 * time.Minute)},
+        SlowQueryThreshold: Duration(100 * time.Millisecond),
+        QueryLimits: QueryLimitsConfig{QueryLimits: QueryLimits{
+            MaxPageSize:      1000,
+            MaxExportSize:    10000,
+            MaxPatternLength: 64,
+        }},
+    }
+}
+
+// loadConfig reads the JSON config file at path on top of the defaults
+func loadConfig(path string) (*Config, error) {
+    c := defaultConfig()
+    if path == "" {
+        return c, nil
+    }
+
+    f, err := os.Open(path)
+    if err != nil {
+        return nil, err
+    }
+    defer f.Close()
+
+    dec := json.NewDecoder(f)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(c); err != nil {
+        return nil, fmt.Errorf("parse %s: %w", path, err)
+    }
+
+    if _, err := parseLogLevel(c.LogLevel); err != nil {
+        return nil, err
+    }
+    if err := c.RateLimit.validate(c.APIKeys); err != nil {
+        return nil, err
+    }
+    if c.Cache.ContactTTL < 0 {
+        return nil, fmt.Errorf("cache.contact_ttl must not be negative")
+    }
+    if _, err := c.AccessLog.validate(); err != nil {
+        return nil, err
+    }
+    if c.AccessLog.MaxSizeMB < 0 || c.AccessLog.MaxBackups < 0 {
+        return nil, fmt.Errorf("access_log.max_size_mb and access_log.max_backups must not be negative")
+    }
+    if err := validateRedaction(c.FieldRedaction); err != nil {
+        return nil, err
+    }
+    if err := c.ChangeApproval.validate(); err != nil {
+        return nil, err
+    }
+    if err := c.QueryLimits.validate(c.APIKeys); err != nil {
+        return nil, err
+    }
+    if err := c.Timeouts.validate(); err != nil {
+        return nil, err
+    }
+    if err := c.Avatars.validate(); err != nil {
+        return nil, err
+    }
+    if err := c.ReadRouting.validate(); err != nil {
+        return nil, err
+    }
+    if err := c.WriteConcern.validate(); err != nil {
+        return nil, err
+    }
+    if c.SlowQueryThreshold < 0 {
+        return nil, fmt.Errorf("slow_query_threshold must not be negative")
+    }
+    if c.Signing.MaxSkew <= 0 {
+        return nil, fmt.Errorf("signing.max_skew must be positive")
+    }
+    if c.Anomaly.Window <= 0 || c.Anomaly.ThrottleFor <= 0 {
+        return nil, fmt.Errorf("anomaly.window and anomaly.throttle_for must be positive")
+    }
+    if err := c.IPFilter.parse(); err != nil {
+        return nil, err
+    }
+    for i := range c.APIKeys {
+        k := &c.APIKeys[i]
+        if k.Key, err = secrets.cachedSecret(k.Key); err != nil {
+            return nil, fmt.Errorf("api key %q: %w", k.ID, err)
+        }
+        if k.SigningSecret, err = secrets.cachedSecret(k.SigningSecret); err != nil {
+            return nil, fmt.Errorf("api key %q: %w", k.ID, err)
+        }
+        k.Tags = normalizeTags(k.Tags)
+    }
+    seen := map[string]bool{}
+    for _, k := range c.APIKeys {
+        if k.ID == "" || (k.Key == "" && k.SigningSecret == "") {
+            return nil, fmt.Errorf("api_keys entries need an id and a key or signing_secret")
+        }
+        if seen[k.ID] {
+            return nil, fmt.Errorf("duplicate api key id %q", k.ID)
+        }
+        seen[k.ID] = true
+    }
+    return c, nil
+}
+
+// applyConfig makes c the active configuration and logs what changed
+func applyConfig(c *Config) {
+    level, _ := parseLogLevel(c.LogLevel)
+    setLogLevel(level)
+
+    old := runtimeConfig.Swap(c)
+    if old == nil || old.AccessLog != c.AccessLog {
+        accessLog.configure(c.AccessLog)
+    }
+    if old == nil {
+        return
+    }
+
+    changes := diffConfig(old, c)
+    if len(changes) == 0 {
+        logInfo("config reloaded, no changes")
+        return
+    }
+    if old.Cache.ContactTTL != c.Cache.ContactTTL {
+        contactCache.Purge()
+    }
+    logInfo("config reloaded: %s", strings.Join(changes, "; "))
+}
+
+// watchConfig reloads the config on SIGHUP and whenever the file's mtime changes
+func watchConfig(path string) {
+    sighup := make(chan os.Signal, 1)
+    signal.Notify(sighup, syscall.SIGHUP)
+
+    var lastMod time.Time
+    if info, err := os.Stat(path); err == nil {
+        lastMod = info.ModTime()
+    }
+
+    ticker := time.NewTicker(configPollInterval)
+    defer ticker.Stop()
+
+    for {
+        select {
+        case <-sighup:
+            reloadConfig(path, "SIGHUP")
+        case <-ticker.C:
+            if path == "" {
+                continue
+            }
+            info, err := os.Stat(path)
+            if err != nil || info.ModTime().Equal(lastMod) {
+                continue
+            }
+            lastMod = info.ModTime()
+            reloadConfig(path, "file change")
+        }
+    }
+}
+
+// reloadConfig keeps the current settings if the new file is invalid
+func reloadConfig(path, reason string) {
+    c, err := loadConfig(path)
+    if err != nil {
+        logError("config reload (%s) failed, keeping current settings: %v", reason, err)
+        return
+    }
+    logDebug("reloading config (%s)", reason)
+    applyConfig(c)
+}
+
+// diffConfig lists the changed fields as "name: old -> new"; fields tagged
+// log:"redact" are reported as changed without their values
+func diffConfig(old, new *Config) []string {
+    var changes []string
+    diffFields("", reflect.ValueOf(*old), reflect.ValueOf(*new), &changes)
+    return changes
+}
+
+func diffFields(prefix string, old, new reflect.Value, changes *[]string) {
+    t := old.Type()
+    for i := 0; i < t.NumField(); i++ {
+        if !t.Field(i).IsExported() {
+            continue
+        }
+        name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+        if name == "" {
+            name = t.Field(i).Name
+        }
+        name = prefix + name
+
+        o, n := old.Field(i), new.Field(i)
+        if o.Kind() == reflect.Struct {
+            diffFields(name+".", o, n, changes)
+            continue
+        }
+        if reflect.DeepEqual(o.Interface(), n.Interface()) {
+            continue
+        }
+        if t.Field(i).Tag.Get("log") == "redact" {
+            *changes = append(*changes, name+" changed")
+        } else {
+            *changes = append(*changes, fmt.Sprintf("%s: %v -> %v", name, o.Interface(), n.Interface()))
+        }
+    }
+}
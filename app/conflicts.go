@@ -0,0 +1,153 @@
+package main
+
+import (
+    "net/http"
+    "reflect"
+    "slices"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// Changes that name the version they were made to are merged with the writes
+// made since then instead of overwriting them. A field the caller changes
+// conflicts if another write changed it too, to a different value; without
+// conflicts the changes are made to the current version, and with any the
+// write is refused with both versions and the conflicting fields, so the
+// client can resolve them and send the result made to the current version.
+
+// maxMergeAttempts caps how often a merge is retried while other writes keep
+// changing the contact
+const maxMergeAttempts = 3
+
+// FieldConflict is a field changed both by the caller and since the version
+// the caller changed; a side where the field isn't set is left out
+type FieldConflict struct {
+    Field   string `json:"field"`
+    Base    any    `json:"base,omitempty"`
+    Current any    `json:"current,omitempty"`
+    Yours   any    `json:"yours,omitempty"`
+}
+
+// fields are the names of the contact fields the changes set
+func (ch contactChanges) fields() []string {
+    var names []string
+    for name, set := range map[string]bool{
+        "name":           ch.Name != nil,
+        "phone":          ch.Phone != nil,
+        "tags":           ch.Tags != nil,
+        "company":        ch.Company != nil,
+        "job_title":      ch.JobTitle != nil,
+        "website":        ch.Website != nil,
+        "social":         ch.Social != nil,
+        "dates":          ch.Dates != nil,
+        "do_not_contact": ch.DoNotContact != nil,
+        "reports_to":     ch.ReportsTo != nil,
+    } {
+        if set {
+            names = append(names, name)
+        }
+    }
+    slices.Sort(names)
+    return names
+}
+
+// applyTo is c with the changes made to it, normalized as update stores them
+func (ch contactChanges) applyTo(c Contact) Contact {
+    if ch.Name != nil {
+        c.Name = normalizeName(*ch.Name)
+    }
+    if ch.Phone != nil {
+        c.Phone = *ch.Phone
+    }
+    if ch.Tags != nil {
+        c.Tags = normalizeTags(*ch.Tags)
+    }
+    if ch.Company != nil {
+        c.Company = normalizeLabel(*ch.Company)
+    }
+    if ch.JobTitle != nil {
+        c.JobTitle = normalizeLabel(*ch.JobTitle)
+    }
+    if ch.Website != nil {
+        c.Website = *ch.Website
+    }
+    if ch.Social != nil {
+        c.Social = ch.Social.orNil()
+    }
+    if ch.Dates != nil {
+        c.Dates = *ch.Dates
+    }
+    if ch.DoNotContact != nil {
+        c.DoNotContact = *ch.DoNotContact
+    }
+    if ch.ReportsTo != nil {
+        c.ReportsTo = ch.manager
+    }
+    return c
+}
+
+// rebaseChanges moves changes made to an earlier version of the contact
+// objID onto its current version, answering 409 VERSION_CONFLICT if they
+// clash with the writes in between. The earlier version is read from the
+// contact's history; if it isn't there, every change to a field that is set
+// now and differs conflicts. found is false, with nothing answered, if there
+// is no such contact.
+func rebaseChanges(w http.ResponseWriter, r *http.Request, objID primitive.ObjectID, changes contactChanges) (rebased contactChanges, found, ok bool) {
+    var current Contact
+    err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"_id": objID})).Decode(&current)
+    if err == mongo.ErrNoDocuments {
+        return changes, false, true
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return changes, false, false
+    }
+    if current.Version == *changes.Version {
+        return changes, true, true
+    }
+
+    var base *Contact
+    var v ContactVersion
+    err = contactVersionsCollection().FindOne(r.Context(),
+        scopeFilter(r, bson.M{"contact_id": objID, "version": *changes.Version})).Decode(&v)
+    if err == nil {
+        base = &v.Contact
+    } else if err != mongo.ErrNoDocuments {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return changes, true, false
+    }
+
+    from := current
+    if base != nil {
+        from = *base
+    }
+    mine := changes.applyTo(from)
+    was, now, yours := contactFields(base), contactFields(&current), contactFields(&mine)
+    conflicts := []FieldConflict{}
+    for _, field := range changes.fields() {
+        if !reflect.DeepEqual(now[field], was[field]) && !reflect.DeepEqual(now[field], yours[field]) {
+            conflicts = append(conflicts, FieldConflict{Field: field, Base: was[field], Current: now[field], Yours: yours[field]})
+        }
+    }
+    if len(conflicts) > 0 {
+        current.setAvatarURL()
+        extra := map[string]any{"current_version": current.Version, "current": current, "conflicts": conflicts}
+        if base != nil {
+            base.setAvatarURL()
+            extra["base"] = base
+        }
+        writeErrorWith(w, http.StatusConflict, codeVersionConflict,
+            "The contact changed since this version; resolve the conflicts and send the changes again with the current version", extra)
+        return changes, true, false
+    }
+    changes.Version = &current.Version
+    return changes, true, true
+}
+
+// writeStillChanging answers 409 when other writes kept changing the contact
+// during every merge attempt
+func writeStillChanging(w http.ResponseWriter) {
+    writeError(w, http.StatusConflict, codeVersionConflict, "The contact keeps changing; try again")
+}
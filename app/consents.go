@@ -0,0 +1,296 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "regexp"
+    "slices"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Consent records are the legal basis on which a contact's data may be used
+// for a purpose, such as "marketing", with when it was granted, when it was
+// revoked and where it came from. Records are never changed but to revoke
+// them, so a contact's records are the history of its consents; the latest
+// unrevoked record of a purpose is the one in force.
+
+const (
+    maxConsentSource    = 200
+    defaultConsentLimit = 100
+    maxConsentLimit     = 1000
+)
+
+// consentBases are the lawful bases of GDPR Article 6(1)
+var consentBases = []string{"consent", "contract", "legal_obligation", "vital_interests", "public_task", "legitimate_interests"}
+
+// consentPurpose is what purposes look like: lowercase words such as
+// "marketing" or "newsletter.weekly"
+var consentPurpose = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,99}$`)
+
+// Consent is one consent record of a contact. RevokedAt is set once it is
+// revoked or superseded by a newer record of its purpose.
+type Consent struct {
+    ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    Tenant       string             `bson:"tenant" json:"-"`
+    ContactID    primitive.ObjectID `bson:"contact_id" json:"contact_id"`
+    Purpose      string             `bson:"purpose" json:"purpose"`
+    Basis        string             `bson:"basis" json:"basis"`
+    Source       string             `bson:"source,omitempty" json:"source,omitempty"`
+    GrantedAt    time.Time          `bson:"granted_at" json:"granted_at"`
+    RevokedAt    *time.Time         `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+    RevokeSource string             `bson:"revoke_source,omitempty" json:"revoke_source,omitempty"`
+    RecordedBy   string             `bson:"recorded_by" json:"recorded_by"`
+}
+
+func consentsCollection() collection {
+    return collectionOf("contact_consents")
+}
+
+// consentFilter adds the ?purpose=, ?basis= and ?status=active|revoked of a
+// consent query to filter, answering a 400 for invalid ones
+func consentFilter(w http.ResponseWriter, r *http.Request, filter bson.M) bool {
+    q := r.URL.Query()
+    if purpose := q.Get("purpose"); purpose != "" {
+        filter["purpose"] = strings.ToLower(purpose)
+    }
+    if basis := q.Get("basis"); basis != "" {
+        if !slices.Contains(consentBases, basis) {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "basis must be one of "+strings.Join(consentBases, ", "))
+            return false
+        }
+        filter["basis"] = basis
+    }
+    switch q.Get("status") {
+    case "":
+    case "active":
+        filter["revoked_at"] = nil
+    case "revoked":
+        filter["revoked_at"] = bson.M{"$ne": nil}
+    default:
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "status must be active or revoked")
+        return false
+    }
+    return true
+}
+
+// listContactConsents handles GET /contacts/{id}/consents[?purpose=&basis=&status=],
+// the contact's consent records newest first
+func listContactConsents(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    filter := scopeFilter(r, bson.M{"contact_id": c.ID})
+    if !consentFilter(w, r, filter) {
+        return
+    }
+    cursor, err := consentsCollection().Find(r.Context(), filter, options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve consents")
+        return
+    }
+    consents := []Consent{}
+    if err := cursor.All(r.Context(), &consents); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    json.NewEncoder(w).Encode(bson.M{"contact_id": c.ID.Hex(), "consents": consents})
+}
+
+// recordConsent handles POST /contacts/{id}/consents with {"purpose",
+// "basis", "source", "granted_at"}. A record already in force for the
+// purpose is superseded: it is revoked as of the new one.
+func recordConsent(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var in struct {
+        Purpose   string     `json:"purpose"`
+        Basis     string     `json:"basis"`
+        Source    string     `json:"source"`
+        GrantedAt *time.Time `json:"granted_at"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    defer r.Body.Close()
+    in.Purpose, in.Source = strings.ToLower(strings.TrimSpace(in.Purpose)), strings.TrimSpace(in.Source)
+    if in.Purpose == "" || in.Basis == "" {
+        writeError(w, http.StatusBadRequest, codeMissingField, "purpose and basis are required")
+        return
+    }
+    if !consentPurpose.MatchString(in.Purpose) {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "purpose must be up to 100 lowercase letters, digits, '_', '.' and '-'")
+        return
+    }
+    if !slices.Contains(consentBases, in.Basis) {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "basis must be one of "+strings.Join(consentBases, ", "))
+        return
+    }
+    if len([]rune(in.Source)) > maxConsentSource {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "source must not be longer than 200 characters")
+        return
+    }
+    now := utcNow()
+    grantedAt := now
+    if in.GrantedAt != nil {
+        if in.GrantedAt.After(now) {
+            writeError(w, http.StatusBadRequest, codeValidationFailed, "granted_at must not be in the future")
+            return
+        }
+        grantedAt = in.GrantedAt.UTC()
+    }
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+
+    consent := Consent{Tenant: tenantOf(r), ContactID: c.ID, Purpose: in.Purpose, Basis: in.Basis, Source: in.Source,
+        GrantedAt: grantedAt, RecordedBy: clientKey(r)}
+    result, err := consentsCollection().InsertOne(r.Context(), consent)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to record consent")
+        return
+    }
+    consent.ID = result.InsertedID.(primitive.ObjectID)
+    _, err = consentsCollection().UpdateMany(r.Context(),
+        scopeFilter(r, bson.M{"contact_id": c.ID, "purpose": in.Purpose, "revoked_at": nil, "_id": bson.M{"$ne": consent.ID}}),
+        bson.M{"$set": bson.M{"revoked_at": grantedAt, "revoke_source": "superseded"}})
+    if err != nil {
+        logError("contact %s: failed to supersede the %s consents: %v", c.ID.Hex(), in.Purpose, err)
+    }
+    recordAudit(r, "contact.consent", c.ID.Hex(), bson.M{"consent": consent.ID.Hex(), "purpose": in.Purpose, "basis": in.Basis})
+
+    w.Header().Set("Location", "/contacts/"+c.ID.Hex()+"/consents")
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(consent)
+}
+
+// revokeConsent handles POST /contacts/{id}/consents/{consent}/revoke[ with
+// {"source"}]
+func revokeConsent(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var in struct {
+        Source string `json:"source"`
+    }
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+            return
+        }
+        defer r.Body.Close()
+    }
+    in.Source = strings.TrimSpace(in.Source)
+    if len([]rune(in.Source)) > maxConsentSource {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "source must not be longer than 200 characters")
+        return
+    }
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    consentID, err := primitive.ObjectIDFromHex(strings.TrimSuffix(r.URL.Path[strings.Index(r.URL.Path, "/consents/")+len("/consents/"):], "/revoke"))
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid consent ID")
+        return
+    }
+
+    filter := scopeFilter(r, bson.M{"_id": consentID, "contact_id": c.ID})
+    set := bson.M{"revoked_at": utcNow()}
+    if in.Source != "" {
+        set["revoke_source"] = in.Source
+    }
+    var consent Consent
+    err = consentsCollection().FindOneAndUpdate(r.Context(), withField(filter, "revoked_at", nil), bson.M{"$set": set},
+        options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&consent)
+    if err == mongo.ErrNoDocuments {
+        // revoked already, or no such record
+        err = consentsCollection().FindOne(r.Context(), filter).Decode(&consent)
+        if err == nil {
+            json.NewEncoder(w).Encode(consent)
+            return
+        }
+    }
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeConsentNotFound, "Consent not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to revoke consent")
+        return
+    }
+    recordAudit(r, "contact.consent.revoke", c.ID.Hex(), bson.M{"consent": consentID.Hex(), "purpose": consent.Purpose})
+    json.NewEncoder(w).Encode(consent)
+}
+
+// withField is a copy of filter with key set to value
+func withField(filter bson.M, key string, value any) bson.M {
+    out := bson.M{key: value}
+    for k, v := range filter {
+        if k != key {
+            out[k] = v
+        }
+    }
+    return out
+}
+
+// listConsents handles GET /consents[?purpose=&basis=&status=&limit=100&before=],
+// the consent records of all the caller's contacts newest first, e.g. the
+// contacts that may be sent marketing with ?purpose=marketing&status=active
+func listConsents(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    limit, ok := queryInt(r, "limit", defaultConsentLimit, maxConsentLimit)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "limit must be a positive number")
+        return
+    }
+    filter := scopeFilter(r, bson.M{})
+    if !consentFilter(w, r, filter) {
+        return
+    }
+    if before := r.URL.Query().Get("before"); before != "" {
+        cursorID, err := primitive.ObjectIDFromHex(before)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "Invalid before cursor")
+            return
+        }
+        filter["_id"] = bson.M{"$lt": cursorID}
+    }
+
+    opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit) + 1)
+    cursor, err := consentsCollection().Find(r.Context(), filter, opts)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve consents")
+        return
+    }
+    consents := []Consent{}
+    if err := cursor.All(r.Context(), &consents); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    body := bson.M{"consents": consents}
+    if len(consents) > limit {
+        body["consents"] = consents[:limit]
+        body["next"] = consents[limit-1].ID.Hex()
+    }
+    json.NewEncoder(w).Encode(body)
+}
+
+// deleteConsents removes the consent records of deleted contacts
+func deleteConsents(r *http.Request, ids ...primitive.ObjectID) {
+    _, err := consentsCollection().DeleteMany(r.Context(), scopeFilter(r, bson.M{"contact_id": bson.M{"$in": ids}}))
+    if err != nil {
+        logError("failed to delete the consents of deleted contacts: %v", err)
+    }
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+    "fmt"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// Schedule computes the next run time of a job
+type Schedule interface {
+    Next(after time.Time) time.Time
+}
+
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(after time.Time) time.Time {
+    return after.Add(time.Duration(s))
+}
+
+// cronSchedule is a standard five-field cron expression stored as bitsets
+type cronSchedule struct {
+    minute, hour, dom, month, dow uint64
+    domStar, dowStar              bool
+}
+
+var cronShorthands = map[string]string{
+    "@hourly":  "0 * * * *",
+    "@daily":   "0 0 * * *",
+    "@weekly":  "0 0 * * 0",
+    "@monthly": "0 0 1 * *",
+    "@yearly":  "0 0 1 1 *",
+}
+
+// parseSchedule accepts "@every <duration>", the @hourly/@daily/@weekly/@monthly/@yearly
+// shorthands, or "minute hour day-of-month month day-of-week" with *, lists, ranges and steps
+func parseSchedule(expr string) (Schedule, error) {
+    expr = strings.TrimSpace(expr)
+    if rest, ok := strings.CutPrefix(expr, "@every "); ok {
+        d, err := time.ParseDuration(strings.TrimSpace(rest))
+        if err != nil || d < time.Second {
+            return nil, fmt.Errorf("invalid interval in %q", expr)
+        }
+        return intervalSchedule(d), nil
+    }
+    if full, ok := cronShorthands[expr]; ok {
+        expr = full
+    }
+
+    fields := strings.Fields(expr)
+    if len(fields) != 5 {
+        return nil, fmt.Errorf("cron expression %q must have 5 fields", expr)
+    }
+
+    var s cronSchedule
+    var err error
+    if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+        return nil, err
+    }
+    if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+        return nil, err
+    }
+    if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+        return nil, err
+    }
+    if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+        return nil, err
+    }
+    if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+        return nil, err
+    }
+    if s.dow&(1<<7) != 0 {
+        s.dow |= 1 // 7 is also Sunday
+    }
+    s.domStar = strings.HasPrefix(fields[2], "*")
+    s.dowStar = strings.HasPrefix(fields[4], "*")
+    return &s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+    var bits uint64
+    for _, part := range strings.Split(field, ",") {
+        rangePart, step := part, 1
+        if before, after, ok := strings.Cut(part, "/"); ok {
+            n, err := strconv.Atoi(after)
+            if err != nil || n < 1 {
+                return 0, fmt.Errorf("invalid step in cron field %q", field)
+            }
+            rangePart, step = before, n
+        }
+
+        lo, hi := min, max
+        if rangePart != "*" {
+            from, to, isRange := strings.Cut(rangePart, "-")
+            var err error
+            if lo, err = strconv.Atoi(from); err != nil {
+                return 0, fmt.Errorf("invalid value in cron field %q", field)
+            }
+            hi = lo
+            if isRange {
+                if hi, err = strconv.Atoi(to); err != nil {
+                    return 0, fmt.Errorf("invalid range in cron field %q", field)
+                }
+            } else if step > 1 {
+                hi = max
+            }
+        }
+        if lo < min || hi > max || lo > hi {
+            return 0, fmt.Errorf("cron field %q out of range %d-%d", field, min, max)
+        }
+
+        for v := lo; v <= hi; v += step {
+            bits |= 1 << uint(v)
+        }
+    }
+    return bits, nil
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+    domOK := s.dom&(1<<uint(t.Day())) != 0
+    dowOK := s.dow&(1<<uint(t.Weekday())) != 0
+    if s.domStar || s.dowStar {
+        return domOK && dowOK
+    }
+    return domOK || dowOK
+}
+
+// Next returns the first matching minute after the given time, or the zero
+// time if the expression cannot match within five years (e.g. "0 0 30 2 *")
+func (s *cronSchedule) Next(after time.Time) time.Time {
+    t := after.Truncate(time.Minute).Add(time.Minute)
+    limit := t.AddDate(5, 0, 0)
+
+    for t.Before(limit) {
+        switch {
+        case s.month&(1<<uint(t.Month())) == 0:
+            t = wallTime(t.Year(), t.Month()+1, 1, 0, t.Location())
+        case !s.dayMatches(t):
+            t = wallTime(t.Year(), t.Month(), t.Day()+1, 0, t.Location())
+        case s.hour&(1<<uint(t.Hour())) == 0:
+            // by the wall clock, as zones such as +05:30 aren't whole hours off UTC
+            t = wallTime(t.Year(), t.Month(), t.Day(), t.Hour()+1, t.Location())
+        case s.minute&(1<<uint(t.Minute())) == 0:
+            t = t.Add(time.Minute)
+        case s.hour != everyHour && repeatedWallClock(t):
+            // when the clocks go back, a job at set hours runs at the first
+            // of the two 01:30s only; one at every hour runs at both
+            t = t.Add(time.Minute)
+        default:
+            return t
+        }
+    }
+    return time.Time{}
+}
+
+// wallTime is the start of the given hour by the wall clock in loc. When the
+// clocks go forward over it, time.Date answers with the time as many minutes
+// before the gap as the hour is into it, which would step Next backwards; it
+// is moved past the gap instead.
+func wallTime(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+    t := time.Date(year, month, day, hour, 0, 0, 0, loc)
+    want := time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+    if t.Day() == want.Day() && t.Hour() == want.Hour() && t.Minute() == 0 {
+        return t
+    }
+    _, before := t.Zone()
+    _, after := t.Add(3 * time.Hour).Zone()
+    return t.Add(time.Duration(after-before) * time.Second)
+}
+
+// everyHour is the hour bitset of "*"
+const everyHour = 1<<24 - 1
+
+// repeatedWallClock reports whether the wall-clock time of t already happened
+// earlier that day, as in the hour repeated when daylight saving time ends
+func repeatedWallClock(t time.Time) bool {
+    _, offset := t.Zone()
+    _, before := t.Add(-2 * time.Hour).Zone()
+    if before <= offset {
+        return false
+    }
+    earlier := t.Add(-time.Duration(before-offset) * time.Second)
+    return earlier.Day() == t.Day() && earlier.Hour() == t.Hour() && earlier.Minute() == t.Minute()
+}
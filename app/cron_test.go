@@ -0,0 +1,116 @@
+package main
+
+import (
+    "testing"
+    "time"
+)
+
+func TestParseSchedule(t *testing.T) {
+    tests := []struct {
+        expr string
+        ok   bool
+    }{
+        {"@every 90s", true},
+        {"@every 1s", true},
+        {"@every 500ms", false},
+        {"@every soon", false},
+        {"@hourly", true},
+        {"@daily", true},
+        {"@weekly", true},
+        {"@monthly", true},
+        {"@yearly", true},
+        {"@sometimes", false},
+        {"*/15 9-17 * * 1-5", true},
+        {"0 0 1,15 * *", true},
+        {"0 0 * * 7", true},
+        {"5/10 * * * *", true},
+        {"* * * *", false},
+        {"* * * * * *", false},
+        {"60 * * * *", false},
+        {"* 24 * * *", false},
+        {"* * 0 * *", false},
+        {"* * 32 * *", false},
+        {"* * * 0 *", false},
+        {"* * * 13 *", false},
+        {"* * * * 8", false},
+        {"*/0 * * * *", false},
+        {"5-1 * * * *", false},
+        {"a * * * *", false},
+        {"1-x * * * *", false},
+    }
+    for _, tt := range tests {
+        _, err := parseSchedule(tt.expr)
+        if (err == nil) != tt.ok {
+            t.Errorf("parseSchedule(%q) error = %v, want ok %v", tt.expr, err, tt.ok)
+        }
+    }
+}
+
+func TestScheduleNext(t *testing.T) {
+    newYork := loadLocation(t, "America/New_York")
+    kolkata := loadLocation(t, "Asia/Kolkata")
+    santiago := loadLocation(t, "America/Santiago")
+
+    tests := []struct {
+        name  string
+        expr  string
+        after time.Time
+        want  time.Time
+    }{
+        {"interval", "@every 90s", date(time.UTC, 2024, 1, 1, 10, 0), time.Date(2024, 1, 1, 10, 1, 30, 0, time.UTC)},
+        {"strictly after", "0 * * * *", date(time.UTC, 2024, 1, 1, 10, 0), date(time.UTC, 2024, 1, 1, 11, 0)},
+        {"seconds dropped", "*/15 * * * *", time.Date(2024, 1, 1, 10, 7, 30, 0, time.UTC), date(time.UTC, 2024, 1, 1, 10, 15)},
+        {"step from a start", "5/20 * * * *", date(time.UTC, 2024, 1, 1, 10, 30), date(time.UTC, 2024, 1, 1, 10, 45)},
+        {"day rollover", "30 8 * * *", date(time.UTC, 2024, 1, 1, 9, 0), date(time.UTC, 2024, 1, 2, 8, 30)},
+        {"month rollover", "0 0 * * *", date(time.UTC, 2024, 1, 31, 23, 59), date(time.UTC, 2024, 2, 1, 0, 0)},
+        {"year rollover", "0 0 1 * *", date(time.UTC, 2024, 12, 15, 0, 0), date(time.UTC, 2025, 1, 1, 0, 0)},
+        {"31st skips short months", "0 0 31 * *", date(time.UTC, 2024, 4, 1, 0, 0), date(time.UTC, 2024, 5, 31, 0, 0)},
+        {"leap day", "0 0 29 2 *", date(time.UTC, 2024, 3, 1, 0, 0), date(time.UTC, 2028, 2, 29, 0, 0)},
+        {"never", "0 0 30 2 *", date(time.UTC, 2024, 1, 1, 0, 0), time.Time{}},
+        {"weekdays", "0 9 * * 1-5", date(time.UTC, 2024, 1, 5, 10, 0), date(time.UTC, 2024, 1, 8, 9, 0)},
+        {"7 is Sunday", "0 0 * * 7", date(time.UTC, 2024, 1, 1, 0, 0), date(time.UTC, 2024, 1, 7, 0, 0)},
+        {"month list", "0 0 1 3,9 *", date(time.UTC, 2024, 4, 1, 0, 0), date(time.UTC, 2024, 9, 1, 0, 0)},
+
+        // with both day fields restricted, either may match
+        {"dom or dow, dow first", "0 0 13 * 5", date(time.UTC, 2024, 1, 1, 0, 0), date(time.UTC, 2024, 1, 5, 0, 0)},
+        {"dom or dow, dom first", "0 0 13 * 5", date(time.UTC, 2024, 1, 12, 0, 0), date(time.UTC, 2024, 1, 13, 0, 0)},
+        {"dom only", "0 0 13 * *", date(time.UTC, 2024, 1, 1, 0, 0), date(time.UTC, 2024, 1, 13, 0, 0)},
+        {"dow only", "0 0 * * 5", date(time.UTC, 2024, 1, 6, 0, 0), date(time.UTC, 2024, 1, 12, 0, 0)},
+        // a day field starting with * counts as unrestricted, so both must match
+        {"stepped dom and dow", "0 0 */10 * 1", date(time.UTC, 2024, 1, 1, 0, 0), date(time.UTC, 2024, 3, 11, 0, 0)},
+
+        {"half-hour zone, hourly", "0 * * * *", date(kolkata, 2024, 1, 1, 10, 10), date(kolkata, 2024, 1, 1, 11, 0)},
+        {"half-hour zone, daily", "30 5 * * *", date(kolkata, 2024, 1, 1, 0, 0), date(kolkata, 2024, 1, 1, 5, 30)},
+
+        {"clocks forward, skipped time", "30 2 * * *", date(newYork, 2024, 3, 10, 0, 0), date(newYork, 2024, 3, 11, 2, 30)},
+        {"clocks forward, after the gap", "0 3 * * *", date(newYork, 2024, 3, 10, 0, 0), date(newYork, 2024, 3, 10, 3, 0)},
+        {"clocks forward at midnight", "0 0 * * *", date(santiago, 2024, 9, 7, 12, 0), date(santiago, 2024, 9, 9, 0, 0)},
+        {"clocks forward at midnight, first hour", "0 1 * * *", date(santiago, 2024, 9, 7, 12, 0), date(santiago, 2024, 9, 8, 1, 0)},
+        {"clocks back, first time", "30 1 * * *", date(newYork, 2024, 11, 3, 0, 0), time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC)},
+        {"clocks back, not twice", "30 1 * * *", time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC).In(newYork), date(newYork, 2024, 11, 4, 1, 30)},
+        {"clocks back, hourly runs twice", "30 * * * *", time.Date(2024, 11, 3, 5, 30, 0, 0, time.UTC).In(newYork), time.Date(2024, 11, 3, 6, 30, 0, 0, time.UTC)},
+        {"clocks back, hour after", "0 2 * * *", date(newYork, 2024, 11, 3, 0, 0), time.Date(2024, 11, 3, 7, 0, 0, 0, time.UTC)},
+    }
+    for _, tt := range tests {
+        s, err := parseSchedule(tt.expr)
+        if err != nil {
+            t.Fatalf("%s: parseSchedule(%q): %v", tt.name, tt.expr, err)
+        }
+        if got := s.Next(tt.after); !got.Equal(tt.want) {
+            t.Errorf("%s: %q after %v = %v, want %v", tt.name, tt.expr, tt.after, got, tt.want)
+        }
+    }
+}
+
+func date(loc *time.Location, year int, month time.Month, day, hour, minute int) time.Time {
+    return time.Date(year, month, day, hour, minute, 0, 0, loc)
+}
+
+func loadLocation(t *testing.T, name string) *time.Location {
+    t.Helper()
+    loc, err := time.LoadLocation(name)
+    if err != nil {
+        t.Skipf("time zone %s: %v", name, err)
+    }
+    return loc
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// A contact created with "draft": true may lack its name or phone, so it can
+// be saved half-filled and completed later. Drafts are left out of lists,
+// groups, saved searches and exports unless asked for with ?drafts=true, and
+// become regular contacts once published.
+
+// publishContact handles POST /contacts/{id}/publish, which checks a draft
+// like POST /contacts checks a new contact and makes it a regular contact
+func publishContact(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    if !c.Draft {
+        writeError(w, http.StatusConflict, codeNotDraft, "The contact is published already")
+        return
+    }
+    if c.Name == "" || c.Phone == "" {
+        writeError(w, http.StatusBadRequest, codeMissingField, "Missing name or phone")
+        return
+    }
+
+    now := utcNow()
+    set := bson.M{"updated_at": now}
+    matched, later, err := updateContactsAsLastWriter(r.Context(), []primitive.ObjectID{c.ID}, scopeFilter(r, bson.M{"draft": true}),
+        set, withNextVersion(bson.M{"$unset": bson.M{"draft": ""}, "$set": set}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to publish contact")
+        return
+    }
+    id := c.ID.Hex()
+    contactCache.Delete(tenantOf(r) + "/" + id)
+    if len(later) > 0 {
+        writeStillChanging(w)
+        return
+    }
+    if matched == 0 {
+        writeError(w, http.StatusConflict, codeNotDraft, "The contact is published already")
+        return
+    }
+    recordVersions(r, versionUpdate, c.ID)
+    recordAudit(r, "contact.publish", id, nil)
+    publishContactEvent(r, "contact.updated", bson.M{"id": id, "changes": bson.M{"draft": false, "updated_at": now}})
+
+    c.Draft, c.UpdatedAt, c.Version = false, now, c.Version+1
+    c.setAvatarURL()
+    json.NewEncoder(w).Encode(bson.M{
+        "message": "Contact published successfully",
+        "contact": c,
+    })
+}
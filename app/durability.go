@@ -0,0 +1,206 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "math"
+    "net/http"
+    "os"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// How durable a write must be before it is acknowledged is a trade between
+// safety and speed: a merge or a delete should survive the primary failing
+// over, a bulk import is better off fast and can be run again. write_concern
+// sets the write concern of each endpoint, keyed "METHOD /route", and of the
+// async jobs, keyed "job:<type>", falling back to its default and then to
+// that of MONGO_URI. Whether writes are retried once after a transient error,
+// such as a primary stepping down, is set for the process with
+// MONGO_RETRY_WRITES, or retryWrites in MONGO_URI; it is on by default.
+
+// WriteConcernRule is a MongoDB write concern: W is a number of members or
+// "majority" (or a tag set name), J asks for the write to be journaled and
+// WTimeout bounds how long to wait for W members
+type WriteConcernRule struct {
+    W        any      `json:"w,omitempty"`
+    J        *bool    `json:"j,omitempty"`
+    WTimeout Duration `json:"wtimeout,omitempty"`
+}
+
+// WriteConcernConfig holds the write concerns of endpoints and jobs, and the
+// default for the rest
+type WriteConcernConfig struct {
+    Default   *WriteConcernRule           `json:"default"`
+    Endpoints map[string]WriteConcernRule `json:"endpoints"`
+}
+
+// clusterSettings are the client settings a cluster was connected with
+type clusterSettings struct {
+    RetryWrites  bool              `json:"retry_writes"`
+    WriteConcern *WriteConcernRule `json:"write_concern,omitempty"`
+}
+
+// clientSettings are the settings of the connected clusters by client
+var clientSettings = map[*mongo.Client]clusterSettings{}
+
+func (rule WriteConcernRule) validate(where string) error {
+    switch w := rule.W.(type) {
+    case float64:
+        // w: 0 acknowledges nothing, which sessions don't allow
+        if w < 1 || w != math.Trunc(w) {
+            return fmt.Errorf("%s.w must be a positive number of members or \"majority\"", where)
+        }
+    case string:
+        if w == "" {
+            return fmt.Errorf("%s.w must not be empty", where)
+        }
+    case nil:
+        if rule.J == nil {
+            return fmt.Errorf("%s needs w or j", where)
+        }
+    default:
+        return fmt.Errorf("%s.w must be a number of members or \"majority\"", where)
+    }
+    if rule.WTimeout < 0 {
+        return fmt.Errorf("%s.wtimeout must not be negative", where)
+    }
+    return nil
+}
+
+// writeConcern returns the driver's form of the rule
+func (rule WriteConcernRule) writeConcern() *writeconcern.WriteConcern {
+    wc := &writeconcern.WriteConcern{Journal: rule.J, WTimeout: time.Duration(rule.WTimeout)}
+    switch w := rule.W.(type) {
+    case float64:
+        wc.W = int(w)
+    case string:
+        wc.W = w
+    }
+    return wc
+}
+
+func (c WriteConcernConfig) validate() error {
+    if c.Default != nil {
+        if err := c.Default.validate("write_concern.default"); err != nil {
+            return err
+        }
+    }
+    for endpoint, rule := range c.Endpoints {
+        if !knownEndpoint(endpoint) {
+            return fmt.Errorf("write_concern.endpoints: unknown endpoint %q (want \"METHOD /route\" of a route, or \"job:<type>\")", endpoint)
+        }
+        if err := rule.validate("write_concern.endpoints." + endpoint); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// knownEndpoint reports whether endpoint is a writing method and route, as in
+// "DELETE /contacts/{id}", or an async job type, as in "job:import"
+func knownEndpoint(endpoint string) bool {
+    if jobType, ok := strings.CutPrefix(endpoint, "job:"); ok {
+        _, ok := jobTypes[jobType]
+        return ok
+    }
+    method, route, ok := strings.Cut(endpoint, " ")
+    return ok && isWriteMethod(method) && slices.Contains(routeTemplates, route)
+}
+
+// ruleFor returns the write concern rule of endpoint, nil for that of the
+// cluster
+func (c WriteConcernConfig) ruleFor(endpoint string) *WriteConcernRule {
+    if rule, ok := c.Endpoints[endpoint]; ok {
+        return &rule
+    }
+    return c.Default
+}
+
+// withEndpoint marks the writes under ctx as made by endpoint, for
+// writeConcernFor
+func withEndpoint(ctx context.Context, endpoint string) context.Context {
+    return context.WithValue(ctx, endpointKey, endpoint)
+}
+
+// writeConcernFor returns the write concern of the writes under ctx, nil for
+// that of the cluster
+func writeConcernFor(ctx context.Context) *writeconcern.WriteConcern {
+    endpoint, _ := ctx.Value(endpointKey).(string)
+    if rule := currentConfig().WriteConcern.ruleFor(endpoint); rule != nil {
+        return rule.writeConcern()
+    }
+    return nil
+}
+
+// DurableWrites middleware marks the writes of a request with its endpoint,
+// for write_concern to apply
+func DurableWrites(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !isWriteMethod(r.Method) {
+            next.ServeHTTP(w, r)
+            return
+        }
+        route, _ := r.Context().Value(routeKey).(string)
+        next.ServeHTTP(w, r.WithContext(withEndpoint(r.Context(), r.Method+" "+route)))
+    })
+}
+
+// applyRetryWrites sets MONGO_RETRY_WRITES on the options of a client
+func applyRetryWrites(opts *options.ClientOptions) error {
+    retry := os.Getenv("MONGO_RETRY_WRITES")
+    if retry == "" {
+        return nil
+    }
+    on, err := strconv.ParseBool(retry)
+    if err != nil {
+        return fmt.Errorf("MONGO_RETRY_WRITES must be true or false")
+    }
+    opts.SetRetryWrites(on)
+    return nil
+}
+
+// settingsOf describes the options a cluster is connected with
+func settingsOf(opts *options.ClientOptions) clusterSettings {
+    s := clusterSettings{RetryWrites: opts.RetryWrites == nil || *opts.RetryWrites}
+    if wc := opts.WriteConcern; wc != nil {
+        s.WriteConcern = &WriteConcernRule{W: wc.W, J: wc.Journal, WTimeout: Duration(wc.WTimeout)}
+    }
+    return s
+}
+
+// getStats handles GET /admin/stats, the database settings in effect: per
+// region the retryable writes and write concern of its cluster, and the write
+// concerns and read routing of the config file
+func getStats(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    c := currentConfig()
+    regions := map[string]clusterSettings{}
+    for _, region := range dataRegions() {
+        regions[region] = clientSettings[regionDatabases[region].Client()]
+    }
+    endpoints := c.WriteConcern.Endpoints
+    if endpoints == nil {
+        endpoints = map[string]WriteConcernRule{}
+    }
+    json.NewEncoder(w).Encode(map[string]any{
+        "database": map[string]any{
+            "home_region": homeRegion,
+            "regions":     regions,
+            "write_concern": map[string]any{
+                "default":   c.WriteConcern.Default,
+                "endpoints": endpoints,
+            },
+            "read_routing": c.ReadRouting,
+            "causal_reads": len(c.ReadRouting.Operations) > 0,
+        },
+    })
+}
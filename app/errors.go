@@ -0,0 +1,88 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+)
+
+// Error codes are part of the API: every error response carries one next to
+// its message, so clients can branch on the code while the message stays free
+// to change. A code is never renamed or reused for another condition.
+const (
+    codeInvalidRequestBody   = "INVALID_REQUEST_BODY" // the body isn't JSON of the expected shape
+    codeMissingField         = "MISSING_FIELD"        // a required body field is missing
+    codeValidationFailed     = "VALIDATION_FAILED"    // a body field has an invalid value
+    codeInvalidParameter     = "INVALID_PARAMETER"    // a query parameter is invalid
+    codeInvalidFilter        = "INVALID_FILTER"       // a name pattern or filter expression was rejected
+    codeInvalidPath          = "INVALID_PATH"         // the path is malformed
+    codeInvalidID            = "INVALID_ID"           // the ID in the path is malformed
+    codeInvalidContactID     = "INVALID_CONTACT_ID"   // the contact ID or short ID is malformed
+    codeRouteNotFound        = "ROUTE_NOT_FOUND"      // no route has this path
+    codeContactNotFound      = "CONTACT_NOT_FOUND"    // no such contact in the caller's tenant
+    codeWebhookNotFound      = "WEBHOOK_NOT_FOUND"    // no such webhook in the caller's tenant
+    codeDeviceNotFound       = "DEVICE_NOT_FOUND"     // no such device of the caller's key
+    codeCommentNotFound      = "COMMENT_NOT_FOUND"    // no such comment on the contact
+    codeAvatarNotFound       = "AVATAR_NOT_FOUND"     // the contact has no avatar
+    codeAttachmentNotFound   = "ATTACHMENT_NOT_FOUND" // no such attachment on the contact
+    codeSuppressionNotFound  = "SUPPRESSION_NOT_FOUND"
+    codeConsentNotFound      = "CONSENT_NOT_FOUND"
+    codeSavedSearchNotFound  = "SAVED_SEARCH_NOT_FOUND"
+    codeGroupNotFound        = "GROUP_NOT_FOUND"
+    codeTagNotFound          = "TAG_NOT_FOUND" // no contact of the caller's tenant has the tag
+    codeRetentionNotFound    = "RETENTION_RULE_NOT_FOUND"
+    codeQuotaNotFound        = "QUOTA_NOT_FOUND"
+    codeScheduleNotFound     = "EXPORT_SCHEDULE_NOT_FOUND"
+    codeJobNotFound          = "JOB_NOT_FOUND"
+    codeVersionNotFound      = "VERSION_NOT_FOUND" // no such version of the contact
+    codeChangeNotFound       = "CHANGE_REQUEST_NOT_FOUND"
+    codeJobFinished          = "JOB_FINISHED"
+    codeUploadNotFound       = "UPLOAD_NOT_FOUND"
+    codeUploadOffsetMismatch = "UPLOAD_OFFSET_MISMATCH"
+    codeUploadIncomplete     = "UPLOAD_INCOMPLETE"
+    codeClientNotFound       = "CLIENT_NOT_FOUND" // no throttle for this client
+    codeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+    codeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+    codeUnauthorized         = "UNAUTHORIZED"      // API key missing or unknown
+    codeInvalidSignature     = "INVALID_SIGNATURE" // request signature missing, stale or wrong
+    codeForbidden            = "FORBIDDEN"         // the client IP, or a key limited to tags, isn't allowed
+    codeApprovalRequired     = "APPROVAL_REQUIRED" // the key's edits need approval, which bulk edits can't get
+    codeAdminDisabled        = "ADMIN_DISABLED"    // no admin token is configured
+    codeRateLimited          = "RATE_LIMITED"      // see Retry-After
+    codeQuotaExceeded        = "QUOTA_EXCEEDED"    // the contact quota (or saved search or group limit) is used up
+    codeExportTooLarge       = "EXPORT_TOO_LARGE"  // page through the list instead
+    codeDuplicatePhone       = "DUPLICATE_PHONE"   // another contact of the tenant has the phone
+    codeIDConflict           = "ID_CONFLICT"       // an upsert's ID belongs to a contact the caller can't see
+    codeVersionConflict      = "VERSION_CONFLICT"  // the changes clash with writes since their version
+    codeSavedSearchExists    = "SAVED_SEARCH_EXISTS"
+    codeGroupExists          = "GROUP_EXISTS"
+    codeChangeReviewed       = "CHANGE_REQUEST_REVIEWED"
+    codeNotDraft             = "CONTACT_NOT_DRAFT"
+    codeGroupCycle           = "GROUP_CYCLE"     // a group can't be moved under its own subtree
+    codeReportingCycle       = "REPORTING_CYCLE" // a contact can't report to its own reports
+    codeTagExists            = "TAG_EXISTS"      // renaming onto a tag in use; merge instead
+    codePreconditionFailed   = "PRECONDITION_FAILED"
+    codeInvalidHeader        = "INVALID_HEADER" // a request header has an unsupported value
+    codeRequestTimeout       = "REQUEST_TIMEOUT"
+    codeNotLeader            = "NOT_LEADER"         // singleton jobs only run on the leader replica
+    codeLookupFailed         = "LOOKUP_FAILED"      // the phone lookup provider failed
+    codeLookupUnavailable    = "LOOKUP_UNAVAILABLE" // no lookup provider, or it is limiting our rate
+    codeInternal             = "INTERNAL_ERROR"
+)
+
+// writeError sends the error body every endpoint uses
+func writeError(w http.ResponseWriter, status int, code, message string) {
+    writeErrorWith(w, status, code, message, nil)
+}
+
+// writeErrorWith sends an error body with extra fields, such as the limit
+// that was exceeded
+func writeErrorWith(w http.ResponseWriter, status int, code, message string, extra map[string]any) {
+    body := map[string]any{"error": message, "code": code}
+    for k, v := range extra {
+        body[k] = v
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(body)
+}
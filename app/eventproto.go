@@ -0,0 +1,219 @@
+package main
+
+import (
+    "encoding/binary"
+    "fmt"
+    "time"
+)
+
+// contactEventMessage is the protobuf type of webhook deliveries in the
+// "protobuf" format, defined in proto/contacts/v1/contacts.proto
+const contactEventMessage = "usermanagement.contacts.v1.ContactEvent"
+
+// protoMessage encodes protobuf wire format by hand; the messages are small
+// and fixed, which doesn't justify a protobuf runtime and code generation
+type protoMessage []byte
+
+const (
+    wireVarint = 0
+    wireBytes  = 2
+)
+
+func (m protoMessage) tag(field, wireType int) protoMessage {
+    return binary.AppendUvarint(m, uint64(field<<3|wireType))
+}
+
+// string appends a proto3 string field, skipping the default ""
+func (m protoMessage) string(field int, s string) protoMessage {
+    if s == "" {
+        return m
+    }
+    return m.bytes(field, []byte(s))
+}
+
+// optionalString appends a field with explicit presence, even when ""
+func (m protoMessage) optionalString(field int, s string) protoMessage {
+    return m.bytes(field, []byte(s))
+}
+
+func (m protoMessage) bytes(field int, b []byte) protoMessage {
+    m = m.tag(field, wireBytes)
+    m = binary.AppendUvarint(m, uint64(len(b)))
+    return append(m, b...)
+}
+
+func (m protoMessage) varint(field int, v uint64) protoMessage {
+    if v == 0 {
+        return m
+    }
+    m = m.tag(field, wireVarint)
+    return binary.AppendUvarint(m, v)
+}
+
+// optionalBool appends a bool field with explicit presence, even when false
+func (m protoMessage) optionalBool(field int, v bool) protoMessage {
+    m = m.tag(field, wireVarint)
+    if v {
+        return append(m, 1)
+    }
+    return append(m, 0)
+}
+
+func (m protoMessage) strings(field int, values []any) protoMessage {
+    for _, v := range values {
+        if s, ok := v.(string); ok {
+            m = m.optionalString(field, s)
+        }
+    }
+    return m
+}
+
+// timestamp appends a google.protobuf.Timestamp parsed from an RFC 3339 value
+func (m protoMessage) timestamp(field int, v any) protoMessage {
+    s, _ := v.(string)
+    t, err := time.Parse(time.RFC3339Nano, s)
+    if err != nil || t.IsZero() {
+        return m
+    }
+    var ts protoMessage
+    ts = ts.varint(1, uint64(t.Unix()))
+    ts = ts.varint(2, uint64(t.Nanosecond()))
+    return m.bytes(field, ts)
+}
+
+func protoContact(data map[string]any) protoMessage {
+    var c protoMessage
+    c = c.string(1, str(data["id"]))
+    c = c.string(2, str(data["name"]))
+    c = c.string(3, str(data["phone"]))
+    tags, _ := data["tags"].([]any)
+    c = c.strings(4, tags)
+    c = c.string(5, str(data["owner"]))
+    c = c.timestamp(6, data["created_at"])
+    c = c.timestamp(7, data["updated_at"])
+    c = c.string(8, str(data["company"]))
+    c = c.string(9, str(data["job_title"]))
+    c = c.string(10, str(data["reports_to"]))
+    if draft, _ := data["draft"].(bool); draft {
+        c = c.varint(11, 1)
+    }
+    c = c.string(12, str(data["website"]))
+    if social, ok := data["social"].(map[string]any); ok {
+        c = c.bytes(13, protoSocial(social))
+    }
+    dates, _ := data["dates"].([]any)
+    c = c.dates(14, dates)
+    if dnc, _ := data["do_not_contact"].(bool); dnc {
+        c = c.varint(15, 1)
+    }
+    return c
+}
+
+func protoSocial(social map[string]any) protoMessage {
+    var s protoMessage
+    s = s.string(1, str(social["linkedin"]))
+    s = s.string(2, str(social["x"]))
+    s = s.string(3, str(social["github"]))
+    return s
+}
+
+// dates appends a repeated ContactDate field
+func (m protoMessage) dates(field int, dates []any) protoMessage {
+    for _, v := range dates {
+        d, _ := v.(map[string]any)
+        var date protoMessage
+        date = date.string(1, str(d["label"]))
+        date = date.string(2, str(d["date"]))
+        m = m.bytes(field, date)
+    }
+    return m
+}
+
+func protoChanges(changes map[string]any) protoMessage {
+    var c protoMessage
+    if v, ok := changes["name"]; ok {
+        c = c.optionalString(1, str(v))
+    }
+    if v, ok := changes["phone"]; ok {
+        c = c.optionalString(2, str(v))
+    }
+    if v, ok := changes["tags"]; ok {
+        tags, _ := v.([]any)
+        var list protoMessage
+        c = c.bytes(3, list.strings(1, tags))
+    }
+    c = c.timestamp(4, changes["updated_at"])
+    if v, ok := changes["company"]; ok {
+        c = c.optionalString(5, str(v))
+    }
+    if v, ok := changes["job_title"]; ok {
+        c = c.optionalString(6, str(v))
+    }
+    if v, ok := changes["reports_to"]; ok {
+        c = c.optionalString(7, str(v))
+    }
+    if v, ok := changes["draft"]; ok {
+        draft, _ := v.(bool)
+        c = c.optionalBool(8, draft)
+    }
+    if v, ok := changes["website"]; ok {
+        c = c.optionalString(9, str(v))
+    }
+    if v, ok := changes["social"]; ok {
+        social, _ := v.(map[string]any)
+        c = c.bytes(10, protoSocial(social))
+    }
+    if v, ok := changes["dates"]; ok {
+        dates, _ := v.([]any)
+        var list protoMessage
+        c = c.bytes(11, list.dates(1, dates))
+    }
+    if v, ok := changes["do_not_contact"]; ok {
+        dnc, _ := v.(bool)
+        c = c.optionalBool(12, dnc)
+    }
+    return c
+}
+
+func str(v any) string {
+    s, _ := v.(string)
+    return s
+}
+
+// protoEvent encodes an event, after field selection, as a ContactEvent
+func protoEvent(event map[string]any) ([]byte, error) {
+    var m protoMessage
+    m = m.string(1, str(event["id"]))
+    m = m.string(2, str(event["type"]))
+    m = m.timestamp(3, event["occurred_at"])
+
+    data, _ := event["data"].(map[string]any)
+    switch event["type"] {
+    case "contact.created":
+        m = m.bytes(4, protoContact(data))
+    case "contact.updated":
+        var u protoMessage
+        u = u.string(1, str(data["id"]))
+        changes, _ := data["changes"].(map[string]any)
+        u = u.bytes(2, protoChanges(changes))
+        m = m.bytes(5, u)
+    case "contact.deleted":
+        var ref protoMessage
+        m = m.bytes(6, ref.string(1, str(data["id"])))
+    case "contact.reminder":
+        reminder, _ := data["reminder"].(map[string]any)
+        days, _ := reminder["days_before"].(float64)
+        var rem protoMessage
+        rem = rem.string(1, str(data["id"]))
+        rem = rem.string(2, str(reminder["owner"]))
+        rem = rem.string(3, str(reminder["label"]))
+        rem = rem.string(4, str(reminder["date"]))
+        rem = rem.string(5, str(reminder["on"]))
+        rem = rem.varint(6, uint64(days))
+        m = m.bytes(7, rem)
+    case "ping":
+    default:
+        return nil, fmt.Errorf("no protobuf message for %s events", event["type"])
+    }
+    return m, nil
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+    "context"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "slices"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// exportFlushEvery is how many exported documents are written between flushes
+const exportFlushEvery = 500
+
+var (
+    fakeFirstNames = []string{"Alex", "Sam", "Jordan", "Taylor", "Morgan", "Casey", "Riley", "Jamie", "Avery", "Quinn", "Robin", "Drew", "Parker", "Rowan", "Skyler", "Reese"}
+    fakeLastNames  = []string{"Smith", "Garcia", "Chen", "Okafor", "Novak", "Silva", "Patel", "Kowalski", "Murphy", "Tanaka", "Berg", "Haddad", "Moreau", "Rossi", "Kim", "Larsen"}
+)
+
+// anonymizer swaps personal data for fake values. Within one export the same
+// input always gets the same replacement, so duplicate names and phones stay
+// duplicates; across exports they differ, so values can't be matched up.
+type anonymizer struct {
+    key []byte
+}
+
+func newAnonymizer() *anonymizer {
+    key := make([]byte, 32)
+    rand.Read(key)
+    return &anonymizer{key: key}
+}
+
+func (a *anonymizer) sum(field, value string) []byte {
+    mac := hmac.New(sha256.New, a.key)
+    mac.Write([]byte(field + "\x00" + value))
+    return mac.Sum(nil)
+}
+
+// name returns a fake "First Last"
+func (a *anonymizer) name(value string) string {
+    h := a.sum("name", value)
+    return fakeFirstNames[int(h[0])%len(fakeFirstNames)] + " " + fakeLastNames[int(h[1])%len(fakeLastNames)]
+}
+
+// phone replaces every digit, keeping the number's length and punctuation
+func (a *anonymizer) phone(value string) string {
+    h := a.sum("phone", value)
+    var b strings.Builder
+    i := 0
+    for _, c := range value {
+        if c >= '0' && c <= '9' {
+            c = '0' + rune(binary.BigEndian.Uint16(h[(i*2)%len(h):])%10)
+            i++
+        }
+        b.WriteRune(c)
+    }
+    return b.String()
+}
+
+// withoutInternalFields drops the fields a stored contact keeps for indexing
+// and searching, which would give away name and phone in anonymized exports
+func withoutInternalFields(doc bson.D) bson.D {
+    out := doc[:0]
+    for _, e := range doc {
+        if !slices.Contains(internalContactFields, e.Key) {
+            out = append(out, e)
+        }
+    }
+    return out
+}
+
+// anonymize rewrites the personal fields of a stored contact; everything else,
+// including IDs, tenant, owner, tags and timestamps, is kept as is
+func (a *anonymizer) anonymize(doc bson.D) {
+    for i, e := range doc {
+        s, ok := e.Value.(string)
+        if !ok {
+            continue
+        }
+        switch e.Key {
+        case "name":
+            doc[i].Value = a.name(s)
+        case "phone":
+            doc[i].Value = a.phone(s)
+        }
+    }
+}
+
+// exportFormats are the file formats of exportTo: "ndjson" is MongoDB Extended
+// JSON, one stored document per line; "json" is an array of contacts as the API
+// returns them; "msgpack" is a stream of MessagePack maps, one per contact
+var exportFormats = []string{"ndjson", "json", "msgpack"}
+
+// exportTo writes the contacts matching filter to out, anonymized if asked,
+// calling flush (if not nil) with the count so far every exportFlushEvery
+// contacts
+func exportTo(ctx context.Context, out io.Writer, filter bson.M, format string, anonymized bool, flush func(count int)) (int, error) {
+    ctx = withReadOperation(ctx, readExport)
+    cursor, err := contactsCollection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+    if err != nil {
+        return 0, err
+    }
+    defer cursor.Close(ctx)
+
+    var anon *anonymizer
+    if anonymized {
+        anon = newAnonymizer()
+    }
+    if format == "json" {
+        out.Write([]byte("["))
+    }
+    count := 0
+    for cursor.Next(ctx) {
+        var doc bson.D
+        if err := cursor.Decode(&doc); err != nil {
+            logWarn("export: skipping undecodable contact: %v", err)
+            continue
+        }
+        doc = withoutInternalFields(doc)
+        if anon != nil {
+            anon.anonymize(doc)
+        }
+
+        var line []byte
+        if format == "json" || format == "msgpack" {
+            var c Contact
+            raw, _ := bson.Marshal(doc)
+            if err = bson.Unmarshal(raw, &c); err == nil {
+                if format == "msgpack" {
+                    line = msgpackContact(nil, c)
+                } else {
+                    line, err = json.Marshal(c)
+                }
+            }
+            if format == "json" && err == nil && count > 0 {
+                line = append([]byte(","), line...)
+            }
+        } else {
+            line, err = bson.MarshalExtJSON(doc, false, false)
+            line = append(line, '\n')
+        }
+        if err != nil {
+            logWarn("export: skipping contact: %v", err)
+            continue
+        }
+        if _, err := out.Write(line); err != nil {
+            return count, err
+        }
+
+        count++
+        if flush != nil && count%exportFlushEvery == 0 {
+            flush(count)
+        }
+    }
+    if err := cursor.Err(); err != nil {
+        return count, err
+    }
+    if format == "json" {
+        out.Write([]byte("]\n"))
+    }
+    return count, nil
+}
+
+// exportContacts handles GET /admin/export/contacts[?tenant=&anonymize=false],
+// filtered like the contact list. It streams the stored contacts as MongoDB
+// Extended JSON, one per line, which mongoimport loads as is. Names and phones
+// are anonymized unless anonymize=false, so the output can seed a staging database.
+// With Accept: application/msgpack it streams MessagePack contacts instead.
+func exportContacts(w http.ResponseWriter, r *http.Request) {
+    anonymized := r.URL.Query().Get("anonymize") != "false"
+    filter, msg := contactFilter(r, queryLimitsFor(r))
+    if msg != "" {
+        writeError(w, http.StatusBadRequest, codeInvalidFilter, msg)
+        return
+    }
+    if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+        filter["tenant"] = tenantFilter(tenant)["tenant"]
+        r = r.WithContext(withRegion(r.Context(), regionOf(tenant)))
+    }
+
+    format := "ndjson"
+    if wantsMsgpack(r) {
+        format = "msgpack"
+    }
+    w.Header().Set("Content-Type", exportContentType(format))
+    w.Header().Set("Content-Disposition", `attachment; filename="contacts.`+format+`"`)
+
+    rc := http.NewResponseController(w)
+    count, err := exportTo(r.Context(), w, filter, format, anonymized, func(int) { rc.Flush() })
+    if err != nil && count == 0 {
+        w.Header().Del("Content-Disposition")
+        w.Header().Set("Content-Type", "application/json")
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
+        return
+    }
+    if err != nil {
+        // the status line is long gone; the client sees a truncated file
+        logError("export aborted after %d contacts: %v", count, err)
+    }
+
+    recordAudit(r, "contacts.export", "", bson.M{"filter": r.URL.RawQuery, "anonymized": anonymized, "count": count})
+}
+
+func init() {
+    registerJobType("export", runExportJob)
+}
+
+// ExportJobParams is what an export job exports: the caller's contacts
+// matching Query, as a file of Format (see exportFormats)
+type ExportJobParams struct {
+    Format string       `bson:"format" json:"format"`
+    Query  ContactQuery `bson:"query" json:"query"`
+}
+
+// startExportJob handles POST /contacts/export. The optional body names the
+// format ("json" by default) and a query; the job writes the file to GridFS
+// and links it for download when it finishes.
+func startExportJob(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    params := ExportJobParams{Format: "json"}
+    if err := json.NewDecoder(r.Body).Decode(&params); err != nil && err != io.EOF {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    if !slices.Contains(exportFormats, params.Format) {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "format must be one of "+strings.Join(exportFormats, ", "))
+        return
+    }
+    if _, msg := params.Query.filter(queryLimitsFor(r)); msg != "" {
+        writeError(w, http.StatusBadRequest, codeInvalidFilter, msg)
+        return
+    }
+
+    job := newAsyncJob(r, "export")
+    job.Export = &params
+    enqueueJob(w, r, job)
+}
+
+// runExportJob exports the job's contacts to a GridFS file, recording
+// progress as it goes
+func runExportJob(ctx context.Context, job *AsyncJob) error {
+    r := jobRequest(ctx, job)
+    filter, msg := job.Export.Query.filter(QueryLimits{})
+    if msg != "" {
+        return errors.New(msg)
+    }
+    filter = scopeFilter(r, filter)
+    // r's context carries the caller, whose key tags limit the export
+    ctx = r.Context()
+    total, err := contactsCollection.CountDocuments(ctx, filter)
+    if err != nil {
+        return err
+    }
+
+    bucket, err := jobFiles(ctx)
+    if err != nil {
+        return err
+    }
+    upload, err := bucket.OpenUploadStream("contacts-" + job.ID.Hex() + "." + job.Export.Format)
+    if err != nil {
+        return err
+    }
+    count, err := exportTo(ctx, upload, filter, job.Export.Format, false, func(count int) {
+        job.Progress.Processed, job.Progress.Succeeded = count, count
+        if total > 0 {
+            job.Progress.Percent = int(int64(count) * 100 / total)
+        }
+        job.saveProgress(ctx)
+    })
+    job.Progress.Processed, job.Progress.Succeeded = count, count
+    if err != nil {
+        upload.Abort()
+        return err
+    }
+    if err := upload.Close(); err != nil {
+        return err
+    }
+    id := upload.FileID.(primitive.ObjectID)
+    job.ResultFile = &id
+
+    recordAudit(r, "contacts.export", "", bson.M{"query": job.Export.Query, "format": job.Export.Format, "count": count, "job": job.ID.Hex()})
+    return nil
+}
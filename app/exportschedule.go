@@ -0,0 +1,489 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "hash"
+    "io"
+    "net/http"
+    "os"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    // exportJobPrefix names the scheduler job of each export schedule
+    exportJobPrefix  = "export:"
+    exportJobTimeout = 30 * time.Minute
+    // exportRunsListed caps GET /admin/exports/schedules/{id}/runs
+    exportRunsListed = 50
+)
+
+// ExportDestination is where a scheduled export is delivered: an S3 bucket,
+// or a URL the file is POSTed to, signed like webhook events
+type ExportDestination struct {
+    Type   string `bson:"type" json:"type"`
+    URL    string `bson:"url,omitempty" json:"url,omitempty"`
+    Bucket string `bson:"bucket,omitempty" json:"bucket,omitempty"`
+    Region string `bson:"region,omitempty" json:"region,omitempty"`
+    Prefix string `bson:"prefix,omitempty" json:"prefix,omitempty"`
+}
+
+// ExportSchedule exports the contacts matching Query (of one tenant, or all
+// of the home region's if Tenant is empty) on a cron schedule
+type ExportSchedule struct {
+    ID          primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    Name        string             `bson:"name" json:"name"`
+    Schedule    string             `bson:"schedule" json:"schedule"`
+    Format      string             `bson:"format" json:"format"`
+    Anonymize   bool               `bson:"anonymize" json:"anonymize"`
+    Tenant      string             `bson:"tenant,omitempty" json:"tenant,omitempty"`
+    Query       ContactQuery       `bson:"query" json:"query"`
+    Destination ExportDestination  `bson:"destination" json:"destination"`
+    Secret      string             `bson:"secret,omitempty" json:"secret,omitempty"`
+    CreatedAt   time.Time          `bson:"created_at" json:"created_at"`
+    UpdatedAt   time.Time          `bson:"updated_at" json:"updated_at"`
+    LastRun     *ExportRun         `bson:"last_run,omitempty" json:"last_run,omitempty"`
+}
+
+// ExportRun is one execution of a schedule, kept in export_runs
+type ExportRun struct {
+    ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    ScheduleID primitive.ObjectID `bson:"schedule_id" json:"schedule_id"`
+    StartedAt  time.Time          `bson:"started_at" json:"started_at"`
+    FinishedAt time.Time          `bson:"finished_at" json:"finished_at"`
+    Status     string             `bson:"status" json:"status"`
+    Contacts   int                `bson:"contacts" json:"contacts"`
+    Bytes      int64              `bson:"bytes" json:"bytes"`
+    Location   string             `bson:"location,omitempty" json:"location,omitempty"`
+    Error      string             `bson:"error,omitempty" json:"error,omitempty"`
+}
+
+var (
+    exportClient    = newTracedClient("export", exportJobTimeout)
+    exportRunsTotal = newCounter("export_runs_total", "Scheduled export runs by outcome.", "result")
+)
+
+func exportSchedulesCollection() collection {
+    return sharedCollectionOf("export_schedules")
+}
+
+func exportRunsCollection() collection {
+    return sharedCollectionOf("export_runs")
+}
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:     "export-schedules",
+        Schedule: "@every 1m",
+        Timeout:  time.Minute,
+        Global:   true,
+        Run:      syncExportSchedules,
+    })
+}
+
+// exportJobs remembers which schedules this replica has registered, and with
+// which cron expression
+var exportJobs = struct {
+    sync.Mutex
+    registered map[primitive.ObjectID]string
+}{registered: map[primitive.ObjectID]string{}}
+
+// syncExportSchedules registers a singleton job for every stored schedule and
+// drops the jobs of deleted ones. It runs on every replica, so whichever holds
+// the leader lease runs the exports.
+func syncExportSchedules(ctx context.Context) error {
+    cursor, err := exportSchedulesCollection().Find(ctx, bson.D{})
+    if err != nil {
+        return err
+    }
+    var schedules []ExportSchedule
+    if err := cursor.All(ctx, &schedules); err != nil {
+        return err
+    }
+
+    exportJobs.Lock()
+    defer exportJobs.Unlock()
+
+    seen := map[primitive.ObjectID]bool{}
+    for _, s := range schedules {
+        seen[s.ID] = true
+        if exportJobs.registered[s.ID] == s.Schedule {
+            continue
+        }
+        id := s.ID
+        scheduler.Unregister(exportJobPrefix + id.Hex())
+        err := scheduler.Register(Job{
+            Name:      exportJobPrefix + id.Hex(),
+            Schedule:  s.Schedule,
+            Timeout:   exportJobTimeout,
+            Singleton: true,
+            Global:    true,
+            Run:       func(ctx context.Context) error { return runScheduledExport(ctx, id) },
+        })
+        if err != nil {
+            logError("export schedule %s: %v", id.Hex(), err)
+            continue
+        }
+        exportJobs.registered[id] = s.Schedule
+    }
+    for id := range exportJobs.registered {
+        if !seen[id] {
+            scheduler.Unregister(exportJobPrefix + id.Hex())
+            delete(exportJobs.registered, id)
+        }
+    }
+    return nil
+}
+
+// runScheduledExport runs the current definition of a schedule and records the run
+func runScheduledExport(ctx context.Context, id primitive.ObjectID) error {
+    var s ExportSchedule
+    if err := exportSchedulesCollection().FindOne(ctx, bson.M{"_id": id}).Decode(&s); err != nil {
+        return err
+    }
+
+    run := ExportRun{ScheduleID: s.ID, StartedAt: utcNow()}
+    err := executeExport(withRegion(ctx, regionOf(s.Tenant)), s, &run)
+    run.FinishedAt = utcNow()
+    run.Status = "success"
+    if err != nil {
+        run.Status = "failed"
+        run.Error = err.Error()
+    }
+    exportRunsTotal.Inc(run.Status)
+
+    result, ierr := exportRunsCollection().InsertOne(ctx, run)
+    if ierr == nil {
+        run.ID = result.InsertedID.(primitive.ObjectID)
+    }
+    exportSchedulesCollection().UpdateOne(ctx, bson.M{"_id": s.ID}, bson.M{"$set": bson.M{"last_run": run}})
+    if err == nil {
+        recordAudit(nil, "contacts.export", s.ID.Hex(), bson.M{
+            "schedule": s.Name, "anonymized": s.Anonymize, "count": run.Contacts, "location": run.Location,
+        })
+    }
+    return err
+}
+
+// executeExport writes the export to a temporary file, then delivers it
+func executeExport(ctx context.Context, s ExportSchedule, run *ExportRun) error {
+    filter, msg := s.Query.filter(QueryLimits{})
+    if msg != "" {
+        return fmt.Errorf("query: %s", msg)
+    }
+    if s.Tenant != "" {
+        filter["tenant"] = tenantFilter(s.Tenant)["tenant"]
+    }
+
+    f, err := os.CreateTemp("", "export-*."+s.Format)
+    if err != nil {
+        return err
+    }
+    defer os.Remove(f.Name())
+    defer f.Close()
+
+    digest := sha256.New()
+    run.Contacts, err = exportTo(ctx, io.MultiWriter(f, digest), filter, s.Format, s.Anonymize, nil)
+    if err != nil {
+        return err
+    }
+    if run.Bytes, err = f.Seek(0, io.SeekCurrent); err != nil {
+        return err
+    }
+    if _, err := f.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+
+    filename := fmt.Sprintf("%s-%s.%s", s.Name, run.StartedAt.Format("20060102T150405Z"), s.Format)
+    switch s.Destination.Type {
+    case "s3":
+        key := s.Destination.Prefix + filename
+        req, err := http.NewRequestWithContext(ctx, "PUT", s3ObjectURL(s.Destination.Bucket, s.Destination.Region, key), f)
+        if err != nil {
+            return err
+        }
+        req.Header.Set("Content-Type", exportContentType(s.Format))
+        if err := putS3Object(req, s.Destination.Region, run.Bytes); err != nil {
+            return err
+        }
+        run.Location = "s3://" + s.Destination.Bucket + "/" + key
+    case "webhook":
+        if err := postExport(ctx, s, f, run.Bytes, filename, digest); err != nil {
+            return err
+        }
+        run.Location = s.Destination.URL
+    }
+    return nil
+}
+
+func exportContentType(format string) string {
+    switch format {
+    case "json":
+        return "application/json"
+    case "msgpack":
+        return msgpackContentType
+    }
+    return "application/x-ndjson"
+}
+
+// postExport sends the file to a webhook destination. X-Export-Signature is
+// "sha256=" + hex HMAC-SHA256, with the schedule's secret, of
+// "<X-Export-Timestamp>.<hex SHA-256 of the body>".
+func postExport(ctx context.Context, s ExportSchedule, body io.Reader, size int64, filename string, digest hash.Hash) error {
+    ts := strconv.FormatInt(time.Now().Unix(), 10)
+    mac := hmac.New(sha256.New, []byte(s.Secret))
+    mac.Write([]byte(ts + "." + hex.EncodeToString(digest.Sum(nil))))
+
+    req, err := http.NewRequestWithContext(ctx, "POST", s.Destination.URL, body)
+    if err != nil {
+        return err
+    }
+    req.ContentLength = size
+    req.Header.Set("Content-Type", exportContentType(s.Format))
+    req.Header.Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+    req.Header.Set("X-Export-Schedule", s.ID.Hex())
+    req.Header.Set("X-Export-Timestamp", ts)
+    req.Header.Set("X-Export-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+    resp, err := exportClient.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        return fmt.Errorf("destination responded %s: %s", resp.Status, bytes.TrimSpace(msg))
+    }
+    return nil
+}
+
+// exportScheduleInput is the body of POST and PUT /admin/exports/schedules
+type exportScheduleInput struct {
+    Name        *string            `json:"name"`
+    Schedule    *string            `json:"schedule"`
+    Format      *string            `json:"format"`
+    Anonymize   *bool              `json:"anonymize"`
+    Tenant      *string            `json:"tenant"`
+    Query       *ContactQuery      `json:"query"`
+    Destination *ExportDestination `json:"destination"`
+}
+
+func (in exportScheduleInput) applyTo(s *ExportSchedule) string {
+    if in.Name != nil {
+        s.Name = strings.TrimSpace(*in.Name)
+    }
+    if in.Schedule != nil {
+        s.Schedule = *in.Schedule
+    }
+    if in.Format != nil {
+        s.Format = *in.Format
+    }
+    if in.Anonymize != nil {
+        s.Anonymize = *in.Anonymize
+    }
+    if in.Tenant != nil {
+        s.Tenant = *in.Tenant
+    }
+    if in.Query != nil {
+        s.Query = *in.Query
+    }
+    if in.Destination != nil {
+        s.Destination = *in.Destination
+    }
+
+    if !requestIDPattern.MatchString(s.Name) {
+        return "name must be 1-64 letters, digits, dots, dashes or underscores"
+    }
+    if _, err := parseSchedule(s.Schedule); err != nil {
+        return "schedule must be a cron expression or @every interval"
+    }
+    if !slices.Contains(exportFormats, s.Format) {
+        return "format must be one of " + strings.Join(exportFormats, ", ")
+    }
+    if _, msg := s.Query.filter(QueryLimits{}); msg != "" {
+        return "query.name: " + msg
+    }
+    d := s.Destination
+    switch {
+    case d.Type == "s3" && (d.Bucket == "" || d.Region == ""):
+        return "s3 destinations need a bucket and region"
+    case d.Type == "webhook" && !absoluteHTTPURL(d.URL):
+        return "webhook destinations need an absolute http or https url"
+    case d.Type != "s3" && d.Type != "webhook":
+        return "destination.type must be s3 or webhook"
+    }
+    return ""
+}
+
+// listExportSchedules handles GET /admin/exports/schedules
+func listExportSchedules(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    cursor, err := exportSchedulesCollection().Find(r.Context(), bson.D{}, options.Find().SetProjection(bson.M{"secret": 0}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve export schedules")
+        return
+    }
+    schedules := []ExportSchedule{}
+    if err := cursor.All(r.Context(), &schedules); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    json.NewEncoder(w).Encode(schedules)
+}
+
+// createExportSchedule handles POST /admin/exports/schedules; the signing
+// secret for webhook destinations is only returned here
+func createExportSchedule(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var in exportScheduleInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+
+    now := utcNow()
+    s := ExportSchedule{Format: "ndjson", Anonymize: true, Secret: randomHex(32), CreatedAt: now, UpdatedAt: now}
+    if msg := in.applyTo(&s); msg != "" {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, msg)
+        return
+    }
+
+    result, err := exportSchedulesCollection().InsertOne(r.Context(), s)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create export schedule")
+        return
+    }
+    s.ID = result.InsertedID.(primitive.ObjectID)
+    recordAudit(r, "export.schedule.create", s.ID.Hex(), bson.M{"name": s.Name, "schedule": s.Schedule, "destination": s.Destination})
+    scheduler.Trigger("export-schedules")
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(s)
+}
+
+// exportScheduleByID loads the schedule named in /admin/exports/schedules/{id}[/runs]
+func exportScheduleByID(w http.ResponseWriter, r *http.Request) (ExportSchedule, bool) {
+    var s ExportSchedule
+
+    id := strings.TrimSuffix(r.URL.Path[len("/admin/exports/schedules/"):], "/runs")
+    objID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid schedule ID")
+        return s, false
+    }
+
+    err = exportSchedulesCollection().FindOne(r.Context(), bson.M{"_id": objID}).Decode(&s)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeScheduleNotFound, "Export schedule not found")
+        return s, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return s, false
+    }
+    return s, true
+}
+
+// getExportSchedule handles GET /admin/exports/schedules/{id}
+func getExportSchedule(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if s, ok := exportScheduleByID(w, r); ok {
+        s.Secret = ""
+        json.NewEncoder(w).Encode(s)
+    }
+}
+
+// updateExportSchedule handles PUT /admin/exports/schedules/{id}
+func updateExportSchedule(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    s, ok := exportScheduleByID(w, r)
+    if !ok {
+        return
+    }
+
+    var in exportScheduleInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    if msg := in.applyTo(&s); msg != "" {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, msg)
+        return
+    }
+    s.UpdatedAt = utcNow()
+
+    _, err := exportSchedulesCollection().ReplaceOne(r.Context(), bson.M{"_id": s.ID}, s)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to update export schedule")
+        return
+    }
+    recordAudit(r, "export.schedule.update", s.ID.Hex(), bson.M{"name": s.Name, "schedule": s.Schedule, "destination": s.Destination})
+    scheduler.Trigger("export-schedules")
+
+    s.Secret = ""
+    json.NewEncoder(w).Encode(s)
+}
+
+// deleteExportSchedule handles DELETE /admin/exports/schedules/{id}, along
+// with its run history
+func deleteExportSchedule(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    s, ok := exportScheduleByID(w, r)
+    if !ok {
+        return
+    }
+
+    if _, err := exportSchedulesCollection().DeleteOne(r.Context(), bson.M{"_id": s.ID}); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete export schedule")
+        return
+    }
+    exportRunsCollection().DeleteMany(r.Context(), bson.M{"schedule_id": s.ID})
+    recordAudit(r, "export.schedule.delete", s.ID.Hex(), nil)
+    scheduler.Trigger("export-schedules")
+
+    json.NewEncoder(w).Encode(bson.M{"message": "Export schedule deleted successfully"})
+}
+
+// listExportRuns handles GET /admin/exports/schedules/{id}/runs, newest first
+func listExportRuns(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    s, ok := exportScheduleByID(w, r)
+    if !ok {
+        return
+    }
+
+    cursor, err := exportRunsCollection().Find(r.Context(), bson.M{"schedule_id": s.ID},
+        options.Find().SetSort(bson.D{{Key: "started_at", Value: -1}}).SetLimit(exportRunsListed))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve export runs")
+        return
+    }
+    runs := []ExportRun{}
+    if err := cursor.All(r.Context(), &runs); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    json.NewEncoder(w).Encode(runs)
+}
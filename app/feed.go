@@ -0,0 +1,151 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+    defaultFeedLimit = 20
+    maxFeedLimit     = 100
+    // feedWindow is how far back GET /feed looks
+    feedWindow = 30 * 24 * time.Hour
+)
+
+// FeedEvent is one change in the caller's feed; Via says why it is there:
+// "owner" for a contact the caller's key created, "watch" for one it watches
+type FeedEvent struct {
+    ID        string    `bson:"-" json:"id"`
+    At        time.Time `bson:"at" json:"at"`
+    Type      string    `bson:"action" json:"type"`
+    Actor     string    `bson:"actor" json:"actor"`
+    ContactID string    `bson:"target" json:"contact_id"`
+    Details   bson.M    `bson:"details,omitempty" json:"details,omitempty"`
+    Via       string    `bson:"via" json:"via"`
+
+    EntryID primitive.ObjectID `bson:"_id" json:"-"`
+}
+
+// Feed is the response of GET /feed; Next is the cursor for the following
+// (older) page, empty on the last one
+type Feed struct {
+    Events []FeedEvent `json:"events"`
+    Next   string      `json:"next,omitempty"`
+}
+
+// getFeed handles GET /feed[?limit=20&before=], the recent changes to the
+// contacts the caller's key owns or watches, newest first, for dashboards.
+// It is assembled from the audit log in one aggregation: each contact entry
+// of the last feedWindow is joined with the contact, or its last version if
+// it was deleted, to find its owner, and with the caller's watches.
+func getFeed(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    limit, ok := queryInt(r, "limit", defaultFeedLimit, maxFeedLimit)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "limit must be a positive number")
+        return
+    }
+    match := scopeFilter(r, bson.M{
+        "action": bson.M{"$regex": `^contact\.`},
+        "at":     bson.M{"$gte": utcNow().Add(-feedWindow)},
+    })
+    if before := r.URL.Query().Get("before"); before != "" {
+        cursorID, err := primitive.ObjectIDFromHex(before)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "Invalid before cursor")
+            return
+        }
+        match["_id"] = bson.M{"$lt": cursorID}
+    }
+
+    me := principalFrom(r).KeyID
+    tenant := tenantFilter(tenantOf(r))["tenant"]
+    pipeline := mongo.Pipeline{
+        {{Key: "$match", Value: match}},
+        {{Key: "$sort", Value: bson.D{{Key: "_id", Value: -1}}}},
+        {{Key: "$addFields", Value: bson.M{"contact_id": bson.M{
+            "$convert": bson.M{"input": "$target", "to": "objectId", "onError": nil, "onNull": nil},
+        }}}},
+        {{Key: "$lookup", Value: bson.M{
+            "from":         "contacts",
+            "localField":   "contact_id",
+            "foreignField": "_id",
+            "as":           "contact",
+        }}},
+        {{Key: "$lookup", Value: bson.M{
+            "from": "contact_versions",
+            "let":  bson.M{"id": "$contact_id"},
+            "pipeline": bson.A{
+                bson.M{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$contact_id", "$$id"}}}},
+                bson.M{"$sort": bson.M{"version": -1}},
+                bson.M{"$limit": 1},
+            },
+            "as": "last",
+        }}},
+        {{Key: "$lookup", Value: bson.M{
+            "from": "contact_watches",
+            "let":  bson.M{"id": "$contact_id"},
+            "pipeline": bson.A{
+                bson.M{"$match": bson.M{"tenant": tenant, "owner": me}},
+                bson.M{"$match": bson.M{"$expr": bson.M{"$eq": bson.A{"$contact_id", "$$id"}}}},
+            },
+            "as": "watch",
+        }}},
+        {{Key: "$addFields", Value: bson.M{
+            "owner": bson.M{"$ifNull": bson.A{
+                bson.M{"$first": "$contact.owner"},
+                bson.M{"$first": "$last.contact.owner"},
+            }},
+            "tags": bson.M{"$ifNull": bson.A{
+                bson.M{"$first": "$contact.tags"},
+                bson.M{"$first": "$last.contact.tags"},
+            }},
+        }}},
+        {{Key: "$addFields", Value: bson.M{"via": bson.M{"$switch": bson.M{
+            "branches": bson.A{
+                bson.M{"case": bson.M{"$eq": bson.A{"$owner", me}}, "then": "owner"},
+                bson.M{"case": bson.M{"$gt": bson.A{bson.M{"$size": "$watch"}, 0}}, "then": "watch"},
+            },
+            "default": nil,
+        }}}}},
+        {{Key: "$match", Value: feedVisible(r)}},
+        {{Key: "$limit", Value: limit + 1}},
+        {{Key: "$project", Value: bson.M{"at": 1, "action": 1, "actor": 1, "target": 1, "details": 1, "via": 1}}},
+    }
+    cursor, err := collectionOf("audit_log").Aggregate(r.Context(), pipeline)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve feed")
+        return
+    }
+    events := []FeedEvent{}
+    if err := cursor.All(r.Context(), &events); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    res := Feed{Events: events}
+    if len(events) > limit {
+        res.Events = events[:limit]
+        res.Next = events[limit-1].EntryID.Hex()
+    }
+    for i := range res.Events {
+        res.Events[i].ID = res.Events[i].EntryID.Hex()
+    }
+    json.NewEncoder(w).Encode(res)
+}
+
+// feedVisible matches the feed entries the caller gets: those with a reason,
+// on contacts a key limited to tags has access to, or had when deleted
+func feedVisible(r *http.Request) bson.M {
+    m := bson.M{"via": bson.M{"$ne": nil}}
+    if tags := keyTags(r.Context()); len(tags) > 0 {
+        m["tags"] = bson.M{"$in": tags}
+    }
+    return m
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ContactQuery holds the filters shared by listing and exporting contacts:
+// Name is a case- and diacritic-insensitive pattern, every tag in Tags must
+// match, Company matches exactly and Filter is an RSQL expression (see
+// compileFilter)
+type ContactQuery struct {
+    Name    string   `bson:"name,omitempty" json:"name,omitempty"`
+    Tags    []string `bson:"tags,omitempty" json:"tags,omitempty"`
+    Owner   string   `bson:"owner,omitempty" json:"owner,omitempty"`
+    Company string   `bson:"company,omitempty" json:"company,omitempty"`
+    Filter  string   `bson:"filter,omitempty" json:"filter,omitempty"`
+    // Drafts selects draft contacts, which are left out otherwise
+    Drafts bool `bson:"drafts,omitempty" json:"drafts,omitempty"`
+}
+
+// contactQueryFrom reads ?name=, ?tag= (repeatable), ?owner=, ?company=,
+// ?filter= and ?drafts=true
+func contactQueryFrom(r *http.Request) ContactQuery {
+    q := r.URL.Query()
+    return ContactQuery{Name: q.Get("name"), Tags: q["tag"], Owner: q.Get("owner"), Company: q.Get("company"), Filter: q.Get("filter"),
+        Drafts: q.Get("drafts") == "true"}
+}
+
+// filter builds the MongoDB query; it returns a message for an invalid pattern
+// or filter expression
+func (cq ContactQuery) filter(limits QueryLimits) (bson.M, string) {
+    filter := bson.M{"draft": bson.M{"$ne": true}}
+    if cq.Drafts {
+        filter["draft"] = true
+    }
+    if cq.Name != "" {
+        if msg := checkPattern(cq.Name, limits); msg != "" {
+            return nil, msg
+        }
+        filter["name_search"] = primitive.Regex{Pattern: foldPattern(cq.Name), Options: "i"}
+    }
+    if tags := normalizeTags(cq.Tags); len(tags) > 0 {
+        filter["tags"] = bson.M{"$all": tags}
+    }
+    if cq.Owner != "" {
+        filter["owner"] = cq.Owner
+    }
+    if company := normalizeLabel(cq.Company); company != "" {
+        filter["company"] = company
+    }
+    if cq.Filter != "" {
+        expr, err := compileFilter(cq.Filter)
+        if err != nil {
+            return nil, "invalid filter " + err.Error()
+        }
+        filter["$and"] = bson.A{expr}
+    }
+    return filter, ""
+}
+
+// listContactsMatching answers like GET /contacts with the filters of cq and
+// the sort order (the default one if empty) in place of the request's;
+// paging, ?locale=, ?region= and ?highlight= are taken from the request
+func listContactsMatching(w http.ResponseWriter, r *http.Request, cq ContactQuery, sort string) {
+    q := r.URL.Query()
+    for _, name := range []string{"name", "tag", "owner", "company", "filter", "drafts", "sort"} {
+        q.Del(name)
+    }
+    set := func(name, value string) {
+        if value != "" {
+            q.Set(name, value)
+        }
+    }
+    set("name", cq.Name)
+    set("owner", cq.Owner)
+    set("company", cq.Company)
+    set("filter", cq.Filter)
+    set("sort", sort)
+    if cq.Drafts {
+        set("drafts", "true")
+    }
+    for _, tag := range cq.Tags {
+        q.Add("tag", tag)
+    }
+
+    run := r.Clone(r.Context())
+    run.URL.RawQuery = q.Encode()
+    getContacts(w, run)
+}
+
+// validSort reports whether sort is empty or an order ?sort= accepts
+func validSort(sort string) bool {
+    _, ok := contactSorts[strings.TrimPrefix(sort, "-")]
+    return sort == "" || ok
+}
+
+// withContactFilter narrows the contacts the request lists to those matching
+// filter as well, for lists whose filter can't be put in query parameters
+func withContactFilter(r *http.Request, filter bson.M) *http.Request {
+    return r.WithContext(context.WithValue(r.Context(), contactFilterKey, filter))
+}
+
+// contactFilter builds the query for the filter parameters of a request and
+// the filter added by withContactFilter
+func contactFilter(r *http.Request, limits QueryLimits) (bson.M, string) {
+    filter, msg := contactQueryFrom(r).filter(limits)
+    if extra, ok := r.Context().Value(contactFilterKey).(bson.M); ok && msg == "" {
+        filter = bson.M{"$and": bson.A{filter, extra}}
+    }
+    return filter, msg
+}
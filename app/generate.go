@@ -0,0 +1,256 @@
+package main
+
+import (
+    "encoding/json"
+    "fmt"
+    "math/rand/v2"
+    "net/http"
+    "sort"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+    maxGenerateCount  = 100000
+    generateBatchSize = 1000
+)
+
+// generatorLocale is what a fake contact from one locale looks like; "#" in a
+// phone format is replaced by a random digit
+type generatorLocale struct {
+    first  []string
+    last   []string
+    phones []string
+}
+
+var generatorLocales = map[string]generatorLocale{
+    "en_US": {
+        first:  []string{"James", "Mary", "Robert", "Patricia", "John", "Jennifer", "Michael", "Linda", "David", "Elizabeth", "William", "Susan"},
+        last:   []string{"Smith", "Johnson", "Williams", "Brown", "Jones", "Miller", "Davis", "Wilson", "Anderson", "Taylor", "Thomas", "Moore"},
+        phones: []string{"+1-###-###-####", "(###) ###-####", "+1 ### ### ####"},
+    },
+    "en_GB": {
+        first:  []string{"Oliver", "Amelia", "George", "Isla", "Harry", "Ava", "Jack", "Emily", "Charlie", "Sophie"},
+        last:   []string{"Jones", "Evans", "Thomas", "Roberts", "Walker", "Wright", "Hughes", "Green", "Hall", "Wood"},
+        phones: []string{"+44 7### ######", "07### ######"},
+    },
+    "de_DE": {
+        first:  []string{"Lukas", "Anna", "Leon", "Lena", "Finn", "Mia", "Jonas", "Hannah", "Paul", "Laura"},
+        last:   []string{"Müller", "Schmidt", "Schneider", "Fischer", "Weber", "Meyer", "Wagner", "Becker", "Schulz", "Hoffmann"},
+        phones: []string{"+49 15# ########", "+49 30 ########"},
+    },
+    "fr_FR": {
+        first:  []string{"Gabriel", "Louise", "Raphaël", "Emma", "Léo", "Jade", "Louis", "Alice", "Jules", "Chloé"},
+        last:   []string{"Martin", "Bernard", "Dubois", "Thomas", "Robert", "Richard", "Petit", "Durand", "Leroy", "Moreau"},
+        phones: []string{"+33 6 ## ## ## ##", "06 ## ## ## ##"},
+    },
+    "es_ES": {
+        first:  []string{"Hugo", "Lucía", "Martín", "Sofía", "Daniel", "Martina", "Pablo", "María", "Alejandro", "Paula"},
+        last:   []string{"García", "Rodríguez", "González", "Fernández", "López", "Martínez", "Sánchez", "Pérez", "Gómez", "Ruiz"},
+        phones: []string{"+34 6## ### ###"},
+    },
+    "ja_JP": {
+        first:  []string{"Haruto", "Yui", "Sota", "Hina", "Yuto", "Aoi", "Riku", "Sakura"},
+        last:   []string{"Sato", "Suzuki", "Takahashi", "Tanaka", "Watanabe", "Ito", "Yamamoto", "Nakamura"},
+        phones: []string{"+81 90-####-####", "080-####-####"},
+    },
+    "hi_IN": {
+        first:  []string{"Aarav", "Saanvi", "Vihaan", "Ananya", "Arjun", "Diya", "Sai", "Ishita", "Reyansh", "Myra"},
+        last:   []string{"Sharma", "Verma", "Gupta", "Singh", "Kumar", "Reddy", "Iyer", "Patel", "Nair", "Mehta"},
+        phones: []string{"+91 9#### #####", "+91 8#### #####"},
+    },
+}
+
+// GenerateRequest is the body of POST /admin/generate. Tags and Locales map a
+// value to its weight (locales) or to the share of contacts carrying it (tags).
+type GenerateRequest struct {
+    Count         int                `json:"count"`
+    Tenant        string             `json:"tenant"`
+    Owner         string             `json:"owner"`
+    Locales       map[string]float64 `json:"locales"`
+    Tags          map[string]float64 `json:"tags"`
+    DuplicateRate float64            `json:"duplicate_rate"`
+    Days          int                `json:"days"`
+    Seed          *uint64            `json:"seed"`
+}
+
+func (g *GenerateRequest) validate() error {
+    if g.Count < 1 || g.Count > maxGenerateCount {
+        return fmt.Errorf("count must be between 1 and %d", maxGenerateCount)
+    }
+    if len(g.Locales) == 0 {
+        g.Locales = map[string]float64{"en_US": 1}
+    }
+    total := 0.0
+    for l, w := range g.Locales {
+        if _, ok := generatorLocales[l]; !ok {
+            return fmt.Errorf("unknown locale %q", l)
+        }
+        if w < 0 {
+            return fmt.Errorf("locale weights must not be negative")
+        }
+        total += w
+    }
+    if total == 0 {
+        return fmt.Errorf("locale weights must not all be zero")
+    }
+    for t, share := range g.Tags {
+        if share < 0 || share > 1 {
+            return fmt.Errorf("tag %q: share must be between 0 and 1", t)
+        }
+    }
+    if g.DuplicateRate < 0 || g.DuplicateRate > 1 {
+        return fmt.Errorf("duplicate_rate must be between 0 and 1")
+    }
+    if g.Days == 0 {
+        g.Days = 365
+    }
+    if g.Days < 0 {
+        return fmt.Errorf("days must be positive")
+    }
+    if g.Tenant == "" {
+        g.Tenant = defaultTenant
+    }
+    if g.Owner == "" {
+        g.Owner = "synthetic"
+    }
+    return nil
+}
+
+// contactGenerator produces the fake contacts of one GenerateRequest
+type contactGenerator struct {
+    req     GenerateRequest
+    rng     *rand.Rand
+    locales []string
+    weights []float64
+    tags    []string
+    made    []bson.M
+}
+
+func newContactGenerator(req GenerateRequest) *contactGenerator {
+    seed := rand.Uint64()
+    if req.Seed != nil {
+        seed = *req.Seed
+    }
+    g := &contactGenerator{req: req, rng: rand.New(rand.NewPCG(seed, seed))}
+    // sorted so that a seed always produces the same contacts
+    for l := range req.Locales {
+        g.locales = append(g.locales, l)
+    }
+    sort.Strings(g.locales)
+    for _, l := range g.locales {
+        g.weights = append(g.weights, req.Locales[l])
+    }
+    for t := range req.Tags {
+        g.tags = append(g.tags, t)
+    }
+    sort.Strings(g.tags)
+    return g
+}
+
+func (g *contactGenerator) pick(list []string) string {
+    return list[g.rng.IntN(len(list))]
+}
+
+func (g *contactGenerator) locale() generatorLocale {
+    total := 0.0
+    for _, w := range g.weights {
+        total += w
+    }
+    x := g.rng.Float64() * total
+    for i, w := range g.weights {
+        if x < w {
+            return generatorLocales[g.locales[i]]
+        }
+        x -= w
+    }
+    return generatorLocales[g.locales[len(g.locales)-1]]
+}
+
+func (g *contactGenerator) phone(format string) string {
+    var b strings.Builder
+    for _, c := range format {
+        if c == '#' {
+            c = '0' + rune(g.rng.IntN(10))
+        }
+        b.WriteRune(c)
+    }
+    return b.String()
+}
+
+// next returns a new contact, or with duplicate_rate probability a near copy of
+// an earlier one: same phone and name, with the name's case changed
+func (g *contactGenerator) next() bson.M {
+    created := utcNow().Add(-time.Duration(g.rng.Int64N(int64(g.req.Days) * int64(24*time.Hour))))
+    c := bson.M{
+        "tenant":     g.req.Tenant,
+        "owner":      g.req.Owner,
+        "created_at": created,
+        "updated_at": created,
+    }
+
+    if len(g.made) > 0 && g.rng.Float64() < g.req.DuplicateRate {
+        orig := g.made[g.rng.IntN(len(g.made))]
+        c["name"] = strings.ToUpper(orig["name"].(string))
+        c["phone"] = orig["phone"]
+    } else {
+        l := g.locale()
+        c["name"] = g.pick(l.first) + " " + g.pick(l.last)
+        c["phone"] = g.phone(g.pick(l.phones))
+    }
+
+    c["name_search"] = searchKey(c["name"].(string))
+    c["rank"] = newRank(created)
+
+    tags := []string{}
+    for _, t := range g.tags {
+        if g.rng.Float64() < g.req.Tags[t] {
+            tags = append(tags, t)
+        }
+    }
+    c["tags"] = normalizeTags(tags)
+
+    g.made = append(g.made, c)
+    return c
+}
+
+// generateContacts handles POST /admin/generate, inserting fake contacts for
+// load tests and demos. They bypass contact quotas and are owned by "synthetic"
+// unless another owner is given, so they are easy to find and remove.
+func generateContacts(w http.ResponseWriter, r *http.Request) {
+    var req GenerateRequest
+    if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    if err := req.validate(); err != nil {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, err.Error())
+        return
+    }
+
+    // the contacts go to the tenant's region
+    r = r.WithContext(withRegion(r.Context(), regionOf(req.Tenant)))
+    g := newContactGenerator(req)
+    inserted := 0
+    for inserted < req.Count {
+        n := min(generateBatchSize, req.Count-inserted)
+        batch := make([]any, n)
+        for i := range batch {
+            c := g.next()
+            c["short_id"] = newShortID()
+            batch[i] = c
+        }
+        if _, err := contactsCollection.InsertMany(r.Context(), batch); err != nil {
+            logError("generate: insert failed after %d contacts: %v", inserted, err)
+            writeErrorWith(w, http.StatusInternalServerError, codeInternal, "Failed to insert contacts", map[string]any{"inserted": inserted})
+            return
+        }
+        inserted += n
+    }
+    recordAudit(r, "contacts.generate", "", bson.M{"tenant": req.Tenant, "owner": req.Owner, "count": inserted})
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(bson.M{"inserted": inserted, "tenant": req.Tenant, "owner": req.Owner})
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    // maxGroups caps the groups of one tenant
+    maxGroups = 500
+    // maxGroupName caps the length of a group's name
+    maxGroupName = 100
+    // maxGroupDepth caps how deeply groups nest; top-level groups are at 1
+    maxGroupDepth = 8
+)
+
+// Group is a named set of a tenant's contacts. Membership isn't stored: the
+// members are the contacts matching Query when the group is read, so a group
+// of {"tags": ["vendor"], "filter": "phone==+49*"} always holds the current
+// German vendors, and one of just a tag is that tag's contacts. Groups nest
+// like folders (region → office → team) through Parent, which is nil for
+// top-level groups.
+type Group struct {
+    ID          primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+    Tenant      string              `bson:"tenant" json:"-"`
+    Parent      *primitive.ObjectID `bson:"parent,omitempty" json:"parent,omitempty"`
+    Name        string              `bson:"name" json:"name"`
+    Description string              `bson:"description,omitempty" json:"description,omitempty"`
+    Query       ContactQuery        `bson:"query" json:"query"`
+    Sort        string              `bson:"sort,omitempty" json:"sort,omitempty"`
+    CreatedAt   time.Time           `bson:"created_at" json:"created_at"`
+    UpdatedAt   time.Time           `bson:"updated_at" json:"updated_at"`
+    // Count is the number of members, when asked for
+    Count *int64 `bson:"-" json:"count,omitempty"`
+}
+
+func groupsCollection() collection {
+    return collectionOf("groups")
+}
+
+// groupInput is the body of POST and PUT /groups; Parent is handled by
+// setParent
+type groupInput struct {
+    Parent      *string       `json:"parent"`
+    Name        *string       `json:"name"`
+    Description *string       `json:"description"`
+    Query       *ContactQuery `json:"query"`
+    Sort        *string       `json:"sort"`
+}
+
+func (in groupInput) applyTo(g *Group, limits QueryLimits) (code, msg string) {
+    if in.Name != nil {
+        g.Name = strings.TrimSpace(*in.Name)
+    }
+    if in.Description != nil {
+        g.Description = *in.Description
+    }
+    if in.Query != nil {
+        g.Query = *in.Query
+    }
+    if in.Sort != nil {
+        g.Sort = *in.Sort
+    }
+
+    if g.Name == "" {
+        return codeValidationFailed, "name is required"
+    }
+    if len(g.Name) > maxGroupName {
+        return codeValidationFailed, "name must not be longer than 100 characters"
+    }
+    if !validSort(g.Sort) {
+        return codeValidationFailed, sortMessage
+    }
+    if _, msg := g.Query.filter(limits); msg != "" {
+        return codeInvalidFilter, msg
+    }
+    return "", ""
+}
+
+// count sets the group's current number of members
+func (g *Group) count(r *http.Request) error {
+    filter, msg := g.Query.filter(QueryLimits{})
+    if msg != "" {
+        return errors.New(msg)
+    }
+    n, err := contactsCollection.CountDocuments(r.Context(), scopeFilter(r, filter))
+    if err != nil {
+        return err
+    }
+    g.Count = &n
+    return nil
+}
+
+// listGroups handles GET /groups[?counts=true], the tenant's groups by name,
+// with their member counts if asked
+func listGroups(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    counts := false
+    if v := r.URL.Query().Get("counts"); v != "" {
+        var err error
+        if counts, err = strconv.ParseBool(v); err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "counts must be true or false")
+            return
+        }
+    }
+
+    cursor, err := groupsCollection().Find(r.Context(), scopeFilter(r, bson.M{}),
+        options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve groups")
+        return
+    }
+    groups := []Group{}
+    if err := cursor.All(r.Context(), &groups); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    if counts {
+        for i := range groups {
+            if err := groups[i].count(r); err != nil {
+                writeError(w, http.StatusInternalServerError, codeInternal, "Failed to count group members")
+                return
+            }
+        }
+    }
+
+    json.NewEncoder(w).Encode(groups)
+}
+
+// createGroup handles POST /groups
+func createGroup(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var in groupInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    now := utcNow()
+    g := Group{ID: primitive.NewObjectID(), Tenant: tenantOf(r), CreatedAt: now, UpdatedAt: now}
+    if code, msg := in.applyTo(&g, queryLimitsFor(r)); msg != "" {
+        writeError(w, http.StatusBadRequest, code, msg)
+        return
+    }
+    if in.Parent != nil && !setParent(w, r, &g, *in.Parent) {
+        return
+    }
+
+    count, err := groupsCollection().CountDocuments(r.Context(), scopeFilter(r, bson.M{}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create group")
+        return
+    }
+    if count >= maxGroups {
+        writeErrorWith(w, http.StatusForbidden, codeQuotaExceeded, "Too many groups, delete some first",
+            map[string]any{"max_groups": maxGroups})
+        return
+    }
+
+    _, err = groupsCollection().InsertOne(r.Context(), g)
+    if mongo.IsDuplicateKeyError(err) {
+        writeError(w, http.StatusConflict, codeGroupExists, "A group with this name already exists")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create group")
+        return
+    }
+    recordAudit(r, "group.create", g.ID.Hex(), bson.M{"name": g.Name, "query": g.Query})
+
+    w.Header().Set("Location", "/groups/"+g.ID.Hex())
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(g)
+}
+
+// groupByID loads the caller's group named in /groups/{id}[/contacts|/move]
+func groupByID(w http.ResponseWriter, r *http.Request) (Group, bool) {
+    var g Group
+
+    id := strings.TrimSuffix(strings.TrimSuffix(r.URL.Path[len("/groups/"):], "/contacts"), "/move")
+    objID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid group ID")
+        return g, false
+    }
+
+    err = groupsCollection().FindOne(r.Context(), scopeFilter(r, bson.M{"_id": objID})).Decode(&g)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeGroupNotFound, "Group not found")
+        return g, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return g, false
+    }
+    return g, true
+}
+
+// getGroup handles GET /groups/{id}, with the current member count
+func getGroup(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    g, ok := groupByID(w, r)
+    if !ok {
+        return
+    }
+    if err := g.count(r); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to count group members")
+        return
+    }
+
+    json.NewEncoder(w).Encode(g)
+}
+
+// updateGroup handles PUT /groups/{id}; fields left out of the body are kept
+func updateGroup(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    g, ok := groupByID(w, r)
+    if !ok {
+        return
+    }
+    var in groupInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    if code, msg := in.applyTo(&g, queryLimitsFor(r)); msg != "" {
+        writeError(w, http.StatusBadRequest, code, msg)
+        return
+    }
+    if in.Parent != nil && !setParent(w, r, &g, *in.Parent) {
+        return
+    }
+    g.UpdatedAt = utcNow()
+
+    _, err := groupsCollection().ReplaceOne(r.Context(), bson.M{"_id": g.ID}, g)
+    if mongo.IsDuplicateKeyError(err) {
+        writeError(w, http.StatusConflict, codeGroupExists, "A group with this name already exists")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to update group")
+        return
+    }
+    recordAudit(r, "group.update", g.ID.Hex(), bson.M{"name": g.Name, "query": g.Query})
+
+    json.NewEncoder(w).Encode(g)
+}
+
+// deleteGroup handles DELETE /groups/{id}; the members are left alone and
+// the subgroups move up to the group's parent
+func deleteGroup(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    g, ok := groupByID(w, r)
+    if !ok {
+        return
+    }
+    if _, err := groupsCollection().DeleteOne(r.Context(), bson.M{"_id": g.ID}); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete group")
+        return
+    }
+    reparent := bson.M{"$unset": bson.M{"parent": ""}}
+    if g.Parent != nil {
+        reparent = bson.M{"$set": bson.M{"parent": *g.Parent}}
+    }
+    if _, err := groupsCollection().UpdateMany(r.Context(), scopeFilter(r, bson.M{"parent": g.ID}), reparent); err != nil {
+        logError("failed to move the subgroups of deleted group %s: %v", g.ID.Hex(), err)
+    }
+    recordAudit(r, "group.delete", g.ID.Hex(), nil)
+
+    json.NewEncoder(w).Encode(bson.M{"message": "Group deleted successfully"})
+}
+
+// getGroupContacts handles GET /groups/{id}/contacts[?recursive=true], the
+// group's current members, answered by listContactsMatching. Recursively
+// they are the contacts matching the query of the group or of any group
+// under it.
+func getGroupContacts(w http.ResponseWriter, r *http.Request) {
+    recursive := false
+    if v := r.URL.Query().Get("recursive"); v != "" {
+        var err error
+        if recursive, err = strconv.ParseBool(v); err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "recursive must be true or false")
+            return
+        }
+    }
+    g, ok := groupByID(w, r)
+    if !ok {
+        return
+    }
+    if !recursive {
+        listContactsMatching(w, r, g.Query, g.Sort)
+        return
+    }
+
+    tree, err := loadGroupTree(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve groups")
+        return
+    }
+    var anyOf bson.A
+    for _, sub := range tree.subtree(g.ID) {
+        filter, msg := tree.groups[sub].Query.filter(QueryLimits{})
+        if msg != "" {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Invalid query in group "+sub.Hex())
+            return
+        }
+        anyOf = append(anyOf, filter)
+    }
+    listContactsMatching(w, withContactFilter(r, bson.M{"$or": anyOf}), ContactQuery{}, g.Sort)
+}
+
+// groupTree is a tenant's groups with the subgroups of each
+type groupTree struct {
+    groups   map[primitive.ObjectID]Group
+    children map[primitive.ObjectID][]primitive.ObjectID
+}
+
+// loadGroupTree loads all of the caller's groups, of which there are at most
+// maxGroups
+func loadGroupTree(r *http.Request) (groupTree, error) {
+    tree := groupTree{groups: map[primitive.ObjectID]Group{}, children: map[primitive.ObjectID][]primitive.ObjectID{}}
+    cursor, err := groupsCollection().Find(r.Context(), scopeFilter(r, bson.M{}),
+        options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+    if err != nil {
+        return tree, err
+    }
+    var groups []Group
+    if err := cursor.All(r.Context(), &groups); err != nil {
+        return tree, err
+    }
+    for _, g := range groups {
+        tree.groups[g.ID] = g
+        if g.Parent != nil {
+            tree.children[*g.Parent] = append(tree.children[*g.Parent], g.ID)
+        }
+    }
+    return tree, nil
+}
+
+// subtree lists id and every group under it, level by level
+func (t groupTree) subtree(id primitive.ObjectID) []primitive.ObjectID {
+    ids, _ := t.levels(id)
+    return ids
+}
+
+// height is how many levels the subtree of id has, including id
+func (t groupTree) height(id primitive.ObjectID) int {
+    _, h := t.levels(id)
+    return h
+}
+
+// levels walks the subtree of id breadth first, returning its groups and how
+// many levels it has
+func (t groupTree) levels(id primitive.ObjectID) ([]primitive.ObjectID, int) {
+    ids := []primitive.ObjectID{id}
+    seen := map[primitive.ObjectID]bool{id: true}
+    h := 0
+    for level := ids; len(level) > 0; h++ {
+        var next []primitive.ObjectID
+        for _, g := range level {
+            for _, c := range t.children[g] {
+                if !seen[c] {
+                    seen[c] = true
+                    next = append(next, c)
+                }
+            }
+        }
+        ids = append(ids, next...)
+        level = next
+    }
+    return ids, h
+}
+
+// depth is how many groups there are from the top down to id, including it
+func (t groupTree) depth(id primitive.ObjectID) int {
+    n := 0
+    for n < len(t.groups) {
+        g, ok := t.groups[id]
+        if !ok {
+            break
+        }
+        n++
+        if g.Parent == nil {
+            break
+        }
+        id = *g.Parent
+    }
+    return n
+}
+
+// setParent moves g under the group with ID parent, or to the top if parent
+// is empty, refusing a parent that is g itself or one of its subgroups, since
+// that would make a cycle, and moves nesting deeper than maxGroupDepth. It
+// answers the request itself if g can't be moved.
+func setParent(w http.ResponseWriter, r *http.Request, g *Group, parent string) bool {
+    if parent == "" {
+        g.Parent = nil
+        return true
+    }
+    parentID, err := primitive.ObjectIDFromHex(parent)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid parent group ID")
+        return false
+    }
+    tree, err := loadGroupTree(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve groups")
+        return false
+    }
+    if _, ok := tree.groups[parentID]; !ok {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "The parent group doesn't exist")
+        return false
+    }
+    if slices.Contains(tree.subtree(g.ID), parentID) {
+        writeError(w, http.StatusConflict, codeGroupCycle, "A group can't be moved under itself or one of its subgroups")
+        return false
+    }
+    if tree.depth(parentID)+tree.height(g.ID) > maxGroupDepth {
+        writeErrorWith(w, http.StatusBadRequest, codeValidationFailed, "Groups can't nest this deeply",
+            map[string]any{"max_group_depth": maxGroupDepth})
+        return false
+    }
+    g.Parent = &parentID
+    return true
+}
+
+// moveGroup handles POST /groups/{id}/move with {"parent": "id"}, or a null
+// or empty parent to move the group to the top, along with its subgroups
+func moveGroup(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    g, ok := groupByID(w, r)
+    if !ok {
+        return
+    }
+    var in struct {
+        Parent *string `json:"parent"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    parent := ""
+    if in.Parent != nil {
+        parent = *in.Parent
+    }
+    if !setParent(w, r, &g, parent) {
+        return
+    }
+    g.UpdatedAt = utcNow()
+
+    update := bson.M{"$set": bson.M{"parent": g.Parent, "updated_at": g.UpdatedAt}}
+    if g.Parent == nil {
+        update = bson.M{"$set": bson.M{"updated_at": g.UpdatedAt}, "$unset": bson.M{"parent": ""}}
+    }
+    if _, err := groupsCollection().UpdateOne(r.Context(), bson.M{"_id": g.ID}, update); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to move group")
+        return
+    }
+    recordAudit(r, "group.move", g.ID.Hex(), bson.M{"parent": g.Parent})
+
+    json.NewEncoder(w).Encode(g)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+    "crypto/sha256"
+    "encoding/hex"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// contentETag is a strong validator of a response body; representations of
+// the same contact (JSON, MessagePack, JSON:API, redacted) get different ones
+func contentETag(body []byte) string {
+    sum := sha256.Sum256(body)
+    return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// HandleHead middleware serves HEAD on the /contacts read routes by running
+// them as GET and sending only the headers, and tags GET and HEAD answers with
+// an ETag and Content-Length, so monitors and caches can validate cheaply.
+func HandleHead(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if (r.Method != "GET" && r.Method != "HEAD") || !strings.HasPrefix(r.URL.Path, "/contacts") {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        head := r.Method == "HEAD"
+        if head {
+            r = r.Clone(r.Context())
+            r.Method = "GET"
+        }
+
+        rw := &redactingWriter{ResponseWriter: w}
+        next.ServeHTTP(rw, r)
+        if rw.status == 0 {
+            rw.status = http.StatusOK
+        }
+
+        body := rw.buf.Bytes()
+        if rw.status == http.StatusOK {
+            w.Header().Set("ETag", contentETag(body))
+        }
+        if rw.status != http.StatusNotModified {
+            w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+        }
+        w.WriteHeader(rw.status)
+        if !head {
+            w.Write(body)
+        }
+    })
+}
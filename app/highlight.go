@@ -0,0 +1,89 @@
+package main
+
+import (
+    "net/http"
+    "regexp"
+    "strconv"
+    "unicode/utf16"
+)
+
+// TextRange is a span of a field's text from Start up to End, counted in
+// UTF-16 code units the way JavaScript strings index them
+type TextRange struct {
+    Start int `json:"start"`
+    End   int `json:"end"`
+}
+
+// highlighter finds where the ?name= pattern of a search matched; a nil
+// highlighter finds nothing
+type highlighter struct {
+    name *regexp.Regexp
+}
+
+// highlighterFor reads ?highlight=. It is nil unless highlighting is asked for
+// and there is a ?name= pattern to highlight; an invalid value is answered
+// with a 400.
+func highlighterFor(w http.ResponseWriter, r *http.Request) (*highlighter, bool) {
+    q := r.URL.Query()
+    if q.Get("highlight") == "" {
+        return nil, true
+    }
+    on, err := strconv.ParseBool(q.Get("highlight"))
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "highlight must be true or false")
+        return nil, false
+    }
+    if !on || q.Get("name") == "" {
+        return nil, true
+    }
+    // the pattern has passed checkPattern by the time a contact is highlighted
+    re, err := regexp.Compile("(?i)" + foldPattern(q.Get("name")))
+    if err != nil {
+        return nil, true
+    }
+    return &highlighter{name: re}, true
+}
+
+// apply sets the highlights of c
+func (h *highlighter) apply(c *Contact) {
+    if h == nil {
+        return
+    }
+    if ranges := foldedMatches(h.name, c.Name); len(ranges) > 0 {
+        c.Highlights = map[string][]TextRange{"name": ranges}
+    }
+}
+
+// foldedMatches runs re over text folded by searchKey, as MongoDB matches the
+// stored name_search, and maps the matches back onto text. A match covering
+// part of what a character folded into (one "s" of the "ss" of "ß") covers the
+// whole character.
+func foldedMatches(re *regexp.Regexp, text string) []TextRange {
+    // for each byte of the folded text, the span of the character it came from
+    var folded []byte
+    var spans []TextRange
+    pos := 0
+    for _, c := range text {
+        key := searchKey(string(c))
+        width := utf16.RuneLen(c)
+        for range len(key) {
+            spans = append(spans, TextRange{pos, pos + width})
+        }
+        folded = append(folded, key...)
+        pos += width
+    }
+
+    var ranges []TextRange
+    for _, m := range re.FindAllIndex(folded, -1) {
+        if m[0] == m[1] {
+            continue
+        }
+        span := TextRange{spans[m[0]].Start, spans[m[1]-1].End}
+        if n := len(ranges); n > 0 && span.Start <= ranges[n-1].End {
+            ranges[n-1].End = max(ranges[n-1].End, span.End)
+            continue
+        }
+        ranges = append(ranges, span)
+    }
+    return ranges
+}
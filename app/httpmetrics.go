@@ -0,0 +1,167 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+// routeTemplates are the API's routes: the route labels of the HTTP metrics
+// and, through StrictPaths, the only paths served. "{...}" matches any one path
+// segment and the first match wins, so literal routes come first. Paths
+// matching none are counted as "other" to keep label cardinality bounded.
+var routeTemplates = []string{
+    "/healthz",
+    "/readyz",
+    "/startupz",
+    "/metrics",
+    "/version",
+    "/quota",
+    "/contacts",
+    "/contacts/analytics",
+    "/contacts/analytics/timeseries",
+    "/contacts/batch",
+    "/contacts/bulk",
+    "/contacts/tags/bulk",
+    "/contacts/export",
+    "/contacts/import/json",
+    "/contacts/recent",
+    "/contacts/sync",
+    "/contacts/changes",
+    "/contacts/{id}",
+    "/contacts/{id}/activity",
+    "/contacts/{id}/avatar",
+    "/contacts/{id}/qrcode",
+    "/contacts/{id}/card",
+    "/contacts/{id}/position",
+    "/contacts/{id}/reports",
+    "/contacts/{id}/publish",
+    "/contacts/{id}/watch",
+    "/contacts/{id}/comments",
+    "/contacts/{id}/comments/{comment}",
+    "/contacts/{id}/attachments",
+    "/contacts/{id}/attachments/{attachment}",
+    "/contacts/{id}/consents",
+    "/contacts/{id}/consents/{consent}/revoke",
+    "/contacts/{id}/versions",
+    "/contacts/{id}/versions/{n}/diff",
+    "/contacts/{id}/versions/{n}/restore",
+    "/admin/jobs",
+    "/admin/jobs/{name}/run",
+    "/admin/anomalies",
+    "/admin/anomalies/throttles/{client}",
+    "/admin/retention/rules",
+    "/admin/retention/rules/{id}",
+    "/admin/retention/rules/{id}/dry-run",
+    "/admin/quotas",
+    "/admin/quotas/{scope}/{name}",
+    "/admin/quotas/{scope}/{name}/usage",
+    "/admin/tenants/{tenant}/settings",
+    "/admin/usage",
+    "/admin/export/contacts",
+    "/admin/exports/schedules",
+    "/admin/exports/schedules/{id}",
+    "/admin/exports/schedules/{id}/runs",
+    "/admin/generate",
+    "/admin/replication/conflicts",
+    "/admin/stats",
+    "/jobs",
+    "/jobs/{id}",
+    "/jobs/{id}/cancel",
+    "/jobs/{id}/download",
+    "/jobs/{id}/errors",
+    "/change-requests",
+    "/change-requests/{id}",
+    "/change-requests/{id}/approve",
+    "/change-requests/{id}/reject",
+    "/groups",
+    "/groups/{id}",
+    "/groups/{id}/contacts",
+    "/groups/{id}/move",
+    "/companies",
+    "/companies/{name}/contacts",
+    "/tags",
+    "/tags/merge",
+    "/tags/{tag}",
+    "/suppressions",
+    "/suppressions/check",
+    "/suppressions/{id}",
+    "/consents",
+    "/merge-suggestions",
+    "/lookup/phone/{number}",
+    "/merge-suggestions/{id}/accept",
+    "/merge-suggestions/{id}/dismiss",
+    "/saved-searches",
+    "/saved-searches/{id}",
+    "/saved-searches/{id}/results",
+    "/devices",
+    "/devices/{id}",
+    "/watches",
+    "/feed",
+    "/notification-preferences",
+    "/reminder-preferences",
+    "/uploads",
+    "/uploads/{id}",
+    "/webhooks",
+    "/webhooks/{id}",
+    "/webhooks/{id}/health",
+}
+
+var (
+    httpRequestsTotal   = newCounter("http_requests_total", "HTTP requests by route and status.", "method", "route", "status")
+    httpRequestDuration = newHistogram("http_request_duration_seconds", "HTTP request latency by route.", defaultBuckets, "method", "route")
+)
+
+// routeLabel maps a request path to its route template
+func routeLabel(path string) string {
+    if path != "/" {
+        path = strings.TrimSuffix(path, "/")
+    }
+    segments := strings.Split(path, "/")
+
+    for _, tmpl := range routeTemplates {
+        parts := strings.Split(tmpl, "/")
+        if len(parts) != len(segments) {
+            continue
+        }
+        matched := true
+        for i, p := range parts {
+            if p != segments[i] && !(strings.HasPrefix(p, "{") && segments[i] != "") {
+                matched = false
+                break
+            }
+        }
+        if matched {
+            return tmpl
+        }
+    }
+    return "other"
+}
+
+// InstrumentRequests middleware records request counts and latency per route
+// and stores the route in the request context for logs further down.
+// Latency observations carry the caller's trace ID as an exemplar so a slow
+// bucket in Grafana links to the trace behind it.
+func InstrumentRequests(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        route := routeLabel(r.URL.Path)
+        rec := newStatusRecorder(w)
+        next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), routeKey, route)))
+
+        method := r.Method
+        switch method {
+        case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+        default:
+            method = "OTHER"
+        }
+        var traceID string
+        if tc, ok := traceFrom(r); ok {
+            traceID = tc.TraceID
+        }
+        httpRequestsTotal.Inc(method, route, strconv.Itoa(rec.status))
+        httpRequestDuration.ObserveWithExemplar(time.Since(start).Seconds(), traceID, method, route)
+    })
+}
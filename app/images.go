@@ -0,0 +1,74 @@
+package main
+
+import (
+    "bytes"
+    "image"
+    "image/draw"
+    _ "image/gif"
+    "image/jpeg"
+    "image/png"
+)
+
+// jpegQuality is the quality resized images are encoded with
+const jpegQuality = 85
+
+// fitWithin returns the size of a w×h image scaled down so its longer side is
+// maxSide, keeping its aspect ratio
+func fitWithin(w, h, maxSide int) (int, int) {
+    if w >= h {
+        return maxSide, max(1, h*maxSide/w)
+    }
+    return max(1, w*maxSide/h), maxSide
+}
+
+// resizeImage scales src down to fit within maxSide×maxSide. Each pixel is the
+// average of the source pixels it covers, which keeps downscaled photos from
+// looking grainy the way sampling single pixels does.
+func resizeImage(src image.Image, maxSide int) *image.RGBA {
+    b := src.Bounds()
+    w, h := b.Dx(), b.Dy()
+    dw, dh := fitWithin(w, h, maxSide)
+
+    // RGBA is premultiplied, so averaging it weighs colours by their alpha
+    full := image.NewRGBA(image.Rect(0, 0, w, h))
+    draw.Draw(full, full.Bounds(), src, b.Min, draw.Src)
+
+    dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+    for y := 0; y < dh; y++ {
+        y0 := y * h / dh
+        y1 := max((y+1)*h/dh, y0+1)
+        for x := 0; x < dw; x++ {
+            x0 := x * w / dw
+            x1 := max((x+1)*w/dw, x0+1)
+            var sum [4]int
+            for sy := y0; sy < y1; sy++ {
+                row := full.Pix[sy*full.Stride:]
+                for sx := x0; sx < x1; sx++ {
+                    p := row[sx*4 : sx*4+4]
+                    sum[0] += int(p[0])
+                    sum[1] += int(p[1])
+                    sum[2] += int(p[2])
+                    sum[3] += int(p[3])
+                }
+            }
+            n := (y1 - y0) * (x1 - x0)
+            d := dst.Pix[y*dst.Stride+x*4:]
+            for i := range sum {
+                d[i] = uint8(sum[i] / n)
+            }
+        }
+    }
+    return dst
+}
+
+// encodeImage encodes img as JPEG, or as PNG if it has transparency JPEG
+// can't keep, and returns its content type
+func encodeImage(img *image.RGBA) ([]byte, string, error) {
+    var buf bytes.Buffer
+    if img.Opaque() {
+        err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: jpegQuality})
+        return buf.Bytes(), "image/jpeg", err
+    }
+    err := png.Encode(&buf, img)
+    return buf.Bytes(), "image/png", err
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "slices"
+    "strconv"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const importBatchSize = 500
+
+// ImportResult is the response of an import: a bulk result whose results
+// only list the elements that failed, since imports can be of any size
+type ImportResult struct {
+    BulkResult
+    QuotaExceeded *QuotaUsage `json:"quota_exceeded,omitempty"`
+}
+
+// importCapacity returns how many contacts the caller may still add and the
+// quota that limits it; -1 means no quota applies
+func importCapacity(r *http.Request) (int64, *QuotaUsage, error) {
+    usages, err := callerQuotas(r.Context(), r, true)
+    if err != nil {
+        return 0, nil, err
+    }
+    capacity, limit := int64(-1), (*QuotaUsage)(nil)
+    for i, u := range usages {
+        if !u.Limited {
+            continue
+        }
+        if left := max(u.MaxContacts-u.Used, 0); capacity < 0 || left < capacity {
+            capacity, limit = left, &usages[i]
+        }
+    }
+    return capacity, limit, nil
+}
+
+// importInputError stops an import at input the caller has to fix
+type importInputError struct {
+    msg string
+}
+
+func (e importInputError) Error() string {
+    return e.msg
+}
+
+// importContacts imports the JSON array of contacts in body into the tenant of
+// r. The body is read one element at a time and inserted in batches, so its
+// size doesn't matter; progress, if set, is called after every batch. Invalid
+// elements are skipped and reported; malformed JSON (an importInputError) or a
+// failed insert stops the import, keeping what was inserted so far. Failures
+// are reported in index order.
+func importContacts(r *http.Request, body io.Reader, progress func(ImportResult)) (res ImportResult, err error) {
+    res.Results = []BulkItemResult{}
+    defer func() {
+        slices.SortFunc(res.Results, func(a, b BulkItemResult) int { return a.Index - b.Index })
+    }()
+
+    capacity, quota, err := importCapacity(r)
+    if err != nil {
+        return res, fmt.Errorf("checking quota: %w", err)
+    }
+    settings, err := callerSettings(r)
+    if err != nil {
+        return res, fmt.Errorf("retrieving settings: %w", err)
+    }
+
+    dec := json.NewDecoder(body)
+    if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+        return res, importInputError{"Body must be a JSON array of contacts"}
+    }
+
+    batch := make([]any, 0, importBatchSize)
+    batchIndexes := make([]int, 0, importBatchSize)
+    flush := func() error {
+        if len(batch) == 0 {
+            return nil
+        }
+        phones := make([]string, len(batch))
+        for i, doc := range batch {
+            phones[i] = doc.(bson.M)["phone"].(string)
+        }
+        suppressed, err := suppressedPhones(r, settings, phones...)
+        if err != nil {
+            return err
+        }
+        for i, doc := range batch {
+            if suppressed[phones[i]] {
+                doc.(bson.M)["do_not_contact"] = true
+            }
+        }
+
+        // unordered, so a phone another contact already has only rejects
+        // that element
+        inserted := len(batch)
+        _, err = contactsCollection.InsertMany(r.Context(), batch, options.InsertMany().SetOrdered(false))
+        var bulkErr mongo.BulkWriteException
+        failed := map[int]bool{}
+        if errors.As(err, &bulkErr) {
+            for _, we := range bulkErr.WriteErrors {
+                if !isPhoneConflict(we) {
+                    return err
+                }
+                res.reject(batchIndexes[we.Index], http.StatusConflict, codeDuplicatePhone, "Another contact already has this phone number")
+                failed[we.Index] = true
+                inserted--
+            }
+        } else if err != nil {
+            return err
+        }
+        created := make([]bson.M, 0, inserted)
+        for i, doc := range batch {
+            if !failed[i] {
+                created = append(created, doc.(bson.M))
+            }
+        }
+        recordCreated(r, versionCreate, created...)
+        res.Succeeded += inserted
+        batch, batchIndexes = batch[:0], batchIndexes[:0]
+        if progress != nil {
+            progress(res)
+        }
+        return nil
+    }
+
+    for index := 0; dec.More(); index++ {
+        var in struct {
+            Name         string          `json:"name"`
+            Phone        string          `json:"phone"`
+            Tags         []string        `json:"tags"`
+            Company      string          `json:"company"`
+            JobTitle     string          `json:"job_title"`
+            Website      string          `json:"website"`
+            Social       *SocialProfiles `json:"social"`
+            Dates        []ContactDate   `json:"dates"`
+            DoNotContact bool            `json:"do_not_contact"`
+        }
+        err := dec.Decode(&in)
+        var typeErr *json.UnmarshalTypeError
+        if errors.As(err, &typeErr) {
+            res.reject(index, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("%s has the wrong type", typeErr.Field))
+            continue
+        }
+        if err != nil {
+            if err := flush(); err != nil {
+                return res, err
+            }
+            return res, importInputError{fmt.Sprintf("Malformed JSON after element %d: %v", index, err)}
+        }
+        if in.Name == "" || in.Phone == "" {
+            res.reject(index, http.StatusBadRequest, codeMissingField, "Missing name or phone")
+            continue
+        }
+        website, err := normalizeWebsite(in.Website)
+        if err != nil {
+            res.reject(index, http.StatusBadRequest, codeValidationFailed, err.Error())
+            continue
+        }
+        social, err := normalizeSocial(in.Social)
+        if err != nil {
+            res.reject(index, http.StatusBadRequest, codeValidationFailed, err.Error())
+            continue
+        }
+        dates, err := normalizeDates(in.Dates)
+        if err != nil {
+            res.reject(index, http.StatusBadRequest, codeValidationFailed, err.Error())
+            continue
+        }
+        if capacity >= 0 && int64(res.Succeeded+len(batch)) >= capacity {
+            res.QuotaExceeded = quota
+            res.reject(index, http.StatusForbidden, codeQuotaExceeded, "Contact quota exceeded")
+            continue
+        }
+
+        doc := newContactDoc(r, settings, Contact{Name: in.Name, Phone: in.Phone, Tags: in.Tags, Company: in.Company, JobTitle: in.JobTitle, Website: website, Social: social, Dates: dates, DoNotContact: in.DoNotContact}, utcNow())
+        doc["_id"], doc["short_id"] = primitive.NewObjectID(), newShortID()
+        batch = append(batch, doc)
+        batchIndexes = append(batchIndexes, index)
+        if len(batch) == importBatchSize {
+            if err := flush(); err != nil {
+                return res, err
+            }
+        }
+    }
+    return res, flush()
+}
+
+// importContactsJSON handles POST /contacts/import/json[?async=true|?upload=].
+// Without async the import runs while the client waits; with it, or when
+// importing a resumable upload, the file is imported by an asynchronous job.
+func importContactsJSON(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if async, _ := strconv.ParseBool(r.URL.Query().Get("async")); async || r.URL.Query().Has("upload") {
+        startImportJob(w, r)
+        return
+    }
+
+    res, err := importContacts(r, r.Body, nil)
+    var inputErr importInputError
+    if errors.As(err, &inputErr) {
+        writeErrorWith(w, http.StatusBadRequest, codeInvalidRequestBody, inputErr.msg, map[string]any{"result": res})
+        return
+    }
+    if err != nil {
+        logError("import: stopped after %d contacts: %v", res.Succeeded, err)
+        writeErrorWith(w, http.StatusInternalServerError, codeInternal, "Failed to import contacts", map[string]any{"result": res})
+        return
+    }
+
+    recordAudit(r, "contacts.import", "", bson.M{"imported": res.Succeeded, "rejected": res.Failed})
+    writeBulkResult(w, res)
+}
+
+func init() {
+    registerJobType("import", runImportJob)
+}
+
+// startImportJob handles POST /contacts/import/json?async=true. It stores the
+// upload in GridFS and queues a job importing it. With ?upload={id} it imports
+// a finished resumable upload instead of the body.
+func startImportJob(w http.ResponseWriter, r *http.Request) {
+    job := newAsyncJob(r, "import")
+    if id := r.URL.Query().Get("upload"); id != "" {
+        if takeUpload(w, r, id, &job) {
+            enqueueJob(w, r, job)
+        }
+        return
+    }
+
+    bucket, err := jobFiles(r.Context())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to store import")
+        return
+    }
+    upload, err := bucket.OpenUploadStream(job.ID.Hex() + ".json")
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to store import")
+        return
+    }
+    size, err := io.Copy(upload, r.Body)
+    if err != nil {
+        upload.Abort()
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Failed to read the upload")
+        return
+    }
+    if err := upload.Close(); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to store import")
+        return
+    }
+    job.InputFile, job.InputSize = upload.FileID.(primitive.ObjectID), size
+    enqueueJob(w, r, job)
+}
+
+// runImportJob imports a stored upload, recording progress after every batch.
+// The failed elements, if any, are kept as the job's error report.
+func runImportJob(ctx context.Context, job *AsyncJob) error {
+    bucket, err := jobFiles(ctx)
+    if err != nil {
+        return err
+    }
+    input, err := openJobInput(bucket, job)
+    if err != nil {
+        return err
+    }
+    body := &countingReader{ReadCloser: input}
+    defer body.Close()
+    record := func(res ImportResult) {
+        job.Progress = JobProgress{
+            Processed: res.Succeeded + res.Failed,
+            Succeeded: res.Succeeded,
+            Failed:    res.Failed,
+            BytesRead: body.n,
+        }
+        if job.InputSize > 0 {
+            job.Progress.Percent = int(body.n * 100 / job.InputSize)
+        }
+    }
+
+    r := jobRequest(ctx, job)
+    res, err := importContacts(r, body, func(res ImportResult) {
+        record(res)
+        job.saveProgress(ctx)
+    })
+    record(res)
+
+    if len(res.Results) > 0 {
+        report, _ := json.Marshal(res.Results)
+        if id, err := bucket.UploadFromStream(job.ID.Hex()+"-errors.json", bytes.NewReader(report)); err == nil {
+            job.ReportFile = &id
+        } else {
+            logError("job %s: failed to store its error report: %v", job.ID.Hex(), err)
+        }
+    }
+    recordAudit(r, "contacts.import", "", bson.M{"imported": res.Succeeded, "rejected": res.Failed, "job": job.ID.Hex()})
+    return err
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "sort"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// indexWaitInterval is how often a replica waiting for another one's index
+// bootstrap checks whether it has finished
+const indexWaitInterval = time.Second
+
+// requiredIndexes are the indexes the service's queries rely on, by collection
+var requiredIndexes = map[string][]mongo.IndexModel{
+    "contacts": {
+        // listing, retention and tenant quotas
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "updated_at", Value: -1}}},
+        // per-key quotas
+        {Keys: bson.D{{Key: "owner", Value: 1}}},
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "tags", Value: 1}}},
+        // GET /companies and ?company=
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "company", Value: 1}}},
+        // GET /contacts/{id}/reports and clearing the reports of deleted contacts
+        {Keys: bson.D{{Key: "reports_to", Value: 1}}},
+        // ?sort=manual and moving contacts
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "pinned", Value: -1}, {Key: "rank", Value: 1}}},
+        // short IDs in URLs; contacts from before short IDs have none until backfilled
+        {Keys: bson.D{{Key: "short_id", Value: 1}}, Options: options.Index().SetUnique(true).
+            SetPartialFilterExpression(bson.M{"short_id": bson.M{"$exists": true}})},
+        // one contact per phone and tenant; older contacts take part once backfilled
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "phone_normalized", Value: 1}}, Options: options.Index().SetUnique(true).
+            SetPartialFilterExpression(bson.M{"phone_normalized": bson.M{"$exists": true}})},
+        // the avatar sweep
+        {Keys: bson.D{{Key: "avatar.file", Value: 1}}, Options: options.Index().SetSparse(true)},
+    },
+    "audit_log": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "at", Value: -1}}},
+        // deletions in the growth time series
+        {Keys: bson.D{{Key: "action", Value: 1}, {Key: "at", Value: -1}}},
+        // contact activity timelines
+        {Keys: bson.D{{Key: "target", Value: 1}, {Key: "_id", Value: -1}}},
+    },
+    "causal_tokens": {
+        {Keys: bson.D{{Key: "at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(causalTokenTTL.Seconds()))},
+    },
+    "change_requests": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "created_at", Value: -1}}},
+    },
+    "contact_versions": {
+        {Keys: bson.D{{Key: "contact_id", Value: 1}, {Key: "version", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "_id", Value: 1}}},
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "at", Value: 1}}},
+    },
+    "push_devices": {
+        {Keys: bson.D{{Key: "platform", Value: 1}, {Key: "token", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "owner", Value: 1}}},
+    },
+    "contact_watches": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "owner", Value: 1}, {Key: "contact_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "contact_id", Value: 1}}},
+    },
+    "notification_preferences": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "owner", Value: 1}}, Options: options.Index().SetUnique(true)},
+    },
+    "suppressions": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "type", Value: 1}, {Key: "value", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "_id", Value: -1}}},
+    },
+    "merge_decisions": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "pair", Value: 1}}},
+    },
+    "reminder_preferences": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "owner", Value: 1}}, Options: options.Index().SetUnique(true)},
+        {Keys: bson.D{{Key: "enabled", Value: 1}}},
+    },
+    "reminder_deliveries": {
+        {Keys: bson.D{{Key: "claimed_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(reminderRetention.Seconds()))},
+    },
+    "contact_comments": {
+        {Keys: bson.D{{Key: "contact_id", Value: 1}, {Key: "_id", Value: -1}}},
+    },
+    "contact_attachments": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "contact_id", Value: 1}}},
+        // storage quotas
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "size", Value: 1}}},
+    },
+    "contact_consents": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "contact_id", Value: 1}, {Key: "purpose", Value: 1}}},
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "purpose", Value: 1}, {Key: "revoked_at", Value: 1}, {Key: "_id", Value: -1}}},
+    },
+    "contact_views": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "viewer", Value: 1}, {Key: "viewed_at", Value: -1}}},
+        {Keys: bson.D{{Key: "viewed_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(recentViewRetention.Seconds()))},
+    },
+    "groups": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+    },
+    "jobs": {
+        // claiming the oldest queued job and sweeping abandoned ones
+        {Keys: bson.D{{Key: "status", Value: 1}, {Key: "created_at", Value: 1}}},
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "created_at", Value: -1}}},
+        {Keys: bson.D{{Key: "finished_at", Value: 1}}},
+    },
+    "replication_conflicts": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "detected_at", Value: -1}, {Key: "_id", Value: -1}}},
+        {Keys: bson.D{{Key: "detected_at", Value: -1}, {Key: "_id", Value: -1}}},
+    },
+    "replication_writes": {
+        {Keys: bson.D{{Key: "logged_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(int32(replicationLogRetention.Seconds()))},
+    },
+    "saved_searches": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "owner", Value: 1}, {Key: "name", Value: 1}}, Options: options.Index().SetUnique(true)},
+    },
+    "uploads": {
+        {Keys: bson.D{{Key: "expires_at", Value: 1}}},
+    },
+    "usage": {
+        {Keys: bson.D{{Key: "day", Value: 1}, {Key: "tenant", Value: 1}}},
+    },
+    "used_signatures": {
+        {Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+    },
+    "webhooks": {
+        {Keys: bson.D{{Key: "tenant", Value: 1}, {Key: "events", Value: 1}}},
+    },
+}
+
+// indexSpecVersion fingerprints requiredIndexes and the data regions, so a
+// deploy that changes them bootstraps again while one that doesn't skips
+// straight past
+func indexSpecVersion() string {
+    names := make([]string, 0, len(requiredIndexes))
+    for name := range requiredIndexes {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    h := sha256.New()
+    for _, name := range names {
+        for _, m := range requiredIndexes[name] {
+            fmt.Fprintf(h, "%s %v", name, m.Keys)
+            if m.Options != nil && m.Options.ExpireAfterSeconds != nil {
+                fmt.Fprintf(h, " ttl=%d", *m.Options.ExpireAfterSeconds)
+            }
+            fmt.Fprintln(h)
+        }
+    }
+    if len(regionDatabases) > 1 {
+        fmt.Fprintln(h, "regions", dataRegions())
+    }
+    return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// ensureIndexes creates any missing required index in every region; existing
+// ones are left alone
+func ensureIndexes(ctx context.Context) error {
+    return forEachRegion(ctx, func(ctx context.Context) error {
+        for name, models := range requiredIndexes {
+            if _, err := collectionOf(name).in(ctx).Indexes().CreateMany(ctx, models); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// bootstrapIndexes makes sure the required indexes exist without every replica
+// of a deploy issuing the same createIndexes at once. The replica holding the
+// "index-bootstrap" lease runs ensureIndexes and records the spec version in
+// the schema collection; the others wait for that record. If the holder dies,
+// its lease expires and a waiting replica takes over.
+func bootstrapIndexes(ctx context.Context) error {
+    version := indexSpecVersion()
+    lock := newLeaderElector(mongoDB, "index-bootstrap", leaseDurationFromEnv())
+    schema := sharedCollectionOf("schema")
+
+    waiting := false
+    for {
+        var applied struct {
+            Version string `bson:"version"`
+        }
+        err := schema.FindOne(ctx, bson.M{"_id": "indexes"}).Decode(&applied)
+        if err != nil && err != mongo.ErrNoDocuments {
+            return err
+        }
+        if applied.Version == version {
+            return nil
+        }
+
+        acquired, err := lock.tryAcquire(ctx)
+        if err != nil {
+            return err
+        }
+        if acquired {
+            break
+        }
+        if !waiting {
+            logInfo("waiting for another replica to bootstrap indexes")
+            waiting = true
+        }
+        select {
+        case <-ctx.Done():
+            return ctx.Err()
+        case <-time.After(indexWaitInterval):
+        }
+    }
+
+    // keep renewing the lease while indexes build, and release it afterwards
+    lock.leading.Store(true)
+    lockCtx, unlock := context.WithCancel(ctx)
+    defer unlock()
+    go lock.Run(lockCtx)
+
+    start := time.Now()
+    if err := ensureIndexes(ctx); err != nil {
+        return err
+    }
+    _, err := schema.UpdateOne(ctx, bson.M{"_id": "indexes"}, bson.M{"$set": bson.M{
+        "version":    version,
+        "applied_by": lock.identity,
+        "applied_at": utcNow(),
+    }}, options.Update().SetUpsert(true))
+    if err != nil {
+        return err
+    }
+    logInfo("bootstrapped indexes (version %s) in %s", version, time.Since(start).Round(time.Millisecond))
+    return nil
+}
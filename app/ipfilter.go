@@ -0,0 +1,127 @@
+package main
+
+import (
+    "fmt"
+    "net"
+    "net/http"
+    "net/netip"
+    "strings"
+)
+
+// IPFilterConfig restricts which client addresses may call the service.
+// Entries are CIDRs or single addresses; an empty allow list allows everyone.
+type IPFilterConfig struct {
+    Allow          []string `json:"allow"`
+    Deny           []string `json:"deny"`
+    TrustedProxies []string `json:"trusted_proxies"`
+
+    allow, deny, proxies []netip.Prefix
+}
+
+// parse validates the lists and caches them as prefixes
+func (c *IPFilterConfig) parse() error {
+    var err error
+    if c.allow, err = parsePrefixes(c.Allow); err != nil {
+        return fmt.Errorf("ip_filter.allow: %w", err)
+    }
+    if c.deny, err = parsePrefixes(c.Deny); err != nil {
+        return fmt.Errorf("ip_filter.deny: %w", err)
+    }
+    if c.proxies, err = parsePrefixes(c.TrustedProxies); err != nil {
+        return fmt.Errorf("ip_filter.trusted_proxies: %w", err)
+    }
+    return nil
+}
+
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+    prefixes := make([]netip.Prefix, 0, len(entries))
+    for _, e := range entries {
+        if strings.Contains(e, "/") {
+            p, err := netip.ParsePrefix(e)
+            if err != nil {
+                return nil, err
+            }
+            prefixes = append(prefixes, p.Masked())
+            continue
+        }
+        addr, err := netip.ParseAddr(e)
+        if err != nil {
+            return nil, err
+        }
+        prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+    }
+    return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+    for _, p := range prefixes {
+        if p.Contains(addr) {
+            return true
+        }
+    }
+    return false
+}
+
+// clientIP returns the address of the caller. When the direct peer is a trusted
+// proxy, X-Forwarded-For is walked from the right and the first address that is
+// not itself a trusted proxy is used.
+func clientIP(r *http.Request) string {
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+
+    proxies := currentConfig().IPFilter.proxies
+    peer, err := netip.ParseAddr(host)
+    if err != nil || !containsAddr(proxies, peer.Unmap()) {
+        return host
+    }
+
+    hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+    for i := len(hops) - 1; i >= 0; i-- {
+        hop := strings.TrimSpace(hops[i])
+        addr, err := netip.ParseAddr(hop)
+        if err != nil {
+            break
+        }
+        if !containsAddr(proxies, addr.Unmap()) {
+            return addr.Unmap().String()
+        }
+        host = hop
+    }
+    return host
+}
+
+// ipAllowed applies the deny list first, then the allow list
+func ipAllowed(ip string) bool {
+    filter := currentConfig().IPFilter
+    if len(filter.allow) == 0 && len(filter.deny) == 0 {
+        return true
+    }
+
+    addr, err := netip.ParseAddr(ip)
+    if err != nil {
+        return false
+    }
+    addr = addr.Unmap()
+
+    if containsAddr(filter.deny, addr) {
+        return false
+    }
+    return len(filter.allow) == 0 || containsAddr(filter.allow, addr)
+}
+
+// FilterIPs middleware rejects callers outside the configured ranges.
+// The probe endpoints stay open so kubelet probes keep working.
+func FilterIPs(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !isProbePath(r.URL.Path) && !ipAllowed(clientIP(r)) {
+            logDebug("rejected request from %s by ip_filter", clientIP(r))
+            w.Header().Set("Content-Type", "application/json")
+            writeError(w, http.StatusForbidden, codeForbidden, "Forbidden")
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
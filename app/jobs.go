@@ -0,0 +1,577 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/gridfs"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Statuses of an AsyncJob
+const (
+    jobQueued    = "queued"
+    jobRunning   = "running"
+    jobSucceeded = "succeeded"
+    jobFailed    = "failed"
+    jobCancelled = "cancelled"
+)
+
+const (
+    asyncJobWorkers = 2
+    // asyncJobLease is how long a worker holds a job without renewing; a job
+    // whose lease ran out was left behind by a replica that stopped
+    asyncJobLease        = time.Minute
+    asyncJobPollInterval = 5 * time.Second
+    // asyncJobRetention is how long finished jobs and their files are kept
+    asyncJobRetention = 7 * 24 * time.Hour
+    // asyncJobsListed caps GET /jobs
+    asyncJobsListed = 50
+)
+
+// JobProgress is how far an AsyncJob has got
+type JobProgress struct {
+    Percent   int   `bson:"percent" json:"percent"`
+    Processed int   `bson:"processed" json:"processed"`
+    Succeeded int   `bson:"succeeded" json:"succeeded"`
+    Failed    int   `bson:"failed" json:"failed"`
+    BytesRead int64 `bson:"bytes_read" json:"-"`
+}
+
+// AsyncJob is work a client started that outlives its request, such as an
+// import of a large file. Jobs are queued in the jobs collection and run by
+// the workers of any replica. Unlike the scheduler's jobs they belong to a
+// tenant and run with the principal that started them.
+type AsyncJob struct {
+    ID              primitive.ObjectID   `bson:"_id" json:"id"`
+    Type            string               `bson:"type" json:"type"`
+    Status          string               `bson:"status" json:"status"`
+    Tenant          string               `bson:"tenant" json:"-"`
+    Principal       Principal            `bson:"principal" json:"-"`
+    Progress        JobProgress          `bson:"progress" json:"progress"`
+    InputFile       primitive.ObjectID   `bson:"input_file,omitempty" json:"-"`
+    InputParts      []primitive.ObjectID `bson:"input_parts,omitempty" json:"-"`
+    InputSize       int64                `bson:"input_size,omitempty" json:"-"`
+    ReportFile      *primitive.ObjectID  `bson:"report_file,omitempty" json:"-"`
+    ReportURL       string               `bson:"-" json:"error_report_url,omitempty"`
+    Export          *ExportJobParams     `bson:"export,omitempty" json:"export,omitempty"`
+    ResultFile      *primitive.ObjectID  `bson:"result_file,omitempty" json:"-"`
+    DownloadURL     string               `bson:"-" json:"download_url,omitempty"`
+    DownloadExpires *time.Time           `bson:"-" json:"download_expires_at,omitempty"`
+    Error           string               `bson:"error,omitempty" json:"error,omitempty"`
+    CancelRequested bool                 `bson:"cancel_requested,omitempty" json:"cancel_requested,omitempty"`
+    Worker          string               `bson:"worker,omitempty" json:"-"`
+    LeaseUntil      *time.Time           `bson:"lease_until,omitempty" json:"-"`
+    CreatedAt       time.Time            `bson:"created_at" json:"created_at"`
+    StartedAt       *time.Time           `bson:"started_at,omitempty" json:"started_at,omitempty"`
+    FinishedAt      *time.Time           `bson:"finished_at,omitempty" json:"finished_at,omitempty"`
+}
+
+// jobRunner does the work of a job type. It keeps job.Progress current (saved
+// with job.saveProgress) and must stop when ctx is cancelled.
+type jobRunner func(ctx context.Context, job *AsyncJob) error
+
+var (
+    jobTypes = map[string]jobRunner{}
+    // jobWake nudges idle workers when this replica queues a job
+    jobWake = make(chan struct{}, asyncJobWorkers)
+
+    asyncJobsTotal = newCounter("async_jobs_total", "Asynchronous jobs finished by type and status.", "type", "status")
+)
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:      "async-job-sweep",
+        Schedule:  "@every 1m",
+        Singleton: true,
+        Run:       sweepAsyncJobs,
+    })
+}
+
+// registerJobType makes jobs of type name runnable; it is called from init
+func registerJobType(name string, run jobRunner) {
+    jobTypes[name] = run
+}
+
+func asyncJobsCollection() collection {
+    return collectionOf("jobs")
+}
+
+// jobFiles is the GridFS bucket holding job inputs and results. A new bucket
+// is made per use since deadlines are set on the bucket.
+func jobFiles(ctx context.Context) (*gridfs.Bucket, error) {
+    return gridfs.NewBucket(databaseFor(ctx), options.GridFSBucket().SetName("job_files"))
+}
+
+// newAsyncJob is a job of jobType for the caller, not yet queued
+func newAsyncJob(r *http.Request, jobType string) AsyncJob {
+    return AsyncJob{
+        ID:        primitive.NewObjectID(),
+        Type:      jobType,
+        Status:    jobQueued,
+        Tenant:    tenantOf(r),
+        Principal: principalFrom(r),
+        CreatedAt: utcNow(),
+    }
+}
+
+// enqueueJob queues job and answers 202 with it, and its URL in Location
+func enqueueJob(w http.ResponseWriter, r *http.Request, job AsyncJob) {
+    if _, err := asyncJobsCollection().InsertOne(r.Context(), job); err != nil {
+        deleteJobFiles(r.Context(), job.inputFiles()...)
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create job")
+        return
+    }
+    recordAudit(r, "job.create", job.ID.Hex(), bson.M{"type": job.Type})
+    select {
+    case jobWake <- struct{}{}:
+    default:
+    }
+
+    w.Header().Set("Location", "/jobs/"+job.ID.Hex())
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(job)
+}
+
+// jobRequest is a request carrying the principal that started job, so the
+// request-scoped helpers (tenants, quotas, audit entries, events) work the
+// same in the background
+func jobRequest(ctx context.Context, job *AsyncJob) *http.Request {
+    ctx = withEndpoint(context.WithValue(ctx, principalKey, job.Principal), "job:"+job.Type)
+    r, _ := http.NewRequestWithContext(ctx, "POST", "/jobs/"+job.ID.Hex(), nil)
+    return r
+}
+
+// saveProgress records job.Progress
+func (job *AsyncJob) saveProgress(ctx context.Context) {
+    _, err := asyncJobsCollection().UpdateOne(ctx, bson.M{"_id": job.ID}, bson.M{"$set": bson.M{"progress": job.Progress}})
+    if err != nil {
+        logWarn("job %s: failed to record progress: %v", job.ID.Hex(), err)
+    }
+}
+
+// startAsyncJobWorkers starts the goroutines that run queued jobs until ctx
+// is done. Jobs are queued in their tenant's region, so workers take turns
+// at the regions' queues.
+func startAsyncJobWorkers(ctx context.Context) {
+    for i := 0; i < asyncJobWorkers; i++ {
+        go func() {
+            ticker := time.NewTicker(asyncJobPollInterval)
+            defer ticker.Stop()
+            for {
+                for _, region := range dataRegions() {
+                    regionCtx := withRegion(ctx, region)
+                    for ctx.Err() == nil {
+                        job, err := claimAsyncJob(regionCtx)
+                        if err != nil {
+                            if err != mongo.ErrNoDocuments && ctx.Err() == nil {
+                                logError("failed to claim a job in region %s: %v", region, err)
+                            }
+                            break
+                        }
+                        runAsyncJob(regionCtx, job)
+                    }
+                }
+                select {
+                case <-ctx.Done():
+                    return
+                case <-ticker.C:
+                case <-jobWake:
+                }
+            }
+        }()
+    }
+}
+
+// claimAsyncJob takes the oldest queued job of a type this replica knows
+func claimAsyncJob(ctx context.Context) (*AsyncJob, error) {
+    types := make([]string, 0, len(jobTypes))
+    for t := range jobTypes {
+        types = append(types, t)
+    }
+    now := utcNow()
+    var job AsyncJob
+    err := asyncJobsCollection().FindOneAndUpdate(ctx,
+        bson.M{"status": jobQueued, "type": bson.M{"$in": types}},
+        bson.M{"$set": bson.M{"status": jobRunning, "worker": leader.identity, "started_at": now, "lease_until": now.Add(asyncJobLease)}},
+        options.FindOneAndUpdate().SetSort(bson.D{{Key: "created_at", Value: 1}}).SetReturnDocument(options.After),
+    ).Decode(&job)
+    return &job, err
+}
+
+// runAsyncJob runs a claimed job, renewing its lease meanwhile and stopping
+// it when a client cancels it, and records how it ended
+func runAsyncJob(ctx context.Context, job *AsyncJob) {
+    jobCtx, cancel := context.WithCancel(ctx)
+    defer cancel()
+    var cancelled atomic.Bool
+    done := make(chan struct{})
+    go func() {
+        ticker := time.NewTicker(asyncJobLease / 3)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-done:
+                return
+            case <-ticker.C:
+            }
+            var current AsyncJob
+            err := asyncJobsCollection().FindOneAndUpdate(jobCtx,
+                bson.M{"_id": job.ID, "worker": leader.identity},
+                bson.M{"$set": bson.M{"lease_until": utcNow().Add(asyncJobLease)}},
+                options.FindOneAndUpdate().SetProjection(bson.M{"cancel_requested": 1}),
+            ).Decode(&current)
+            if err != nil {
+                logWarn("job %s: failed to renew its lease: %v", job.ID.Hex(), err)
+                continue
+            }
+            if current.CancelRequested {
+                cancelled.Store(true)
+                cancel()
+                return
+            }
+        }
+    }()
+
+    logInfo("job %s (%s) started", job.ID.Hex(), job.Type)
+    err := runJobSafely(jobCtx, func(ctx context.Context) error {
+        return jobTypes[job.Type](ctx, job)
+    })
+    close(done)
+
+    status := jobSucceeded
+    switch {
+    case cancelled.Load():
+        status, err = jobCancelled, nil
+    case ctx.Err() != nil:
+        status, err = jobFailed, errors.New("interrupted by a shutdown")
+    case err != nil:
+        status = jobFailed
+    default:
+        job.Progress.Percent = 100
+    }
+    // the outcome is recorded even when shutting down
+    finishAsyncJob(context.WithoutCancel(ctx), job, status, err)
+}
+
+// finishAsyncJob records how job ended, with err if it failed, and deletes
+// its input
+func finishAsyncJob(ctx context.Context, job *AsyncJob, status string, err error) {
+    now := utcNow()
+    job.Status, job.FinishedAt = status, &now
+    set := bson.M{"status": status, "progress": job.Progress, "finished_at": now}
+    if job.ReportFile != nil {
+        set["report_file"] = job.ReportFile
+    }
+    if job.ResultFile != nil {
+        set["result_file"] = job.ResultFile
+    }
+    if err != nil {
+        job.Error = err.Error()
+        set["error"] = job.Error
+        logError("job %s (%s) failed: %v", job.ID.Hex(), job.Type, err)
+    } else {
+        logInfo("job %s (%s) %s", job.ID.Hex(), job.Type, status)
+    }
+    _, updateErr := asyncJobsCollection().UpdateOne(ctx, bson.M{"_id": job.ID},
+        bson.M{"$set": set, "$unset": bson.M{"worker": "", "lease_until": ""}})
+    if updateErr != nil {
+        logError("job %s: failed to record its outcome: %v", job.ID.Hex(), updateErr)
+    }
+    asyncJobsTotal.Inc(job.Type, status)
+    deleteJobFiles(ctx, job.inputFiles()...)
+}
+
+// inputFiles are the files the job was started with: one, or the chunks of a
+// resumable upload
+func (job *AsyncJob) inputFiles() []primitive.ObjectID {
+    return append([]primitive.ObjectID{job.InputFile}, job.InputParts...)
+}
+
+// deleteJobFiles deletes files of jobs, skipping unset IDs
+func deleteJobFiles(ctx context.Context, ids ...primitive.ObjectID) {
+    bucket, err := jobFiles(ctx)
+    if err != nil {
+        return
+    }
+    for _, id := range ids {
+        if id.IsZero() {
+            continue
+        }
+        if err := bucket.DeleteContext(ctx, id); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+            logWarn("failed to delete job file %s: %v", id.Hex(), err)
+        }
+    }
+}
+
+// sweepAsyncJobs fails jobs whose worker stopped renewing their lease, rather
+// than running them again, since work such as an import can't safely be
+// repeated, and deletes finished jobs and their files after asyncJobRetention
+func sweepAsyncJobs(ctx context.Context) error {
+    var abandoned []AsyncJob
+    cursor, err := asyncJobsCollection().Find(ctx, bson.M{"status": jobRunning, "lease_until": bson.M{"$lt": utcNow()}})
+    if err != nil {
+        return err
+    }
+    if err := cursor.All(ctx, &abandoned); err != nil {
+        return err
+    }
+    for i := range abandoned {
+        logWarn("job %s (%s) was abandoned by %s", abandoned[i].ID.Hex(), abandoned[i].Type, abandoned[i].Worker)
+        finishAsyncJob(ctx, &abandoned[i], jobFailed, errors.New("interrupted: the replica running it stopped"))
+    }
+
+    var expired []AsyncJob
+    cursor, err = asyncJobsCollection().Find(ctx, bson.M{"finished_at": bson.M{"$lt": utcNow().Add(-asyncJobRetention)}},
+        options.Find().SetProjection(bson.M{"_id": 1, "input_file": 1, "input_parts": 1, "report_file": 1, "result_file": 1}))
+    if err != nil {
+        return err
+    }
+    if err := cursor.All(ctx, &expired); err != nil {
+        return err
+    }
+    for _, job := range expired {
+        files := job.inputFiles()
+        for _, f := range []*primitive.ObjectID{job.ReportFile, job.ResultFile} {
+            if f != nil {
+                files = append(files, *f)
+            }
+        }
+        deleteJobFiles(ctx, files...)
+        if _, err := asyncJobsCollection().DeleteOne(ctx, bson.M{"_id": job.ID}); err != nil {
+            return err
+        }
+    }
+    if len(expired) > 0 {
+        logInfo("async-job-sweep: deleted %d finished jobs", len(expired))
+    }
+    return nil
+}
+
+// jobByID loads the job in /jobs/{id}[/...] of the caller's tenant, answering
+// the request itself if there is none
+func jobByID(w http.ResponseWriter, r *http.Request) (AsyncJob, bool) {
+    var job AsyncJob
+    id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+    objID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid job ID")
+        return job, false
+    }
+    err = asyncJobsCollection().FindOne(r.Context(), bson.M{"_id": objID, "tenant": tenantOf(r)}).Decode(&job)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeJobNotFound, "Job not found")
+        return job, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve job")
+        return job, false
+    }
+    job.setLinks()
+    return job, true
+}
+
+// setLinks fills in the URLs of the job's results. The download URL is signed
+// afresh each time, if signed URLs are enabled, so it can be handed to
+// clients without the API key.
+func (job *AsyncJob) setLinks() {
+    if job.ReportFile != nil {
+        job.ReportURL = "/jobs/" + job.ID.Hex() + "/errors"
+    }
+    if job.ResultFile != nil {
+        job.DownloadURL = "/jobs/" + job.ID.Hex() + "/download"
+        if signed, expires, ok := signURL(job.DownloadURL); ok {
+            job.DownloadURL, job.DownloadExpires = signed, &expires
+        }
+    }
+}
+
+// listAsyncJobs handles GET /jobs[?status=&type=&limit=], the jobs of the
+// caller's tenant, newest first
+func listAsyncJobs(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    q := r.URL.Query()
+    filter := bson.M{"tenant": tenantOf(r)}
+    if status := q.Get("status"); status != "" {
+        filter["status"] = status
+    }
+    if jobType := q.Get("type"); jobType != "" {
+        filter["type"] = jobType
+    }
+    limit := asyncJobsListed
+    if v := q.Get("limit"); v != "" {
+        n, err := strconv.Atoi(v)
+        if err != nil || n < 1 || n > asyncJobsListed {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, fmt.Sprintf("limit must be between 1 and %d", asyncJobsListed))
+            return
+        }
+        limit = n
+    }
+
+    cursor, err := asyncJobsCollection().Find(r.Context(), filter,
+        options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(int64(limit)))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve jobs")
+        return
+    }
+    jobs := []AsyncJob{}
+    if err := cursor.All(r.Context(), &jobs); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    for i := range jobs {
+        jobs[i].setLinks()
+    }
+
+    json.NewEncoder(w).Encode(bson.M{"jobs": jobs})
+}
+
+// getAsyncJob handles GET /jobs/{id}
+func getAsyncJob(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if job, ok := jobByID(w, r); ok {
+        json.NewEncoder(w).Encode(job)
+    }
+}
+
+// cancelAsyncJob handles POST /jobs/{id}/cancel. A queued job is cancelled at
+// once (200); a running one is stopped by its worker within a third of the
+// lease, keeping the work already done, so the answer is 202.
+func cancelAsyncJob(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    job, ok := jobByID(w, r)
+    if !ok {
+        return
+    }
+
+    var updated AsyncJob
+    status := http.StatusOK
+    err := asyncJobsCollection().FindOneAndUpdate(r.Context(),
+        bson.M{"_id": job.ID, "status": jobQueued},
+        bson.M{"$set": bson.M{"status": jobCancelled, "finished_at": utcNow()}},
+        options.FindOneAndUpdate().SetReturnDocument(options.After),
+    ).Decode(&updated)
+    if err == nil {
+        asyncJobsTotal.Inc(updated.Type, jobCancelled)
+        deleteJobFiles(r.Context(), updated.InputFile)
+    } else if err == mongo.ErrNoDocuments {
+        status = http.StatusAccepted
+        err = asyncJobsCollection().FindOneAndUpdate(r.Context(),
+            bson.M{"_id": job.ID, "status": jobRunning},
+            bson.M{"$set": bson.M{"cancel_requested": true}},
+            options.FindOneAndUpdate().SetReturnDocument(options.After),
+        ).Decode(&updated)
+    }
+    if err == mongo.ErrNoDocuments {
+        writeErrorWith(w, http.StatusConflict, codeJobFinished, "The job has already finished", map[string]any{"status": job.Status})
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to cancel job")
+        return
+    }
+    recordAudit(r, "job.cancel", job.ID.Hex(), bson.M{"type": job.Type})
+
+    updated.setLinks()
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(updated)
+}
+
+// downloadJobResult handles GET /jobs/{id}/download, the file a job such as
+// an export produced. Signed URLs need no API key.
+func downloadJobResult(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var job AsyncJob
+    if validSignedURL(r) {
+        id, _ := primitive.ObjectIDFromHex(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/download"))
+        err := asyncJobsCollection().FindOne(r.Context(), bson.M{"_id": id}).Decode(&job)
+        if err == mongo.ErrNoDocuments {
+            writeError(w, http.StatusNotFound, codeJobNotFound, "Job not found")
+            return
+        }
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve job")
+            return
+        }
+    } else {
+        var ok bool
+        if job, ok = jobByID(w, r); !ok {
+            return
+        }
+    }
+    if job.ResultFile == nil {
+        writeError(w, http.StatusNotFound, codeJobNotFound, "The job has no result to download")
+        return
+    }
+    bucket, err := jobFiles(r.Context())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve the result")
+        return
+    }
+    result, err := bucket.OpenDownloadStream(*job.ResultFile)
+    if errors.Is(err, gridfs.ErrFileNotFound) {
+        writeError(w, http.StatusNotFound, codeJobNotFound, "The job has no result to download")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve the result")
+        return
+    }
+    defer result.Close()
+
+    w.Header().Set("Content-Type", "application/octet-stream")
+    if job.Export != nil {
+        w.Header().Set("Content-Type", exportContentType(job.Export.Format))
+    }
+    w.Header().Set("Content-Length", strconv.FormatInt(result.GetFile().Length, 10))
+    w.Header().Set("Content-Disposition", `attachment; filename="`+result.GetFile().Name+`"`)
+    io.Copy(w, result)
+}
+
+// getJobErrors handles GET /jobs/{id}/errors, the failed elements of a
+// finished job as a JSON array of bulk item results
+func getJobErrors(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    job, ok := jobByID(w, r)
+    if !ok {
+        return
+    }
+    if job.ReportFile == nil {
+        writeError(w, http.StatusNotFound, codeJobNotFound, "The job has no error report")
+        return
+    }
+    bucket, err := jobFiles(r.Context())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve error report")
+        return
+    }
+    report, err := bucket.OpenDownloadStream(*job.ReportFile)
+    if errors.Is(err, gridfs.ErrFileNotFound) {
+        writeError(w, http.StatusNotFound, codeJobNotFound, "The job has no error report")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve error report")
+        return
+    }
+    defer report.Close()
+
+    w.Header().Set("Content-Disposition", `attachment; filename="`+job.ID.Hex()+`-errors.json"`)
+    io.Copy(w, report)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "io"
+    "mime"
+    "net/http"
+    "strconv"
+    "strings"
+)
+
+// jsonAPIContentType is negotiated with Accept: application/vnd.api+json
+const jsonAPIContentType = "application/vnd.api+json"
+
+// wantsJSONAPI reports whether the caller asked for JSON:API documents
+func wantsJSONAPI(r *http.Request) bool {
+    return strings.Contains(r.Header.Get("Accept"), jsonAPIContentType)
+}
+
+// jsonAPIResource turns a contact as the API returns it into a resource
+// object; the key that created it becomes the "owner" relationship
+func jsonAPIResource(c map[string]any) map[string]any {
+    id, _ := c["id"].(string)
+    attributes := map[string]any{}
+    for k, v := range c {
+        if k != "id" && k != "owner" {
+            attributes[k] = v
+        }
+    }
+    res := map[string]any{
+        "type":       "contacts",
+        "id":         id,
+        "attributes": attributes,
+        "links":      map[string]any{"self": "/contacts/" + id},
+    }
+    if owner, ok := c["owner"].(string); ok && owner != "" {
+        res["relationships"] = map[string]any{
+            "owner": map[string]any{"data": map[string]any{"type": "api-keys", "id": owner}},
+        }
+    }
+    return res
+}
+
+// jsonAPIDocument wraps a response body: contacts become primary data, error
+// bodies an errors array and anything else (analytics, import results) meta
+func jsonAPIDocument(r *http.Request, status int, body []byte) map[string]any {
+    var v any
+    dec := json.NewDecoder(bytes.NewReader(body))
+    dec.UseNumber()
+    if err := dec.Decode(&v); err != nil {
+        v = nil
+    }
+
+    if status >= 400 {
+        title := http.StatusText(status)
+        detail := strings.TrimSpace(string(body))
+        e := map[string]any{"status": strconv.Itoa(status), "title": title}
+        if m, ok := v.(map[string]any); ok {
+            if msg, ok := m["error"].(string); ok {
+                detail = msg
+            }
+            if code, ok := m["code"].(string); ok {
+                e["code"] = code
+            }
+        }
+        if detail != "" && detail != title {
+            e["detail"] = detail
+        }
+        return map[string]any{"errors": []any{e}}
+    }
+
+    switch v := v.(type) {
+    case []any:
+        data := make([]any, 0, len(v))
+        for _, item := range v {
+            c, ok := item.(map[string]any)
+            if !ok || c["id"] == nil {
+                return map[string]any{"meta": map[string]any{"items": v}}
+            }
+            data = append(data, jsonAPIResource(c))
+        }
+        return map[string]any{"data": data, "links": map[string]any{"self": r.URL.RequestURI()}}
+    case map[string]any:
+        if _, ok := v["id"].(string); ok {
+            return map[string]any{"data": jsonAPIResource(v)}
+        }
+        return map[string]any{"meta": v}
+    }
+    return map[string]any{"meta": map[string]any{}}
+}
+
+// unwrapJSONAPIBody turns a JSON:API request document into the plain JSON the
+// handlers read: the attributes of data, or an array of them for imports
+func unwrapJSONAPIBody(body []byte) ([]byte, bool) {
+    var doc struct {
+        Data json.RawMessage `json:"data"`
+    }
+    if err := json.Unmarshal(body, &doc); err != nil || len(doc.Data) == 0 {
+        return nil, false
+    }
+    type resource struct {
+        Type       string          `json:"type"`
+        Attributes json.RawMessage `json:"attributes"`
+    }
+    var one resource
+    if err := json.Unmarshal(doc.Data, &one); err == nil {
+        return one.Attributes, one.Type == "contacts" && len(one.Attributes) > 0
+    }
+    var many []resource
+    if err := json.Unmarshal(doc.Data, &many); err != nil {
+        return nil, false
+    }
+    items := make([]json.RawMessage, 0, len(many))
+    for _, res := range many {
+        if res.Type != "contacts" || len(res.Attributes) == 0 {
+            return nil, false
+        }
+        items = append(items, res.Attributes)
+    }
+    out, err := json.Marshal(items)
+    return out, err == nil
+}
+
+// JSONAPI middleware offers the JSON:API representation of /contacts routes
+// to callers that ask for it: request documents sent as application/vnd.api+json
+// are unwrapped for the handlers, and responses, errors included, are rewritten
+// as JSON:API documents. It runs after authentication, as request signatures
+// cover the body as sent.
+func JSONAPI(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if !strings.HasPrefix(r.URL.Path, "/contacts") {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        if mt, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil && mt == jsonAPIContentType {
+            if len(params) > 0 {
+                w.Header().Set("Content-Type", jsonAPIContentType)
+                w.WriteHeader(http.StatusUnsupportedMediaType)
+                json.NewEncoder(w).Encode(map[string]any{"errors": []any{map[string]any{
+                    "status": "415", "title": "Unsupported Media Type", "code": codeUnsupportedMediaType,
+                    "detail": "media type parameters are not allowed",
+                }}})
+                return
+            }
+            body, err := io.ReadAll(r.Body)
+            r.Body.Close()
+            plain, ok := unwrapJSONAPIBody(body)
+            if err != nil || !ok {
+                w.Header().Set("Content-Type", jsonAPIContentType)
+                w.WriteHeader(http.StatusBadRequest)
+                json.NewEncoder(w).Encode(map[string]any{"errors": []any{map[string]any{
+                    "status": "400", "title": "Bad Request", "code": codeInvalidRequestBody,
+                    "detail": "body must be a JSON:API document with contacts resources",
+                }}})
+                return
+            }
+            r = r.Clone(r.Context())
+            r.Body = io.NopCloser(bytes.NewReader(plain))
+            r.ContentLength = int64(len(plain))
+            r.Header.Set("Content-Type", "application/json")
+        }
+
+        if !wantsJSONAPI(r) {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        // handlers answer in JSON, whatever else Accept lists
+        r = r.Clone(r.Context())
+        r.Header.Set("Accept", jsonAPIContentType)
+
+        rw := &redactingWriter{ResponseWriter: w}
+        next.ServeHTTP(rw, r)
+        if rw.status == 0 {
+            rw.status = http.StatusOK
+        }
+        if rw.status == http.StatusNoContent || rw.status == http.StatusNotModified {
+            w.WriteHeader(rw.status)
+            return
+        }
+
+        body, err := json.Marshal(jsonAPIDocument(r, rw.status, rw.buf.Bytes()))
+        if err != nil {
+            body = rw.buf.Bytes()
+        } else {
+            body = append(body, '\n')
+            w.Header().Set("Content-Type", jsonAPIContentType)
+        }
+        w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+        w.WriteHeader(rw.status)
+        w.Write(body)
+    })
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "os"
+    "sync/atomic"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// defaultLeaseDuration is used when LEADER_LEASE_DURATION is not set
+const defaultLeaseDuration = 15 * time.Second
+
+// LeaderElector competes for a named lease document in the "leases" collection.
+// The holder renews the lease every third of its duration; if it stops renewing,
+// another replica takes over once the lease has expired.
+type LeaderElector struct {
+    name     string
+    identity string
+    ttl      time.Duration
+    leases   *mongo.Collection
+    leading  atomic.Bool
+}
+
+// leader decides which replica runs singleton background jobs
+var leader *LeaderElector
+
+func newLeaderElector(db *mongo.Database, name string, ttl time.Duration) *LeaderElector {
+    host, err := os.Hostname()
+    if err != nil {
+        host = "unknown"
+    }
+    return &LeaderElector{
+        name:     name,
+        identity: fmt.Sprintf("%s:%d", host, os.Getpid()),
+        ttl:      ttl,
+        leases:   db.Collection("leases"),
+    }
+}
+
+// leaseDurationFromEnv reads LEADER_LEASE_DURATION (e.g. "15s")
+func leaseDurationFromEnv() time.Duration {
+    if v := os.Getenv("LEADER_LEASE_DURATION"); v != "" {
+        if d, err := time.ParseDuration(v); err == nil && d > 0 {
+            return d
+        }
+        logWarn("ignoring invalid LEADER_LEASE_DURATION %q", v)
+    }
+    return defaultLeaseDuration
+}
+
+// IsLeader reports whether this replica currently holds the lease
+func (e *LeaderElector) IsLeader() bool {
+    return e != nil && e.leading.Load()
+}
+
+// Run keeps acquiring or renewing the lease until ctx is cancelled, then releases it
+func (e *LeaderElector) Run(ctx context.Context) {
+    ticker := time.NewTicker(e.ttl / 3)
+    defer ticker.Stop()
+
+    for {
+        acquired, err := e.tryAcquire(ctx)
+        if err != nil {
+            logWarn("leader election for %q failed: %v", e.name, err)
+        }
+        if acquired != e.leading.Swap(acquired) {
+            if acquired {
+                logInfo("%s became leader for %q", e.identity, e.name)
+            } else {
+                logInfo("%s lost leadership for %q", e.identity, e.name)
+            }
+        }
+
+        select {
+        case <-ctx.Done():
+            e.release()
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+// Holder returns the identity of the replica holding the lease, "" if it is
+// free or expired
+func (e *LeaderElector) Holder(ctx context.Context) (string, error) {
+    var lease struct {
+        Holder string `bson:"holder"`
+    }
+    err := e.leases.FindOne(ctx, bson.M{"_id": e.name, "expires_at": bson.M{"$gte": time.Now()}}).Decode(&lease)
+    if err == mongo.ErrNoDocuments {
+        return "", nil
+    }
+    return lease.Holder, err
+}
+
+// tryAcquire takes the lease if it is free or expired, or renews it if we hold it.
+// A duplicate key error means the upsert lost against another replica's live lease.
+func (e *LeaderElector) tryAcquire(ctx context.Context) (bool, error) {
+    ctx, cancel := context.WithTimeout(ctx, e.ttl/3)
+    defer cancel()
+
+    now := time.Now()
+    filter := bson.M{
+        "_id": e.name,
+        "$or": []bson.M{
+            {"holder": e.identity},
+            {"expires_at": bson.M{"$lt": now}},
+        },
+    }
+    update := bson.M{"$set": bson.M{
+        "holder":     e.identity,
+        "expires_at": now.Add(e.ttl),
+        "renewed_at": now,
+    }}
+
+    _, err := e.leases.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+    if mongo.IsDuplicateKeyError(err) {
+        return false, nil
+    }
+    if err != nil {
+        return false, err
+    }
+    return true, nil
+}
+
+// release expires our lease so another replica can take over without waiting
+func (e *LeaderElector) release() {
+    if !e.leading.Swap(false) {
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+
+    _, err := e.leases.UpdateOne(ctx,
+        bson.M{"_id": e.name, "holder": e.identity},
+        bson.M{"$set": bson.M{"expires_at": time.Now()}},
+    )
+    if err != nil {
+        logWarn("failed to release lease %q: %v", e.name, err)
+        return
+    }
+    logInfo("%s released lease %q", e.identity, e.name)
+}
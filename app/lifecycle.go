@@ -0,0 +1,91 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "net/http"
+    "os"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
+    "time"
+)
+
+const (
+    defaultDrainPeriod     = 15 * time.Second
+    defaultShutdownTimeout = 10 * time.Second
+)
+
+// draining is set once SIGTERM arrives; from then on /readyz fails so the
+// Service stops routing new traffic here while in-flight requests finish
+var draining atomic.Bool
+
+// isProbePath reports whether path is one of the kubelet probe endpoints
+func isProbePath(path string) bool {
+    return path == "/healthz" || path == "/readyz" || path == "/startupz"
+}
+
+// readinessCheck handles the /readyz route for the readiness probe
+func readinessCheck(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    if !warmedUp.Load() {
+        w.WriteHeader(http.StatusServiceUnavailable)
+        json.NewEncoder(w).Encode(map[string]string{"status": "starting"})
+        return
+    }
+    if draining.Load() {
+        w.WriteHeader(http.StatusServiceUnavailable)
+        json.NewEncoder(w).Encode(map[string]string{"status": "draining"})
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// durationFromEnv reads a non-negative duration such as "15s" from the environment
+func durationFromEnv(name string, def time.Duration) time.Duration {
+    if v := os.Getenv(name); v != "" {
+        if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+            return d
+        }
+        logWarn("ignoring invalid %s %q", name, v)
+    }
+    return def
+}
+
+// serve runs the HTTP server until SIGTERM or SIGINT. It then fails readiness,
+// keeps serving for DRAIN_PERIOD so endpoints controllers and load balancers
+// catch up, and gives in-flight requests SHUTDOWN_TIMEOUT to finish. The sum
+// should stay below the pod's terminationGracePeriodSeconds.
+func serve(srv *http.Server) error {
+    errs := make(chan error, 1)
+    go func() {
+        errs <- srv.ListenAndServe()
+    }()
+
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+    defer signal.Stop(signals)
+
+    select {
+    case err := <-errs:
+        return err
+    case sig := <-signals:
+        drain := durationFromEnv("DRAIN_PERIOD", defaultDrainPeriod)
+        logInfo("received %s, failing readiness and draining for %s", sig, drain)
+        draining.Store(true)
+        srv.SetKeepAlivesEnabled(false)
+        time.Sleep(drain)
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), durationFromEnv("SHUTDOWN_TIMEOUT", defaultShutdownTimeout))
+    defer cancel()
+    logInfo("shutting down, waiting for in-flight requests")
+    if err := srv.Shutdown(ctx); err != nil {
+        return err
+    }
+    if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+        return err
+    }
+    return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+    "fmt"
+    "log"
+    "strings"
+    "sync/atomic"
+)
+
+type logLevel int32
+
+const (
+    levelDebug logLevel = iota
+    levelInfo
+    levelWarn
+    levelError
+)
+
+var logLevelNames = map[string]logLevel{
+    "debug": levelDebug,
+    "info":  levelInfo,
+    "warn":  levelWarn,
+    "error": levelError,
+}
+
+var activeLogLevel atomic.Int32
+
+func init() {
+    activeLogLevel.Store(int32(levelInfo))
+}
+
+// parseLogLevel accepts debug, info, warn or error
+func parseLogLevel(s string) (logLevel, error) {
+    level, ok := logLevelNames[strings.ToLower(s)]
+    if !ok {
+        return levelInfo, fmt.Errorf("unknown log level %q", s)
+    }
+    return level, nil
+}
+
+func setLogLevel(level logLevel) {
+    activeLogLevel.Store(int32(level))
+}
+
+func logAt(level logLevel, tag, format string, args ...any) {
+    if int32(level) < activeLogLevel.Load() {
+        return
+    }
+    log.Printf(tag+" "+format, args...)
+}
+
+func logDebug(format string, args ...any) { logAt(levelDebug, "[DEBUG]", format, args...) }
+func logInfo(format string, args ...any)  { logAt(levelInfo, "[INFO]", format, args...) }
+func logWarn(format string, args ...any)  { logAt(levelWarn, "[WARN]", format, args...) }
+func logError(format string, args ...any) { logAt(levelError, "[ERROR]", format, args...) }
@@ -7,6 +7,8 @@ import (
     "log"
     "net/http"
     "os"
+    "slices"
+    "strings"
     "time"
 
     "go.mongodb.org/mongo-driver/bson"
@@ -17,42 +19,103 @@ import (
 
 // Contact represents the data model in MongoDB
 type Contact struct {
-    ID    primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-    Name  string             `bson:"name" json:"name"`
-    Phone string             `bson:"phone" json:"phone"`
+    ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    Name           string             `bson:"name" json:"name"`
+    Phone          string             `bson:"phone" json:"phone"`
+    PhoneE164      string             `bson:"-" json:"phone_e164,omitempty"`
+    PhoneFormatted string             `bson:"-" json:"phone_formatted,omitempty"`
+    ShortID        string             `bson:"short_id,omitempty" json:"short_id,omitempty"`
+    Tags           []string           `bson:"tags,omitempty" json:"tags,omitempty"`
+    Company        string             `bson:"company,omitempty" json:"company,omitempty"`
+    JobTitle       string             `bson:"job_title,omitempty" json:"job_title,omitempty"`
+    Website        string             `bson:"website,omitempty" json:"website,omitempty"`
+    Social         *SocialProfiles    `bson:"social,omitempty" json:"social,omitempty"`
+    Dates          []ContactDate      `bson:"dates,omitempty" json:"dates,omitempty"`
+    Tenant         string             `bson:"tenant,omitempty" json:"-"`
+    Owner          string             `bson:"owner,omitempty" json:"owner,omitempty"`
+    Avatar         *Avatar            `bson:"avatar,omitempty" json:"avatar,omitempty"`
+    CreatedAt      time.Time          `bson:"created_at,omitempty" json:"created_at"`
+    UpdatedAt      time.Time          `bson:"updated_at,omitempty" json:"updated_at"`
+    Rank           string             `bson:"rank,omitempty" json:"rank,omitempty"`
+    Pinned         bool               `bson:"pinned,omitempty" json:"pinned,omitempty"`
+    // the contact's manager, see checkManager
+    ReportsTo *primitive.ObjectID `bson:"reports_to,omitempty" json:"reports_to,omitempty"`
+    // drafts skip required-field validation until published, see publishContact
+    Draft bool `bson:"draft,omitempty" json:"draft,omitempty"`
+    // set for contacts that must not be contacted, see suppressions.go
+    DoNotContact bool `bson:"do_not_contact,omitempty" json:"do_not_contact,omitempty"`
+    // counted up by every write, see versions.go
+    Version int `bson:"version,omitempty" json:"version,omitempty"`
+    // when and where the contact was last written, see replication.go
+    Replication *WriteStamp `bson:"replication,omitempty" json:"-"`
+    // filled in after the website is set, see websites.go
+    WebsitePreview *WebsitePreview `bson:"website_preview,omitempty" json:"website_preview,omitempty"`
+    // where a search matched, by field, with ?highlight=true
+    Highlights map[string][]TextRange `bson:"-" json:"highlights,omitempty"`
 }
 
-var contactsCollection *mongo.Collection
+var (
+    mongoDB            *mongo.Database
+    contactsCollection collection
+)
 
-// init connects to MongoDB
-func init() {
+// connectDatabase connects to MongoDB. main calls it before anything else;
+// it isn't an init function so the package's unit tests run without a database.
+func connectDatabase() {
     ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
     defer cancel()
 
-    mongoURI := os.Getenv("MONGO_URI")
+    mongoURI, err := envSecret("MONGO_URI")
+    if err != nil {
+        log.Fatalf("Failed to load the MongoDB URI: %v", err)
+    }
     if mongoURI == "" {
         mongoURI = "mongodb://user-db:27017"
     }
 
-    client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
+    client, err := connectMongo(ctx, mongoURI)
     if err != nil {
         log.Fatalf("Failed to connect to MongoDB: %v", err)
     }
 
-    if err := client.Ping(ctx, nil); err != nil {
-        log.Fatalf("Failed to ping MongoDB: %v", err)
+    fmt.Println("Connected to MongoDB successfully!")
+    mongoDB = client.Database("contacts_db")
+    if err := connectRegions(ctx, mongoDB); err != nil {
+        log.Fatalf("Failed to connect to the regional MongoDB clusters: %v", err)
     }
+    contactsCollection = collectionOf("contacts")
+    contactsCollection.tagScoped = true
+}
 
-    fmt.Println("Connected to MongoDB successfully!")
-    contactsCollection = client.Database("contacts_db").Collection("contacts")
+// connectMongo connects to the cluster at uri and pings it
+func connectMongo(ctx context.Context, uri string) (*mongo.Client, error) {
+    opts := options.Client().ApplyURI(uri).
+        SetMonitor(newSlowQueryMonitor()).
+        SetMinPoolSize(warmupConnections)
+    if err := applyRetryWrites(opts); err != nil {
+        return nil, err
+    }
+    client, err := mongo.Connect(ctx, opts)
+    if err != nil {
+        return nil, err
+    }
+    clientSettings[client] = settingsOf(opts)
+    if err := client.Ping(ctx, nil); err != nil {
+        return nil, fmt.Errorf("ping: %w", err)
+    }
+    return client, nil
 }
 
 // EnableCORS middleware
 func EnableCORS(next http.Handler) http.Handler {
     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-        w.Header().Set("Access-Control-Allow-Origin", "*")
-        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-        w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+        if origin := allowedOrigin(r.Header.Get("Origin")); origin != "" {
+            w.Header().Set("Access-Control-Allow-Origin", origin)
+        }
+        w.Header().Add("Vary", "Origin")
+        w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-None-Match, Upload-Length, Upload-Offset, X-Client-Session")
+        w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+        w.Header().Set("Access-Control-Expose-Headers", "ETag, Location, Upload-Offset, Upload-Length, Upload-Expires")
 
         if r.Method == "OPTIONS" {
             w.WriteHeader(http.StatusOK)
@@ -63,212 +126,1001 @@ func EnableCORS(next http.Handler) http.Handler {
     })
 }
 
+// allowedOrigin returns the Access-Control-Allow-Origin value for origin, or "" if it is not allowed
+func allowedOrigin(origin string) string {
+    for _, o := range currentConfig().CORSOrigins {
+        if o == "*" {
+            return "*"
+        }
+        if origin != "" && o == origin {
+            return origin
+        }
+    }
+    return ""
+}
+
 // healthCheck handles the /healthz route for probes
 func healthCheck(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
     json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
-// createContact handles POST /contacts
+// createContact handles POST /contacts. With If-None-Match: * it refuses to
+// create a contact whose phone the tenant already has, see createOnly. A
+// multipart/form-data body carries the contact with its avatar, and the
+// contact is only created if the avatar could be stored.
 func createContact(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
 
     var contact Contact
-    if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
-        http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+    var avatar *Avatar
+    if isMultipart(r) {
+        var ok bool
+        if contact, avatar, ok = readContactMultipart(w, r); !ok {
+            return
+        }
+        defer func() {
+            if avatar != nil && contact.ID.IsZero() {
+                deleteAvatarFiles(context.WithoutCancel(r.Context()), avatar.files()...)
+            }
+        }()
+    } else if err := json.NewDecoder(r.Body).Decode(&contact); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
         return
     }
     defer r.Body.Close()
 
-    if contact.Name == "" || contact.Phone == "" {
-        http.Error(w, `{"error": "Missing name or phone"}`, http.StatusBadRequest)
+    if !contact.Draft && (contact.Name == "" || contact.Phone == "") {
+        writeError(w, http.StatusBadRequest, codeMissingField, "Missing name or phone")
         return
     }
-
-    result, err := contactsCollection.InsertOne(context.TODO(), bson.M{
-        "name":  contact.Name,
-        "phone": contact.Phone,
-    })
+    website, err := normalizeWebsite(contact.Website)
     if err != nil {
-        http.Error(w, `{"error": "Failed to create contact"}`, http.StatusInternalServerError)
+        writeError(w, http.StatusBadRequest, codeValidationFailed, err.Error())
+        return
+    }
+    contact.Website, contact.WebsitePreview = website, nil
+    if contact.Social, err = normalizeSocial(contact.Social); err != nil {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, err.Error())
+        return
+    }
+    if contact.Dates, err = normalizeDates(contact.Dates); err != nil {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, err.Error())
+        return
+    }
+    if contact.ReportsTo != nil {
+        if status, code, msg := checkManager(r, primitive.NilObjectID, *contact.ReportsTo); status != 0 {
+            writeError(w, status, code, msg)
+            return
+        }
+    }
+    only, ok := createOnly(w, r)
+    if !ok {
         return
     }
+    if only && contact.Phone != "" {
+        existing, err := contactWithPhone(r, contact.Phone)
+        if err == nil {
+            writeAlreadyExists(w, existing)
+            return
+        }
+        if err != mongo.ErrNoDocuments {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create contact")
+            return
+        }
+    }
 
-    contact.ID = result.InsertedID.(primitive.ObjectID)
+    contact.ID, contact.Avatar, contact.Version = primitive.NilObjectID, avatar, 0
+    if !insertContact(w, r, &contact) {
+        return
+    }
+    recordAudit(r, "contact.create", contact.ID.Hex(), nil)
+    publishContactEvent(r, "contact.created", contact)
+    contact.setAvatarURL()
     json.NewEncoder(w).Encode(bson.M{
         "message": "Contact created successfully",
         "contact": contact,
     })
 }
 
-// getContacts handles GET /contacts
+// insertContact stores a new contact in the caller's tenant, under c.ID if it
+// is set, and fills in the fields the store assigns. It answers quota,
+// conflict and database errors itself. A c.Version above 1 continues the
+// history of a deleted contact being restored.
+func insertContact(w http.ResponseWriter, r *http.Request, c *Contact) bool {
+    exceeded, err := checkContactQuota(r.Context(), r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to check quota")
+        return false
+    }
+    if exceeded != nil {
+        writeQuotaExceeded(w, exceeded)
+        return false
+    }
+    settings, err := callerSettings(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve settings")
+        return false
+    }
+
+    suppressed, err := suppressedPhones(r, settings, c.Phone)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to check the suppression list")
+        return false
+    }
+    c.DoNotContact = c.DoNotContact || suppressed[c.Phone]
+
+    now := utcNow()
+    c.Name = normalizeName(c.Name)
+    c.Tags = normalizeTags(c.Tags)
+    doc := newContactDoc(r, settings, *c, now)
+    c.Tags = doc["tags"].([]string)
+    c.Company, c.JobTitle = normalizeLabel(c.Company), normalizeLabel(c.JobTitle)
+    if !c.ID.IsZero() {
+        doc["_id"] = c.ID
+    }
+    action := versionCreate
+    if c.Version > 1 {
+        doc["version"], action = c.Version, versionRestore
+    }
+    if c.Avatar != nil {
+        doc["avatar"] = c.Avatar
+    }
+    key, _ := doc["phone_normalized"].(string)
+    var result *mongo.InsertOneResult
+    for attempt := 0; attempt < 3; attempt++ {
+        doc["short_id"] = newShortID()
+        if result, err = contactsCollection.InsertOne(r.Context(), doc); !isShortIDConflict(err) {
+            break
+        }
+    }
+    if isPhoneConflict(err) {
+        writePhoneConflict(w, r, key)
+        return false
+    }
+    if isIDConflict(err) {
+        writeError(w, http.StatusConflict, codeIDConflict, "The contact ID is taken")
+        return false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create contact")
+        return false
+    }
+
+    c.ID = result.InsertedID.(primitive.ObjectID)
+    c.ShortID = doc["short_id"].(string)
+    c.Owner = principalFrom(r).KeyID
+    c.CreatedAt, c.UpdatedAt = now, now
+    c.Version = doc["version"].(int)
+    doc["_id"] = c.ID
+    recordCreated(r, action, doc)
+    return true
+}
+
+// newContactDoc is the document a new contact c of the caller is stored as,
+// without the IDs the store assigns
+func newContactDoc(r *http.Request, settings TenantSettings, c Contact, now time.Time) bson.M {
+    doc := bson.M{
+        "name":        normalizeName(c.Name),
+        "name_search": searchKey(c.Name),
+        "phone":       c.Phone,
+        "tags":        withKeyTags(r, normalizeTags(c.Tags)),
+        "tenant":      tenantOf(r),
+        "created_at":  now,
+        "updated_at":  now,
+        "rank":        newRank(now),
+        "version":     1,
+    }
+    if owner := principalFrom(r).KeyID; owner != "" {
+        doc["owner"] = owner
+    }
+    if company := normalizeLabel(c.Company); company != "" {
+        doc["company"] = company
+    }
+    if title := normalizeLabel(c.JobTitle); title != "" {
+        doc["job_title"] = title
+    }
+    if c.Website != "" {
+        doc["website"] = c.Website
+    }
+    if c.Social != nil {
+        doc["social"] = c.Social
+    }
+    if len(c.Dates) > 0 {
+        doc["dates"] = c.Dates
+    }
+    if c.ReportsTo != nil {
+        doc["reports_to"] = *c.ReportsTo
+    }
+    if c.Draft {
+        doc["draft"] = true
+    }
+    if c.DoNotContact {
+        doc["do_not_contact"] = true
+    }
+    if key := phoneKey(c.Phone, settings.PhoneRegion); key != "" && settings.uniquePhones() {
+        doc["phone_normalized"] = key
+    }
+    return withWriteStamp(doc)
+}
+
+// normalizeTags trims and lowercases tags, dropping empty and repeated ones
+func normalizeTags(tags []string) []string {
+    out := []string{}
+    seen := map[string]bool{}
+    for _, t := range tags {
+        t = strings.ToLower(strings.TrimSpace(t))
+        if t == "" || seen[t] {
+            continue
+        }
+        seen[t] = true
+        out = append(out, t)
+    }
+    return out
+}
+
+// getContacts handles GET /contacts[?limit=&offset=&sort=], filtered as
+// described at contactFilter and ordered as described at contactOrder. Without
+// a limit the whole collection is exported, up to the caller's
+// max_export_size. Last-Modified is the tenant's latest change.
 func getContacts(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
 
+    limits := queryLimitsFor(r)
+    limit, offset, msg := pageParams(r, limits)
+    if msg != "" {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, msg)
+        return
+    }
+    filter, msg := contactFilter(r, limits)
+    if msg != "" {
+        writeError(w, http.StatusBadRequest, codeInvalidFilter, msg)
+        return
+    }
+    order, collation, ok := contactOrder(w, r)
+    if !ok {
+        return
+    }
+    highlight, ok := highlighterFor(w, r)
+    if !ok {
+        return
+    }
+    r = r.WithContext(withReadOperation(r.Context(), contactsReadOperation(r, limit)))
+
+    // dated before the query runs, so a change racing it can only make the
+    // date too old, never too new
+    lastModified, err := tenantLastModified(r.Context(), r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
+        return
+    }
+    if notModified(w, r, lastModified) {
+        return
+    }
+
+    opts := options.Find().SetSort(order).SetSkip(offset)
+    if collation != nil {
+        opts.SetCollation(collation)
+    }
+    export := limit == 0
+    if !export {
+        opts.SetLimit(limit)
+    } else if limits.MaxExportSize > 0 {
+        // one more than allowed tells us the export is too large
+        opts.SetLimit(int64(limits.MaxExportSize) + 1)
+    }
+
     var contacts []Contact
-    cursor, err := contactsCollection.Find(context.TODO(), bson.D{})
+    cursor, err := contactsCollection.Find(r.Context(), scopeFilter(r, filter), opts)
     if err != nil {
-        http.Error(w, `{"error": "Failed to retrieve contacts"}`, http.StatusInternalServerError)
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
         return
     }
-    defer cursor.Close(context.TODO())
+    defer cursor.Close(r.Context())
 
-    for cursor.Next(context.TODO()) {
+    for cursor.Next(r.Context()) {
         var c Contact
         cursor.Decode(&c)
+        highlight.apply(&c)
         contacts = append(contacts, c)
     }
 
     if err := cursor.Err(); err != nil {
-        http.Error(w, `{"error": "Cursor error"}`, http.StatusInternalServerError)
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    if export && limits.MaxExportSize > 0 && len(contacts) > limits.MaxExportSize {
+        writeErrorWith(w, http.StatusRequestEntityTooLarge, codeExportTooLarge,
+            "Export too large, page through it with limit and offset", map[string]any{"max_export_size": limits.MaxExportSize})
         return
     }
 
-    json.NewEncoder(w).Encode(contacts)
+    recordsServed(r, len(contacts))
+    writeContacts(w, r, contacts)
 }
 
 // getContact handles GET /contacts/{id}
 func getContact(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
 
-    id := r.URL.Path[len("/contacts/"):]
-    if id == "" {
-        http.Error(w, `{"error": "Missing contact ID"}`, http.StatusBadRequest)
+    objID, ok := contactIDFromPath(w, r)
+    if !ok {
         return
     }
+    id := objID.Hex()
 
-    objID, err := primitive.ObjectIDFromHex(id)
-    if err != nil {
-        http.Error(w, `{"error": "Invalid contact ID"}`, http.StatusBadRequest)
+    cacheKey := tenantOf(r) + "/" + id
+    if c, ok := contactCache.Get(cacheKey); ok && maySee(r, c.Tags) {
+        recordContactView(r, objID)
+        writeContact(w, r, c)
         return
     }
 
     var c Contact
-    err = contactsCollection.FindOne(context.TODO(), bson.M{"_id": objID}).Decode(&c)
+    err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"_id": objID})).Decode(&c)
     if err != nil {
         if err == mongo.ErrNoDocuments {
-            http.Error(w, `{"error": "Contact not found"}`, http.StatusNotFound)
+            writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
             return
         }
-        http.Error(w, `{"error": "Database error"}`, http.StatusInternalServerError)
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
         return
     }
 
+    contactCache.Set(cacheKey, c, time.Duration(currentConfig().Cache.ContactTTL))
+    recordContactView(r, objID)
+    writeContact(w, r, c)
+}
+
+// contactByID loads the caller's contact in /contacts/{id}[/...], answering
+// the request itself if there is none
+func contactByID(w http.ResponseWriter, r *http.Request) (Contact, bool) {
+    var c Contact
+    objID, ok := contactIDFromPath(w, r)
+    if !ok {
+        return c, false
+    }
+    err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"_id": objID})).Decode(&c)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+        return c, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return c, false
+    }
+    return c, true
+}
+
+// writeContact sends c as JSON or, if asked for, MessagePack, unless the
+// caller's copy is still current
+func writeContact(w http.ResponseWriter, r *http.Request, c Contact) {
+    if notModified(w, r, contactLastModified(c)) {
+        return
+    }
+    f, ok := phoneFormatFor(w, r)
+    if !ok {
+        return
+    }
+    f.apply(&c)
+    c.setAvatarURL()
+    if wantsMsgpack(r) {
+        writeMsgpack(w, msgpackContact(nil, c))
+        return
+    }
     json.NewEncoder(w).Encode(c)
 }
 
-// updateContact handles PUT /contacts/{id}
+// writeContacts sends a list of contacts like writeContact
+func writeContacts(w http.ResponseWriter, r *http.Request, contacts []Contact) {
+    f, ok := phoneFormatFor(w, r)
+    if !ok {
+        return
+    }
+    for i := range contacts {
+        f.apply(&contacts[i])
+        contacts[i].setAvatarURL()
+    }
+    if wantsMsgpack(r) {
+        b := msgpackArrayHeader(nil, len(contacts))
+        for _, c := range contacts {
+            b = msgpackContact(b, c)
+        }
+        writeMsgpack(w, b)
+        return
+    }
+    json.NewEncoder(w).Encode(contacts)
+}
+
+// contactChanges are the fields PUT /contacts/{id} can change; fields left
+// out (nil) are kept
+type contactChanges struct {
+    Name     *string   `bson:"name,omitempty" json:"name,omitempty"`
+    Phone    *string   `bson:"phone,omitempty" json:"phone,omitempty"`
+    Tags     *[]string `bson:"tags,omitempty" json:"tags,omitempty"`
+    Company  *string   `bson:"company,omitempty" json:"company,omitempty"`
+    JobTitle *string   `bson:"job_title,omitempty" json:"job_title,omitempty"`
+    Website  *string   `bson:"website,omitempty" json:"website,omitempty"`
+    // Social replaces all of the contact's profiles; {} removes them
+    Social *SocialProfiles `bson:"social,omitempty" json:"social,omitempty"`
+    // Dates replaces all of the contact's dates; [] removes them
+    Dates *[]ContactDate `bson:"dates,omitempty" json:"dates,omitempty"`
+    // DoNotContact is set when the phone changes to a suppressed one
+    DoNotContact *bool `bson:"do_not_contact,omitempty" json:"do_not_contact,omitempty"`
+    // ReportsTo is the ID or short ID of the manager, "" for none; it is
+    // resolved into manager by resolveReportsTo
+    ReportsTo *string `bson:"reports_to,omitempty" json:"reports_to,omitempty"`
+    manager   *primitive.ObjectID
+    // Version is the version of the contact the changes were made to, if
+    // the caller wants writes since then merged rather than overwritten;
+    // see conflicts.go
+    Version *int `bson:"version,omitempty" json:"version,omitempty"`
+}
+
+// update builds the MongoDB update making the changes, along with the fields
+// stored with them, and returns the fields it sets
+func (ch contactChanges) update(settings TenantSettings) (update, set bson.M) {
+    set = bson.M{}
+    unset := bson.M{}
+    if ch.Name != nil {
+        set["name"] = normalizeName(*ch.Name)
+        set["name_search"] = searchKey(*ch.Name)
+    }
+    if ch.Phone != nil {
+        set["phone"] = *ch.Phone
+        if key := phoneKey(*ch.Phone, settings.PhoneRegion); key != "" && settings.uniquePhones() {
+            set["phone_normalized"] = key
+        } else {
+            unset["phone_normalized"] = ""
+        }
+    }
+    if ch.Tags != nil {
+        set["tags"] = normalizeTags(*ch.Tags)
+    }
+    if ch.Company != nil {
+        set["company"] = normalizeLabel(*ch.Company)
+    }
+    if ch.JobTitle != nil {
+        set["job_title"] = normalizeLabel(*ch.JobTitle)
+    }
+    if ch.Website != nil {
+        set["website"] = *ch.Website
+        unset["website_preview"] = ""
+    }
+    if ch.Social != nil {
+        set["social"] = ch.Social.orNil()
+    }
+    if ch.Dates != nil {
+        set["dates"] = *ch.Dates
+    }
+    if ch.DoNotContact != nil {
+        set["do_not_contact"] = *ch.DoNotContact
+    }
+    if ch.ReportsTo != nil {
+        set["reports_to"] = ch.manager
+    }
+    set["updated_at"] = utcNow()
+
+    update = withNextVersion(bson.M{"$set": set})
+    if len(unset) > 0 {
+        update["$unset"] = unset
+    }
+    return update, set
+}
+
+// publicChanges drops the internal fields from fields set by an update, for
+// events
+func publicChanges(set bson.M) bson.M {
+    changes := bson.M{}
+    for k, v := range set {
+        if !slices.Contains(internalContactFields, k) {
+            changes[k] = v
+        }
+    }
+    return changes
+}
+
+// updateContact handles PUT /contacts/{id}[?upsert=true]. With If-None-Match: *
+// it only creates, see createOnly.
 func updateContact(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
 
-    id := r.URL.Path[len("/contacts/"):]
-    if id == "" {
-        http.Error(w, `{"error": "Missing contact ID"}`, http.StatusBadRequest)
+    objID, ok := contactIDFromPath(w, r)
+    if !ok {
         return
     }
 
-    objID, err := primitive.ObjectIDFromHex(id)
-    if err != nil {
-        http.Error(w, `{"error": "Invalid contact ID"}`, http.StatusBadRequest)
+    var updateData contactChanges
+    if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
         return
     }
-
-    var updateData map[string]string
-    if err := json.NewDecoder(r.Body).Decode(&updateData); err != nil {
-        http.Error(w, `{"error": "Invalid request body"}`, http.StatusBadRequest)
+    if updateData.Version != nil && *updateData.Version < 1 {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "version must be a positive number")
         return
     }
-
-    updateFields := bson.M{}
-    if name, ok := updateData["name"]; ok {
-        updateFields["name"] = name
+    if msg := updateData.normalizeWebsite(); msg != "" {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, msg)
+        return
+    }
+    if msg := updateData.normalizeSocial(); msg != "" {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, msg)
+        return
     }
-    if phone, ok := updateData["phone"]; ok {
-        updateFields["phone"] = phone
+    if msg := updateData.normalizeDates(); msg != "" {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, msg)
+        return
+    }
+    if status, code, msg := updateData.resolveReportsTo(r, objID); status != 0 {
+        writeError(w, status, code, msg)
+        return
+    }
+    only, ok := createOnly(w, r)
+    if !ok {
+        return
+    }
+    if only {
+        err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"_id": objID}),
+            options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+        if err == nil {
+            writeAlreadyExists(w, objID)
+            return
+        }
+        if err != mongo.ErrNoDocuments {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+            return
+        }
+        createContactAt(w, r, objID, updateData)
+        return
     }
 
-    result, err := contactsCollection.UpdateOne(context.TODO(), bson.M{"_id": objID}, bson.M{"$set": updateFields})
-    if err != nil {
-        http.Error(w, `{"error": "Failed to update contact"}`, http.StatusInternalServerError)
+    if needsApproval(r) {
+        requestChange(w, r, objID, changeUpdate, &updateData)
         return
     }
 
-    if result.MatchedCount == 0 {
-        http.Error(w, `{"error": "Contact not found"}`, http.StatusNotFound)
+    found, ok := saveContactChanges(w, r, objID, updateData, versionUpdate, nil)
+    if !ok {
+        return
+    }
+    if !found {
+        if upsertRequested(r) {
+            createContactAt(w, r, objID, updateData)
+            return
+        }
+        writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
         return
     }
 
     json.NewEncoder(w).Encode(bson.M{"message": "Contact updated successfully"})
 }
 
+// saveContactChanges makes changes to the contact objID, recording them as a
+// version made by action and with details in the audit log. It answers errors
+// itself; found is false, with nothing answered, if there is no such contact.
+func saveContactChanges(w http.ResponseWriter, r *http.Request, objID primitive.ObjectID, changes contactChanges, action string, details bson.M) (found, ok bool) {
+    id := objID.Hex()
+
+    settings, err := callerSettings(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve settings")
+        return false, false
+    }
+    if err := changes.flagSuppressed(r, settings); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to check the suppression list")
+        return false, false
+    }
+    var updateFields bson.M
+    for attempt := 1; ; attempt++ {
+        filter := scopeFilter(r, bson.M{"_id": objID})
+        if changes.Version != nil {
+            if changes, found, ok = rebaseChanges(w, r, objID, changes); !found || !ok {
+                return found, ok
+            }
+            filter["version"] = *changes.Version
+        }
+        var update bson.M
+        update, updateFields = changes.update(settings)
+        result, err := contactsCollection.UpdateOne(r.Context(), lastWriterFilter(filter, update), update)
+        if isPhoneConflict(err) {
+            writePhoneConflict(w, r, updateFields["phone_normalized"].(string))
+            return false, false
+        }
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to update contact")
+            return false, false
+        }
+
+        contactCache.Delete(tenantOf(r) + "/" + id)
+        if result.MatchedCount > 0 {
+            break
+        }
+        if changes.Version == nil && !writtenLater(r, objID, update) {
+            return false, true
+        }
+        if attempt == maxMergeAttempts {
+            writeStillChanging(w)
+            return true, false
+        }
+    }
+    recordVersions(r, action, objID)
+    recordAudit(r, "contact.update", id, details)
+    publishContactEvent(r, "contact.updated", bson.M{"id": id, "changes": publicChanges(updateFields)})
+    return true, true
+}
+
 // deleteContact handles DELETE /contacts/{id}
 func deleteContact(w http.ResponseWriter, r *http.Request) {
     w.Header().Set("Content-Type", "application/json")
 
-    id := r.URL.Path[len("/contacts/"):]
-    if id == "" {
-        http.Error(w, `{"error": "Missing contact ID"}`, http.StatusBadRequest)
+    objID, ok := contactIDFromPath(w, r)
+    if !ok {
         return
     }
-
-    objID, err := primitive.ObjectIDFromHex(id)
-    if err != nil {
-        http.Error(w, `{"error": "Invalid contact ID"}`, http.StatusBadRequest)
+    if needsApproval(r) {
+        requestChange(w, r, objID, changeDelete, nil)
         return
     }
 
-    result, err := contactsCollection.DeleteOne(context.TODO(), bson.M{"_id": objID})
-    if err != nil {
-        http.Error(w, `{"error": "Failed to delete contact"}`, http.StatusInternalServerError)
+    found, ok := removeContact(w, r, objID, nil)
+    if !ok {
         return
     }
-
-    if result.DeletedCount == 0 {
-        http.Error(w, `{"error": "Contact not found"}`, http.StatusNotFound)
+    if !found {
+        writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
         return
     }
 
     json.NewEncoder(w).Encode(bson.M{"message": "Contact deleted successfully"})
 }
 
+// removeContact deletes the contact objID, recording it with details in the
+// audit log, like saveContactChanges
+func removeContact(w http.ResponseWriter, r *http.Request, objID primitive.ObjectID, details bson.M) (found, ok bool) {
+    id := objID.Hex()
+
+    var c Contact
+    err := contactsCollection.FindOneAndDelete(r.Context(), scopeFilter(r, bson.M{"_id": objID})).Decode(&c)
+    contactCache.Delete(tenantOf(r) + "/" + id)
+    if err == mongo.ErrNoDocuments {
+        return false, true
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete contact")
+        return false, false
+    }
+    recordDeleted(r, c)
+    cleanUpDeleted(r, objID)
+    recordAudit(r, "contact.delete", id, details)
+    emitSecurityEvent(r, "erasure", "contact.delete", "success", id, nil)
+    publishContactEvent(r, "contact.deleted", bson.M{"id": id})
+    return true, true
+}
+
+// cleanUpDeleted removes what hangs off deleted contacts: their comments,
+// attachments, consents and watches, and the reports_to of their reports
+func cleanUpDeleted(r *http.Request, ids ...primitive.ObjectID) {
+    clearReportsTo(r, ids...)
+    deleteComments(r, ids...)
+    deleteAttachments(r, ids...)
+    deleteConsents(r, ids...)
+    deleteWatches(r, ids...)
+}
+
 func main() {
+    connectDatabase()
+
+    configPath := os.Getenv("CONFIG_FILE")
+    cfg, err := loadConfig(configPath)
+    if err != nil {
+        log.Fatalf("Failed to load config: %v", err)
+    }
+    applyConfig(cfg)
+    go watchConfig(configPath)
+    go secrets.refreshLoop(configPath)
+
+    startSpanExporter()
+    if err := startSIEMShipper(); err != nil {
+        log.Fatalf("Failed to configure SIEM shipping: %v", err)
+    }
+    if err := startPushSenders(); err != nil {
+        log.Fatalf("Failed to configure push notifications: %v", err)
+    }
+    if err := startReminderMailer(); err != nil {
+        log.Fatalf("Failed to configure reminder emails: %v", err)
+    }
+    if err := startPhoneLookup(); err != nil {
+        log.Fatalf("Failed to configure phone lookups: %v", err)
+    }
+    if err := startReplication(); err != nil {
+        log.Fatalf("Failed to configure replication: %v", err)
+    }
+
+    leader = newLeaderElector(mongoDB, "background-jobs", leaseDurationFromEnv())
+    ctx, stop := context.WithCancel(context.Background())
+    go leader.Run(ctx)
+    scheduler.Start(ctx)
+    scheduler.Trigger("export-schedules")
+    startWebhookWorkers()
+    startRecentViewRecorder()
+    startWebsiteFetchers()
+    startAsyncJobWorkers(ctx)
+    go warmup(ctx)
+
     router := http.NewServeMux()
-    
+
     // Health check endpoint for Kubernetes probes
     router.HandleFunc("/healthz", healthCheck)
+    router.HandleFunc("/readyz", readinessCheck)
+    router.HandleFunc("/startupz", startupCheck)
+    router.HandleFunc("/metrics", metricsHandler)
+    router.HandleFunc("/version", versionHandler)
 
-    // /contacts (no trailing slash)
-    router.HandleFunc("/contacts", func(w http.ResponseWriter, r *http.Request) {
-        switch r.Method {
-        case "POST":
-            createContact(w, r)
-        case "GET":
-            getContacts(w, r)
+    // Background job status and manual triggers
+    router.HandleFunc("/admin/jobs", requireAdmin(methods{"GET": listJobs}.ServeHTTP))
+    router.HandleFunc("/admin/jobs/", requireAdmin(methods{"POST": runJob}.ServeHTTP))
+
+    // Abuse and anomaly alerts
+    router.HandleFunc("/admin/anomalies", requireAdmin(methods{"GET": listAnomalies}.ServeHTTP))
+    router.HandleFunc("/admin/anomalies/throttles/", requireAdmin(methods{"DELETE": liftThrottle}.ServeHTTP))
+
+    // Data retention rules
+    router.HandleFunc("/admin/retention/rules", requireAdmin(methods{
+        "GET":  listRetentionRules,
+        "POST": createRetentionRule,
+    }.ServeHTTP))
+    router.HandleFunc("/admin/retention/rules/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasSuffix(r.URL.Path, "/dry-run") {
+            methods{"GET": dryRunRetentionRule}.ServeHTTP(w, r)
+            return
+        }
+        methods{"PUT": updateRetentionRule, "DELETE": deleteRetentionRule}.ServeHTTP(w, r)
+    }))
+
+    // Per-tenant and per-owner contact quotas
+    router.HandleFunc("/admin/quotas", requireAdmin(methods{"GET": listQuotas}.ServeHTTP))
+    router.HandleFunc("/admin/quotas/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasSuffix(r.URL.Path, "/usage") {
+            methods{"GET": getQuotaUsage}.ServeHTTP(w, r)
+            return
+        }
+        methods{"PUT": setQuota, "DELETE": deleteQuota}.ServeHTTP(w, r)
+    }))
+
+    // Per-tenant settings
+    router.HandleFunc("/admin/tenants/", requireAdmin(methods{
+        "GET": getTenantSettings,
+        "PUT": setTenantSettings,
+    }.ServeHTTP))
+
+    // Usage metering for chargeback
+    router.HandleFunc("/admin/usage", requireAdmin(methods{"GET": getUsage}.ServeHTTP))
+    router.HandleFunc("/admin/export/contacts", requireAdmin(methods{"GET": exportContacts}.ServeHTTP))
+    router.HandleFunc("/admin/exports/schedules", requireAdmin(methods{
+        "GET":  listExportSchedules,
+        "POST": createExportSchedule,
+    }.ServeHTTP))
+    router.HandleFunc("/admin/exports/schedules/", requireAdmin(func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasSuffix(r.URL.Path, "/runs") {
+            methods{"GET": listExportRuns}.ServeHTTP(w, r)
+            return
+        }
+        methods{
+            "GET":    getExportSchedule,
+            "PUT":    updateExportSchedule,
+            "DELETE": deleteExportSchedule,
+        }.ServeHTTP(w, r)
+    }))
+    router.HandleFunc("/admin/generate", requireAdmin(methods{"POST": generateContacts}.ServeHTTP))
+    router.HandleFunc("/admin/replication/conflicts", requireAdmin(methods{"GET": listReplicationConflicts}.ServeHTTP))
+    router.HandleFunc("/admin/stats", requireAdmin(methods{"GET": getStats}.ServeHTTP))
+    router.Handle("/quota", methods{"GET": getOwnQuota})
+
+    // Webhook subscriptions
+    router.Handle("/webhooks", methods{"GET": listWebhooks, "POST": createWebhook})
+    router.HandleFunc("/webhooks/", func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasSuffix(r.URL.Path, "/health") {
+            methods{"GET": getWebhookHealth}.ServeHTTP(w, r)
+            return
+        }
+        methods{"GET": getWebhook, "DELETE": deleteWebhook}.ServeHTTP(w, r)
+    })
+
+    // Asynchronous jobs
+    router.Handle("/jobs", methods{"GET": listAsyncJobs})
+    router.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+        switch {
+        case strings.HasSuffix(r.URL.Path, "/errors"):
+            methods{"GET": getJobErrors}.ServeHTTP(w, r)
+        case strings.HasSuffix(r.URL.Path, "/download"):
+            methods{"GET": downloadJobResult}.ServeHTTP(w, r)
+        case strings.HasSuffix(r.URL.Path, "/cancel"):
+            methods{"POST": cancelAsyncJob}.ServeHTTP(w, r)
         default:
-            http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+            methods{"GET": getAsyncJob}.ServeHTTP(w, r)
         }
     })
 
-    // /contacts/{id}
-    router.HandleFunc("/contacts/", func(w http.ResponseWriter, r *http.Request) {
-        if r.URL.Path == "/contacts/" && r.Method == "GET" {
-            getContacts(w, r)
+    // Groups, whose members are the contacts matching a query
+    router.Handle("/groups", methods{"GET": listGroups, "POST": createGroup})
+    router.HandleFunc("/groups/", func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasSuffix(r.URL.Path, "/contacts") {
+            methods{"GET": getGroupContacts}.ServeHTTP(w, r)
             return
         }
+        if strings.HasSuffix(r.URL.Path, "/move") {
+            methods{"POST": moveGroup}.ServeHTTP(w, r)
+            return
+        }
+        methods{"GET": getGroup, "PUT": updateGroup, "DELETE": deleteGroup}.ServeHTTP(w, r)
+    })
+
+    // Contact edits waiting for review
+    router.Handle("/change-requests", methods{"GET": listChangeRequests})
+    router.HandleFunc("/change-requests/", func(w http.ResponseWriter, r *http.Request) {
+        switch {
+        case strings.HasSuffix(r.URL.Path, "/approve"):
+            methods{"POST": approveChangeRequest}.ServeHTTP(w, r)
+        case strings.HasSuffix(r.URL.Path, "/reject"):
+            methods{"POST": rejectChangeRequest}.ServeHTTP(w, r)
+        default:
+            methods{"GET": getChangeRequest}.ServeHTTP(w, r)
+        }
+    })
+
+    // The tenant's suppression list, see suppressions.go
+    router.Handle("/suppressions", methods{"GET": listSuppressions, "POST": addSuppressions})
+    router.Handle("/suppressions/check", methods{"POST": checkSuppressions})
+    router.Handle("/suppressions/", methods{"DELETE": deleteSuppression})
+
+    // Consent records of all the tenant's contacts, see consents.go
+    router.Handle("/consents", methods{"GET": listConsents})
 
-        switch r.Method {
-        case "GET":
-            getContact(w, r)
-        case "PUT":
-            updateContact(w, r)
-        case "DELETE":
-            deleteContact(w, r)
+    // Reverse phone lookups, see phonelookup.go
+    router.Handle("/lookup/phone/", methods{"GET": lookupPhone})
+
+    // Likely duplicates, see merges.go
+    router.Handle("/merge-suggestions", methods{"GET": getMergeSuggestions})
+    router.HandleFunc("/merge-suggestions/", func(w http.ResponseWriter, r *http.Request) {
+        switch {
+        case strings.HasSuffix(r.URL.Path, "/accept"):
+            methods{"POST": acceptMergeSuggestion}.ServeHTTP(w, r)
+        case strings.HasSuffix(r.URL.Path, "/dismiss"):
+            methods{"POST": dismissMergeSuggestion}.ServeHTTP(w, r)
         default:
-            http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+            writeError(w, http.StatusNotFound, codeRouteNotFound, "Not found")
+        }
+    })
+
+    // Companies of the contacts
+    router.Handle("/companies", methods{"GET": listCompanies})
+    router.Handle("/companies/", methods{"GET": getCompanyContacts})
+
+    // Tags
+    router.Handle("/tags", methods{"GET": listTags})
+    router.HandleFunc("/tags/", func(w http.ResponseWriter, r *http.Request) {
+        if r.URL.Path == "/tags/merge" {
+            methods{"POST": mergeTags}.ServeHTTP(w, r)
+            return
+        }
+        methods{"PUT": renameTag}.ServeHTTP(w, r)
+    })
+
+    // Saved searches
+    router.Handle("/saved-searches", methods{"GET": listSavedSearches, "POST": createSavedSearch})
+    router.HandleFunc("/saved-searches/", func(w http.ResponseWriter, r *http.Request) {
+        if strings.HasSuffix(r.URL.Path, "/results") {
+            methods{"GET": getSavedSearchResults}.ServeHTTP(w, r)
+            return
+        }
+        methods{"GET": getSavedSearch, "PUT": updateSavedSearch, "DELETE": deleteSavedSearch}.ServeHTTP(w, r)
+    })
+
+    // Push notifications
+    router.Handle("/devices", methods{"GET": listDevices, "POST": registerDevice})
+    router.Handle("/devices/", methods{"DELETE": deleteDevice})
+    router.Handle("/watches", methods{"GET": listWatches})
+    router.Handle("/feed", methods{"GET": getFeed})
+    router.Handle("/notification-preferences", methods{"GET": getNotificationPrefs, "PUT": updateNotificationPrefs})
+    router.Handle("/reminder-preferences", methods{"GET": getReminderPrefs, "PUT": updateReminderPrefs})
+
+    // Resumable uploads
+    router.Handle("/uploads", methods{"POST": createUpload})
+    router.Handle("/uploads/", methods{"GET": getUpload, "PATCH": appendUpload, "DELETE": deleteUpload})
+
+    // /contacts (no trailing slash)
+    router.Handle("/contacts", methods{"GET": getContacts, "POST": createContact})
+
+    // /contacts/{id} and the routes below /contacts
+    contactRoutes := map[string]methods{
+        "/contacts/analytics":            {"GET": getContactAnalytics},
+        "/contacts/analytics/timeseries": {"GET": getContactTimeseries},
+        "/contacts/import/json":          {"POST": importContactsJSON},
+        "/contacts/recent":               {"GET": getRecentContacts},
+        "/contacts/sync":                 {"GET": syncContacts},
+        "/contacts/changes":              {"GET": getContactChanges},
+        "/contacts/batch":                {"GET": batchGetContacts},
+        "/contacts/export":               {"GET": exportContactsPDF, "POST": startExportJob},
+        "/contacts/bulk":                 {"POST": bulkCreateContacts, "PATCH": bulkUpdateContacts, "DELETE": bulkDeleteContacts},
+        "/contacts/tags/bulk":            {"POST": bulkTagContacts},
+    }
+    router.HandleFunc("/contacts/", func(w http.ResponseWriter, r *http.Request) {
+        if route, ok := contactRoutes[r.URL.Path]; ok {
+            route.ServeHTTP(w, r)
+            return
+        }
+        if strings.HasSuffix(r.URL.Path, "/activity") {
+            methods{"GET": getContactActivity}.ServeHTTP(w, r)
+            return
         }
+        if strings.HasSuffix(r.URL.Path, "/avatar") {
+            methods{"GET": getContactAvatar}.ServeHTTP(w, r)
+            return
+        }
+        if strings.HasSuffix(r.URL.Path, "/qrcode") {
+            methods{"GET": getContactQRCode}.ServeHTTP(w, r)
+            return
+        }
+        if strings.HasSuffix(r.URL.Path, "/position") {
+            methods{"PUT": moveContact}.ServeHTTP(w, r)
+            return
+        }
+        if strings.HasSuffix(r.URL.Path, "/reports") {
+            methods{"GET": getContactReports}.ServeHTTP(w, r)
+            return
+        }
+        if strings.HasSuffix(r.URL.Path, "/versions") {
+            methods{"GET": getContactVersions}.ServeHTTP(w, r)
+            return
+        }
+        if strings.Contains(r.URL.Path, "/versions/") && strings.HasSuffix(r.URL.Path, "/diff") {
+            methods{"GET": getContactVersionDiff}.ServeHTTP(w, r)
+            return
+        }
+        if strings.Contains(r.URL.Path, "/versions/") && strings.HasSuffix(r.URL.Path, "/restore") {
+            methods{"POST": restoreContactVersion}.ServeHTTP(w, r)
+            return
+        }
+        if strings.HasSuffix(r.URL.Path, "/comments") {
+            methods{"GET": listComments, "POST": createComment}.ServeHTTP(w, r)
+            return
+        }
+        if strings.Contains(r.URL.Path, "/comments/") {
+            methods{"DELETE": deleteComment}.ServeHTTP(w, r)
+            return
+        }
+        if strings.HasSuffix(r.URL.Path, "/attachments") {
+            methods{"GET": listAttachments, "POST": createAttachment}.ServeHTTP(w, r)
+            return
+        }
+        if strings.Contains(r.URL.Path, "/attachments/") {
+            methods{"GET": getAttachment, "DELETE": deleteAttachment}.ServeHTTP(w, r)
+            return
+        }
+        if strings.HasSuffix(r.URL.Path, "/consents") {
+            methods{"GET": listContactConsents, "POST": recordConsent}.ServeHTTP(w, r)
+            return
+        }
+        if strings.Contains(r.URL.Path, "/consents/") && strings.HasSuffix(r.URL.Path, "/revoke") {
+            methods{"POST": revokeConsent}.ServeHTTP(w, r)
+            return
+        }
+        if strings.HasSuffix(r.URL.Path, "/watch") {
+            methods{"PUT": watchContact, "DELETE": unwatchContact}.ServeHTTP(w, r)
+            return
+        }
+        if strings.HasSuffix(r.URL.Path, "/publish") {
+            methods{"POST": publishContact}.ServeHTTP(w, r)
+            return
+        }
+        if strings.HasSuffix(r.URL.Path, "/card") {
+            methods{"GET": getContactCard}.ServeHTTP(w, r)
+            return
+        }
+        methods{"GET": getContact, "PUT": updateContact, "DELETE": deleteContact}.ServeHTTP(w, r)
     })
 
-    handler := EnableCORS(router)
+    handler := ServiceVersion(RequestID(InstrumentRequests(AccessLog(StrictPaths(FilterIPs(EnableCORS(Authenticate(HandleHead(JSONAPI(MeterUsage(DetectAnomalies(RateLimit(RequestTimeout(RedactFields(DurableWrites(CausalReads(router)))))))))))))))))
 
     port := os.Getenv("PORT")
     if port == "" {
@@ -276,5 +1128,18 @@ func main() {
     }
 
     fmt.Printf("Contacts API running on port %s...\n", port)
-    log.Fatal(http.ListenAndServe(":"+port, handler))
+    if err := serve(&http.Server{Addr: ":" + port, Handler: handler}); err != nil {
+        log.Fatal(err)
+    }
+
+    // stop background jobs, hand the lease to another replica and persist
+    // usage counted since the last flush
+    stop()
+    leader.release()
+    flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+    defer cancel()
+    if err := meter.flush(flushCtx); err != nil {
+        logError("failed to flush usage on shutdown: %v", err)
+    }
+    logInfo("shutdown complete")
 }
@@ -0,0 +1,411 @@
+package main
+
+import (
+    "encoding/json"
+    "math"
+    "net/http"
+    "slices"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Merge suggestions are pairs of the tenant's contacts that look like the
+// same person, scored from their phones and names. Only pairs sharing a
+// phone or a name word are compared, and words shared by too many contacts
+// are skipped, so a suggestion run stays far from comparing every pair.
+// Accepting a suggestion merges the pair; dismissing it keeps it from being
+// suggested again.
+
+const (
+    // maxMergeScan caps the contacts one suggestion run compares, the most
+    // recently created first
+    maxMergeScan = 10000
+    // maxMergeBlock skips phones and name words shared by more contacts than
+    // this, which say little about two of them being the same
+    maxMergeBlock = 50
+    // minMergeScore is the score a pair needs to be suggested
+    minMergeScore     = 0.45
+    phoneMergeWeight  = 0.5
+    nameMergeWeight   = 0.5
+    defaultMergeLimit = 20
+    maxMergeLimit     = 100
+    mergeAccepted     = "accepted"
+    mergeDismissed    = "dismissed"
+)
+
+// MergeSuggestion is two contacts that may be one. Its ID is the two contact
+// IDs, the older first.
+type MergeSuggestion struct {
+    ID       string       `json:"id"`
+    Contacts [2]Contact   `json:"contacts"`
+    Score    float64      `json:"score"`
+    Reasons  MergeReasons `json:"reasons"`
+}
+
+// MergeReasons are what the score of a suggestion is made of
+type MergeReasons struct {
+    // SamePhone is set when the phones are the same once normalized
+    SamePhone bool `json:"same_phone"`
+    // NameSimilarity is 1 for names that read the same, 0 for names with
+    // nothing in common
+    NameSimilarity float64 `json:"name_similarity"`
+}
+
+// MergeDecision records an accepted or dismissed suggestion
+type MergeDecision struct {
+    ID        string    `bson:"_id" json:"-"`
+    Tenant    string    `bson:"tenant" json:"-"`
+    Pair      string    `bson:"pair" json:"id"`
+    Status    string    `bson:"status" json:"status"`
+    DecidedBy string    `bson:"decided_by" json:"decided_by"`
+    DecidedAt time.Time `bson:"decided_at" json:"decided_at"`
+}
+
+func mergeDecisionsCollection() collection {
+    return collectionOf("merge_decisions")
+}
+
+// mergePair is the suggestion ID of the contacts a and b
+func mergePair(a, b primitive.ObjectID) string {
+    if b.Hex() < a.Hex() {
+        a, b = b, a
+    }
+    return a.Hex() + "-" + b.Hex()
+}
+
+// nameSimilarity compares two names folded by searchKey, as written and with
+// their words sorted, so "Doe John" is "John Doe": 1 minus the edit distance
+// over the length of the longer one
+func nameSimilarity(a, b string) float64 {
+    sorted := func(s string) string {
+        words := strings.Fields(s)
+        slices.Sort(words)
+        return strings.Join(words, " ")
+    }
+    a, b = strings.Join(strings.Fields(a), " "), strings.Join(strings.Fields(b), " ")
+    return max(editSimilarity(a, b), editSimilarity(sorted(a), sorted(b)))
+}
+
+// editSimilarity is 1 minus the Levenshtein distance of a and b over the
+// runes of the longer one
+func editSimilarity(a, b string) float64 {
+    ra, rb := []rune(a), []rune(b)
+    if len(ra) == 0 || len(rb) == 0 {
+        return 0
+    }
+    prev := make([]int, len(rb)+1)
+    cur := make([]int, len(rb)+1)
+    for j := range prev {
+        prev[j] = j
+    }
+    for i := 1; i <= len(ra); i++ {
+        cur[0] = i
+        for j := 1; j <= len(rb); j++ {
+            cost := 1
+            if ra[i-1] == rb[j-1] {
+                cost = 0
+            }
+            cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+        }
+        prev, cur = cur, prev
+    }
+    return 1 - float64(prev[len(rb)])/float64(max(len(ra), len(rb)))
+}
+
+// mergeCandidate is a contact as the suggestion run compares it
+type mergeCandidate struct {
+    contact Contact
+    name    string
+    phone   string
+}
+
+// getMergeSuggestions handles GET /merge-suggestions[?limit=20], the pairs
+// of the caller's contacts most likely to be duplicates, best first. Drafts
+// and dismissed pairs are left out.
+func getMergeSuggestions(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    limit, ok := queryInt(r, "limit", defaultMergeLimit, maxMergeLimit)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "limit must be a positive number")
+        return
+    }
+    settings, err := callerSettings(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve settings")
+        return
+    }
+    pairs, err := mergeDecisionsCollection().Distinct(r.Context(), "pair", scopeFilter(r, bson.M{}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve merge decisions")
+        return
+    }
+    decided := map[any]bool{}
+    for _, p := range pairs {
+        decided[p] = true
+    }
+
+    opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(maxMergeScan + 1)
+    cursor, err := contactsCollection.Find(r.Context(), scopeFilter(r, bson.M{"draft": bson.M{"$ne": true}}), opts)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
+        return
+    }
+    var contacts []Contact
+    if err := cursor.All(r.Context(), &contacts); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    truncated := len(contacts) > maxMergeScan
+    if truncated {
+        contacts = contacts[:maxMergeScan]
+    }
+
+    candidates := make([]mergeCandidate, len(contacts))
+    blocks := map[string][]int{}
+    for i, c := range contacts {
+        candidates[i] = mergeCandidate{contact: c, name: searchKey(c.Name), phone: phoneKey(c.Phone, settings.PhoneRegion)}
+        if candidates[i].phone != "" {
+            blocks["phone:"+candidates[i].phone] = append(blocks["phone:"+candidates[i].phone], i)
+        }
+        for _, word := range strings.Fields(candidates[i].name) {
+            key := "name:" + word
+            if block := blocks[key]; len([]rune(word)) > 1 && (len(block) == 0 || block[len(block)-1] != i) {
+                blocks[key] = append(blocks[key], i)
+            }
+        }
+    }
+
+    compared := map[[2]int]bool{}
+    suggestions := []MergeSuggestion{}
+    for _, block := range blocks {
+        if len(block) < 2 || len(block) > maxMergeBlock {
+            continue
+        }
+        for x := 0; x < len(block); x++ {
+            for y := x + 1; y < len(block); y++ {
+                pair := [2]int{min(block[x], block[y]), max(block[x], block[y])}
+                if compared[pair] {
+                    continue
+                }
+                compared[pair] = true
+                if s, ok := scoreMerge(candidates[pair[0]], candidates[pair[1]]); ok && !decided[s.ID] {
+                    suggestions = append(suggestions, s)
+                }
+            }
+        }
+    }
+    slices.SortFunc(suggestions, func(a, b MergeSuggestion) int {
+        if a.Score != b.Score {
+            return int(math.Copysign(1, b.Score-a.Score))
+        }
+        return strings.Compare(a.ID, b.ID)
+    })
+    if len(suggestions) > limit {
+        suggestions = suggestions[:limit]
+    }
+    f, ok := phoneFormatFor(w, r)
+    if !ok {
+        return
+    }
+    for i := range suggestions {
+        for j := range suggestions[i].Contacts {
+            f.apply(&suggestions[i].Contacts[j])
+            suggestions[i].Contacts[j].setAvatarURL()
+        }
+    }
+    json.NewEncoder(w).Encode(bson.M{"suggestions": suggestions, "scanned": len(contacts), "truncated": truncated})
+}
+
+// scoreMerge scores a and b as duplicates, reporting whether they score
+// enough to be suggested
+func scoreMerge(a, b mergeCandidate) (MergeSuggestion, bool) {
+    reasons := MergeReasons{
+        SamePhone:      a.phone != "" && a.phone == b.phone,
+        NameSimilarity: math.Round(nameSimilarity(a.name, b.name)*100) / 100,
+    }
+    score := nameMergeWeight * reasons.NameSimilarity
+    if reasons.SamePhone {
+        score += phoneMergeWeight
+    }
+    score = math.Round(score*100) / 100
+    if score < minMergeScore {
+        return MergeSuggestion{}, false
+    }
+    first, second := a.contact, b.contact
+    if second.ID.Hex() < first.ID.Hex() {
+        first, second = second, first
+    }
+    return MergeSuggestion{ID: mergePair(first.ID, second.ID), Contacts: [2]Contact{first, second}, Score: score, Reasons: reasons}, true
+}
+
+// mergePairFromPath reads the pair of /merge-suggestions/{id}/{action}
+func mergePairFromPath(w http.ResponseWriter, r *http.Request) (a, b primitive.ObjectID, ok bool) {
+    id, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/merge-suggestions/"), "/")
+    first, second, _ := strings.Cut(id, "-")
+    a, errA := primitive.ObjectIDFromHex(first)
+    b, errB := primitive.ObjectIDFromHex(second)
+    if errA != nil || errB != nil || a == b {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid merge suggestion ID")
+        return a, b, false
+    }
+    return a, b, true
+}
+
+// recordMergeDecision remembers that the caller decided on the pair, which
+// is then no longer suggested
+func recordMergeDecision(r *http.Request, pair, status string) (MergeDecision, error) {
+    d := MergeDecision{ID: tenantOf(r) + "/" + pair, Tenant: tenantOf(r), Pair: pair, Status: status, DecidedBy: clientKey(r), DecidedAt: utcNow()}
+    _, err := mergeDecisionsCollection().ReplaceOne(r.Context(), bson.M{"_id": d.ID}, d, options.Replace().SetUpsert(true))
+    return d, err
+}
+
+// dismissMergeSuggestion handles POST /merge-suggestions/{id}/dismiss: the
+// pair is not a duplicate and is no longer suggested
+func dismissMergeSuggestion(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    a, b, ok := mergePairFromPath(w, r)
+    if !ok {
+        return
+    }
+    pair := mergePair(a, b)
+    d, err := recordMergeDecision(r, pair, mergeDismissed)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to dismiss merge suggestion")
+        return
+    }
+    recordAudit(r, "contact.merge.dismiss", pair, nil)
+    json.NewEncoder(w).Encode(d)
+}
+
+// acceptMergeSuggestion handles POST /merge-suggestions/{id}/accept[ with
+// {"keep": id}]: the other contact is merged into the kept one, the older by
+// default, and deleted. The kept contact keeps its name and phone and takes
+// the other's fields it lacks, tags and dates; comments, attachments and
+// consent records move over to it.
+func acceptMergeSuggestion(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if refuseUnreviewed(w, r) {
+        return
+    }
+    a, b, ok := mergePairFromPath(w, r)
+    if !ok {
+        return
+    }
+    var in struct {
+        Keep string `json:"keep"`
+    }
+    if r.ContentLength != 0 {
+        if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+            return
+        }
+        defer r.Body.Close()
+    }
+    pair := mergePair(a, b)
+    keepID, dropID := a, b
+    if b.Hex() < a.Hex() {
+        keepID, dropID = b, a
+    }
+    switch in.Keep {
+    case "", keepID.Hex():
+    case dropID.Hex():
+        keepID, dropID = dropID, keepID
+    default:
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "keep must be one of the suggestion's contacts")
+        return
+    }
+
+    var keep, drop Contact
+    for _, c := range []struct {
+        id  primitive.ObjectID
+        out *Contact
+    }{{keepID, &keep}, {dropID, &drop}} {
+        err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"_id": c.id})).Decode(c.out)
+        if err == mongo.ErrNoDocuments {
+            writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+            return
+        }
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+            return
+        }
+    }
+
+    changes := mergedChanges(keep, drop)
+    details := bson.M{"merged": dropID.Hex()}
+    found, ok := saveContactChanges(w, r, keepID, changes, versionUpdate, details)
+    if !ok {
+        return
+    }
+    if !found {
+        writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+        return
+    }
+    for _, coll := range []collection{commentsCollection(), attachmentsCollection(), consentsCollection()} {
+        _, err := coll.UpdateMany(r.Context(), scopeFilter(r, bson.M{"contact_id": dropID}), bson.M{"$set": bson.M{"contact_id": keepID}})
+        if err != nil {
+            logError("failed to move the comments, attachments and consents of contact %s to %s: %v", dropID.Hex(), keepID.Hex(), err)
+        }
+    }
+    if _, ok := removeContact(w, r, dropID, bson.M{"merged_into": keepID.Hex()}); !ok {
+        return
+    }
+    if _, err := recordMergeDecision(r, pair, mergeAccepted); err != nil {
+        logError("failed to record the merge of %s: %v", pair, err)
+    }
+    recordAudit(r, "contact.merge", keepID.Hex(), details)
+
+    var merged Contact
+    if err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"_id": keepID})).Decode(&merged); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return
+    }
+    merged.setAvatarURL()
+    json.NewEncoder(w).Encode(bson.M{
+        "message": "Contacts merged successfully",
+        "contact": merged,
+        "deleted": dropID.Hex(),
+    })
+}
+
+// mergedChanges are the changes merging drop into keep makes to keep
+func mergedChanges(keep, drop Contact) contactChanges {
+    var ch contactChanges
+    tags := normalizeTags(append(slices.Clone(keep.Tags), drop.Tags...))
+    if len(tags) > len(keep.Tags) {
+        ch.Tags = &tags
+    }
+    for _, f := range []struct {
+        kept, other string
+        change      **string
+    }{
+        {keep.Company, drop.Company, &ch.Company},
+        {keep.JobTitle, drop.JobTitle, &ch.JobTitle},
+        {keep.Website, drop.Website, &ch.Website},
+    } {
+        if f.kept == "" && f.other != "" {
+            *f.change = &f.other
+        }
+    }
+    if keep.Social == nil && drop.Social != nil {
+        ch.Social = drop.Social
+    }
+    dates := slices.Clone(keep.Dates)
+    for _, d := range drop.Dates {
+        if len(dates) < maxContactDates && !slices.ContainsFunc(dates, func(k ContactDate) bool { return k.Label == d.Label }) {
+            dates = append(dates, d)
+        }
+    }
+    if len(dates) > len(keep.Dates) {
+        ch.Dates = &dates
+    }
+    return ch
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+    "fmt"
+    "io"
+    "math"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// defaultBuckets suit request and job durations in seconds
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+type series struct {
+    labelValues []string
+    value       float64
+    counts      []uint64
+    count       uint64
+    sum         float64
+    exemplars   []*exemplar
+}
+
+// exemplar links the latest observation in a histogram bucket to its trace
+type exemplar struct {
+    traceID string
+    value   float64
+    at      time.Time
+}
+
+// metricFamily is one named metric with a fixed set of label names, rendered
+// in the Prometheus text exposition format by GET /metrics
+type metricFamily struct {
+    name    string
+    help    string
+    kind    string
+    labels  []string
+    buckets []float64
+
+    mu     sync.Mutex
+    series map[string]*series
+}
+
+var (
+    metricsMu       sync.Mutex
+    metricFamilies  []*metricFamily
+    metricCallbacks []func(w io.Writer)
+)
+
+func newFamily(name, help, kind string, buckets []float64, labels []string) *metricFamily {
+    f := &metricFamily{name: name, help: help, kind: kind, labels: labels, buckets: buckets, series: map[string]*series{}}
+    metricsMu.Lock()
+    metricFamilies = append(metricFamilies, f)
+    metricsMu.Unlock()
+    return f
+}
+
+// Counter only goes up
+type Counter struct{ f *metricFamily }
+
+// Gauge can be set to any value
+type Gauge struct{ f *metricFamily }
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct{ f *metricFamily }
+
+func newCounter(name, help string, labels ...string) Counter {
+    return Counter{newFamily(name, help, "counter", nil, labels)}
+}
+
+func newGauge(name, help string, labels ...string) Gauge {
+    return Gauge{newFamily(name, help, "gauge", nil, labels)}
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) Histogram {
+    return Histogram{newFamily(name, help, "histogram", buckets, labels)}
+}
+
+// gaugeFunc registers a gauge whose value is read at scrape time
+func gaugeFunc(name, help string, fn func() float64) {
+    metricsMu.Lock()
+    defer metricsMu.Unlock()
+    metricCallbacks = append(metricCallbacks, func(w io.Writer) {
+        fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(fn()))
+    })
+}
+
+func (c Counter) Inc(labelValues ...string) { c.Add(1, labelValues...) }
+
+func (c Counter) Add(v float64, labelValues ...string) {
+    c.f.with(labelValues, func(s *series) { s.value += v })
+}
+
+func (g Gauge) Set(v float64, labelValues ...string) {
+    g.f.with(labelValues, func(s *series) { s.value = v })
+}
+
+func (g Gauge) Add(v float64, labelValues ...string) {
+    g.f.with(labelValues, func(s *series) { s.value += v })
+}
+
+// Delete drops a series, e.g. when the thing it describes is removed
+func (g Gauge) Delete(labelValues ...string) {
+    g.f.mu.Lock()
+    defer g.f.mu.Unlock()
+    delete(g.f.series, strings.Join(labelValues, "\xff"))
+}
+
+func (h Histogram) Observe(v float64, labelValues ...string) {
+    h.ObserveWithExemplar(v, "", labelValues...)
+}
+
+// ObserveWithExemplar records v and, when traceID is set, keeps it as the
+// exemplar of the smallest bucket v falls into
+func (h Histogram) ObserveWithExemplar(v float64, traceID string, labelValues ...string) {
+    h.f.with(labelValues, func(s *series) {
+        marked := traceID == ""
+        for i, b := range h.f.buckets {
+            if v <= b {
+                s.counts[i]++
+                if !marked {
+                    s.exemplars[i] = &exemplar{traceID: traceID, value: v, at: time.Now()}
+                    marked = true
+                }
+            }
+        }
+        if !marked {
+            s.exemplars[len(h.f.buckets)] = &exemplar{traceID: traceID, value: v, at: time.Now()}
+        }
+        s.count++
+        s.sum += v
+    })
+}
+
+func (f *metricFamily) with(labelValues []string, update func(*series)) {
+    if len(labelValues) != len(f.labels) {
+        panic(fmt.Sprintf("metric %s: got %d label values, want %d", f.name, len(labelValues), len(f.labels)))
+    }
+    key := strings.Join(labelValues, "\xff")
+
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    s, ok := f.series[key]
+    if !ok {
+        s = &series{
+            labelValues: append([]string(nil), labelValues...),
+            counts:      make([]uint64, len(f.buckets)),
+            exemplars:   make([]*exemplar, len(f.buckets)+1),
+        }
+        f.series[key] = s
+    }
+    update(s)
+}
+
+// write renders the family; in OpenMetrics counters are declared without their
+// _total suffix and histogram buckets carry exemplars
+func (f *metricFamily) write(w io.Writer, openMetrics bool) {
+    f.mu.Lock()
+    defer f.mu.Unlock()
+
+    declared := f.name
+    if openMetrics && f.kind == "counter" {
+        declared = strings.TrimSuffix(f.name, "_total")
+    }
+    fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", declared, f.help, declared, f.kind)
+
+    keys := make([]string, 0, len(f.series))
+    for k := range f.series {
+        keys = append(keys, k)
+    }
+    sort.Strings(keys)
+
+    for _, k := range keys {
+        s := f.series[k]
+        if f.kind != "histogram" {
+            fmt.Fprintf(w, "%s%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatFloat(s.value))
+            continue
+        }
+        for i, b := range f.buckets {
+            fmt.Fprintf(w, "%s_bucket%s %d%s\n", f.name, formatLabels(f.labels, s.labelValues, "le", formatFloat(b)), s.counts[i], formatExemplar(s.exemplars[i], openMetrics))
+        }
+        fmt.Fprintf(w, "%s_bucket%s %d%s\n", f.name, formatLabels(f.labels, s.labelValues, "le", "+Inf"), s.count, formatExemplar(s.exemplars[len(f.buckets)], openMetrics))
+        fmt.Fprintf(w, "%s_sum%s %s\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), formatFloat(s.sum))
+        fmt.Fprintf(w, "%s_count%s %d\n", f.name, formatLabels(f.labels, s.labelValues, "", ""), s.count)
+    }
+}
+
+func formatLabels(names, values []string, extraName, extraValue string) string {
+    var parts []string
+    for i, n := range names {
+        parts = append(parts, n+`="`+escapeLabel(values[i])+`"`)
+    }
+    if extraName != "" {
+        parts = append(parts, extraName+`="`+extraValue+`"`)
+    }
+    if len(parts) == 0 {
+        return ""
+    }
+    return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatExemplar(e *exemplar, openMetrics bool) string {
+    if e == nil || !openMetrics {
+        return ""
+    }
+    return fmt.Sprintf(` # {trace_id="%s"} %s %.3f`, e.traceID, formatFloat(e.value), float64(e.at.UnixMilli())/1000)
+}
+
+func escapeLabel(v string) string {
+    return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+    if math.IsInf(v, 1) {
+        return "+Inf"
+    }
+    return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// metricsHandler handles GET /metrics for Prometheus scraping. Scrapers that
+// accept OpenMetrics get exemplars, which the classic text format cannot carry.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+    openMetrics := strings.Contains(r.Header.Get("Accept"), "application/openmetrics-text")
+    if openMetrics {
+        w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+    } else {
+        w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+    }
+
+    metricsMu.Lock()
+    families := append([]*metricFamily(nil), metricFamilies...)
+    callbacks := append([]func(w io.Writer){}, metricCallbacks...)
+    metricsMu.Unlock()
+
+    for _, f := range families {
+        f.write(w, openMetrics)
+    }
+    for _, cb := range callbacks {
+        cb(w)
+    }
+    if openMetrics {
+        fmt.Fprint(w, "# EOF\n")
+    }
+}
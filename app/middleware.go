@@ -0,0 +1,32 @@
+package main
+
+import (
+    "net/http"
+)
+
+// statusRecorder captures the status code and body size written by a handler
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+    bytes  int
+}
+
+func newStatusRecorder(w http.ResponseWriter) *statusRecorder {
+    return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+    rec.status = status
+    rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+    n, err := rec.ResponseWriter.Write(b)
+    rec.bytes += n
+    return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+    return rec.ResponseWriter
+}
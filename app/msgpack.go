@@ -0,0 +1,366 @@
+package main
+
+import (
+    "encoding/binary"
+    "encoding/json"
+    "maps"
+    "math"
+    "net/http"
+    "slices"
+    "strings"
+    "time"
+)
+
+// msgpackContentType is negotiated with Accept: application/msgpack
+const msgpackContentType = "application/msgpack"
+
+// wantsMsgpack reports whether the caller asked for MessagePack
+func wantsMsgpack(r *http.Request) bool {
+    accept := r.Header.Get("Accept")
+    return strings.Contains(accept, msgpackContentType) || strings.Contains(accept, "application/x-msgpack")
+}
+
+// The encoder below writes the subset of MessagePack the API needs. Contacts
+// have a dedicated path, as avoiding reflection is the point of offering it.
+
+func msgpackNil(b []byte) []byte {
+    return append(b, 0xc0)
+}
+
+func msgpackBool(b []byte, v bool) []byte {
+    if v {
+        return append(b, 0xc3)
+    }
+    return append(b, 0xc2)
+}
+
+func msgpackInt(b []byte, v int64) []byte {
+    switch {
+    case v >= 0 && v <= 0x7f:
+        return append(b, byte(v))
+    case v < 0 && v >= -32:
+        return append(b, byte(v))
+    case v >= math.MinInt32 && v <= math.MaxInt32:
+        return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(v))
+    default:
+        return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+    }
+}
+
+func msgpackFloat(b []byte, v float64) []byte {
+    return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(v))
+}
+
+func msgpackString(b []byte, s string) []byte {
+    n := len(s)
+    switch {
+    case n <= 31:
+        b = append(b, 0xa0|byte(n))
+    case n <= math.MaxUint8:
+        b = append(b, 0xd9, byte(n))
+    case n <= math.MaxUint16:
+        b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+    default:
+        b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+    }
+    return append(b, s...)
+}
+
+func msgpackArrayHeader(b []byte, n int) []byte {
+    switch {
+    case n <= 15:
+        return append(b, 0x90|byte(n))
+    case n <= math.MaxUint16:
+        return binary.BigEndian.AppendUint16(append(b, 0xdc), uint16(n))
+    default:
+        return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+    }
+}
+
+func msgpackMapHeader(b []byte, n int) []byte {
+    switch {
+    case n <= 15:
+        return append(b, 0x80|byte(n))
+    case n <= math.MaxUint16:
+        return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+    default:
+        return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+    }
+}
+
+// msgpackTime uses the timestamp extension type (-1)
+func msgpackTime(b []byte, t time.Time) []byte {
+    sec, nsec := t.Unix(), int64(t.Nanosecond())
+    if sec >= 0 && sec < 1<<34 {
+        return binary.BigEndian.AppendUint64(append(b, 0xd7, 0xff), uint64(nsec)<<34|uint64(sec))
+    }
+    b = append(b, 0xc7, 12, 0xff)
+    b = binary.BigEndian.AppendUint32(b, uint32(nsec))
+    return binary.BigEndian.AppendUint64(b, uint64(sec))
+}
+
+// msgpackContact encodes a contact with the keys of its JSON form
+func msgpackContact(b []byte, c Contact) []byte {
+    n := 5
+    if c.PhoneE164 != "" {
+        n += 2
+    }
+    if c.ShortID != "" {
+        n++
+    }
+    if len(c.Tags) > 0 {
+        n++
+    }
+    if c.Company != "" {
+        n++
+    }
+    if c.JobTitle != "" {
+        n++
+    }
+    if c.Website != "" {
+        n++
+    }
+    if c.WebsitePreview != nil {
+        n++
+    }
+    if c.Social != nil {
+        n++
+    }
+    if len(c.Dates) > 0 {
+        n++
+    }
+    if c.ReportsTo != nil {
+        n++
+    }
+    if c.Owner != "" {
+        n++
+    }
+    if c.Avatar != nil {
+        n++
+    }
+    if len(c.Highlights) > 0 {
+        n++
+    }
+    if c.Rank != "" {
+        n++
+    }
+    if c.Pinned {
+        n++
+    }
+    if c.Draft {
+        n++
+    }
+    if c.DoNotContact {
+        n++
+    }
+    if c.Version > 0 {
+        n++
+    }
+    b = msgpackMapHeader(b, n)
+    b = msgpackString(b, "id")
+    b = msgpackString(b, c.ID.Hex())
+    b = msgpackString(b, "name")
+    b = msgpackString(b, c.Name)
+    b = msgpackString(b, "phone")
+    b = msgpackString(b, c.Phone)
+    if c.PhoneE164 != "" {
+        b = msgpackString(b, "phone_e164")
+        b = msgpackString(b, c.PhoneE164)
+        b = msgpackString(b, "phone_formatted")
+        b = msgpackString(b, c.PhoneFormatted)
+    }
+    if c.ShortID != "" {
+        b = msgpackString(b, "short_id")
+        b = msgpackString(b, c.ShortID)
+    }
+    if len(c.Tags) > 0 {
+        b = msgpackString(b, "tags")
+        b = msgpackArrayHeader(b, len(c.Tags))
+        for _, t := range c.Tags {
+            b = msgpackString(b, t)
+        }
+    }
+    if c.Company != "" {
+        b = msgpackString(b, "company")
+        b = msgpackString(b, c.Company)
+    }
+    if c.JobTitle != "" {
+        b = msgpackString(b, "job_title")
+        b = msgpackString(b, c.JobTitle)
+    }
+    if c.Website != "" {
+        b = msgpackString(b, "website")
+        b = msgpackString(b, c.Website)
+    }
+    if p := c.WebsitePreview; p != nil {
+        b = msgpackString(b, "website_preview")
+        b = msgpackMapHeader(b, 3)
+        b = msgpackString(b, "title")
+        b = msgpackString(b, p.Title)
+        b = msgpackString(b, "favicon")
+        b = msgpackString(b, p.Favicon)
+        b = msgpackString(b, "fetched_at")
+        b = msgpackTime(b, p.FetchedAt)
+    }
+    if c.Social != nil {
+        handles := c.Social.handles()
+        b = msgpackString(b, "social")
+        b = msgpackMapHeader(b, len(handles))
+        for _, h := range handles {
+            b = msgpackString(b, h.network.key)
+            b = msgpackString(b, h.handle)
+        }
+    }
+    if len(c.Dates) > 0 {
+        b = msgpackString(b, "dates")
+        b = msgpackArrayHeader(b, len(c.Dates))
+        for _, d := range c.Dates {
+            b = msgpackMapHeader(b, 2)
+            b = msgpackString(b, "label")
+            b = msgpackString(b, d.Label)
+            b = msgpackString(b, "date")
+            b = msgpackString(b, d.Date)
+        }
+    }
+    if c.ReportsTo != nil {
+        b = msgpackString(b, "reports_to")
+        b = msgpackString(b, c.ReportsTo.Hex())
+    }
+    if c.Owner != "" {
+        b = msgpackString(b, "owner")
+        b = msgpackString(b, c.Owner)
+    }
+    if c.Avatar != nil {
+        b = msgpackString(b, "avatar")
+        b = msgpackAvatar(b, c.Avatar)
+    }
+    b = msgpackString(b, "created_at")
+    b = msgpackTime(b, c.CreatedAt)
+    b = msgpackString(b, "updated_at")
+    b = msgpackTime(b, c.UpdatedAt)
+    if c.Rank != "" {
+        b = msgpackString(b, "rank")
+        b = msgpackString(b, c.Rank)
+    }
+    if c.Pinned {
+        b = msgpackString(b, "pinned")
+        b = msgpackBool(b, true)
+    }
+    if c.Draft {
+        b = msgpackString(b, "draft")
+        b = msgpackBool(b, true)
+    }
+    if c.DoNotContact {
+        b = msgpackString(b, "do_not_contact")
+        b = msgpackBool(b, true)
+    }
+    if c.Version > 0 {
+        b = msgpackString(b, "version")
+        b = msgpackInt(b, int64(c.Version))
+    }
+    if len(c.Highlights) > 0 {
+        b = msgpackString(b, "highlights")
+        b = msgpackMapHeader(b, len(c.Highlights))
+        for _, field := range slices.Sorted(maps.Keys(c.Highlights)) {
+            b = msgpackString(b, field)
+            b = msgpackArrayHeader(b, len(c.Highlights[field]))
+            for _, span := range c.Highlights[field] {
+                b = msgpackMapHeader(b, 2)
+                b = msgpackString(b, "start")
+                b = msgpackInt(b, int64(span.Start))
+                b = msgpackString(b, "end")
+                b = msgpackInt(b, int64(span.End))
+            }
+        }
+    }
+    return b
+}
+
+// msgpackAvatar encodes an avatar with the keys of its JSON form
+func msgpackAvatar(b []byte, a *Avatar) []byte {
+    extra := 1
+    if len(a.Sizes) > 0 {
+        extra++
+    }
+    if a.URL != "" {
+        extra++
+    }
+    b = msgpackAvatarImage(b, a.AvatarImage, extra)
+    if len(a.Sizes) > 0 {
+        b = msgpackString(b, "sizes")
+        b = msgpackMapHeader(b, len(a.Sizes))
+        for _, name := range slices.Sorted(maps.Keys(a.Sizes)) {
+            b = msgpackString(b, name)
+            b = msgpackAvatarImage(b, a.Sizes[name], 0)
+        }
+    }
+    b = msgpackString(b, "updated_at")
+    b = msgpackTime(b, a.UpdatedAt)
+    if a.URL != "" {
+        b = msgpackString(b, "url")
+        b = msgpackString(b, a.URL)
+    }
+    return b
+}
+
+// msgpackAvatarImage encodes img as a map with room for extra keys the
+// caller appends
+func msgpackAvatarImage(b []byte, img AvatarImage, extra int) []byte {
+    n := 2 + extra
+    if img.Width != 0 {
+        n += 2
+    }
+    b = msgpackMapHeader(b, n)
+    b = msgpackString(b, "content_type")
+    b = msgpackString(b, img.ContentType)
+    b = msgpackString(b, "size")
+    b = msgpackInt(b, img.Size)
+    if img.Width != 0 {
+        b = msgpackString(b, "width")
+        b = msgpackInt(b, int64(img.Width))
+        b = msgpackString(b, "height")
+        b = msgpackInt(b, int64(img.Height))
+    }
+    return b
+}
+
+// msgpackValue encodes a decoded JSON document
+func msgpackValue(b []byte, v any) []byte {
+    switch v := v.(type) {
+    case nil:
+        return msgpackNil(b)
+    case bool:
+        return msgpackBool(b, v)
+    case string:
+        return msgpackString(b, v)
+    case json.Number:
+        if i, err := v.Int64(); err == nil {
+            return msgpackInt(b, i)
+        }
+        f, _ := v.Float64()
+        return msgpackFloat(b, f)
+    case float64:
+        return msgpackFloat(b, v)
+    case []any:
+        b = msgpackArrayHeader(b, len(v))
+        for _, e := range v {
+            b = msgpackValue(b, e)
+        }
+        return b
+    case map[string]any:
+        b = msgpackMapHeader(b, len(v))
+        for k, e := range v {
+            b = msgpackString(b, k)
+            b = msgpackValue(b, e)
+        }
+        return b
+    default:
+        return msgpackNil(b)
+    }
+}
+
+// writeMsgpack sends an encoded MessagePack body
+func writeMsgpack(w http.ResponseWriter, body []byte) {
+    w.Header().Set("Content-Type", msgpackContentType)
+    w.Write(body)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+    "context"
+    "strings"
+    "time"
+    "unicode"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+    "golang.org/x/text/unicode/norm"
+)
+
+// nameSearchBackfill is how many contacts one backfill round updates
+const nameSearchBackfill = 1000
+
+// foldedLetters are letters that don't decompose into a base letter and a
+// mark but are commonly typed as the ASCII letters they resemble
+var foldedLetters = strings.NewReplacer(
+    "ß", "ss", "æ", "ae", "œ", "oe", "ø", "o", "đ", "d", "ð", "d", "ł", "l", "þ", "th", "ı", "i",
+)
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:      "name-search-backfill",
+        Schedule:  "@hourly",
+        Timeout:   30 * time.Minute,
+        Singleton: true,
+        Run:       backfillNameSearch,
+    })
+}
+
+// normalizeName is how names are stored: in Unicode NFC, so "é" typed as one
+// code point and as "e" plus a combining accent are the same name
+func normalizeName(name string) string {
+    return norm.NFC.String(name)
+}
+
+// searchKey folds name for diacritic- and case-insensitive search: "José
+// Müller" becomes "jose muller". It is stored with every contact as
+// name_search.
+func searchKey(name string) string {
+    var b strings.Builder
+    for _, c := range norm.NFD.String(strings.ToLower(name)) {
+        if !unicode.Is(unicode.Mn, c) {
+            b.WriteRune(c)
+        }
+    }
+    return foldedLetters.Replace(b.String())
+}
+
+// foldPattern folds the literal letters of a ?name= pattern the way
+// searchKey folds names, leaving escapes such as \D and \p{Lu} alone
+func foldPattern(pattern string) string {
+    var b strings.Builder
+    runes := []rune(pattern)
+    for i := 0; i < len(runes); i++ {
+        if runes[i] != '\\' || i+1 == len(runes) {
+            b.WriteString(searchKey(string(runes[i])))
+            continue
+        }
+        end := i + 1
+        if (runes[end] == 'p' || runes[end] == 'P') && end+1 < len(runes) && runes[end+1] == '{' {
+            for end < len(runes)-1 && runes[end] != '}' {
+                end++
+            }
+        }
+        b.WriteString(string(runes[i : end+1]))
+        i = end
+    }
+    return b.String()
+}
+
+// backfillNameSearch normalizes the names of contacts written before names
+// were normalized and gives them a name_search key
+func backfillNameSearch(ctx context.Context) error {
+    for {
+        filter := bson.M{"name_search": bson.M{"$exists": false}, "name": bson.M{"$type": "string"}}
+        cursor, err := contactsCollection.Find(ctx, filter,
+            options.Find().SetProjection(bson.M{"_id": 1, "name": 1}).SetLimit(nameSearchBackfill))
+        if err != nil {
+            return err
+        }
+        var docs []struct {
+            ID   primitive.ObjectID `bson:"_id"`
+            Name string             `bson:"name"`
+        }
+        if err := cursor.All(ctx, &docs); err != nil {
+            return err
+        }
+        if len(docs) == 0 {
+            return nil
+        }
+
+        models := make([]mongo.WriteModel, len(docs))
+        for i, d := range docs {
+            // matching the old name too leaves a contact renamed meanwhile
+            // alone; its new name already came with a key
+            models[i] = mongo.NewUpdateOneModel().
+                SetFilter(bson.M{"_id": d.ID, "name": d.Name, "name_search": bson.M{"$exists": false}}).
+                SetUpdate(bson.M{"$set": bson.M{"name": normalizeName(d.Name), "name_search": searchKey(d.Name)}})
+        }
+        result, err := contactsCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+        if err != nil {
+            return err
+        }
+        logInfo("name-search-backfill: updated %d contacts", result.ModifiedCount)
+        if len(docs) < nameSearchBackfill {
+            return nil
+        }
+    }
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "sync/atomic"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// rankBackfill is how many contacts one backfill round ranks
+const rankBackfill = 1000
+
+// rankDigits are the digits of ranks, in ascending byte order so MongoDB's
+// binary string comparison orders ranks as numbers
+const rankDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// rankSeq tells apart the ranks given out in the same millisecond
+var rankSeq atomic.Uint32
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:      "rank-backfill",
+        Schedule:  "@hourly",
+        Timeout:   30 * time.Minute,
+        Singleton: true,
+        Run:       backfillRanks,
+    })
+}
+
+// newRank is the rank of a contact created at t, which puts it after the
+// contacts created before it. It ends in a digit other than "0", as every rank
+// must for there to be room for ranks just below it.
+func newRank(t time.Time) string {
+    return fmt.Sprintf("%011x%05xV", t.UnixMilli(), rankSeq.Add(1)&0xfffff)
+}
+
+// rankBetween returns a rank that sorts after a and before b, either of which
+// may be empty for no bound. Ranks are fractions in base 62: there is always
+// one between two others, so moving a contact only ever rewrites its own rank.
+func rankBetween(a, b string) string {
+    if b != "" {
+        // a shared prefix stays; a is padded with zeros to compare
+        n := 0
+        for n < len(b) && rankDigitAt(a, n) == b[n] {
+            n++
+        }
+        if n > 0 {
+            rest := ""
+            if n < len(a) {
+                rest = a[n:]
+            }
+            return b[:n] + rankBetween(rest, b[n:])
+        }
+    }
+    da := strings.IndexByte(rankDigits, rankDigitAt(a, 0))
+    db := len(rankDigits)
+    if b != "" {
+        db = strings.IndexByte(rankDigits, b[0])
+    }
+    if db-da > 1 {
+        return string(rankDigits[(da+db)/2])
+    }
+    // adjacent first digits: b's first digit alone sorts between if b goes on,
+    // otherwise keep a's first digit and go one place further
+    if len(b) > 1 {
+        return b[:1]
+    }
+    rest := ""
+    if len(a) > 1 {
+        rest = a[1:]
+    }
+    return string(rankDigitAt(a, 0)) + rankBetween(rest, "")
+}
+
+// rankDigitAt is digit i of rank, "0" past its end
+func rankDigitAt(rank string, i int) byte {
+    if i < len(rank) {
+        return rank[i]
+    }
+    return rankDigits[0]
+}
+
+// backfillRanks ranks contacts created before contacts were ranked, in the
+// order they were created
+func backfillRanks(ctx context.Context) error {
+    for {
+        cursor, err := contactsCollection.Find(ctx, bson.M{"rank": bson.M{"$exists": false}},
+            options.Find().SetProjection(bson.M{"_id": 1, "created_at": 1}).SetLimit(rankBackfill))
+        if err != nil {
+            return err
+        }
+        var docs []struct {
+            ID        primitive.ObjectID `bson:"_id"`
+            CreatedAt time.Time          `bson:"created_at"`
+        }
+        if err := cursor.All(ctx, &docs); err != nil {
+            return err
+        }
+        if len(docs) == 0 {
+            return nil
+        }
+
+        models := make([]mongo.WriteModel, len(docs))
+        for i, d := range docs {
+            created := d.CreatedAt
+            if created.IsZero() {
+                created = d.ID.Timestamp()
+            }
+            models[i] = mongo.NewUpdateOneModel().
+                SetFilter(bson.M{"_id": d.ID, "rank": bson.M{"$exists": false}}).
+                SetUpdate(bson.M{"$set": bson.M{"rank": newRank(created)}})
+        }
+        result, err := contactsCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+        if err != nil {
+            return err
+        }
+        logInfo("rank-backfill: ranked %d contacts", result.ModifiedCount)
+        if len(docs) < rankBackfill {
+            return nil
+        }
+    }
+}
+
+// contactPosition is the body of PUT /contacts/{id}/position: the contact to
+// place it right after or right before, or whether to pin it
+type contactPosition struct {
+    After  string `json:"after"`
+    Before string `json:"before"`
+    Pinned *bool  `json:"pinned"`
+}
+
+// neighbour loads the contact with id (or short ID) in the caller's tenant,
+// ranking it first if the backfill hasn't yet
+func neighbour(r *http.Request, id string) (Contact, error) {
+    var c Contact
+    objID, err := resolveContactID(r, id)
+    if err != nil {
+        return c, err
+    }
+    filter := scopeFilter(r, bson.M{"_id": objID})
+    projection := options.FindOne().SetProjection(bson.M{"_id": 1, "rank": 1, "pinned": 1})
+    if err := contactsCollection.FindOne(r.Context(), filter, projection).Decode(&c); err != nil || c.Rank != "" {
+        return c, err
+    }
+    _, err = contactsCollection.UpdateOne(r.Context(), bson.M{"_id": objID, "rank": bson.M{"$exists": false}},
+        bson.M{"$set": bson.M{"rank": newRank(objID.Timestamp())}})
+    if err != nil {
+        return c, err
+    }
+    err = contactsCollection.FindOne(r.Context(), filter, projection).Decode(&c)
+    return c, err
+}
+
+// adjacentRank is the rank next to anchor's among the contacts pinned like
+// it, other than the one being moved: the next one up if after, else the next
+// one down. It is empty if anchor is at that end.
+func adjacentRank(r *http.Request, anchor Contact, moved primitive.ObjectID, after bool) (string, error) {
+    op, dir := "$gt", 1
+    if !after {
+        op, dir = "$lt", -1
+    }
+    filter := scopeFilter(r, bson.M{"rank": bson.M{op: anchor.Rank}, "_id": bson.M{"$ne": moved}})
+    if anchor.Pinned {
+        filter["pinned"] = true
+    } else {
+        filter["pinned"] = bson.M{"$exists": false}
+    }
+    var next Contact
+    err := contactsCollection.FindOne(r.Context(), filter, options.FindOne().
+        SetSort(bson.D{{Key: "rank", Value: dir}}).SetProjection(bson.M{"rank": 1})).Decode(&next)
+    if err == mongo.ErrNoDocuments {
+        return "", nil
+    }
+    return next.Rank, err
+}
+
+// moveContact handles PUT /contacts/{id}/position. Placing a contact after or
+// before another gives it a rank between that contact's and its neighbour's,
+// and pins or unpins it like that contact; pinned contacts come first in
+// ?sort=manual. Only the moved contact is written.
+func moveContact(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if refuseUnreviewed(w, r) {
+        return
+    }
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    var pos contactPosition
+    if err := json.NewDecoder(r.Body).Decode(&pos); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    anchorID := pos.After + pos.Before
+    switch {
+    case pos.After != "" && pos.Before != "":
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "give either after or before, not both")
+        return
+    case anchorID == "" && pos.Pinned == nil:
+        writeError(w, http.StatusBadRequest, codeMissingField, "after, before or pinned is required")
+        return
+    case anchorID != "" && pos.Pinned != nil:
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "pinned can't be combined with after or before; the contact is pinned like its new neighbour")
+        return
+    }
+
+    rank, pinned := c.Rank, c.Pinned
+    if pos.Pinned != nil {
+        pinned = *pos.Pinned
+    }
+    if anchorID != "" {
+        anchor, err := neighbour(r, anchorID)
+        switch {
+        case err == errInvalidContactID:
+            writeError(w, http.StatusBadRequest, codeValidationFailed, "Invalid contact ID to place the contact next to")
+            return
+        case err == mongo.ErrNoDocuments:
+            writeError(w, http.StatusBadRequest, codeValidationFailed, "The contact to place the contact next to doesn't exist")
+            return
+        case err != nil:
+            writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+            return
+        case anchor.ID == c.ID:
+            writeError(w, http.StatusBadRequest, codeValidationFailed, "A contact can't be placed next to itself")
+            return
+        }
+        adjacent, err := adjacentRank(r, anchor, c.ID, pos.After != "")
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+            return
+        }
+        if pos.After != "" {
+            rank = rankBetween(anchor.Rank, adjacent)
+        } else {
+            rank = rankBetween(adjacent, anchor.Rank)
+        }
+        pinned = anchor.Pinned
+    }
+
+    set := bson.M{"rank": rank, "updated_at": utcNow()}
+    update := bson.M{"$set": set}
+    if pinned {
+        set["pinned"] = true
+    } else {
+        update["$unset"] = bson.M{"pinned": ""}
+    }
+    matched, later, err := updateContactsAsLastWriter(r.Context(), []primitive.ObjectID{c.ID}, scopeFilter(r, bson.M{}), set, withNextVersion(update))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to move contact")
+        return
+    }
+    contactCache.Delete(tenantOf(r) + "/" + c.ID.Hex())
+    if len(later) > 0 {
+        writeStillChanging(w)
+        return
+    }
+    if matched == 0 {
+        writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+        return
+    }
+    recordVersions(r, versionUpdate, c.ID)
+    publishContactEvent(r, "contact.updated", bson.M{"id": c.ID.Hex(), "changes": bson.M{"rank": rank, "pinned": pinned}})
+
+    json.NewEncoder(w).Encode(bson.M{"id": c.ID.Hex(), "rank": rank, "pinned": pinned})
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+    "strings"
+    "testing"
+    "time"
+)
+
+// between reports whether a < r < b, an empty bound being no bound
+func between(a, r, b string) bool {
+    return r > a && (b == "" || r < b)
+}
+
+func TestRankBetween(t *testing.T) {
+    tests := []struct {
+        a, b string
+    }{
+        {"", ""},
+        {"", "1"},
+        {"", "01"},
+        {"1", ""},
+        {"zzz", ""},
+        {"1", "3"},
+        {"1", "2"},
+        {"V", "W"},
+        {"Vz", "W"},
+        {"V", "V1"},
+        {"V", "V01"},
+        {"V0V", "V1"},
+        {"A", "A01"},
+        {"y", "z"},
+        {"yz", "z"},
+        {"0V", "1"},
+    }
+    for _, tt := range tests {
+        r := rankBetween(tt.a, tt.b)
+        if !between(tt.a, r, tt.b) {
+            t.Errorf("rankBetween(%q, %q) = %q, not between them", tt.a, tt.b, r)
+        }
+        if strings.HasSuffix(r, "0") || strings.Trim(r, rankDigits) != "" {
+            t.Errorf("rankBetween(%q, %q) = %q, not a valid rank", tt.a, tt.b, r)
+        }
+    }
+}
+
+// Moving contacts to the same place over and over, to the top or to the
+// bottom always finds room. bounds picks the neighbours of the next move
+// from the last two ranks, and the new rank takes the place of one of them.
+func TestRankBetweenRepeated(t *testing.T) {
+    tests := []struct {
+        name   string
+        bounds func(lo, hi string) (string, string)
+        keep   func(lo, hi, r string) (string, string)
+    }{
+        {"just after", func(lo, hi string) (string, string) { return lo, hi },
+            func(lo, hi, r string) (string, string) { return lo, r }},
+        {"just before", func(lo, hi string) (string, string) { return lo, hi },
+            func(lo, hi, r string) (string, string) { return r, hi }},
+        {"to the top", func(lo, hi string) (string, string) { return "", lo },
+            func(lo, hi, r string) (string, string) { return r, hi }},
+        {"to the bottom", func(lo, hi string) (string, string) { return hi, "" },
+            func(lo, hi, r string) (string, string) { return lo, r }},
+    }
+    now := time.Now()
+    for _, tt := range tests {
+        lo, hi := newRank(now), newRank(now.Add(time.Millisecond))
+        for i := 0; i < 500; i++ {
+            a, b := tt.bounds(lo, hi)
+            r := rankBetween(a, b)
+            if !between(a, r, b) || strings.HasSuffix(r, "0") {
+                t.Fatalf("%s: move %d between %q and %q gave %q", tt.name, i, a, b, r)
+            }
+            lo, hi = tt.keep(lo, hi, r)
+        }
+    }
+}
+
+func TestNewRank(t *testing.T) {
+    now := time.Now()
+    tests := []struct {
+        name          string
+        before, after time.Time
+    }{
+        {"same millisecond", now, now},
+        {"later millisecond", now, now.Add(time.Millisecond)},
+        {"later year", now, now.AddDate(1, 0, 0)},
+    }
+    for _, tt := range tests {
+        a, b := newRank(tt.before), newRank(tt.after)
+        if a >= b {
+            t.Errorf("%s: newRank gave %q then %q, out of order", tt.name, a, b)
+        }
+        if strings.HasSuffix(a, "0") || rankBetween(a, b) <= a {
+            t.Errorf("%s: no room after %q", tt.name, a)
+        }
+    }
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "slices"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    // maxReportingChain caps how many managers a contact can have above it
+    maxReportingChain = 50
+    // defaultReportsDepth and maxReportsDepth are the levels of reports
+    // GET /contacts/{id}/reports returns by default and at most
+    defaultReportsDepth = 3
+    maxReportsDepth     = 10
+)
+
+// checkManager checks that the contact id (zero for a new contact) may report
+// to manager: manager is one of the caller's contacts, and the chain of
+// managers above it neither comes back to id nor grows longer than
+// maxReportingChain. It returns the status, code and message to answer with
+// if not.
+func checkManager(r *http.Request, id, manager primitive.ObjectID) (int, string, string) {
+    if manager == id {
+        return http.StatusConflict, codeReportingCycle, "A contact can't report to itself"
+    }
+    next := manager
+    for n := 1; ; n++ {
+        if n > maxReportingChain {
+            return http.StatusBadRequest, codeValidationFailed, "The reporting chain above the manager is too long"
+        }
+        var c Contact
+        err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"_id": next}),
+            options.FindOne().SetProjection(bson.M{"reports_to": 1})).Decode(&c)
+        if err == mongo.ErrNoDocuments && n == 1 {
+            return http.StatusBadRequest, codeValidationFailed, "The manager in reports_to doesn't exist"
+        }
+        if err == mongo.ErrNoDocuments || (err == nil && c.ReportsTo == nil) {
+            return 0, "", ""
+        }
+        if err != nil {
+            return http.StatusInternalServerError, codeInternal, "Database error"
+        }
+        if *c.ReportsTo == id {
+            return http.StatusConflict, codeReportingCycle, "The contact can't report to someone who reports to it"
+        }
+        next = *c.ReportsTo
+    }
+}
+
+// resolveReportsTo checks the new manager of the contact id, if the changes
+// name one, and keeps its ID for update. An empty reports_to clears it.
+func (ch *contactChanges) resolveReportsTo(r *http.Request, id primitive.ObjectID) (int, string, string) {
+    if ch.ReportsTo == nil || *ch.ReportsTo == "" {
+        return 0, "", ""
+    }
+    manager, err := resolveContactID(r, *ch.ReportsTo)
+    switch {
+    case err == errInvalidContactID:
+        return http.StatusBadRequest, codeValidationFailed, "Invalid contact ID in reports_to"
+    case err == mongo.ErrNoDocuments:
+        return http.StatusBadRequest, codeValidationFailed, "The manager in reports_to doesn't exist"
+    case err != nil:
+        return http.StatusInternalServerError, codeInternal, "Database error"
+    }
+    if status, code, msg := checkManager(r, id, manager); status != 0 {
+        return status, code, msg
+    }
+    ch.manager = &manager
+    return 0, "", ""
+}
+
+// clearReportsTo leaves the direct reports of deleted contacts reporting to
+// no one, including those the caller's key tags hide
+func clearReportsTo(r *http.Request, ids ...primitive.ObjectID) {
+    all := r.WithContext(unscoped(r.Context()))
+    reports, err := matchingContactIDs(all, scopeFilter(r, bson.M{"reports_to": bson.M{"$in": ids}}), 0)
+    var later []primitive.ObjectID
+    if err == nil && len(reports) > 0 {
+        update := withNextVersion(bson.M{"$unset": bson.M{"reports_to": ""}})
+        set, _ := update["$set"].(bson.M)
+        _, later, err = updateContactsAsLastWriter(all.Context(), reports, scopeFilter(r, bson.M{}), set, update)
+    }
+    if err != nil {
+        logError("failed to clear reports_to of the reports of deleted contacts: %v", err)
+        return
+    }
+    if len(later) > 0 {
+        logError("failed to clear reports_to of %d reports of deleted contacts, which keep changing", len(later))
+        reports = slices.DeleteFunc(reports, func(id primitive.ObjectID) bool { return slices.Contains(later, id) })
+    }
+    for _, id := range reports {
+        contactCache.Delete(tenantOf(r) + "/" + id.Hex())
+    }
+    recordVersions(r, versionUpdate, reports...)
+}
+
+// OrgNode is a contact with the contacts reporting to it
+type OrgNode struct {
+    Contact
+    Reports []OrgNode `json:"reports"`
+}
+
+// getContactReports handles GET /contacts/{id}/reports[?depth=3], the
+// contact with the tree of contacts reporting to it, depth levels down (at
+// most maxReportsDepth), each level by name. The tree is read with one
+// $graphLookup, which stops at cycles left by concurrent changes.
+func getContactReports(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    depth, ok := queryInt(r, "depth", defaultReportsDepth, maxReportsDepth)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "depth must be a positive number")
+        return
+    }
+    root, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+
+    // the lookup isn't limited by the contacts collection, so it's given
+    // the tenant and key tags to stay within
+    within := scopeFilter(r, bson.M{})
+    if tags := keyTags(r.Context()); len(tags) > 0 {
+        within["tags"] = bson.M{"$in": tags}
+    }
+    cursor, err := contactsCollection.Aggregate(r.Context(), mongo.Pipeline{
+        {{Key: "$match", Value: scopeFilter(r, bson.M{"_id": root.ID})}},
+        {{Key: "$graphLookup", Value: bson.M{
+            "from":                    "contacts",
+            "startWith":               "$_id",
+            "connectFromField":        "_id",
+            "connectToField":          "reports_to",
+            "as":                      "reports",
+            "maxDepth":                depth - 1,
+            "restrictSearchWithMatch": within,
+        }}},
+        {{Key: "$project", Value: bson.M{"reports": 1}}},
+    })
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve reports")
+        return
+    }
+    var found []struct {
+        Reports []Contact `bson:"reports"`
+    }
+    if err := cursor.All(r.Context(), &found); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    limits := queryLimitsFor(r)
+    if len(found) == 1 && limits.MaxExportSize > 0 && len(found[0].Reports) > limits.MaxExportSize {
+        writeErrorWith(w, http.StatusRequestEntityTooLarge, codeExportTooLarge,
+            "Too many reports, ask for fewer levels", map[string]any{"max_export_size": limits.MaxExportSize})
+        return
+    }
+
+    f, ok := phoneFormatFor(w, r)
+    if !ok {
+        return
+    }
+    reports := map[primitive.ObjectID][]Contact{}
+    for _, found := range found {
+        for _, c := range found.Reports {
+            if c.ReportsTo != nil {
+                reports[*c.ReportsTo] = append(reports[*c.ReportsTo], c)
+            }
+        }
+    }
+    seen := map[primitive.ObjectID]bool{}
+    var node func(c Contact) OrgNode
+    node = func(c Contact) OrgNode {
+        seen[c.ID] = true
+        f.apply(&c)
+        c.setAvatarURL()
+        n := OrgNode{Contact: c, Reports: []OrgNode{}}
+        under := reports[c.ID]
+        slices.SortFunc(under, func(a, b Contact) int { return strings.Compare(a.Name, b.Name) })
+        for _, report := range under {
+            if !seen[report.ID] {
+                n.Reports = append(n.Reports, node(report))
+            }
+        }
+        return n
+    }
+
+    json.NewEncoder(w).Encode(node(root))
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+)
+
+// StrictPaths middleware only lets through paths naming a route in
+// routeTemplates. A trailing slash is redirected (308, keeping the method) to
+// the path without it; encoded slashes and control characters are rejected,
+// as they would change which segment an ID is read from; anything else gets 404.
+func StrictPaths(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if strings.Contains(strings.ToLower(r.URL.RawPath), "%2f") || strings.ContainsFunc(r.URL.Path, isControl) {
+            w.Header().Set("Content-Type", "application/json")
+            writeError(w, http.StatusBadRequest, codeInvalidPath, "Invalid characters in path")
+            return
+        }
+
+        path := r.URL.Path
+        if path != "/" && strings.HasSuffix(path, "/") {
+            canonical := strings.TrimRight(path, "/")
+            if canonical != "" && routeLabel(canonical) != "other" {
+                target := canonical
+                if r.URL.RawQuery != "" {
+                    target += "?" + r.URL.RawQuery
+                }
+                http.Redirect(w, r, target, http.StatusPermanentRedirect)
+                return
+            }
+        } else if routeLabel(path) != "other" {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Set("Content-Type", "application/json")
+        writeError(w, http.StatusNotFound, codeRouteNotFound, "Not found")
+    })
+}
+
+func isControl(c rune) bool {
+    return c < 0x20 || c == 0x7f
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+    "bytes"
+    "compress/zlib"
+    "fmt"
+    "strings"
+
+    "golang.org/x/text/encoding/charmap"
+)
+
+// A4 in points, the unit of PDF coordinates
+const (
+    pdfPageWidth  = 595
+    pdfPageHeight = 842
+)
+
+// pdfFont is one of the standard Type 1 fonts every PDF reader has, so
+// nothing needs embedding; they only cover Windows-1252, and other characters
+// print as "?"
+type pdfFont int
+
+const (
+    pdfRegular pdfFont = iota
+    pdfBold
+)
+
+// pdfWidths are the advance widths of the printable ASCII characters in
+// thousandths of the font size, from the Helvetica and Helvetica-Bold AFMs
+var pdfWidths = [...][95]int{
+    pdfRegular: {
+        278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+        556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+        1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+        667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+        333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+        556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+    },
+    pdfBold: {
+        278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+        556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+        975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+        667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+        333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+        611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+    },
+}
+
+// pdfText encodes s in Windows-1252 for the standard fonts, with "?" for
+// characters it lacks
+func pdfText(s string) []byte {
+    b := make([]byte, 0, len(s))
+    for _, r := range s {
+        c, ok := charmap.Windows1252.EncodeRune(r)
+        if !ok {
+            c = '?'
+        }
+        b = append(b, c)
+    }
+    return b
+}
+
+// width is how wide text encoded by pdfText is at size, in points. Characters
+// past ASCII are taken to be as wide as a digit, which is close enough for
+// the accented letters they mostly are.
+func (f pdfFont) width(text []byte, size float64) float64 {
+    units := 0
+    for _, c := range text {
+        if c >= 32 && c < 127 {
+            units += pdfWidths[f][c-32]
+        } else {
+            units += 556
+        }
+    }
+    return float64(units) * size / 1000
+}
+
+// fit shortens text to at most maxWidth points at size, ending it with an
+// ellipsis if anything had to go
+func (f pdfFont) fit(text []byte, size, maxWidth float64) []byte {
+    if f.width(text, size) <= maxWidth {
+        return text
+    }
+    const ellipsis = 0x85
+    for len(text) > 0 {
+        text = text[:len(text)-1]
+        if f.width(text, size)+f.width([]byte{ellipsis}, size) <= maxWidth {
+            break
+        }
+    }
+    return append(bytes.TrimRight(text, " "), ellipsis)
+}
+
+// pdfString writes b as a PDF literal string
+func pdfString(buf *bytes.Buffer, b []byte) {
+    buf.WriteByte('(')
+    for _, c := range b {
+        if c == '(' || c == ')' || c == '\\' {
+            buf.WriteByte('\\')
+        }
+        buf.WriteByte(c)
+    }
+    buf.WriteByte(')')
+}
+
+// pdfDoc is a PDF under construction: pages of text and lines drawn with
+// coordinates from the bottom left corner of the page
+type pdfDoc struct {
+    title string
+    pages []*bytes.Buffer
+    at    int
+}
+
+// newPage starts a page and turns to it
+func (d *pdfDoc) newPage() {
+    d.pages = append(d.pages, &bytes.Buffer{})
+    d.at = len(d.pages) - 1
+}
+
+// turnTo makes page i (from 0) the one drawn on
+func (d *pdfDoc) turnTo(i int) {
+    d.at = i
+}
+
+func (d *pdfDoc) page() *bytes.Buffer {
+    return d.pages[d.at]
+}
+
+// text draws encoded text with its baseline starting at x, y
+func (d *pdfDoc) text(x, y float64, font pdfFont, size float64, text []byte) {
+    p := d.page()
+    fmt.Fprintf(p, "BT /F%d %.1f Tf %.2f %.2f Td ", font+1, size, x, y)
+    pdfString(p, text)
+    p.WriteString(" Tj ET\n")
+}
+
+// rule draws a horizontal line of the given gray level (0 is black) from x1
+// to x2 at y
+func (d *pdfDoc) rule(x1, x2, y, gray float64) {
+    fmt.Fprintf(d.page(), "%.2f G 0.5 w %.2f %.2f m %.2f %.2f l S\n", gray, x1, y, x2, y)
+}
+
+// bytes writes out the document
+func (d *pdfDoc) bytes() []byte {
+    var out bytes.Buffer
+    var offsets []int
+    object := func(format string, args ...any) {
+        offsets = append(offsets, out.Len())
+        fmt.Fprintf(&out, "%d 0 obj\n", len(offsets))
+        fmt.Fprintf(&out, format, args...)
+        out.WriteString("\nendobj\n")
+    }
+
+    // objects 1-4 are fixed, then each page is followed by its contents
+    out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+    object("<< /Type /Catalog /Pages 2 0 R >>")
+    kids := make([]string, len(d.pages))
+    for i := range d.pages {
+        kids[i] = fmt.Sprintf("%d 0 R", 5+2*i)
+    }
+    object("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages))
+    object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+    object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+    for i, page := range d.pages {
+        object("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %d %d] /Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>",
+            pdfPageWidth, pdfPageHeight, 6+2*i)
+        var z bytes.Buffer
+        zw := zlib.NewWriter(&z)
+        zw.Write(page.Bytes())
+        zw.Close()
+        object("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", z.Len(), z.Bytes())
+    }
+    var info bytes.Buffer
+    info.WriteString("<< /Title ")
+    pdfString(&info, pdfText(d.title))
+    fmt.Fprintf(&info, " /Producer (user-service %s) /CreationDate (D:%s) >>", version, utcNow().Format("20060102150405Z"))
+    object("%s", info.Bytes())
+
+    xref := out.Len()
+    fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+    for _, off := range offsets {
+        fmt.Fprintf(&out, "%010d 00000 n \n", off)
+    }
+    fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info %d 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, len(offsets), xref)
+    return out.Bytes()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+    "net/http"
+    "sort"
+    "strings"
+)
+
+// phoneRegion describes how a country's numbers are dialled and written.
+// Formats maps the length of the national number (without trunk prefix) to
+// its national form, one X per digit.
+type phoneRegion struct {
+    Code    string
+    Trunk   string
+    Formats map[int]string
+}
+
+// phoneRegions are the regions numbers can be formatted for. Numbers of other
+// countries are still recognised in international form, and written as E.164.
+var phoneRegions = map[string]*phoneRegion{
+    "AU": {Code: "61", Trunk: "0", Formats: map[int]string{9: "0X XXXX XXXX"}},
+    "BR": {Code: "55", Trunk: "0", Formats: map[int]string{10: "(XX) XXXX-XXXX", 11: "(XX) XXXXX-XXXX"}},
+    "CA": {Code: "1", Trunk: "1", Formats: map[int]string{10: "(XXX) XXX-XXXX"}},
+    "CH": {Code: "41", Trunk: "0", Formats: map[int]string{9: "0XX XXX XX XX"}},
+    "DE": {Code: "49", Trunk: "0", Formats: map[int]string{9: "0XX XXXXXXX", 10: "0XXX XXXXXXX", 11: "0XXXX XXXXXXX"}},
+    "ES": {Code: "34", Formats: map[int]string{9: "XXX XX XX XX"}},
+    "FR": {Code: "33", Trunk: "0", Formats: map[int]string{9: "0X XX XX XX XX"}},
+    "GB": {Code: "44", Trunk: "0", Formats: map[int]string{10: "0XXXX XXXXXX"}},
+    "IE": {Code: "353", Trunk: "0", Formats: map[int]string{9: "0XX XXX XXXX"}},
+    "IN": {Code: "91", Trunk: "0", Formats: map[int]string{10: "XXXXX XXXXX"}},
+    "JP": {Code: "81", Trunk: "0", Formats: map[int]string{10: "0XX-XXX-XXXX"}},
+    "MX": {Code: "52", Formats: map[int]string{10: "XX XXXX XXXX"}},
+    "NL": {Code: "31", Trunk: "0", Formats: map[int]string{9: "0XX XXX XXXX"}},
+    "SE": {Code: "46", Trunk: "0", Formats: map[int]string{9: "0XX-XXX XX XX"}},
+    "US": {Code: "1", Trunk: "1", Formats: map[int]string{10: "(XXX) XXX-XXXX"}},
+}
+
+// regionsByCode finds a region for a country calling code. Regions sharing a
+// code (US and CA) share their formats, so either will do.
+var regionsByCode = func() map[string]*phoneRegion {
+    m := map[string]*phoneRegion{}
+    for _, pr := range phoneRegions {
+        m[pr.Code] = pr
+    }
+    return m
+}()
+
+func phoneRegionNames() []string {
+    names := make([]string, 0, len(phoneRegions))
+    for name := range phoneRegions {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    return names
+}
+
+// phoneNumber is a parsed number: its country calling code, if known, and the
+// national number without trunk prefix
+type phoneNumber struct {
+    Code     string
+    National string
+}
+
+// E164 returns the number as "+" followed by its digits
+func (n phoneNumber) E164() string {
+    return "+" + n.Code + n.National
+}
+
+// parsePhone reads raw, which may use spaces, dots, dashes, slashes and
+// parentheses between digits. Numbers starting with "+" or "00" are
+// international; others are read as national numbers of region. It reports
+// false for anything that can't be an E.164 number.
+func parsePhone(raw, region string) (phoneNumber, bool) {
+    raw = strings.TrimSpace(raw)
+    international := strings.HasPrefix(raw, "+")
+    if international {
+        raw = raw[1:]
+    }
+    digits := make([]byte, 0, len(raw))
+    for i := 0; i < len(raw); i++ {
+        switch c := raw[i]; {
+        case c >= '0' && c <= '9':
+            digits = append(digits, c)
+        case strings.IndexByte(" .-/()", c) < 0:
+            return phoneNumber{}, false
+        }
+    }
+    s := string(digits)
+    if !international && strings.HasPrefix(s, "00") {
+        s, international = s[2:], true
+    }
+
+    if international {
+        if len(s) < 8 || len(s) > 15 {
+            return phoneNumber{}, false
+        }
+        for n := 1; n <= 3; n++ {
+            if regionsByCode[s[:n]] != nil {
+                return phoneNumber{Code: s[:n], National: s[n:]}, true
+            }
+        }
+        return phoneNumber{National: s}, true
+    }
+
+    pr := phoneRegions[region]
+    if pr == nil {
+        return phoneNumber{}, false
+    }
+    if _, ok := pr.Formats[len(s)]; !ok && pr.Trunk != "" && strings.HasPrefix(s, pr.Trunk) {
+        s = s[len(pr.Trunk):]
+    }
+    if _, ok := pr.Formats[len(s)]; !ok {
+        return phoneNumber{}, false
+    }
+    return phoneNumber{Code: pr.Code, National: s}, true
+}
+
+// formatPhone writes n the way callers in region expect: in national form for
+// numbers of their own country, in international form otherwise. Numbers of
+// countries without known formats are written as E.164.
+func formatPhone(n phoneNumber, region string) string {
+    pr := regionsByCode[n.Code]
+    if pr == nil || pr.Formats[len(n.National)] == "" {
+        return n.E164()
+    }
+    format := pr.Formats[len(n.National)]
+    if own := phoneRegions[region]; own != nil && own.Code == n.Code {
+        return fillPhoneFormat(format, n.National)
+    }
+
+    // the international form drops the trunk prefix and the punctuation
+    format = strings.TrimLeft(format, "0123456789")
+    format = strings.NewReplacer("(", "", ")", "", "-", " ").Replace(format)
+    return "+" + n.Code + " " + fillPhoneFormat(format, n.National)
+}
+
+// fillPhoneFormat puts the digits in place of format's Xs
+func fillPhoneFormat(format, digits string) string {
+    var b strings.Builder
+    for i := 0; i < len(format); i++ {
+        if format[i] == 'X' {
+            b.WriteByte(digits[0])
+            digits = digits[1:]
+            continue
+        }
+        b.WriteByte(format[i])
+    }
+    return b.String()
+}
+
+// phoneFormat fills in the derived phone fields of contacts in responses
+type phoneFormat struct {
+    parseRegion   string
+    displayRegion string
+}
+
+// phoneFormatFor picks the regions for the caller's responses: national
+// numbers are read as the tenant's phone_region, and shown for the region
+// asked for with ?region= (or the region of ?locale=, like "en-GB"), or the
+// tenant's if neither is given. An unknown ?region= is answered with a 400.
+func phoneFormatFor(w http.ResponseWriter, r *http.Request) (phoneFormat, bool) {
+    settings, err := callerSettings(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve settings")
+        return phoneFormat{}, false
+    }
+
+    q := r.URL.Query()
+    region := strings.ToUpper(q.Get("region"))
+    if region != "" && phoneRegions[region] == nil {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "region must be one of "+strings.Join(phoneRegionNames(), ", "))
+        return phoneFormat{}, false
+    }
+    if region == "" {
+        // a locale's region is only a hint, so one we can't format is ignored
+        locale := strings.ReplaceAll(q.Get("locale"), "_", "-")
+        if i := strings.LastIndexByte(locale, '-'); i >= 0 && phoneRegions[strings.ToUpper(locale[i+1:])] != nil {
+            region = strings.ToUpper(locale[i+1:])
+        }
+    }
+
+    f := phoneFormat{parseRegion: settings.PhoneRegion, displayRegion: settings.PhoneRegion}
+    if region != "" {
+        f.displayRegion = region
+        if f.parseRegion == "" {
+            f.parseRegion = region
+        }
+    }
+    return f, true
+}
+
+// apply sets c's phone_e164 and phone_formatted, leaving them out for phones
+// that can't be read as a number
+func (f phoneFormat) apply(c *Contact) {
+    n, ok := parsePhone(c.Phone, f.parseRegion)
+    if !ok {
+        return
+    }
+    c.PhoneE164 = n.E164()
+    c.PhoneFormatted = formatPhone(n, f.displayRegion)
+}
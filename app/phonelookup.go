@@ -0,0 +1,300 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "net/url"
+    "os"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+)
+
+// GET /lookup/phone/{number} asks a reverse-lookup provider about a phone
+// number: its carrier, line type and how likely it is to be spam. Providers
+// charge per lookup and limit their rate, so answers are cached for
+// PHONE_LOOKUP_TTL, and a provider answering 429 isn't asked again until its
+// Retry-After has passed.
+
+const (
+    phoneLookupTimeout    = 5 * time.Second
+    defaultPhoneLookupTTL = 24 * time.Hour
+    // phoneLookupBackoff is how long a provider that limited our rate without
+    // a Retry-After is left alone
+    phoneLookupBackoff = time.Minute
+)
+
+// PhoneLookup is what a provider knows of a number. Found is false for
+// numbers it has no data on; SpamScore runs from 0 (not spam) to 1.
+type PhoneLookup struct {
+    Number     string    `json:"number"`
+    Found      bool      `json:"found"`
+    Carrier    string    `json:"carrier,omitempty"`
+    LineType   string    `json:"line_type,omitempty"`
+    SpamScore  *float64  `json:"spam_score,omitempty"`
+    SpamLabel  string    `json:"spam_label,omitempty"`
+    Provider   string    `json:"provider"`
+    LookedUpAt time.Time `json:"looked_up_at"`
+    Cached     bool      `json:"cached"`
+}
+
+// phoneLookupProvider looks numbers up; it is chosen with
+// PHONE_LOOKUP_PROVIDER, see startPhoneLookup
+type phoneLookupProvider interface {
+    name() string
+    // lookup returns what the provider knows of the E.164 number, or an
+    // errLookupRateLimited
+    lookup(ctx context.Context, number string) (PhoneLookup, error)
+}
+
+// errLookupRateLimited is returned by providers that limited our rate, with
+// when they can be asked again
+type errLookupRateLimited struct {
+    until time.Time
+}
+
+func (e errLookupRateLimited) Error() string {
+    return "rate limited by the lookup provider"
+}
+
+var (
+    phoneLookups     phoneLookupProvider
+    phoneLookupTTL   = defaultPhoneLookupTTL
+    phoneLookupCache = newTTLCache[PhoneLookup]()
+    phoneLookupTotal = newCounter("phone_lookups_total", "Phone number lookups by provider and outcome.", "provider", "result")
+
+    // phoneLookupBlocked is until when the provider limited our rate
+    phoneLookupBlockedMu sync.Mutex
+    phoneLookupBlocked   time.Time
+)
+
+// startPhoneLookup configures the lookup provider from PHONE_LOOKUP_PROVIDER:
+// "http" asks PHONE_LOOKUP_URL, with {number} replaced by the number and
+// PHONE_LOOKUP_TOKEN as bearer token; "twilio" uses the Twilio Lookup API
+// with TWILIO_ACCOUNT_SID and TWILIO_AUTH_TOKEN. PHONE_LOOKUP_TTL sets how
+// long answers are cached.
+func startPhoneLookup() error {
+    if ttl := os.Getenv("PHONE_LOOKUP_TTL"); ttl != "" {
+        d, err := time.ParseDuration(ttl)
+        if err != nil || d <= 0 {
+            return fmt.Errorf("PHONE_LOOKUP_TTL must be a positive duration such as 24h")
+        }
+        phoneLookupTTL = d
+    }
+    switch provider := os.Getenv("PHONE_LOOKUP_PROVIDER"); provider {
+    case "":
+    case "http":
+        endpoint := os.Getenv("PHONE_LOOKUP_URL")
+        if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || !strings.Contains(endpoint, "{number}") {
+            return fmt.Errorf("PHONE_LOOKUP_URL must be an http(s) URL containing {number}")
+        }
+        token, err := envSecret("PHONE_LOOKUP_TOKEN")
+        if err != nil {
+            return err
+        }
+        phoneLookups = &httpPhoneLookup{
+            url:    endpoint,
+            token:  token,
+            client: newTracedClient("phone-lookup", phoneLookupTimeout),
+        }
+    case "twilio":
+        sid := os.Getenv("TWILIO_ACCOUNT_SID")
+        token, err := envSecret("TWILIO_AUTH_TOKEN")
+        if err != nil {
+            return err
+        }
+        if sid == "" || token == "" {
+            return fmt.Errorf("the twilio provider needs TWILIO_ACCOUNT_SID and TWILIO_AUTH_TOKEN")
+        }
+        phoneLookups = &twilioPhoneLookup{
+            sid:    sid,
+            token:  token,
+            client: newTracedClient("phone-lookup", phoneLookupTimeout),
+        }
+    default:
+        return fmt.Errorf("PHONE_LOOKUP_PROVIDER must be http or twilio, not %q", provider)
+    }
+    return nil
+}
+
+// lookupPhone handles GET /lookup/phone/{number}. National numbers are read
+// as numbers of the tenant's phone region.
+func lookupPhone(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if phoneLookups == nil {
+        writeError(w, http.StatusServiceUnavailable, codeLookupUnavailable, "No phone lookup provider is configured")
+        return
+    }
+    settings, err := callerSettings(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve settings")
+        return
+    }
+    n, ok := parsePhone(strings.TrimPrefix(r.URL.Path, "/lookup/phone/"), settings.PhoneRegion)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "The number must be a phone number, in E.164 or of the tenant's region")
+        return
+    }
+    number := n.E164()
+    provider := phoneLookups.name()
+
+    if cached, ok := phoneLookupCache.Get(number); ok {
+        phoneLookupTotal.Inc(provider, "cached")
+        cached.Cached = true
+        json.NewEncoder(w).Encode(cached)
+        return
+    }
+    phoneLookupBlockedMu.Lock()
+    blocked := phoneLookupBlocked
+    phoneLookupBlockedMu.Unlock()
+    if wait := time.Until(blocked); wait > 0 {
+        phoneLookupTotal.Inc(provider, "rate_limited")
+        w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds())+1))
+        writeError(w, http.StatusServiceUnavailable, codeLookupUnavailable, "The phone lookup provider is rate limiting, try again later")
+        return
+    }
+
+    result, err := phoneLookups.lookup(r.Context(), number)
+    var limited errLookupRateLimited
+    if errors.As(err, &limited) {
+        phoneLookupBlockedMu.Lock()
+        phoneLookupBlocked = limited.until
+        phoneLookupBlockedMu.Unlock()
+        phoneLookupTotal.Inc(provider, "rate_limited")
+        w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(limited.until).Seconds())+1))
+        writeError(w, http.StatusServiceUnavailable, codeLookupUnavailable, "The phone lookup provider is rate limiting, try again later")
+        return
+    }
+    if err != nil {
+        phoneLookupTotal.Inc(provider, "failed")
+        logWarn("phone lookup with %s failed: %v", provider, err)
+        writeError(w, http.StatusBadGateway, codeLookupFailed, "The phone lookup provider failed")
+        return
+    }
+    result.Number, result.Provider, result.LookedUpAt = number, provider, utcNow()
+    phoneLookupCache.Set(number, result, phoneLookupTTL)
+    phoneLookupTotal.Inc(provider, "fetched")
+    recordAudit(r, "phone.lookup", number, bson.M{"provider": provider})
+    json.NewEncoder(w).Encode(result)
+}
+
+// rateLimitedUntil reads the Retry-After of a 429, in seconds or as a date
+func rateLimitedUntil(resp *http.Response) errLookupRateLimited {
+    retry := resp.Header.Get("Retry-After")
+    if s, err := strconv.Atoi(retry); err == nil && s > 0 {
+        return errLookupRateLimited{until: time.Now().Add(time.Duration(s) * time.Second)}
+    }
+    if t, err := http.ParseTime(retry); err == nil && t.After(time.Now()) {
+        return errLookupRateLimited{until: t}
+    }
+    return errLookupRateLimited{until: time.Now().Add(phoneLookupBackoff)}
+}
+
+// httpPhoneLookup asks a lookup service of our own, or a proxy to one, that
+// answers {"carrier", "line_type", "spam_score", "spam_label"}, or 404 for
+// numbers it doesn't know
+type httpPhoneLookup struct {
+    url    string
+    token  string
+    client *http.Client
+}
+
+func (p *httpPhoneLookup) name() string { return "http" }
+
+func (p *httpPhoneLookup) lookup(ctx context.Context, number string) (PhoneLookup, error) {
+    var result PhoneLookup
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(p.url, "{number}", url.PathEscape(number)), nil)
+    if err != nil {
+        return result, err
+    }
+    req.Header.Set("Accept", "application/json")
+    if p.token != "" {
+        req.Header.Set("Authorization", "Bearer "+p.token)
+    }
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return result, err
+    }
+    defer resp.Body.Close()
+    switch resp.StatusCode {
+    case http.StatusOK:
+    case http.StatusNotFound:
+        return result, nil
+    case http.StatusTooManyRequests:
+        return result, rateLimitedUntil(resp)
+    default:
+        return result, errors.New(resp.Status)
+    }
+    var body struct {
+        Carrier   string   `json:"carrier"`
+        LineType  string   `json:"line_type"`
+        SpamScore *float64 `json:"spam_score"`
+        SpamLabel string   `json:"spam_label"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+        return result, err
+    }
+    if body.SpamScore != nil && (*body.SpamScore < 0 || *body.SpamScore > 1) {
+        return result, fmt.Errorf("spam_score %v is not between 0 and 1", *body.SpamScore)
+    }
+    result.Found = true
+    result.Carrier, result.LineType, result.SpamScore, result.SpamLabel = body.Carrier, body.LineType, body.SpamScore, body.SpamLabel
+    return result, nil
+}
+
+// twilioPhoneLookup uses the line type intelligence of the Twilio Lookup v2
+// API, which knows carriers and line types but not spam
+type twilioPhoneLookup struct {
+    sid    string
+    token  string
+    client *http.Client
+}
+
+func (p *twilioPhoneLookup) name() string { return "twilio" }
+
+func (p *twilioPhoneLookup) lookup(ctx context.Context, number string) (PhoneLookup, error) {
+    var result PhoneLookup
+    endpoint := "https://lookups.twilio.com/v2/PhoneNumbers/" + url.PathEscape(number) + "?Fields=line_type_intelligence"
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+    if err != nil {
+        return result, err
+    }
+    req.SetBasicAuth(p.sid, p.token)
+    resp, err := p.client.Do(req)
+    if err != nil {
+        return result, err
+    }
+    defer resp.Body.Close()
+    switch resp.StatusCode {
+    case http.StatusOK:
+    case http.StatusNotFound:
+        return result, nil
+    case http.StatusTooManyRequests:
+        return result, rateLimitedUntil(resp)
+    default:
+        return result, errors.New(resp.Status)
+    }
+    var body struct {
+        Valid bool `json:"valid"`
+        Line  *struct {
+            CarrierName string `json:"carrier_name"`
+            Type        string `json:"type"`
+        } `json:"line_type_intelligence"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+        return result, err
+    }
+    if !body.Valid || body.Line == nil {
+        return result, nil
+    }
+    result.Found = true
+    result.Carrier, result.LineType = body.Line.CarrierName, body.Line.Type
+    return result, nil
+}
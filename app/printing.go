@@ -0,0 +1,296 @@
+package main
+
+import (
+    "bytes"
+    "net/http"
+    "strconv"
+    "strings"
+    "text/template"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Printouts are written as templates of a small line-based markup, which
+// layoutPDF sets on A4 pages:
+//
+//   - "# text" is a title and "## text" a heading
+//   - "---" is a rule across the page
+//   - "@columns 40 60" sets the widths of the table columns that follow, in percent
+//   - "! a\tb" is a table header row, repeated at the top of each page
+//   - any other line is a table row, or a paragraph if it has no tabs
+//
+// A blank line adds a little space. Values go through the row and text
+// functions, which keep tabs and newlines in them from breaking the markup.
+var printTemplates = template.Must(template.New("").Funcs(template.FuncMap{
+    "row":  printRow,
+    "text": printText,
+    "date": func(t time.Time) string {
+        return t.UTC().Format("2 Jan 2006")
+    },
+    "join":  strings.Join,
+    "phone": contactPhoneText,
+}).Parse(`
+{{- define "list" -}}
+# {{text .Title}}
+{{with .Subtitle}}{{text .}}{{end}}
+
+@columns 30 25 20 25
+! Name	Company	Phone	Tags
+{{range .Contacts}}{{row .Name .Company (phone .) (join .Tags ", ")}}
+{{end}}
+{{- end}}
+
+{{- define "card" -}}
+# {{text .Contact.Name}}
+{{- with .Contact.JobTitle}}
+{{text .}}{{end}}
+---
+@columns 25 75
+{{with .Contact.Company}}{{row "Company" .}}
+{{end}}
+{{- row "Phone" (phone .Contact)}}
+{{with .Contact.Tags}}{{row "Tags" (join . ", ")}}
+{{end}}
+{{- with .Contact.Owner}}{{row "Owner" .}}
+{{end}}
+{{- if not .Contact.CreatedAt.IsZero}}{{row "Added" (date .Contact.CreatedAt)}}
+{{end}}
+{{- if not .Contact.UpdatedAt.IsZero}}{{row "Updated" (date .Contact.UpdatedAt)}}
+{{end}}
+{{- end}}
+`))
+
+// printText flattens a value onto one line
+func printText(s string) string {
+    return strings.Join(strings.Fields(s), " ")
+}
+
+// printRow is a table row of the values
+func printRow(cells ...string) string {
+    for i, c := range cells {
+        cells[i] = printText(c)
+    }
+    // a leading "!" or "#" would make the row markup of its own
+    return " " + strings.Join(cells, "\t")
+}
+
+// contactPhoneText is how a printout shows a contact's phone: formatted for
+// the region asked for, if the number could be read
+func contactPhoneText(c Contact) string {
+    if c.PhoneFormatted != "" {
+        return c.PhoneFormatted
+    }
+    return c.Phone
+}
+
+// Sizes and spacing of printouts, in points
+const (
+    printMargin    = 50
+    printTitleSize = 18
+    printHeadSize  = 13
+    printBodySize  = 10
+    printCellGap   = 8
+)
+
+// renderPDF executes the printout template name with data and sets the
+// result as a PDF titled title
+func renderPDF(name, title string, data any) ([]byte, error) {
+    var markup bytes.Buffer
+    if err := printTemplates.ExecuteTemplate(&markup, name, data); err != nil {
+        return nil, err
+    }
+    return layoutPDF(title, markup.String()), nil
+}
+
+// layoutPDF sets printout markup on pages, numbering them at the foot
+func layoutPDF(title, markup string) []byte {
+    doc := &pdfDoc{title: title}
+    left, right := float64(printMargin), float64(pdfPageWidth-printMargin)
+    bottom := float64(printMargin + 2*printBodySize)
+    var y float64
+    var columns []float64
+    var header []string
+
+    cells := func(font pdfFont, values []string) {
+        x := left
+        for i, v := range values {
+            width := right - x
+            if i < len(columns) && i < len(values)-1 {
+                width = columns[i] * (right - left) / 100
+            }
+            doc.text(x, y, font, printBodySize, font.fit(pdfText(v), printBodySize, width-printCellGap))
+            x += width
+        }
+    }
+    // space makes room for a line of height, starting a page if it won't fit
+    space := func(height float64) {
+        if len(doc.pages) == 0 || y-height < bottom {
+            doc.newPage()
+            y = pdfPageHeight - printMargin
+            if header != nil {
+                y -= 1.4 * printBodySize
+                cells(pdfBold, header)
+                doc.rule(left, right, y-4, 0.5)
+                y -= 6
+            }
+        }
+        y -= height
+    }
+
+    for _, line := range strings.Split(markup, "\n") {
+        switch {
+        case strings.HasPrefix(line, "## "):
+            space(2 * printHeadSize)
+            doc.text(left, y, pdfBold, printHeadSize, pdfBold.fit(pdfText(line[3:]), printHeadSize, right-left))
+        case strings.HasPrefix(line, "# "):
+            space(1.6 * printTitleSize)
+            doc.text(left, y, pdfBold, printTitleSize, pdfBold.fit(pdfText(line[2:]), printTitleSize, right-left))
+            y -= printTitleSize / 2
+        case line == "---":
+            space(printBodySize)
+            doc.rule(left, right, y+printBodySize/2, 0)
+        case strings.HasPrefix(line, "@columns "):
+            columns = columns[:0]
+            for _, f := range strings.Fields(line[len("@columns "):]) {
+                if pct, err := strconv.ParseFloat(f, 64); err == nil {
+                    columns = append(columns, pct)
+                }
+            }
+            header = nil
+        case strings.HasPrefix(line, "! "):
+            header = nil
+            space(1.4 * printBodySize)
+            header = strings.Split(line[2:], "\t")
+            cells(pdfBold, header)
+            doc.rule(left, right, y-4, 0.5)
+            y -= 6
+        case strings.TrimSpace(line) == "":
+            if len(doc.pages) > 0 {
+                y -= printBodySize / 2
+            }
+        default:
+            space(1.4 * printBodySize)
+            cells(pdfRegular, strings.Split(strings.TrimPrefix(line, " "), "\t"))
+        }
+    }
+    if len(doc.pages) == 0 {
+        doc.newPage()
+    }
+
+    for i := range doc.pages {
+        doc.turnTo(i)
+        footer := pdfText("Page " + strconv.Itoa(i+1) + " of " + strconv.Itoa(len(doc.pages)))
+        doc.text(right-pdfRegular.width(footer, 8), printMargin, pdfRegular, 8, footer)
+    }
+    return doc.bytes()
+}
+
+// exportContactsPDF handles GET /contacts/export?format=pdf, a printable
+// phone list of the contacts matching the list filters, sorted by name unless
+// ?sort= says otherwise. Other formats are exported by POST /contacts/export.
+func exportContactsPDF(w http.ResponseWriter, r *http.Request) {
+    q := r.URL.Query()
+    if q.Get("format") != "pdf" {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "format must be pdf; other formats are exported with POST /contacts/export")
+        return
+    }
+    if q.Get("sort") == "" {
+        q.Set("sort", "name")
+        r.URL.RawQuery = q.Encode()
+    }
+
+    limits := queryLimitsFor(r)
+    filter, msg := contactFilter(r, limits)
+    if msg != "" {
+        writeError(w, http.StatusBadRequest, codeInvalidFilter, msg)
+        return
+    }
+    order, collation, ok := contactOrder(w, r)
+    if !ok {
+        return
+    }
+    f, ok := phoneFormatFor(w, r)
+    if !ok {
+        return
+    }
+
+    opts := options.Find().SetSort(order)
+    if collation != nil {
+        opts.SetCollation(collation)
+    }
+    if limits.MaxExportSize > 0 {
+        // one more than allowed tells us the export is too large
+        opts.SetLimit(int64(limits.MaxExportSize) + 1)
+    }
+    var contacts []Contact
+    ctx := withReadOperation(r.Context(), readExport)
+    cursor, err := contactsCollection.Find(ctx, scopeFilter(r, filter), opts)
+    if err == nil {
+        err = cursor.All(ctx, &contacts)
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
+        return
+    }
+    if limits.MaxExportSize > 0 && len(contacts) > limits.MaxExportSize {
+        writeErrorWith(w, http.StatusRequestEntityTooLarge, codeExportTooLarge,
+            "Export too large, narrow it down with filters", map[string]any{"max_export_size": limits.MaxExportSize})
+        return
+    }
+    for i := range contacts {
+        f.apply(&contacts[i])
+    }
+
+    noun := " contacts"
+    if len(contacts) == 1 {
+        noun = " contact"
+    }
+    data := map[string]any{
+        "Title":    "Contacts",
+        "Subtitle": strconv.Itoa(len(contacts)) + noun + ", printed " + utcNow().Format("2 Jan 2006"),
+        "Contacts": contacts,
+    }
+    pdf, err := renderPDF("list", "Contacts", data)
+    if err != nil {
+        logError("printing contact list: %v", err)
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to render PDF")
+        return
+    }
+
+    recordsServed(r, len(contacts))
+    recordAudit(r, "contacts.export", "", bson.M{"filter": r.URL.RawQuery, "format": "pdf", "count": len(contacts)})
+    w.Header().Set("Content-Type", "application/pdf")
+    w.Header().Set("Content-Disposition", `attachment; filename="contacts.pdf"`)
+    w.Header().Set("Cache-Control", "private, no-store")
+    w.Write(pdf)
+}
+
+// getContactCard handles GET /contacts/{id}/card, the contact printed on a
+// page of its own
+func getContactCard(w http.ResponseWriter, r *http.Request) {
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    f, ok := phoneFormatFor(w, r)
+    if !ok {
+        return
+    }
+    f.apply(&c)
+
+    w.Header().Set("Cache-Control", "private, no-cache")
+    if notModified(w, r, contactLastModified(c)) {
+        return
+    }
+    pdf, err := renderPDF("card", c.Name, map[string]any{"Contact": c})
+    if err != nil {
+        logError("printing contact %s: %v", c.ID.Hex(), err)
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to render PDF")
+        return
+    }
+    w.Header().Set("Content-Type", "application/pdf")
+    w.Header().Set("Content-Disposition", `inline; filename="contact-`+c.ID.Hex()+`.pdf"`)
+    w.Write(pdf)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "slices"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// API keys watch contacts with PUT /contacts/{id}/watch and register the
+// devices of their app users with POST /devices. When a watched contact is
+// updated or deleted, every device of every watching key is sent a push
+// notification through FCM or APNs (see pushsend.go), unless the key's
+// notification preferences turn that event off. The change's own key isn't
+// notified. Notifications carry only the event and the contact ID, since they
+// pass through Google and Apple; apps fetch the contact to show more.
+
+const (
+    pushQueueSize = 1000
+    // maxDevices caps the devices one API key can register
+    maxDevices = 100
+    // maxDeviceToken caps the length of a device token
+    maxDeviceToken = 4096
+)
+
+// push platforms
+const (
+    platformFCM  = "fcm"
+    platformAPNs = "apns"
+)
+
+// pushEvents are the contact events notifications can be sent for
+var pushEvents = []string{"contact.updated", "contact.deleted"}
+
+// Device is a mobile device an API key registered for push notifications
+type Device struct {
+    ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    Tenant    string             `bson:"tenant" json:"-"`
+    Owner     string             `bson:"owner" json:"owner,omitempty"`
+    Platform  string             `bson:"platform" json:"platform"`
+    Token     string             `bson:"token" json:"token"`
+    CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// ContactWatch is an API key watching a contact
+type ContactWatch struct {
+    Tenant    string             `bson:"tenant" json:"-"`
+    Owner     string             `bson:"owner" json:"-"`
+    ContactID primitive.ObjectID `bson:"contact_id" json:"contact_id"`
+    CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+// NotificationPreferences are an API key's choices of what to be notified of;
+// a key that never set them gets notifications for every event
+type NotificationPreferences struct {
+    Tenant string   `bson:"tenant" json:"-"`
+    Owner  string   `bson:"owner" json:"-"`
+    Muted  bool     `bson:"muted" json:"muted"`
+    Events []string `bson:"events" json:"events"`
+}
+
+// pushEvent is a change to a watched contact waiting to be fanned out
+type pushEvent struct {
+    ctx    context.Context
+    tenant string
+    actor  string
+    event  string
+    id     primitive.ObjectID
+}
+
+var (
+    pushQueue   = make(chan pushEvent, pushQueueSize)
+    pushSent    = newCounter("push_notifications_total", "Push notifications by platform and outcome.", "platform", "result")
+    pushDropped = newCounter("push_events_dropped_total", "Contact events not fanned out because the push queue was full.")
+)
+
+func devicesCollection() collection {
+    return collectionOf("push_devices")
+}
+
+func contactWatchesCollection() collection {
+    return collectionOf("contact_watches")
+}
+
+func notificationPrefsCollection() collection {
+    return collectionOf("notification_preferences")
+}
+
+// startPushWorker starts the goroutine that fans queued events out to devices
+func startPushWorker() {
+    go func() {
+        for e := range pushQueue {
+            fanOutPush(e)
+        }
+    }()
+}
+
+// notifyWatchers queues eventType on the contact in data for the keys
+// watching it. Like webhook deliveries, watchers are looked up and notified
+// after the response.
+func notifyWatchers(r *http.Request, eventType string, data any) {
+    if !slices.Contains(pushEvents, eventType) {
+        return
+    }
+    m, _ := data.(bson.M)
+    id, _ := m["id"].(string)
+    objID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        return
+    }
+    e := pushEvent{ctx: withTrace(r.Context(), context.Background()), tenant: tenantOf(r), actor: principalFrom(r).KeyID, event: eventType, id: objID}
+    select {
+    case pushQueue <- e:
+    default:
+        pushDropped.Inc()
+        logWarn("push queue full, dropped %s for contact %s", eventType, id)
+    }
+}
+
+// fanOutPush sends e to the devices of the keys other than its own watching
+// the contact that want notifications of it. A deleted contact's watches go.
+func fanOutPush(e pushEvent) {
+    ctx, cancel := context.WithTimeout(e.ctx, time.Minute)
+    defer cancel()
+    tenant := tenantFilter(e.tenant)["tenant"]
+    cursor, err := contactWatchesCollection().Find(ctx, bson.M{
+        "tenant":     tenant,
+        "contact_id": e.id,
+        "owner":      bson.M{"$ne": e.actor},
+    })
+    var watches []ContactWatch
+    if err == nil {
+        err = cursor.All(ctx, &watches)
+    }
+    if err == nil && e.event == "contact.deleted" {
+        _, err = contactWatchesCollection().DeleteMany(ctx, bson.M{"tenant": tenant, "contact_id": e.id})
+    }
+    if err != nil {
+        logError("failed to load watchers of contact %s: %v", e.id.Hex(), err)
+        return
+    }
+    owners := make([]string, len(watches))
+    for i, w := range watches {
+        owners[i] = w.Owner
+    }
+    if len(owners) == 0 {
+        return
+    }
+
+    var prefs []NotificationPreferences
+    cursor, err = notificationPrefsCollection().Find(ctx, bson.M{"tenant": tenant, "owner": bson.M{"$in": owners}})
+    if err == nil {
+        err = cursor.All(ctx, &prefs)
+    }
+    var devices []Device
+    if err == nil {
+        for _, p := range prefs {
+            if p.Muted || !slices.Contains(p.Events, e.event) {
+                owners = slices.DeleteFunc(owners, func(o string) bool { return o == p.Owner })
+            }
+        }
+        cursor, err = devicesCollection().Find(ctx, bson.M{"tenant": tenant, "owner": bson.M{"$in": owners}})
+    }
+    if err == nil {
+        err = cursor.All(ctx, &devices)
+    }
+    if err != nil {
+        logError("failed to load devices to notify of contact %s: %v", e.id.Hex(), err)
+        return
+    }
+    for _, d := range devices {
+        sendPush(ctx, d, e.event, e.id.Hex())
+    }
+}
+
+// deviceInput is the body of POST /devices
+type deviceInput struct {
+    Platform string `json:"platform"`
+    Token    string `json:"token"`
+}
+
+// registerDevice handles POST /devices with {"platform": "fcm" or "apns",
+// "token"}. Registering a token again, under any key, moves it to the caller,
+// since a device belongs to whoever is signed in on it.
+func registerDevice(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var in deviceInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    defer r.Body.Close()
+    in.Token = strings.TrimSpace(in.Token)
+    if in.Platform != platformFCM && in.Platform != platformAPNs {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "platform must be fcm or apns")
+        return
+    }
+    if in.Token == "" || len(in.Token) > maxDeviceToken {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "token is required and must not be longer than 4096 characters")
+        return
+    }
+
+    count, err := devicesCollection().CountDocuments(r.Context(), ownerFilter(r, bson.M{"token": bson.M{"$ne": in.Token}}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to register device")
+        return
+    }
+    if count >= maxDevices {
+        writeErrorWith(w, http.StatusForbidden, codeQuotaExceeded, "Too many devices, delete some first",
+            map[string]any{"max_devices": maxDevices})
+        return
+    }
+
+    d := Device{Tenant: tenantOf(r), Owner: principalFrom(r).KeyID, Platform: in.Platform, Token: in.Token, CreatedAt: utcNow()}
+    err = devicesCollection().FindOneAndUpdate(r.Context(),
+        bson.M{"platform": d.Platform, "token": d.Token},
+        bson.M{"$set": bson.M{"tenant": d.Tenant, "owner": d.Owner, "created_at": d.CreatedAt}},
+        options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)).Decode(&d)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to register device")
+        return
+    }
+    recordAudit(r, "device.register", d.ID.Hex(), bson.M{"platform": d.Platform})
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(d)
+}
+
+// listDevices handles GET /devices, the caller's devices, newest first
+func listDevices(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    cursor, err := devicesCollection().Find(r.Context(), ownerFilter(r, bson.M{}),
+        options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve devices")
+        return
+    }
+    devices := []Device{}
+    if err := cursor.All(r.Context(), &devices); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    json.NewEncoder(w).Encode(devices)
+}
+
+// deleteDevice handles DELETE /devices/{id}, for an app user signing out
+func deleteDevice(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    objID, err := primitive.ObjectIDFromHex(strings.TrimPrefix(r.URL.Path, "/devices/"))
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid device ID")
+        return
+    }
+    result, err := devicesCollection().DeleteOne(r.Context(), ownerFilter(r, bson.M{"_id": objID}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete device")
+        return
+    }
+    if result.DeletedCount == 0 {
+        writeError(w, http.StatusNotFound, codeDeviceNotFound, "Device not found")
+        return
+    }
+    recordAudit(r, "device.delete", objID.Hex(), nil)
+    json.NewEncoder(w).Encode(bson.M{"message": "Device deleted successfully"})
+}
+
+// watchContact handles PUT /contacts/{id}/watch, which is idempotent
+func watchContact(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    owner := principalFrom(r).KeyID
+    _, err := contactWatchesCollection().UpdateOne(r.Context(),
+        bson.M{"tenant": tenantOf(r), "owner": owner, "contact_id": c.ID},
+        bson.M{"$setOnInsert": bson.M{"created_at": utcNow()}},
+        options.Update().SetUpsert(true))
+    if err != nil && !mongo.IsDuplicateKeyError(err) {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to watch contact")
+        return
+    }
+    json.NewEncoder(w).Encode(bson.M{"message": "Contact watched", "contact_id": c.ID.Hex()})
+}
+
+// unwatchContact handles DELETE /contacts/{id}/watch; the contact may be gone
+func unwatchContact(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    objID, ok := versionsContactID(w, r)
+    if !ok {
+        return
+    }
+    _, err := contactWatchesCollection().DeleteOne(r.Context(), ownerFilter(r, bson.M{"contact_id": objID}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to unwatch contact")
+        return
+    }
+    json.NewEncoder(w).Encode(bson.M{"message": "Contact unwatched", "contact_id": objID.Hex()})
+}
+
+// deleteWatches removes the watches of deleted contacts
+func deleteWatches(r *http.Request, ids ...primitive.ObjectID) {
+    _, err := contactWatchesCollection().DeleteMany(r.Context(), scopeFilter(r, bson.M{"contact_id": bson.M{"$in": ids}}))
+    if err != nil {
+        logError("failed to delete the watches of deleted contacts: %v", err)
+    }
+}
+
+// listWatches handles GET /watches, the contacts the caller watches, newest first
+func listWatches(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    cursor, err := contactWatchesCollection().Find(r.Context(), ownerFilter(r, bson.M{}),
+        options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve watches")
+        return
+    }
+    watches := []ContactWatch{}
+    if err := cursor.All(r.Context(), &watches); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    json.NewEncoder(w).Encode(watches)
+}
+
+// notificationPrefs reads the caller's preferences, or the defaults
+func notificationPrefs(r *http.Request) (NotificationPreferences, error) {
+    p := NotificationPreferences{Events: pushEvents}
+    err := notificationPrefsCollection().FindOne(r.Context(), ownerFilter(r, bson.M{})).Decode(&p)
+    if err == mongo.ErrNoDocuments {
+        err = nil
+    }
+    return p, err
+}
+
+// getNotificationPrefs handles GET /notification-preferences
+func getNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    p, err := notificationPrefs(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve notification preferences")
+        return
+    }
+    json.NewEncoder(w).Encode(p)
+}
+
+// notificationPrefsInput is the body of PUT /notification-preferences;
+// fields left out are kept
+type notificationPrefsInput struct {
+    Muted  *bool     `json:"muted"`
+    Events *[]string `json:"events"`
+}
+
+// updateNotificationPrefs handles PUT /notification-preferences with
+// {"muted", "events"}
+func updateNotificationPrefs(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var in notificationPrefsInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    defer r.Body.Close()
+    p, err := notificationPrefs(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve notification preferences")
+        return
+    }
+    if in.Muted != nil {
+        p.Muted = *in.Muted
+    }
+    if in.Events != nil {
+        p.Events = []string{}
+        for _, e := range *in.Events {
+            if !slices.Contains(pushEvents, e) {
+                writeError(w, http.StatusBadRequest, codeValidationFailed, "events must be contact.updated or contact.deleted")
+                return
+            }
+            if !slices.Contains(p.Events, e) {
+                p.Events = append(p.Events, e)
+            }
+        }
+    }
+
+    p.Tenant, p.Owner = tenantOf(r), principalFrom(r).KeyID
+    _, err = notificationPrefsCollection().ReplaceOne(r.Context(), ownerFilter(r, bson.M{}), p, options.Replace().SetUpsert(true))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to save notification preferences")
+        return
+    }
+    json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto"
+    "crypto/ecdsa"
+    "crypto/rand"
+    "crypto/rsa"
+    "crypto/sha256"
+    "crypto/x509"
+    "encoding/base64"
+    "encoding/json"
+    "encoding/pem"
+    "errors"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+    fcmScope    = "https://www.googleapis.com/auth/firebase.messaging"
+    pushTimeout = 10 * time.Second
+    // apnsTokenAge is how long an APNs provider token is used; Apple wants a
+    // new one at least hourly but not more often than every 20 minutes
+    apnsTokenAge = 40 * time.Minute
+)
+
+// pushSenders are the configured push services by platform; see startPushSenders
+var pushSenders = map[string]pushSender{}
+
+// errDeviceGone is returned for a token the push service no longer accepts,
+// such as one of an uninstalled app
+var errDeviceGone = errors.New("device token is no longer valid")
+
+type pushSender interface {
+    send(ctx context.Context, token, event, contactID string) error
+}
+
+// startPushSenders configures FCM from PUSH_FCM_CREDENTIALS, a Google service
+// account key (JSON), and APNs from PUSH_APNS_KEY, a .p8 signing key, with
+// PUSH_APNS_KEY_ID, PUSH_APNS_TEAM_ID, PUSH_APNS_TOPIC (the app's bundle ID)
+// and PUSH_APNS_SANDBOX=true for development builds. Both keys are secrets:
+// they may be set as NAME_FILE or file:/vault: references.
+func startPushSenders() error {
+    creds, err := envSecret("PUSH_FCM_CREDENTIALS")
+    if err != nil {
+        return err
+    }
+    if creds != "" {
+        s, err := newFCMSender([]byte(creds))
+        if err != nil {
+            return fmt.Errorf("PUSH_FCM_CREDENTIALS: %w", err)
+        }
+        pushSenders[platformFCM] = s
+    }
+    key, err := envSecret("PUSH_APNS_KEY")
+    if err != nil {
+        return err
+    }
+    if key != "" {
+        s, err := newAPNsSender([]byte(key))
+        if err != nil {
+            return fmt.Errorf("PUSH_APNS_KEY: %w", err)
+        }
+        pushSenders[platformAPNs] = s
+    }
+    startPushWorker()
+    return nil
+}
+
+// pushTitle is the notification shown for a contact event
+func pushTitle(event string) string {
+    switch event {
+    case "contact.deleted":
+        return "A contact you watch was deleted"
+    case "contact.reminder":
+        return "A contact's date is coming up"
+    }
+    return "A contact you watch was updated"
+}
+
+// sendPush notifies one device, retrying once, and removes devices whose
+// token the push service rejects as gone. It reports whether the device was
+// notified.
+func sendPush(ctx context.Context, d Device, event, contactID string) bool {
+    s, ok := pushSenders[d.Platform]
+    if !ok {
+        pushSent.Inc(d.Platform, "unconfigured")
+        return false
+    }
+    var err error
+    for attempt := 1; attempt <= 2; attempt++ {
+        if err = s.send(ctx, d.Token, event, contactID); err == nil || err == errDeviceGone {
+            break
+        }
+    }
+    switch {
+    case err == errDeviceGone:
+        pushSent.Inc(d.Platform, "unregistered")
+        if _, err := devicesCollection().DeleteOne(ctx, bson.M{"_id": d.ID}); err != nil {
+            logWarn("failed to remove unregistered device %s: %v", d.ID.Hex(), err)
+        }
+    case err != nil:
+        pushSent.Inc(d.Platform, "failed")
+        logWarn("push to device %s failed: %v", d.ID.Hex(), err)
+    default:
+        pushSent.Inc(d.Platform, "sent")
+    }
+    return err == nil
+}
+
+// jwtPart is a base64url-encoded JSON part of a JSON Web Token
+func jwtPart(v any) string {
+    b, _ := json.Marshal(v)
+    return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// pemKey parses the PKCS #8 private key in a PEM block
+func pemKey(data []byte) (crypto.PrivateKey, error) {
+    block, _ := pem.Decode(data)
+    if block == nil {
+        return nil, errors.New("no PEM private key found")
+    }
+    return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// fcmSender sends through the Firebase Cloud Messaging HTTP v1 API, with
+// OAuth access tokens obtained for a service account
+type fcmSender struct {
+    project  string
+    email    string
+    tokenURI string
+    key      *rsa.PrivateKey
+    client   *http.Client
+
+    mu          sync.Mutex
+    accessToken string
+    expires     time.Time
+}
+
+func newFCMSender(creds []byte) (*fcmSender, error) {
+    var account struct {
+        ProjectID   string `json:"project_id"`
+        ClientEmail string `json:"client_email"`
+        PrivateKey  string `json:"private_key"`
+        TokenURI    string `json:"token_uri"`
+    }
+    if err := json.Unmarshal(creds, &account); err != nil {
+        return nil, fmt.Errorf("not a service account key: %w", err)
+    }
+    if account.ProjectID == "" || account.ClientEmail == "" || account.TokenURI == "" {
+        return nil, errors.New("service account key lacks project_id, client_email or token_uri")
+    }
+    key, err := pemKey([]byte(account.PrivateKey))
+    if err != nil {
+        return nil, err
+    }
+    rsaKey, ok := key.(*rsa.PrivateKey)
+    if !ok {
+        return nil, errors.New("service account private key isn't an RSA key")
+    }
+    return &fcmSender{
+        project:  account.ProjectID,
+        email:    account.ClientEmail,
+        tokenURI: account.TokenURI,
+        key:      rsaKey,
+        client:   newTracedClient("fcm", pushTimeout),
+    }, nil
+}
+
+// token returns an access token, exchanging a signed assertion for a new one
+// shortly before the current one expires
+func (s *fcmSender) token(ctx context.Context) (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.accessToken != "" && time.Until(s.expires) > time.Minute {
+        return s.accessToken, nil
+    }
+
+    now := time.Now()
+    unsigned := jwtPart(map[string]string{"alg": "RS256", "typ": "JWT"}) + "." + jwtPart(map[string]any{
+        "iss":   s.email,
+        "scope": fcmScope,
+        "aud":   s.tokenURI,
+        "iat":   now.Unix(),
+        "exp":   now.Add(time.Hour).Unix(),
+    })
+    digest := sha256.Sum256([]byte(unsigned))
+    sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+    if err != nil {
+        return "", err
+    }
+    form := url.Values{
+        "grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+        "assertion":  {unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)},
+    }
+    req, err := http.NewRequestWithContext(ctx, "POST", s.tokenURI, bytes.NewBufferString(form.Encode()))
+    if err != nil {
+        return "", err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return "", err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        return "", fmt.Errorf("FCM token exchange: %s: %s", resp.Status, body)
+    }
+    var grant struct {
+        AccessToken string `json:"access_token"`
+        ExpiresIn   int    `json:"expires_in"`
+    }
+    if err := json.NewDecoder(resp.Body).Decode(&grant); err != nil {
+        return "", err
+    }
+    s.accessToken, s.expires = grant.AccessToken, now.Add(time.Duration(grant.ExpiresIn)*time.Second)
+    return s.accessToken, nil
+}
+
+func (s *fcmSender) send(ctx context.Context, token, event, contactID string) error {
+    accessToken, err := s.token(ctx)
+    if err != nil {
+        return err
+    }
+    body, _ := json.Marshal(map[string]any{"message": map[string]any{
+        "token":        token,
+        "notification": map[string]string{"title": pushTitle(event)},
+        "data":         map[string]string{"event": event, "contact_id": contactID},
+    }})
+    endpoint := "https://fcm.googleapis.com/v1/projects/" + url.PathEscape(s.project) + "/messages:send"
+    req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    req.Header.Set("Authorization", "Bearer "+accessToken)
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    switch {
+    case resp.StatusCode == http.StatusOK:
+        return nil
+    case resp.StatusCode == http.StatusNotFound:
+        // UNREGISTERED
+        return errDeviceGone
+    }
+    msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+    return fmt.Errorf("FCM: %s: %s", resp.Status, msg)
+}
+
+// apnsSender sends through the Apple Push Notification service over HTTP/2,
+// authenticated with provider tokens signed by a .p8 key
+type apnsSender struct {
+    host   string
+    keyID  string
+    teamID string
+    topic  string
+    key    *ecdsa.PrivateKey
+    client *http.Client
+
+    mu       sync.Mutex
+    jwt      string
+    issuedAt time.Time
+}
+
+func newAPNsSender(p8 []byte) (*apnsSender, error) {
+    key, err := pemKey(p8)
+    if err != nil {
+        return nil, err
+    }
+    ecKey, ok := key.(*ecdsa.PrivateKey)
+    if !ok {
+        return nil, errors.New("not an APNs signing key (ECDSA P-256)")
+    }
+    s := &apnsSender{
+        host:   "api.push.apple.com",
+        keyID:  os.Getenv("PUSH_APNS_KEY_ID"),
+        teamID: os.Getenv("PUSH_APNS_TEAM_ID"),
+        topic:  os.Getenv("PUSH_APNS_TOPIC"),
+        key:    ecKey,
+        client: newTracedClient("apns", pushTimeout),
+    }
+    if s.keyID == "" || s.teamID == "" || s.topic == "" {
+        return nil, errors.New("PUSH_APNS_KEY_ID, PUSH_APNS_TEAM_ID and PUSH_APNS_TOPIC are required")
+    }
+    if os.Getenv("PUSH_APNS_SANDBOX") == "true" {
+        s.host = "api.sandbox.push.apple.com"
+    }
+    return s, nil
+}
+
+// providerToken returns the current provider token, signing a new one when
+// it is apnsTokenAge old
+func (s *apnsSender) providerToken() (string, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.jwt != "" && time.Since(s.issuedAt) < apnsTokenAge {
+        return s.jwt, nil
+    }
+
+    now := time.Now()
+    unsigned := jwtPart(map[string]string{"alg": "ES256", "kid": s.keyID}) + "." +
+        jwtPart(map[string]any{"iss": s.teamID, "iat": now.Unix()})
+    digest := sha256.Sum256([]byte(unsigned))
+    r, sv, err := ecdsa.Sign(rand.Reader, s.key, digest[:])
+    if err != nil {
+        return "", err
+    }
+    // JWS wants the two 32-byte halves of the signature, not ASN.1
+    sig := make([]byte, 64)
+    r.FillBytes(sig[:32])
+    sv.FillBytes(sig[32:])
+    s.jwt, s.issuedAt = unsigned+"."+base64.RawURLEncoding.EncodeToString(sig), now
+    return s.jwt, nil
+}
+
+func (s *apnsSender) send(ctx context.Context, token, event, contactID string) error {
+    jwt, err := s.providerToken()
+    if err != nil {
+        return err
+    }
+    body, _ := json.Marshal(map[string]any{
+        "aps":        map[string]any{"alert": map[string]string{"title": pushTitle(event)}},
+        "event":      event,
+        "contact_id": contactID,
+    })
+    req, err := http.NewRequestWithContext(ctx, "POST", "https://"+s.host+"/3/device/"+url.PathEscape(token), bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization", "bearer "+jwt)
+    req.Header.Set("apns-topic", s.topic)
+    req.Header.Set("apns-push-type", "alert")
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusOK {
+        return nil
+    }
+    var reply struct {
+        Reason string `json:"reason"`
+    }
+    json.NewDecoder(io.LimitReader(resp.Body, 512)).Decode(&reply)
+    if resp.StatusCode == http.StatusGone || reply.Reason == "BadDeviceToken" {
+        return errDeviceGone
+    }
+    return fmt.Errorf("APNs: %s: %s", resp.Status, reply.Reason)
+}
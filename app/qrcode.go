@@ -0,0 +1,461 @@
+package main
+
+import (
+    "bytes"
+    "errors"
+    "fmt"
+    "image"
+    "image/color"
+    "image/png"
+    "strings"
+)
+
+// A QR code encoder (ISO/IEC 18004) for what the service needs: byte mode at
+// error correction level M, the smallest version that fits, and the mask
+// with the lowest penalty.
+
+// qrQuietZone is the light border around a symbol, in modules
+const qrQuietZone = 4
+
+// Per version 1-40 at level M: error correction codewords per block and
+// number of blocks
+var (
+    qrECCPerBlock = [41]int{0, 10, 16, 26, 18, 24, 16, 18, 22, 22, 26, 30, 22, 22, 24, 24, 28, 28, 26, 26, 26, 26, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28, 28}
+    qrECCBlocks   = [41]int{0, 1, 1, 1, 2, 2, 4, 4, 4, 5, 5, 5, 8, 9, 9, 10, 10, 11, 13, 14, 16, 17, 17, 18, 20, 21, 23, 25, 26, 28, 29, 31, 33, 35, 37, 38, 40, 43, 45, 47, 49}
+)
+
+var errQRTooLong = errors.New("too much data for a QR code")
+
+// qrCode is an encoded symbol; modules[y][x] is true for dark modules
+type qrCode struct {
+    size     int
+    modules  [][]bool
+    function [][]bool
+}
+
+// encodeQR encodes data in the smallest QR code it fits in
+func encodeQR(data []byte) (*qrCode, error) {
+    version := 0
+    for v := 1; v <= 40; v++ {
+        if 4+qrCountBits(v)+8*len(data) <= 8*qrDataCodewords(v) {
+            version = v
+            break
+        }
+    }
+    if version == 0 {
+        return nil, errQRTooLong
+    }
+
+    // byte mode segment, terminator and padding
+    var bits qrBits
+    bits.append(0x4, 4)
+    bits.append(len(data), qrCountBits(version))
+    for _, b := range data {
+        bits.append(int(b), 8)
+    }
+    capacity := 8 * qrDataCodewords(version)
+    bits.append(0, min(4, capacity-len(bits)))
+    bits.append(0, (8-len(bits)%8)%8)
+    for pad := 0xEC; len(bits) < capacity; pad ^= 0xEC ^ 0x11 {
+        bits.append(pad, 8)
+    }
+    codewords := make([]byte, len(bits)/8)
+    for i, bit := range bits {
+        if bit {
+            codewords[i/8] |= 1 << (7 - i%8)
+        }
+    }
+
+    q := newQRCode(version)
+    q.drawCodewords(qrAddECC(codewords, version))
+    best, bestPenalty := 0, -1
+    for mask := 0; mask < 8; mask++ {
+        q.applyMask(mask)
+        q.drawFormatBits(mask)
+        if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+            best, bestPenalty = mask, p
+        }
+        q.applyMask(mask) // masking twice undoes it
+    }
+    q.applyMask(best)
+    q.drawFormatBits(best)
+    return q, nil
+}
+
+// qrCountBits is the length of the byte mode character count
+func qrCountBits(version int) int {
+    if version <= 9 {
+        return 8
+    }
+    return 16
+}
+
+// qrRawModules is how many modules of a version hold data and error
+// correction, after the function patterns and format and version bits
+func qrRawModules(version int) int {
+    n := (16*version+128)*version + 64
+    if version >= 2 {
+        align := version/7 + 2
+        n -= (25*align-10)*align - 55
+        if version >= 7 {
+            n -= 36
+        }
+    }
+    return n
+}
+
+// qrDataCodewords is how many data codewords a version holds at level M
+func qrDataCodewords(version int) int {
+    return qrRawModules(version)/8 - qrECCPerBlock[version]*qrECCBlocks[version]
+}
+
+type qrBits []bool
+
+func (b *qrBits) append(v, n int) {
+    for i := n - 1; i >= 0; i-- {
+        *b = append(*b, v>>i&1 == 1)
+    }
+}
+
+// qrAddECC splits data into the version's blocks, appends each block's
+// Reed-Solomon codewords and interleaves the blocks
+func qrAddECC(data []byte, version int) []byte {
+    numBlocks, eccLen := qrECCBlocks[version], qrECCPerBlock[version]
+    raw := qrRawModules(version) / 8
+    numShort := numBlocks - raw%numBlocks
+    shortLen := raw / numBlocks
+    divisor := qrRSDivisor(eccLen)
+
+    blocks := make([][]byte, numBlocks)
+    k := 0
+    for i := range blocks {
+        n := shortLen - eccLen
+        if i >= numShort {
+            n++
+        }
+        block := append([]byte{}, data[k:k+n]...)
+        k += n
+        ecc := qrRSRemainder(block, divisor)
+        if i < numShort {
+            block = append(block, 0) // short blocks skip this position
+        }
+        blocks[i] = append(block, ecc...)
+    }
+
+    out := make([]byte, 0, raw)
+    for i := range blocks[0] {
+        for j, block := range blocks {
+            if i != shortLen-eccLen || j >= numShort {
+                out = append(out, block[i])
+            }
+        }
+    }
+    return out
+}
+
+// qrGFMul multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1
+func qrGFMul(x, y byte) byte {
+    var z int
+    for i := 7; i >= 0; i-- {
+        z = z<<1 ^ (z>>7)*0x11D
+        z ^= int(y>>i&1) * int(x)
+    }
+    return byte(z)
+}
+
+func qrRSDivisor(degree int) []byte {
+    d := make([]byte, degree)
+    d[degree-1] = 1
+    root := byte(1)
+    for i := 0; i < degree; i++ {
+        for j := range d {
+            d[j] = qrGFMul(d[j], root)
+            if j+1 < len(d) {
+                d[j] ^= d[j+1]
+            }
+        }
+        root = qrGFMul(root, 0x02)
+    }
+    return d
+}
+
+func qrRSRemainder(data, divisor []byte) []byte {
+    r := make([]byte, len(divisor))
+    for _, b := range data {
+        factor := b ^ r[0]
+        copy(r, r[1:])
+        r[len(r)-1] = 0
+        for i := range r {
+            r[i] ^= qrGFMul(divisor[i], factor)
+        }
+    }
+    return r
+}
+
+// newQRCode is a symbol of version with its function patterns drawn
+func newQRCode(version int) *qrCode {
+    size := version*4 + 17
+    q := &qrCode{size: size, modules: make([][]bool, size), function: make([][]bool, size)}
+    for y := range q.modules {
+        q.modules[y] = make([]bool, size)
+        q.function[y] = make([]bool, size)
+    }
+
+    for i := 0; i < size; i++ {
+        q.setFunction(6, i, i%2 == 0)
+        q.setFunction(i, 6, i%2 == 0)
+    }
+    for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+        for dy := -4; dy <= 4; dy++ {
+            for dx := -4; dx <= 4; dx++ {
+                x, y := c[0]+dx, c[1]+dy
+                if x >= 0 && x < size && y >= 0 && y < size {
+                    d := max(abs(dx), abs(dy))
+                    q.setFunction(x, y, d != 2 && d != 4)
+                }
+            }
+        }
+    }
+    align := qrAlignmentPositions(version)
+    for i, ay := range align {
+        for j, ax := range align {
+            if i == 0 && j == 0 || i == 0 && j == len(align)-1 || i == len(align)-1 && j == 0 {
+                continue // finder patterns
+            }
+            for dy := -2; dy <= 2; dy++ {
+                for dx := -2; dx <= 2; dx++ {
+                    q.setFunction(ax+dx, ay+dy, max(abs(dx), abs(dy)) != 1)
+                }
+            }
+        }
+    }
+    q.drawFormatBits(0) // reserves the area; redrawn once the mask is chosen
+    if version >= 7 {
+        rem := version
+        for i := 0; i < 12; i++ {
+            rem = rem<<1 ^ (rem>>11)*0x1F25
+        }
+        bits := version<<12 | rem
+        for i := 0; i < 18; i++ {
+            a, b := size-11+i%3, i/3
+            q.setFunction(a, b, bits>>i&1 == 1)
+            q.setFunction(b, a, bits>>i&1 == 1)
+        }
+    }
+    return q
+}
+
+func abs(n int) int {
+    if n < 0 {
+        return -n
+    }
+    return n
+}
+
+func qrAlignmentPositions(version int) []int {
+    if version == 1 {
+        return nil
+    }
+    n := version/7 + 2
+    step := (version*4 + n*2 + 1) / (n*2 - 2) * 2
+    if version == 32 {
+        step = 26
+    }
+    pos := make([]int, n)
+    pos[0] = 6
+    for i, p := n-1, version*4+10; i >= 1; i, p = i-1, p-step {
+        pos[i] = p
+    }
+    return pos
+}
+
+func (q *qrCode) setFunction(x, y int, dark bool) {
+    q.modules[y][x] = dark
+    q.function[y][x] = true
+}
+
+// drawFormatBits draws both copies of the level and mask
+func (q *qrCode) drawFormatBits(mask int) {
+    data := mask // level M is 00, before the mask
+    rem := data
+    for i := 0; i < 10; i++ {
+        rem = rem<<1 ^ (rem>>9)*0x537
+    }
+    bits := (data<<10 | rem) ^ 0x5412
+    bit := func(i int) bool { return bits>>i&1 == 1 }
+
+    for i := 0; i <= 5; i++ {
+        q.setFunction(8, i, bit(i))
+    }
+    q.setFunction(8, 7, bit(6))
+    q.setFunction(8, 8, bit(7))
+    q.setFunction(7, 8, bit(8))
+    for i := 9; i < 15; i++ {
+        q.setFunction(14-i, 8, bit(i))
+    }
+    for i := 0; i < 8; i++ {
+        q.setFunction(q.size-1-i, 8, bit(i))
+    }
+    for i := 8; i < 15; i++ {
+        q.setFunction(8, q.size-15+i, bit(i))
+    }
+    q.setFunction(8, q.size-8, true)
+}
+
+// drawCodewords places data in the zigzag of two-module columns, bottom
+// right first, skipping function modules
+func (q *qrCode) drawCodewords(data []byte) {
+    i := 0
+    for right := q.size - 1; right >= 1; right -= 2 {
+        if right == 6 {
+            right = 5 // the vertical timing pattern
+        }
+        for vert := 0; vert < q.size; vert++ {
+            for j := 0; j < 2; j++ {
+                x := right - j
+                y := vert
+                if (right+1)&2 == 0 {
+                    y = q.size - 1 - vert
+                }
+                if !q.function[y][x] && i < len(data)*8 {
+                    q.modules[y][x] = data[i>>3]>>(7-i&7)&1 == 1
+                    i++
+                }
+            }
+        }
+    }
+}
+
+func (q *qrCode) applyMask(mask int) {
+    for y := 0; y < q.size; y++ {
+        for x := 0; x < q.size; x++ {
+            var invert bool
+            switch mask {
+            case 0:
+                invert = (x+y)%2 == 0
+            case 1:
+                invert = y%2 == 0
+            case 2:
+                invert = x%3 == 0
+            case 3:
+                invert = (x+y)%3 == 0
+            case 4:
+                invert = (x/3+y/2)%2 == 0
+            case 5:
+                invert = x*y%2+x*y%3 == 0
+            case 6:
+                invert = (x*y%2+x*y%3)%2 == 0
+            case 7:
+                invert = ((x+y)%2+x*y%3)%2 == 0
+            }
+            if invert && !q.function[y][x] {
+                q.modules[y][x] = !q.modules[y][x]
+            }
+        }
+    }
+}
+
+// penalty scores how hard the symbol is to scan: long runs of one colour,
+// 2×2 blocks, patterns that look like finders and an uneven dark/light ratio
+func (q *qrCode) penalty() int {
+    p, dark := 0, 0
+    line := make([]bool, q.size)
+    for _, vertical := range []bool{false, true} {
+        for a := 0; a < q.size; a++ {
+            for b := 0; b < q.size; b++ {
+                if vertical {
+                    line[b] = q.modules[b][a]
+                } else {
+                    line[b] = q.modules[a][b]
+                }
+            }
+            run := 1
+            for b := 1; b <= q.size; b++ {
+                if b < q.size && line[b] == line[b-1] {
+                    run++
+                    continue
+                }
+                if run >= 5 {
+                    p += run - 2
+                }
+                run = 1
+            }
+            for b := 0; b+11 <= q.size; b++ {
+                if qrFinderLike(line[b:b+11], false) || qrFinderLike(line[b:b+11], true) {
+                    p += 40
+                }
+            }
+        }
+    }
+    for y := 0; y < q.size; y++ {
+        for x := 0; x < q.size; x++ {
+            if q.modules[y][x] {
+                dark++
+            }
+            if x+1 < q.size && y+1 < q.size {
+                c := q.modules[y][x]
+                if c == q.modules[y][x+1] && c == q.modules[y+1][x] && c == q.modules[y+1][x+1] {
+                    p += 3
+                }
+            }
+        }
+    }
+    total := q.size * q.size
+    k := (abs(dark*20-total*10)+total-1)/total - 1
+    return p + max(k, 0)*10
+}
+
+// qrFinderLike reports whether s is dark-light-dark×3-light-dark followed (or,
+// reversed, preceded) by four light modules
+func qrFinderLike(s []bool, reversed bool) bool {
+    pattern := [11]bool{true, false, true, true, true, false, true, false, false, false, false}
+    for i, want := range pattern {
+        j := i
+        if reversed {
+            j = 10 - i
+        }
+        if s[j] != want {
+            return false
+        }
+    }
+    return true
+}
+
+// png renders the symbol with scale pixels per module and its quiet zone
+func (q *qrCode) png(scale int) ([]byte, error) {
+    side := (q.size + 2*qrQuietZone) * scale
+    img := image.NewPaletted(image.Rect(0, 0, side, side), color.Palette{color.White, color.Black})
+    for y := 0; y < q.size; y++ {
+        for x := 0; x < q.size; x++ {
+            if !q.modules[y][x] {
+                continue
+            }
+            for py := 0; py < scale; py++ {
+                row := img.Pix[((y+qrQuietZone)*scale+py)*img.Stride:]
+                for px := 0; px < scale; px++ {
+                    row[(x+qrQuietZone)*scale+px] = 1
+                }
+            }
+        }
+    }
+    var buf bytes.Buffer
+    err := png.Encode(&buf, img)
+    return buf.Bytes(), err
+}
+
+// svg renders the symbol as one path, one unit per module
+func (q *qrCode) svg() []byte {
+    side := q.size + 2*qrQuietZone
+    var b strings.Builder
+    fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, side, side)
+    fmt.Fprintf(&b, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, side, side)
+    for y := 0; y < q.size; y++ {
+        for x := 0; x < q.size; x++ {
+            if q.modules[y][x] {
+                fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+            }
+        }
+    }
+    b.WriteString(`"/></svg>`)
+    return []byte(b.String())
+}
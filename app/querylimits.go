@@ -0,0 +1,115 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "regexp/syntax"
+    "strconv"
+)
+
+// QueryLimits caps what a single request may ask of the database (0 is unlimited)
+type QueryLimits struct {
+    MaxPageSize      int `json:"max_page_size"`
+    MaxExportSize    int `json:"max_export_size"`
+    MaxPatternLength int `json:"max_pattern_length"`
+}
+
+// QueryLimitsConfig holds the limits for every caller; Keys replaces them for
+// individual API keys, e.g. a trusted backup job that exports everything
+type QueryLimitsConfig struct {
+    QueryLimits
+    Keys map[string]QueryLimits `json:"keys"`
+}
+
+func (c QueryLimitsConfig) validate(keys []APIKeyConfig) error {
+    check := func(where string, l QueryLimits) error {
+        if l.MaxPageSize < 0 || l.MaxExportSize < 0 || l.MaxPatternLength < 0 {
+            return fmt.Errorf("%s: values must not be negative", where)
+        }
+        return nil
+    }
+    if err := check("query_limits", c.QueryLimits); err != nil {
+        return err
+    }
+    for id, l := range c.Keys {
+        if !hasAPIKey(keys, id) {
+            return fmt.Errorf("query_limits.keys: unknown api key %q", id)
+        }
+        if err := check("query_limits.keys."+id, l); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func hasAPIKey(keys []APIKeyConfig, id string) bool {
+    for _, k := range keys {
+        if k.ID == id {
+            return true
+        }
+    }
+    return false
+}
+
+// queryLimitsFor returns the limits that apply to the caller
+func queryLimitsFor(r *http.Request) QueryLimits {
+    c := currentConfig().QueryLimits
+    if l, ok := c.Keys[principalFrom(r).KeyID]; ok {
+        return l
+    }
+    return c.QueryLimits
+}
+
+// pageParams reads ?limit= and ?offset=; limit is 0 when the caller wants
+// everything. Limits above the caller's max_page_size are rejected, not clamped,
+// so clients notice they are not getting what they asked for.
+func pageParams(r *http.Request, limits QueryLimits) (limit, offset int64, msg string) {
+    q := r.URL.Query()
+    if v := q.Get("limit"); v != "" {
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || n < 1 {
+            return 0, 0, "limit must be a positive integer"
+        }
+        if limits.MaxPageSize > 0 && n > int64(limits.MaxPageSize) {
+            return 0, 0, fmt.Sprintf("limit must not exceed %d", limits.MaxPageSize)
+        }
+        limit = n
+    }
+    if v := q.Get("offset"); v != "" {
+        n, err := strconv.ParseInt(v, 10, 64)
+        if err != nil || n < 0 {
+            return 0, 0, "offset must be a non-negative integer"
+        }
+        offset = n
+    }
+    return limit, offset, ""
+}
+
+// checkPattern rejects search patterns that could make MongoDB's regex engine
+// backtrack catastrophically: overly long ones and nested repetition such as (a+)+
+func checkPattern(pattern string, limits QueryLimits) string {
+    if limits.MaxPatternLength > 0 && len(pattern) > limits.MaxPatternLength {
+        return fmt.Sprintf("pattern must not be longer than %d characters", limits.MaxPatternLength)
+    }
+    re, err := syntax.Parse(pattern, syntax.Perl)
+    if err != nil {
+        return "invalid pattern"
+    }
+    if nestedRepeat(re, false) {
+        return "pattern must not nest repetitions"
+    }
+    return ""
+}
+
+func nestedRepeat(re *syntax.Regexp, inRepeat bool) bool {
+    repeat := re.Op == syntax.OpStar || re.Op == syntax.OpPlus || re.Op == syntax.OpRepeat
+    if repeat && inRepeat {
+        return true
+    }
+    for _, sub := range re.Sub {
+        if nestedRepeat(sub, inRepeat || repeat) {
+            return true
+        }
+    }
+    return false
+}
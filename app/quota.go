@@ -0,0 +1,299 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Quota caps the number of contacts a tenant or an owner (API key) may hold,
+// and for tenants the bytes their contacts' attachments may take up. Either
+// cap may be left out.
+type Quota struct {
+    ID                 string    `bson:"_id" json:"-"`
+    Scope              string    `bson:"scope" json:"scope"`
+    Name               string    `bson:"name" json:"name"`
+    MaxContacts        *int64    `bson:"max_contacts,omitempty" json:"max_contacts,omitempty"`
+    MaxAttachmentBytes *int64    `bson:"max_attachment_bytes,omitempty" json:"max_attachment_bytes,omitempty"`
+    UpdatedAt          time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// QuotaUsage pairs a quota with the current contact count and, where asked
+// for, the bytes of attachments stored
+type QuotaUsage struct {
+    Scope       string `json:"scope"`
+    Name        string `json:"name"`
+    MaxContacts int64  `json:"max_contacts,omitempty"`
+    Used        int64  `json:"used"`
+    Limited     bool   `json:"limited"`
+
+    MaxAttachmentBytes *int64 `json:"max_attachment_bytes,omitempty"`
+    AttachmentBytes    *int64 `json:"attachment_bytes,omitempty"`
+}
+
+func quotasCollection() collection {
+    return sharedCollectionOf("quotas")
+}
+
+func quotaID(scope, name string) string {
+    return scope + ":" + name
+}
+
+// quotaFilter matches the contacts counted against a quota
+func quotaFilter(scope, name string) bson.M {
+    if scope == "tenant" {
+        return tenantFilter(name)
+    }
+    return bson.M{"owner": name}
+}
+
+// quotaTenant returns the tenant whose contacts count against a quota; owner
+// quotas are those of API keys
+func quotaTenant(scope, name string) string {
+    if scope == "tenant" {
+        return name
+    }
+    for _, k := range currentConfig().APIKeys {
+        if k.ID == name {
+            return k.Tenant
+        }
+    }
+    return ""
+}
+
+// loadQuota loads a quota's limits without counting anything against it
+func loadQuota(ctx context.Context, scope, name string) (QuotaUsage, error) {
+    usage := QuotaUsage{Scope: scope, Name: name}
+
+    var q Quota
+    err := quotasCollection().FindOne(ctx, bson.M{"_id": quotaID(scope, name)}).Decode(&q)
+    if err != nil && err != mongo.ErrNoDocuments {
+        return usage, err
+    }
+    if err == nil && q.MaxContacts != nil {
+        usage.MaxContacts, usage.Limited = *q.MaxContacts, true
+    }
+    usage.MaxAttachmentBytes = q.MaxAttachmentBytes
+    return usage, nil
+}
+
+// countUsage counts the contacts held against u, in the region of the tenant
+// or owner key's tenant
+func countUsage(ctx context.Context, u *QuotaUsage) error {
+    ctx = withRegion(ctx, regionOf(quotaTenant(u.Scope, u.Name)))
+    var err error
+    u.Used, err = contactsCollection.CountDocuments(unscoped(ctx), quotaFilter(u.Scope, u.Name))
+    return err
+}
+
+// quotaUsage loads a quota and counts the contacts held against it
+func quotaUsage(ctx context.Context, scope, name string) (QuotaUsage, error) {
+    usage, err := loadQuota(ctx, scope, name)
+    if err != nil {
+        return usage, err
+    }
+    return usage, countUsage(ctx, &usage)
+}
+
+// callerQuotas lists the quotas that apply to the caller: its tenant and, for
+// API keys, its owner quota. With limitedOnly, contacts are only counted
+// against quotas with a max_contacts, which is all a create needs to check, so
+// unlimited callers don't pay for a count on every insert.
+func callerQuotas(ctx context.Context, r *http.Request, limitedOnly bool) ([]QuotaUsage, error) {
+    scopes := [][2]string{{"tenant", tenantOf(r)}}
+    if owner := principalFrom(r).KeyID; owner != "" {
+        scopes = append(scopes, [2]string{"owner", owner})
+    }
+
+    var usages []QuotaUsage
+    for _, s := range scopes {
+        u, err := loadQuota(ctx, s[0], s[1])
+        if err != nil {
+            return nil, err
+        }
+        if u.Limited || !limitedOnly {
+            if err := countUsage(ctx, &u); err != nil {
+                return nil, err
+            }
+        }
+        usages = append(usages, u)
+    }
+    return usages, nil
+}
+
+// addAttachmentUsage fills in the bytes of attachments stored against a
+// tenant quota; owner quotas don't cover attachments
+func addAttachmentUsage(ctx context.Context, u *QuotaUsage) error {
+    if u.Scope != "tenant" {
+        return nil
+    }
+    used, err := attachmentBytes(withRegion(ctx, regionOf(u.Name)), u.Name)
+    u.AttachmentBytes = &used
+    return err
+}
+
+// checkContactQuota reports the first quota that one more contact would exceed.
+// It counts and then the caller inserts, with nothing held in between, so
+// concurrent creates can overshoot a limit by the number of requests in flight;
+// quotas are a guard against runaway clients, not an exact cap.
+func checkContactQuota(ctx context.Context, r *http.Request) (*QuotaUsage, error) {
+    usages, err := callerQuotas(ctx, r, true)
+    if err != nil {
+        return nil, err
+    }
+    for _, u := range usages {
+        if u.Limited && u.Used >= u.MaxContacts {
+            return &u, nil
+        }
+    }
+    return nil, nil
+}
+
+// writeQuotaExceeded answers 403 with the quota that was hit
+func writeQuotaExceeded(w http.ResponseWriter, u *QuotaUsage) {
+    writeErrorWith(w, http.StatusForbidden, codeQuotaExceeded, "Contact quota exceeded", map[string]any{"quota": u})
+}
+
+// getOwnQuota handles GET /quota
+func getOwnQuota(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    usages, err := callerQuotas(r.Context(), r, false)
+    if err == nil {
+        err = addAttachmentUsage(r.Context(), &usages[0])
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve quota")
+        return
+    }
+
+    json.NewEncoder(w).Encode(usages)
+}
+
+// listQuotas handles GET /admin/quotas
+func listQuotas(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    cursor, err := quotasCollection().Find(r.Context(), bson.D{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve quotas")
+        return
+    }
+    quotas := []Quota{}
+    if err := cursor.All(r.Context(), &quotas); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    json.NewEncoder(w).Encode(quotas)
+}
+
+// parseQuotaPath splits /admin/quotas/{scope}/{name}[/usage]
+func parseQuotaPath(w http.ResponseWriter, r *http.Request) (scope, name string, ok bool) {
+    parts := strings.Split(strings.TrimSuffix(r.URL.Path[len("/admin/quotas/"):], "/usage"), "/")
+    if len(parts) != 2 || parts[1] == "" || (parts[0] != "tenant" && parts[0] != "owner") {
+        writeError(w, http.StatusBadRequest, codeInvalidPath, "Quota path must be /admin/quotas/{tenant|owner}/{name}")
+        return "", "", false
+    }
+    return parts[0], parts[1], true
+}
+
+// setQuota handles PUT /admin/quotas/{scope}/{name}
+func setQuota(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    scope, name, ok := parseQuotaPath(w, r)
+    if !ok {
+        return
+    }
+
+    var body struct {
+        MaxContacts        *int64 `json:"max_contacts"`
+        MaxAttachmentBytes *int64 `json:"max_attachment_bytes"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    switch {
+    case body.MaxContacts == nil && body.MaxAttachmentBytes == nil:
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "max_contacts or max_attachment_bytes is required")
+        return
+    case body.MaxContacts != nil && *body.MaxContacts < 0:
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "max_contacts must be a non-negative number")
+        return
+    case body.MaxAttachmentBytes != nil && *body.MaxAttachmentBytes < 0:
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "max_attachment_bytes must be a non-negative number")
+        return
+    case body.MaxAttachmentBytes != nil && scope != "tenant":
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "max_attachment_bytes only applies to tenant quotas")
+        return
+    }
+
+    q := Quota{
+        ID:                 quotaID(scope, name),
+        Scope:              scope,
+        Name:               name,
+        MaxContacts:        body.MaxContacts,
+        MaxAttachmentBytes: body.MaxAttachmentBytes,
+        UpdatedAt:          utcNow(),
+    }
+    _, err := quotasCollection().ReplaceOne(r.Context(), bson.M{"_id": q.ID}, q, options.Replace().SetUpsert(true))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to save quota")
+        return
+    }
+    recordAudit(r, "quota.set", q.ID, bson.M{"max_contacts": q.MaxContacts, "max_attachment_bytes": q.MaxAttachmentBytes})
+
+    json.NewEncoder(w).Encode(q)
+}
+
+// deleteQuota handles DELETE /admin/quotas/{scope}/{name}
+func deleteQuota(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    scope, name, ok := parseQuotaPath(w, r)
+    if !ok {
+        return
+    }
+
+    result, err := quotasCollection().DeleteOne(r.Context(), bson.M{"_id": quotaID(scope, name)})
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete quota")
+        return
+    }
+    if result.DeletedCount == 0 {
+        writeError(w, http.StatusNotFound, codeQuotaNotFound, "Quota not found")
+        return
+    }
+    recordAudit(r, "quota.delete", quotaID(scope, name), nil)
+
+    json.NewEncoder(w).Encode(bson.M{"message": "Quota deleted successfully"})
+}
+
+// getQuotaUsage handles GET /admin/quotas/{scope}/{name}/usage
+func getQuotaUsage(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    scope, name, ok := parseQuotaPath(w, r)
+    if !ok {
+        return
+    }
+
+    usage, err := quotaUsage(r.Context(), scope, name)
+    if err == nil {
+        err = addAttachmentUsage(r.Context(), &usage)
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve quota usage")
+        return
+    }
+
+    json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+    "fmt"
+    "math"
+    "net/http"
+    "slices"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// bucketIdleTimeout is how long an untouched bucket is kept before it is dropped
+const bucketIdleTimeout = 5 * time.Minute
+
+type tokenBucket struct {
+    tokens float64
+    last   time.Time
+}
+
+// rateLimiter keeps one token bucket per client, sized from the current config
+type rateLimiter struct {
+    mu        sync.Mutex
+    buckets   map[string]*tokenBucket
+    lastSweep time.Time
+}
+
+var limiter = &rateLimiter{buckets: map[string]*tokenBucket{}}
+
+// bucketState is the outcome of taking a token: whether it was granted, how
+// long to wait if not, and the bucket after the request
+type bucketState struct {
+    allowed   bool
+    wait      time.Duration
+    limit     int
+    remaining int
+    reset     time.Duration
+}
+
+// allow takes a token from key's bucket
+func (l *rateLimiter) allow(key string, rate float64, burst int) bucketState {
+    now := time.Now()
+    if burst < 1 {
+        burst = int(math.Ceil(rate))
+    }
+
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    if now.Sub(l.lastSweep) > bucketIdleTimeout {
+        for k, b := range l.buckets {
+            if now.Sub(b.last) > bucketIdleTimeout {
+                delete(l.buckets, k)
+            }
+        }
+        l.lastSweep = now
+    }
+
+    b, ok := l.buckets[key]
+    if !ok {
+        b = &tokenBucket{tokens: float64(burst), last: now}
+        l.buckets[key] = b
+    }
+
+    b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+    b.last = now
+
+    state := bucketState{limit: burst}
+    if b.tokens >= 1 {
+        b.tokens--
+        state.allowed = true
+    } else {
+        state.wait = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+    }
+    state.remaining = int(b.tokens)
+    state.reset = time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second))
+    return state
+}
+
+// Route classes rate limits can be configured for
+var routeClasses = []string{"read", "write", "export"}
+
+// RateLimitRule is the token bucket for one route class (0 requests_per_second disables limiting)
+type RateLimitRule struct {
+    RequestsPerSecond float64 `json:"requests_per_second"`
+    Burst             int     `json:"burst"`
+}
+
+// routeClass sorts a request into read, write or export; listing the whole
+// collection, a group or a saved search's results, printing them and
+// downloading a job's file count as exports
+func routeClass(r *http.Request) string {
+    switch {
+    case isWriteMethod(r.Method):
+        return "write"
+    case r.URL.Path == "/contacts" || r.URL.Path == "/contacts/export" || strings.HasPrefix(r.URL.Path, "/admin/export/"),
+        strings.HasPrefix(r.URL.Path, "/saved-searches/") && strings.HasSuffix(r.URL.Path, "/results"),
+        strings.HasPrefix(r.URL.Path, "/groups/") && strings.HasSuffix(r.URL.Path, "/contacts"),
+        strings.HasPrefix(r.URL.Path, "/companies/") && strings.HasSuffix(r.URL.Path, "/contacts"),
+        strings.HasPrefix(r.URL.Path, "/jobs/") && strings.HasSuffix(r.URL.Path, "/download"):
+        return "export"
+    default:
+        return "read"
+    }
+}
+
+// ruleFor picks the most specific rule for a request: the caller's tier for the
+// route class, the tier's "default", the route class, then the global rate
+func (c RateLimitConfig) ruleFor(tier, class string) RateLimitRule {
+    if rules, ok := c.Tiers[tier]; ok {
+        if rule, ok := rules[class]; ok {
+            return rule
+        }
+        if rule, ok := rules["default"]; ok {
+            return rule
+        }
+    }
+    if rule, ok := c.Routes[class]; ok {
+        return rule
+    }
+    return RateLimitRule{RequestsPerSecond: c.RequestsPerSecond, Burst: c.Burst}
+}
+
+// validate checks rule values, class names and the tiers api keys refer to
+func (c RateLimitConfig) validate(keys []APIKeyConfig) error {
+    check := func(where string, rules map[string]RateLimitRule, allowDefault bool) error {
+        for class, rule := range rules {
+            if !(allowDefault && class == "default") && !slices.Contains(routeClasses, class) {
+                return fmt.Errorf("%s: unknown route class %q (want one of %s)", where, class, strings.Join(routeClasses, ", "))
+            }
+            if rule.RequestsPerSecond < 0 || rule.Burst < 0 {
+                return fmt.Errorf("%s.%s: values must not be negative", where, class)
+            }
+        }
+        return nil
+    }
+
+    if c.RequestsPerSecond < 0 || c.Burst < 0 {
+        return fmt.Errorf("rate_limit values must not be negative")
+    }
+    if err := check("rate_limit.routes", c.Routes, false); err != nil {
+        return err
+    }
+    for tier, rules := range c.Tiers {
+        if err := check("rate_limit.tiers."+tier, rules, true); err != nil {
+            return err
+        }
+    }
+    for _, k := range keys {
+        if _, ok := c.Tiers[k.Tier]; k.Tier != "" && !ok {
+            return fmt.Errorf("api key %q: unknown rate limit tier %q", k.ID, k.Tier)
+        }
+    }
+    return nil
+}
+
+// RateLimit middleware applies the configured per-client request rate for the
+// request's route class and API key tier, and reports the bucket in RateLimit-* headers
+func RateLimit(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        p := principalFrom(r)
+        class := routeClass(r)
+        rule := currentConfig().RateLimit.ruleFor(p.Tier, class)
+        if rule.RequestsPerSecond <= 0 {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        state := limiter.allow(clientKey(r)+"|"+class, rule.RequestsPerSecond, rule.Burst)
+        w.Header().Set("RateLimit-Limit", strconv.Itoa(state.limit))
+        w.Header().Set("RateLimit-Remaining", strconv.Itoa(state.remaining))
+        w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(state.reset.Seconds()))))
+        w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", state.limit, int(math.Ceil(float64(state.limit)/rule.RequestsPerSecond))))
+
+        if !state.allowed {
+            w.Header().Set("Content-Type", "application/json")
+            w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(state.wait.Seconds()))))
+            writeError(w, http.StatusTooManyRequests, codeRateLimited, "Too many requests")
+            return
+        }
+
+        next.ServeHTTP(w, r)
+    })
+}
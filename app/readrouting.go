@@ -0,0 +1,83 @@
+package main
+
+import (
+    "context"
+    "fmt"
+    "net/http"
+    "slices"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/mongo/readpref"
+)
+
+// Listing, searching and exporting contacts read many documents, and can be
+// sent to secondaries to take that load off the primary. The operations named
+// in read_routing.operations read secondaryPreferred, from members at most
+// read_routing.max_staleness behind the primary; every other read, those of a
+// contact by ID in particular, stays on the primary and so sees the writes
+// made before it.
+
+// Read operations that can be routed to secondaries
+const (
+    readList   = "list"
+    readSearch = "search"
+    readExport = "export"
+)
+
+var readOperations = []string{readList, readSearch, readExport}
+
+// minMaxStaleness is the least maxStaleness MongoDB accepts
+const minMaxStaleness = 90 * time.Second
+
+// ReadRoutingConfig lists the read operations sent to secondaries and how far
+// behind the primary those may be (0 for no bound)
+type ReadRoutingConfig struct {
+    Operations   []string `json:"operations"`
+    MaxStaleness Duration `json:"max_staleness"`
+}
+
+func (c ReadRoutingConfig) validate() error {
+    for _, op := range c.Operations {
+        if !slices.Contains(readOperations, op) {
+            return fmt.Errorf("read_routing.operations: unknown operation %q (want one of %s)", op, strings.Join(readOperations, ", "))
+        }
+    }
+    if c.MaxStaleness != 0 && time.Duration(c.MaxStaleness) < minMaxStaleness {
+        return fmt.Errorf("read_routing.max_staleness must be 0 or at least %s", minMaxStaleness)
+    }
+    return nil
+}
+
+// withReadOperation marks the reads under ctx as op, for readPreferenceFor
+func withReadOperation(ctx context.Context, op string) context.Context {
+    return context.WithValue(ctx, readOperationKey, op)
+}
+
+// readPreferenceFor returns the read preference of the reads under ctx, nil
+// for those staying on the primary
+func readPreferenceFor(ctx context.Context) *readpref.ReadPref {
+    op, _ := ctx.Value(readOperationKey).(string)
+    c := currentConfig().ReadRouting
+    if op == "" || !slices.Contains(c.Operations, op) {
+        return nil
+    }
+    if c.MaxStaleness > 0 {
+        return readpref.SecondaryPreferred(readpref.WithMaxStaleness(time.Duration(c.MaxStaleness)))
+    }
+    return readpref.SecondaryPreferred()
+}
+
+// contactsReadOperation sorts a contact listing with the given limit: without
+// one it is an export, with list filters a search
+func contactsReadOperation(r *http.Request, limit int64) string {
+    cq := contactQueryFrom(r)
+    switch {
+    case limit == 0:
+        return readExport
+    case cq.Name != "" || len(cq.Tags) > 0 || cq.Owner != "" || cq.Company != "" || cq.Filter != "":
+        return readSearch
+    default:
+        return readList
+    }
+}
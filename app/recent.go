@@ -0,0 +1,139 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    recentViewQueueSize = 1000
+    // recentViewThrottle is how often one caller's views of one contact are stored
+    recentViewThrottle = time.Minute
+    // recentViewRetention is how long views are kept (a TTL index removes them)
+    recentViewRetention = 30 * 24 * time.Hour
+    defaultRecentLimit  = 20
+    maxRecentLimit      = 50
+)
+
+// contactView is the last time a caller read a contact, one per caller and contact
+type contactView struct {
+    ID        string             `bson:"_id"`
+    Tenant    string             `bson:"tenant"`
+    Viewer    string             `bson:"viewer"`
+    ContactID primitive.ObjectID `bson:"contact_id"`
+    ViewedAt  time.Time          `bson:"viewed_at"`
+}
+
+var (
+    recentViews       = make(chan contactView, recentViewQueueSize)
+    recentViewsSeen   = newTTLCache[bool]()
+    recentViewsStored = newCounter("contact_views_recorded_total", "Contact reads recorded for recents by outcome.", "result")
+)
+
+func contactViewsCollection() collection {
+    return collectionOf("contact_views")
+}
+
+// startRecentViewRecorder starts the goroutine that stores queued views
+func startRecentViewRecorder() {
+    go func() {
+        for v := range recentViews {
+            ctx, cancel := context.WithTimeout(withRegion(context.Background(), regionOf(v.Tenant)), 5*time.Second)
+            _, err := contactViewsCollection().UpdateOne(ctx, bson.M{"_id": v.ID}, bson.M{"$set": v}, options.Update().SetUpsert(true))
+            cancel()
+            if err != nil {
+                recentViewsStored.Inc("failed")
+                logWarn("failed to record view of contact %s: %v", v.ContactID.Hex(), err)
+                continue
+            }
+            recentViewsStored.Inc("stored")
+        }
+    }()
+}
+
+// recordContactView notes that the caller read a contact. It never blocks the
+// request: repeated reads within recentViewThrottle are ignored and views are
+// dropped when the queue is full.
+func recordContactView(r *http.Request, id primitive.ObjectID) {
+    v := contactView{Tenant: tenantOf(r), Viewer: clientKey(r), ContactID: id, ViewedAt: utcNow()}
+    v.ID = v.Tenant + "|" + v.Viewer + "|" + id.Hex()
+    if _, ok := recentViewsSeen.Get(v.ID); ok {
+        recentViewsStored.Inc("throttled")
+        return
+    }
+    recentViewsSeen.Set(v.ID, true, recentViewThrottle)
+    select {
+    case recentViews <- v:
+    default:
+        recentViewsStored.Inc("dropped")
+    }
+}
+
+// getRecentContacts handles GET /contacts/recent[?limit=20], the contacts the
+// caller read most recently, newest first. Deleted contacts are left out.
+func getRecentContacts(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    limit, ok := queryInt(r, "limit", defaultRecentLimit, maxRecentLimit)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "limit must be a positive number")
+        return
+    }
+
+    opts := options.Find().SetSort(bson.D{{Key: "viewed_at", Value: -1}}).SetLimit(int64(limit))
+    cursor, err := contactViewsCollection().Find(r.Context(), bson.M{"tenant": tenantOf(r), "viewer": clientKey(r)}, opts)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve recent contacts")
+        return
+    }
+    var views []contactView
+    if err := cursor.All(r.Context(), &views); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    ids := make([]primitive.ObjectID, len(views))
+    for i, v := range views {
+        ids[i] = v.ContactID
+    }
+    cursor, err = contactsCollection.Find(r.Context(), scopeFilter(r, bson.M{"_id": bson.M{"$in": ids}}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve recent contacts")
+        return
+    }
+    var found []Contact
+    if err := cursor.All(r.Context(), &found); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    f, ok := phoneFormatFor(w, r)
+    if !ok {
+        return
+    }
+    byID := make(map[primitive.ObjectID]Contact, len(found))
+    for _, c := range found {
+        f.apply(&c)
+        c.setAvatarURL()
+        byID[c.ID] = c
+    }
+
+    type recentContact struct {
+        Contact
+        ViewedAt time.Time `json:"viewed_at"`
+    }
+    recent := make([]recentContact, 0, len(found))
+    for _, v := range views {
+        if c, ok := byID[v.ContactID]; ok {
+            recent = append(recent, recentContact{Contact: c, ViewedAt: v.ViewedAt})
+        }
+    }
+
+    recordsServed(r, len(recent))
+    json.NewEncoder(w).Encode(recent)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strconv"
+    "strings"
+    "unicode"
+)
+
+// redactionModes are what a role's field rule can do: drop the field or mask
+// all but its last four characters
+var redactionModes = []string{"hide", "mask"}
+
+// validateRedaction checks field_redaction, which maps role -> field -> mode
+func validateRedaction(rules map[string]map[string]string) error {
+    for role, fields := range rules {
+        for field, mode := range fields {
+            if mode != "hide" && mode != "mask" {
+                return fmt.Errorf("field_redaction.%s.%s: unknown mode %q (want one of %s)", role, field, mode, strings.Join(redactionModes, ", "))
+            }
+        }
+    }
+    return nil
+}
+
+// maskValue replaces every letter and digit but the last four with "*",
+// keeping separators so "+1-234-567-8900" becomes "+*-***-***-8900"
+func maskValue(s string) string {
+    runes := []rune(s)
+    keep := 0
+    for i := len(runes) - 1; i >= 0; i-- {
+        if !unicode.IsLetter(runes[i]) && !unicode.IsDigit(runes[i]) {
+            continue
+        }
+        if keep < 4 {
+            keep++
+            continue
+        }
+        runes[i] = '*'
+    }
+    return string(runes)
+}
+
+// derivedFields are response fields computed from a stored field; a rule for
+// the stored field applies to them as well
+var derivedFields = map[string][]string{
+    "phone": {"phone_e164", "phone_formatted"},
+}
+
+// redactContacts applies rules to every object with an "id" (a contact) in v
+func redactContacts(v any, rules map[string]string) {
+    switch v := v.(type) {
+    case map[string]any:
+        if _, ok := v["id"]; ok {
+            for field, mode := range rules {
+                for _, f := range append([]string{field}, derivedFields[field]...) {
+                    val, ok := v[f]
+                    if !ok {
+                        continue
+                    }
+                    if mode == "hide" {
+                        delete(v, f)
+                    } else if s, ok := val.(string); ok {
+                        v[f] = maskValue(s)
+                    } else {
+                        v[f] = "****"
+                    }
+                }
+            }
+        }
+        for _, child := range v {
+            redactContacts(child, rules)
+        }
+    case []any:
+        for _, child := range v {
+            redactContacts(child, rules)
+        }
+    }
+}
+
+// redactingWriter holds back the response so it can be redacted as a whole
+type redactingWriter struct {
+    http.ResponseWriter
+    status int
+    buf    bytes.Buffer
+}
+
+func (rw *redactingWriter) WriteHeader(status int) {
+    if rw.status == 0 {
+        rw.status = status
+    }
+}
+
+func (rw *redactingWriter) Write(b []byte) (int, error) {
+    if rw.status == 0 {
+        rw.status = http.StatusOK
+    }
+    return rw.buf.Write(b)
+}
+
+// RedactFields middleware applies the caller's role rules from field_redaction
+// to every contact in /contacts responses, so that no handler can hand a
+// restricted field to a role that must not see it. Callers whose role has no
+// rules get responses untouched.
+func RedactFields(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        rules := currentConfig().FieldRedaction[principalFrom(r).Role]
+        if len(rules) == 0 || !strings.HasPrefix(r.URL.Path, "/contacts") {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        // the handler answers in JSON so the rules can be applied; the
+        // redacted document is re-encoded if the caller wanted MessagePack
+        msgpack := wantsMsgpack(r)
+        if msgpack {
+            r = r.Clone(r.Context())
+            r.Header.Set("Accept", "application/json")
+        }
+
+        rw := &redactingWriter{ResponseWriter: w}
+        next.ServeHTTP(rw, r)
+        if rw.status == 0 {
+            rw.status = http.StatusOK
+        }
+
+        body := rw.buf.Bytes()
+        var v any
+        dec := json.NewDecoder(bytes.NewReader(body))
+        dec.UseNumber()
+        if err := dec.Decode(&v); err == nil {
+            redactContacts(v, rules)
+            if msgpack {
+                body = msgpackValue(nil, v)
+                w.Header().Set("Content-Type", msgpackContentType)
+            } else if out, err := json.Marshal(v); err == nil {
+                body = append(out, '\n')
+            }
+        }
+        // a body that isn't JSON carries no contact fields and passes through
+
+        w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+        w.WriteHeader(rw.status)
+        w.Write(body)
+    })
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "mime"
+    "net/http"
+    "net/mail"
+    "net/smtp"
+    "net/url"
+    "os"
+    "regexp"
+    "slices"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Contacts carry dates to remember, such as birthdays. API keys that turn
+// reminders on with PUT /reminder-preferences are reminded of the dates of
+// the contacts they own or watch some days before, through the channels they
+// pick. The hourly reminders job claims each reminder in reminder_deliveries
+// before sending it, so reruns and restarts don't send it twice.
+
+const (
+    // maxContactDates caps the dates of one contact
+    maxContactDates = 20
+    // maxDateLabel caps the characters of a date's label
+    maxDateLabel = 50
+    // maxReminderDays is how far ahead reminders can be asked for
+    maxReminderDays = 60
+    // reminderClaimTimeout is after how long a reminder claimed by a run
+    // that never finished sending it is claimed again
+    reminderClaimTimeout = 15 * time.Minute
+    // reminderRetention is how long sent reminders are remembered
+    reminderRetention = 400 * 24 * time.Hour
+)
+
+// reminder channels
+const (
+    channelEmail   = "email"
+    channelWebhook = "webhook"
+    channelPush    = "push"
+)
+
+var reminderChannels = []string{channelEmail, channelWebhook, channelPush}
+
+// recurringDate is a date without a year: --MM-DD as in vCards
+var recurringDate = regexp.MustCompile(`^--\d\d-\d\d$`)
+
+// ContactDate is a date to remember about a contact, recurring every year.
+// Date is YYYY-MM-DD, or --MM-DD when the year isn't known.
+type ContactDate struct {
+    Label string `bson:"label" json:"label"`
+    Date  string `bson:"date" json:"date"`
+}
+
+// monthDay is the MM-DD of the date
+func (d ContactDate) monthDay() string {
+    return d.Date[len(d.Date)-5:]
+}
+
+// ReminderPreferences are how and when an API key is reminded of its
+// contacts' dates. Labels limits the dates to those labels, all if empty.
+type ReminderPreferences struct {
+    Tenant     string   `bson:"tenant" json:"-"`
+    Owner      string   `bson:"owner" json:"-"`
+    Enabled    bool     `bson:"enabled" json:"enabled"`
+    DaysBefore int      `bson:"days_before" json:"days_before"`
+    Channels   []string `bson:"channels" json:"channels"`
+    Labels     []string `bson:"labels" json:"labels"`
+    Email      string   `bson:"email,omitempty" json:"email,omitempty"`
+}
+
+// reminder is one date of one contact an API key is reminded of
+type reminder struct {
+    prefs   ReminderPreferences
+    contact Contact
+    date    ContactDate
+    // on is the day the date falls on this time
+    on time.Time
+}
+
+// reminderMailer sends reminder emails; nil unless SMTP_URL is set
+var reminderMailer *smtpMailer
+
+var remindersSent = newCounter("reminders_total", "Date reminders by channel and outcome.", "channel", "result")
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:      "reminders",
+        Schedule:  "@hourly",
+        Timeout:   30 * time.Minute,
+        Singleton: true,
+        Run:       sendReminders,
+    })
+}
+
+func reminderPrefsCollection() collection {
+    return collectionOf("reminder_preferences")
+}
+
+func reminderDeliveriesCollection() collection {
+    return collectionOf("reminder_deliveries")
+}
+
+// normalizeDates checks a contact's dates, trimming and lowercasing labels
+func normalizeDates(dates []ContactDate) ([]ContactDate, error) {
+    if len(dates) > maxContactDates {
+        return nil, fmt.Errorf("a contact can have at most %d dates", maxContactDates)
+    }
+    out := make([]ContactDate, 0, len(dates))
+    for _, d := range dates {
+        d.Label = strings.ToLower(normalizeLabel(d.Label))
+        if d.Label == "" || len([]rune(d.Label)) > maxDateLabel {
+            return nil, fmt.Errorf("date labels are required and must not be longer than %d characters", maxDateLabel)
+        }
+        if slices.ContainsFunc(out, func(o ContactDate) bool { return o.Label == d.Label }) {
+            return nil, fmt.Errorf("the contact has more than one %s date", d.Label)
+        }
+        full := d.Date
+        if recurringDate.MatchString(d.Date) {
+            // 2000 was a leap year, so --02-29 is valid
+            full = "2000" + d.Date[1:]
+        }
+        if _, err := time.Parse(time.DateOnly, full); err != nil {
+            return nil, fmt.Errorf("date %s must be YYYY-MM-DD or --MM-DD", d.Label)
+        }
+        out = append(out, d)
+    }
+    return out, nil
+}
+
+// normalizeDates normalizes the dates the changes set, returning why they
+// are invalid if they are
+func (ch *contactChanges) normalizeDates() string {
+    if ch.Dates == nil {
+        return ""
+    }
+    dates, err := normalizeDates(*ch.Dates)
+    if err != nil {
+        return err.Error()
+    }
+    ch.Dates = &dates
+    return ""
+}
+
+// reminderPrefs returns the caller's reminder preferences, the defaults if
+// it has none
+func reminderPrefs(r *http.Request) (ReminderPreferences, error) {
+    p := ReminderPreferences{DaysBefore: 1, Channels: []string{channelPush}, Labels: []string{}}
+    err := reminderPrefsCollection().FindOne(r.Context(), ownerFilter(r, bson.M{})).Decode(&p)
+    if err == mongo.ErrNoDocuments {
+        err = nil
+    }
+    return p, err
+}
+
+// getReminderPrefs handles GET /reminder-preferences
+func getReminderPrefs(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    p, err := reminderPrefs(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve reminder preferences")
+        return
+    }
+    json.NewEncoder(w).Encode(p)
+}
+
+// reminderPrefsInput is the body of PUT /reminder-preferences; fields left
+// out are kept
+type reminderPrefsInput struct {
+    Enabled    *bool     `json:"enabled"`
+    DaysBefore *int      `json:"days_before"`
+    Channels   *[]string `json:"channels"`
+    Labels     *[]string `json:"labels"`
+    Email      *string   `json:"email"`
+}
+
+// updateReminderPrefs handles PUT /reminder-preferences with {"enabled",
+// "days_before", "channels", "labels", "email"}
+func updateReminderPrefs(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if principalFrom(r).KeyID == "" {
+        writeError(w, http.StatusForbidden, codeForbidden, "Reminders need an API key")
+        return
+    }
+    var in reminderPrefsInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    defer r.Body.Close()
+    p, err := reminderPrefs(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve reminder preferences")
+        return
+    }
+    if in.Enabled != nil {
+        p.Enabled = *in.Enabled
+    }
+    if in.DaysBefore != nil {
+        if *in.DaysBefore < 0 || *in.DaysBefore > maxReminderDays {
+            writeError(w, http.StatusBadRequest, codeValidationFailed, fmt.Sprintf("days_before must be between 0 and %d", maxReminderDays))
+            return
+        }
+        p.DaysBefore = *in.DaysBefore
+    }
+    if in.Channels != nil {
+        p.Channels = []string{}
+        for _, c := range *in.Channels {
+            if !slices.Contains(reminderChannels, c) {
+                writeError(w, http.StatusBadRequest, codeValidationFailed, "channels must be email, webhook or push")
+                return
+            }
+            if !slices.Contains(p.Channels, c) {
+                p.Channels = append(p.Channels, c)
+            }
+        }
+    }
+    if in.Labels != nil {
+        p.Labels = []string{}
+        for _, l := range *in.Labels {
+            if l = strings.ToLower(normalizeLabel(l)); l != "" && !slices.Contains(p.Labels, l) {
+                p.Labels = append(p.Labels, l)
+            }
+        }
+    }
+    if in.Email != nil {
+        p.Email = strings.TrimSpace(*in.Email)
+        if addr, err := mail.ParseAddress(p.Email); p.Email != "" && (err != nil || addr.Name != "") {
+            writeError(w, http.StatusBadRequest, codeValidationFailed, "email must be an email address")
+            return
+        }
+    }
+    if slices.Contains(p.Channels, channelEmail) && p.Email == "" {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "the email channel needs an email address")
+        return
+    }
+
+    p.Tenant, p.Owner = tenantOf(r), principalFrom(r).KeyID
+    _, err = reminderPrefsCollection().ReplaceOne(r.Context(), ownerFilter(r, bson.M{}), p, options.Replace().SetUpsert(true))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to save reminder preferences")
+        return
+    }
+    json.NewEncoder(w).Encode(p)
+}
+
+// sendReminders sends the reminders due today (UTC) to every key with
+// reminders on, for the dates days_before ahead of today
+func sendReminders(ctx context.Context) error {
+    cursor, err := reminderPrefsCollection().Find(ctx, bson.M{"enabled": true})
+    if err != nil {
+        return err
+    }
+    var all []ReminderPreferences
+    if err := cursor.All(ctx, &all); err != nil {
+        return err
+    }
+    today := utcNow().Truncate(24 * time.Hour)
+    for _, p := range all {
+        due, err := dueReminders(ctx, p, today.AddDate(0, 0, p.DaysBefore))
+        if err != nil {
+            return err
+        }
+        for _, rem := range due {
+            for _, channel := range p.Channels {
+                deliverReminder(ctx, rem, channel)
+            }
+        }
+    }
+    return nil
+}
+
+// dueReminders finds the dates falling on day of the contacts p's key owns
+// or watches. Dates on February 29 fall on the 28th in other years.
+func dueReminders(ctx context.Context, p ReminderPreferences, day time.Time) ([]reminder, error) {
+    days := []string{day.Format("01-02")}
+    if days[0] == "02-28" && day.AddDate(0, 0, 1).Month() == time.March {
+        days = append(days, "02-29")
+    }
+    suffixes := make([]string, len(days))
+    for i, d := range days {
+        suffixes[i] = "-" + d + "$"
+    }
+    watched, err := contactWatchesCollection().Distinct(ctx, "contact_id", bson.M{"tenant": p.Tenant, "owner": p.Owner})
+    if err != nil {
+        return nil, err
+    }
+    filter := tenantFilter(p.Tenant)
+    filter["$or"] = bson.A{bson.M{"owner": p.Owner}, bson.M{"_id": bson.M{"$in": watched}}}
+    filter["dates.date"] = bson.M{"$regex": strings.Join(suffixes, "|")}
+    cursor, err := contactsCollection.Find(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    var contacts []Contact
+    if err := cursor.All(ctx, &contacts); err != nil {
+        return nil, err
+    }
+
+    var due []reminder
+    for _, c := range contacts {
+        for _, d := range c.Dates {
+            if !slices.Contains(days, d.monthDay()) || (len(p.Labels) > 0 && !slices.Contains(p.Labels, d.Label)) {
+                continue
+            }
+            due = append(due, reminder{prefs: p, contact: c, date: d, on: day})
+        }
+    }
+    return due, nil
+}
+
+// deliverReminder sends rem through channel unless it was sent already. The
+// reminder is claimed first; a failed send gives the claim up so the next
+// run tries again, and a claim left by a run that stopped while sending is
+// taken over after reminderClaimTimeout.
+func deliverReminder(ctx context.Context, rem reminder, channel string) {
+    id := strings.Join([]string{rem.prefs.Tenant, rem.prefs.Owner, rem.contact.ID.Hex(), rem.date.Label, rem.on.Format(time.DateOnly), channel}, "/")
+    now := utcNow()
+    _, err := reminderDeliveriesCollection().InsertOne(ctx, bson.M{"_id": id, "status": "sending", "claimed_at": now})
+    if mongo.IsDuplicateKeyError(err) {
+        var res *mongo.UpdateResult
+        res, err = reminderDeliveriesCollection().UpdateOne(ctx,
+            bson.M{"_id": id, "status": "sending", "claimed_at": bson.M{"$lt": now.Add(-reminderClaimTimeout)}},
+            bson.M{"$set": bson.M{"claimed_at": now}})
+        if err == nil && res.ModifiedCount == 0 {
+            return
+        }
+    }
+    if err != nil {
+        logError("reminder %s: failed to claim it: %v", id, err)
+        return
+    }
+
+    switch channel {
+    case channelEmail:
+        err = emailReminder(rem)
+    case channelWebhook:
+        err = webhookReminder(ctx, rem)
+    case channelPush:
+        err = pushReminder(ctx, rem)
+    }
+    if err != nil {
+        remindersSent.Inc(channel, "failed")
+        logWarn("reminder %s: %v", id, err)
+        if _, err := reminderDeliveriesCollection().DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+            logError("reminder %s: failed to give up its claim: %v", id, err)
+        }
+        return
+    }
+    remindersSent.Inc(channel, "sent")
+    _, err = reminderDeliveriesCollection().UpdateOne(ctx, bson.M{"_id": id},
+        bson.M{"$set": bson.M{"status": "sent", "sent_at": utcNow()}})
+    if err != nil {
+        logError("reminder %s: sent, but failed to record it: %v", id, err)
+    }
+}
+
+// reminderData is what webhooks receive of a reminder
+func reminderData(rem reminder) bson.M {
+    return bson.M{"id": rem.contact.ID.Hex(), "reminder": bson.M{
+        "owner":       rem.prefs.Owner,
+        "label":       rem.date.Label,
+        "date":        rem.date.Date,
+        "on":          rem.on.Format(time.DateOnly),
+        "days_before": rem.prefs.DaysBefore,
+    }}
+}
+
+// webhookReminder queues a contact.reminder event for the tenant's webhooks
+// asking for it
+func webhookReminder(ctx context.Context, rem reminder) error {
+    filter := tenantFilter(rem.prefs.Tenant)
+    filter["events"] = bson.M{"$in": bson.A{"contact.reminder", "*"}}
+    cursor, err := webhooksCollection().Find(ctx, filter)
+    if err != nil {
+        return err
+    }
+    var hooks []Webhook
+    if err := cursor.All(ctx, &hooks); err != nil {
+        return err
+    }
+    event := WebhookEvent{ID: randomHex(12), Type: "contact.reminder", OccurredAt: utcNow(), Data: reminderData(rem)}
+    for _, h := range hooks {
+        select {
+        case webhookDeliveries <- webhookDelivery{ctx: withTrace(ctx, context.Background()), webhook: h, event: event}:
+        default:
+            webhookDeliveriesTotal.Inc("dropped")
+            return errors.New("webhook queue full")
+        }
+    }
+    return nil
+}
+
+// pushReminder notifies the devices of the reminded key. Like other pushes,
+// the notification carries only the event and the contact ID.
+func pushReminder(ctx context.Context, rem reminder) error {
+    filter := tenantFilter(rem.prefs.Tenant)
+    filter["owner"] = rem.prefs.Owner
+    cursor, err := devicesCollection().Find(ctx, filter)
+    if err != nil {
+        return err
+    }
+    var devices []Device
+    if err := cursor.All(ctx, &devices); err != nil {
+        return err
+    }
+    sent := len(devices) == 0
+    for _, d := range devices {
+        sent = sendPush(ctx, d, "contact.reminder", rem.contact.ID.Hex()) || sent
+    }
+    if !sent {
+        return errors.New("no device could be notified")
+    }
+    return nil
+}
+
+// emailReminder mails the reminder to the key's email address
+func emailReminder(rem reminder) error {
+    if reminderMailer == nil {
+        return errors.New("email isn't configured, set SMTP_URL")
+    }
+    name := strings.Join(strings.Fields(rem.contact.Name), " ")
+    subject := fmt.Sprintf("Reminder: %s of %s on %s", rem.date.Label, name, rem.on.Format("January 2"))
+    body := fmt.Sprintf("The %s of %s is on %s.\r\n\r\nContact: /contacts/%s\r\n",
+        rem.date.Label, name, rem.on.Format("Monday, January 2"), rem.contact.ID.Hex())
+    return reminderMailer.send(rem.prefs.Email, subject, body)
+}
+
+// smtpMailer sends plain text emails through an SMTP server
+type smtpMailer struct {
+    addr string
+    auth smtp.Auth
+    from string
+}
+
+// startReminderMailer configures reminder emails from SMTP_URL
+// (smtp://host:587), SMTP_FROM and optionally SMTP_USERNAME and SMTP_PASSWORD
+func startReminderMailer() error {
+    raw := os.Getenv("SMTP_URL")
+    if raw == "" {
+        return nil
+    }
+    u, err := url.Parse(raw)
+    if err != nil || u.Scheme != "smtp" || u.Port() == "" {
+        return fmt.Errorf("SMTP_URL must look like smtp://host:587")
+    }
+    from, err := mail.ParseAddress(os.Getenv("SMTP_FROM"))
+    if err != nil {
+        return fmt.Errorf("SMTP_FROM must be an email address")
+    }
+    m := &smtpMailer{addr: u.Host, from: from.Address}
+    if user := os.Getenv("SMTP_USERNAME"); user != "" {
+        password, err := envSecret("SMTP_PASSWORD")
+        if err != nil {
+            return err
+        }
+        m.auth = smtp.PlainAuth("", user, password, u.Hostname())
+    }
+    reminderMailer = m
+    return nil
+}
+
+func (m *smtpMailer) send(to, subject, body string) error {
+    msg := "From: " + m.from + "\r\n" +
+        "To: " + to + "\r\n" +
+        "Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n" +
+        "MIME-Version: 1.0\r\n" +
+        "Content-Type: text/plain; charset=utf-8\r\n" +
+        "\r\n" + body
+    return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
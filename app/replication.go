@@ -0,0 +1,415 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "regexp"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Deployments in several sites can each write to their own cluster, with
+// REPLICATION_SITE naming the site. MongoDB doesn't replicate between
+// clusters that both take writes (a replica set has one primary, and
+// mongosync copies one way), so this relies on a replicator run next to the
+// service: a change stream consumer per cluster, such as a Kafka Connect
+// MongoDB source and sink pair, applying every other site's changes to
+// contacts, replication_writes and replication_conflicts. For contacts it
+// must resolve concurrent writes last writer wins on the write stamp every
+// versioned contact write stores in "replication": a hybrid logical clock
+// reading, milliseconds that never go back, and the site. A site never stamps
+// a write older than the contact it changes (every stamped update goes
+// through lastWriterFilter), so the write made last is the one that wins. The service only stamps and checks; it doesn't replicate.
+//
+// The replicator drops the losing write silently. To notice, every site
+// logs its writes in replication_writes with the version they made:
+// writes made to the same version at two sites were made without seeing each
+// other, since a write counts up the version it saw. The
+// replication-conflicts job records such writes as a conflict, reported by
+// GET /admin/replication/conflicts.
+
+const (
+    // replicationScanWindow is how far back the replication-conflicts job
+    // looks for concurrent writes; it must exceed the replication lag
+    replicationScanWindow = time.Hour
+    // replicationLogRetention is how long the write log is kept
+    replicationLogRetention  = 7 * 24 * time.Hour
+    defaultReplicationListed = 50
+    maxReplicationListed     = 500
+)
+
+// replicationSitePattern is what site names look like, e.g. "eu-west-1"
+var replicationSitePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// WriteStamp is when and where a contact was last written. At is a hybrid
+// logical clock reading in Unix milliseconds; Site breaks ties.
+type WriteStamp struct {
+    At   int64  `bson:"at" json:"at"`
+    Site string `bson:"site" json:"site"`
+}
+
+// after reports whether s was written after o
+func (s WriteStamp) after(o WriteStamp) bool {
+    return s.At > o.At || (s.At == o.At && s.Site > o.Site)
+}
+
+// ReplicatedWrite is a versioned contact write as a site logged it
+type ReplicatedWrite struct {
+    ID        string             `bson:"_id" json:"-"`
+    Tenant    string             `bson:"tenant" json:"-"`
+    ContactID primitive.ObjectID `bson:"contact_id" json:"-"`
+    Version   int                `bson:"version" json:"version"`
+    Action    string             `bson:"action" json:"action"`
+    Actor     string             `bson:"actor" json:"actor"`
+    Stamp     WriteStamp         `bson:"stamp" json:"stamp"`
+    LoggedAt  time.Time          `bson:"logged_at" json:"logged_at"`
+}
+
+// ReplicationConflict is a set of writes to one version of a contact made at
+// different sites, the winning one first
+type ReplicationConflict struct {
+    ID         string             `bson:"_id" json:"id"`
+    Tenant     string             `bson:"tenant" json:"tenant"`
+    ContactID  primitive.ObjectID `bson:"contact_id" json:"contact_id"`
+    Version    int                `bson:"version" json:"version"`
+    Writes     []ReplicatedWrite  `bson:"writes" json:"writes"`
+    DetectedAt time.Time          `bson:"detected_at" json:"detected_at"`
+}
+
+var (
+    replicationSite      string
+    replicationConflicts = newCounter("replication_conflicts_total", "Concurrent contact writes at different sites.", "site")
+
+    // hlc is the last write stamp issued or seen
+    hlcMu sync.Mutex
+    hlc   int64
+)
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:      "replication-conflicts",
+        Schedule:  "@every 1m",
+        Timeout:   time.Minute,
+        Singleton: true,
+        Run:       detectReplicationConflicts,
+    })
+}
+
+func replicationWritesCollection() collection {
+    return collectionOf("replication_writes")
+}
+
+func replicationConflictsCollection() collection {
+    return collectionOf("replication_conflicts")
+}
+
+// startReplication reads the site of this deployment from REPLICATION_SITE;
+// without one, writes aren't stamped
+func startReplication() error {
+    site := os.Getenv("REPLICATION_SITE")
+    if site == "" {
+        return nil
+    }
+    if !replicationSitePattern.MatchString(site) {
+        return fmt.Errorf("REPLICATION_SITE must be lowercase letters, digits and '-', such as eu-west-1")
+    }
+    replicationSite = site
+    logInfo("stamping contact writes for active-active replication as site %s", site)
+    return nil
+}
+
+// nextWriteStamp reads the hybrid logical clock: the wall clock, unless a
+// stamp issued or seen is as late
+func nextWriteStamp() WriteStamp {
+    hlcMu.Lock()
+    defer hlcMu.Unlock()
+    hlc = max(hlc+1, time.Now().UnixMilli())
+    return WriteStamp{At: hlc, Site: replicationSite}
+}
+
+// observeWriteStamp moves the clock past a stamp seen on a contact, so that
+// the site's next write to it is stamped later
+func observeWriteStamp(s WriteStamp) {
+    hlcMu.Lock()
+    defer hlcMu.Unlock()
+    hlc = max(hlc, s.At)
+}
+
+// withWriteStamp adds the write stamp to the fields set by a contact write,
+// or to a new contact, if there's a site
+func withWriteStamp(set bson.M) bson.M {
+    if replicationSite != "" {
+        set["replication"] = nextWriteStamp()
+    }
+    return set
+}
+
+// stampWrite adds the write stamp to a contact update
+func stampWrite(update bson.M) bson.M {
+    if replicationSite == "" {
+        return update
+    }
+    set, _ := update["$set"].(bson.M)
+    if set == nil {
+        set = bson.M{}
+        update["$set"] = set
+    }
+    withWriteStamp(set)
+    return update
+}
+
+// lastWriterFilter limits filter to contacts last written before update's
+// write stamp, so a site with a clock running behind doesn't make a write
+// that loses to the one it replaces
+func lastWriterFilter(filter, update bson.M) bson.M {
+    set, _ := update["$set"].(bson.M)
+    stamp, ok := set["replication"].(WriteStamp)
+    if !ok {
+        return filter
+    }
+    filter["replication.at"] = bson.M{"$not": bson.M{"$gte": stamp.At}}
+    return filter
+}
+
+// writtenLater reports whether a contact's update matched nothing because the
+// contact was written later than the update's stamp; the clock is then moved
+// past it, for the update to be made again
+func writtenLater(r *http.Request, id primitive.ObjectID, update bson.M) bool {
+    set, _ := update["$set"].(bson.M)
+    stamp, ok := set["replication"].(WriteStamp)
+    if !ok {
+        return false
+    }
+    var c Contact
+    err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"_id": id}),
+        options.FindOne().SetProjection(bson.M{"replication": 1})).Decode(&c)
+    if err != nil || c.Replication == nil || !c.Replication.after(stamp) {
+        return false
+    }
+    observeWriteStamp(*c.Replication)
+    return true
+}
+
+// writtenLaterThan lists the contacts of stamps, those matching filter, that
+// were written later than the stamp of the update made to them; the clock is
+// moved past them, for the updates to be made again
+func writtenLaterThan(ctx context.Context, filter bson.M, stamps map[primitive.ObjectID]WriteStamp) ([]primitive.ObjectID, error) {
+    ids := make([]primitive.ObjectID, 0, len(stamps))
+    for id := range stamps {
+        ids = append(ids, id)
+    }
+    cursor, err := contactsCollection.Find(ctx, bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$in": ids}}}},
+        options.Find().SetProjection(bson.M{"replication": 1}))
+    if err != nil {
+        return nil, err
+    }
+    var contacts []Contact
+    if err := cursor.All(ctx, &contacts); err != nil {
+        return nil, err
+    }
+    var later []primitive.ObjectID
+    for _, c := range contacts {
+        if c.Replication != nil && c.Replication.after(stamps[c.ID]) {
+            observeWriteStamp(*c.Replication)
+            later = append(later, c.ID)
+        }
+    }
+    return later, nil
+}
+
+// updateContactsAsLastWriter makes update, a versioned update stamped in set,
+// to the contacts ids that match filter, with lastWriterFilter keeping it off
+// contacts another site wrote later. Those are updated again with a later
+// stamp, up to maxMergeAttempts times; it returns how many contacts matched
+// and the ones still written later after that.
+func updateContactsAsLastWriter(ctx context.Context, ids []primitive.ObjectID, filter, set bson.M, update any) (int64, []primitive.ObjectID, error) {
+    var matched int64
+    for attempt := 1; ; attempt++ {
+        guarded := lastWriterFilter(bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$in": ids}}}}, bson.M{"$set": set})
+        result, err := contactsCollection.UpdateMany(ctx, guarded, update)
+        if err != nil {
+            return matched, nil, err
+        }
+        matched += result.MatchedCount
+        stamp, ok := set["replication"].(WriteStamp)
+        if !ok || result.MatchedCount == int64(len(ids)) {
+            return matched, nil, nil
+        }
+        stamps := make(map[primitive.ObjectID]WriteStamp, len(ids))
+        for _, id := range ids {
+            stamps[id] = stamp
+        }
+        later, err := writtenLaterThan(ctx, filter, stamps)
+        if err != nil || len(later) == 0 || attempt == maxMergeAttempts {
+            return matched, later, err
+        }
+        ids = later
+        withWriteStamp(set)
+    }
+}
+
+// logReplicatedWrites adds the stamped versions to the site's write log
+func logReplicatedWrites(r *http.Request, versions []ContactVersion) {
+    if replicationSite == "" {
+        return
+    }
+    var models []mongo.WriteModel
+    for _, v := range versions {
+        stamp := v.Contact.Replication
+        if stamp == nil || stamp.Site != replicationSite {
+            continue
+        }
+        observeWriteStamp(*stamp)
+        w := ReplicatedWrite{
+            ID:        fmt.Sprintf("%s|%s|%d", v.ContactID.Hex(), replicationSite, v.Version),
+            Tenant:    tenantOf(r),
+            ContactID: v.ContactID,
+            Version:   v.Version,
+            Action:    v.Action,
+            Actor:     clientKey(r),
+            Stamp:     *stamp,
+            LoggedAt:  utcNow(),
+        }
+        models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": w.ID}).SetReplacement(w).SetUpsert(true))
+    }
+    if len(models) == 0 {
+        return
+    }
+    if _, err := replicationWritesCollection().BulkWrite(r.Context(), models, options.BulkWrite().SetOrdered(false)); err != nil {
+        logError("failed to log %d replicated writes: %v", len(models), err)
+    }
+}
+
+// detectReplicationConflicts records the writes of the last
+// replicationScanWindow made to the same version of a contact at different
+// sites. Every site runs it; a conflict is recorded once.
+func detectReplicationConflicts(ctx context.Context) error {
+    if replicationSite == "" {
+        return nil
+    }
+    cursor, err := replicationWritesCollection().Aggregate(ctx, mongo.Pipeline{
+        {{Key: "$match", Value: bson.M{"logged_at": bson.M{"$gte": utcNow().Add(-replicationScanWindow)}}}},
+        {{Key: "$sort", Value: bson.D{{Key: "stamp.at", Value: -1}, {Key: "stamp.site", Value: -1}}}},
+        {{Key: "$group", Value: bson.M{
+            "_id":    bson.M{"contact_id": "$contact_id", "version": "$version"},
+            "sites":  bson.M{"$addToSet": "$stamp.site"},
+            "writes": bson.M{"$push": "$$ROOT"},
+        }}},
+        {{Key: "$match", Value: bson.M{"sites.1": bson.M{"$exists": true}}}},
+    })
+    if err != nil {
+        return err
+    }
+    var groups []struct {
+        Writes []ReplicatedWrite `bson:"writes"`
+    }
+    if err := cursor.All(ctx, &groups); err != nil {
+        return err
+    }
+
+    for _, g := range groups {
+        first := g.Writes[0]
+        conflict := ReplicationConflict{
+            ID:         fmt.Sprintf("%s|%d", first.ContactID.Hex(), first.Version),
+            Tenant:     first.Tenant,
+            ContactID:  first.ContactID,
+            Version:    first.Version,
+            Writes:     g.Writes,
+            DetectedAt: utcNow(),
+        }
+        result, err := replicationConflictsCollection().UpdateOne(ctx, bson.M{"_id": conflict.ID},
+            bson.M{"$setOnInsert": conflict}, options.Update().SetUpsert(true))
+        if err != nil {
+            return err
+        }
+        if result.UpsertedCount == 0 {
+            continue
+        }
+        for _, w := range g.Writes[1:] {
+            replicationConflicts.Inc(w.Stamp.Site)
+        }
+        logWarn("replication conflict on contact %s version %d: the write at %s won over %d concurrent ones",
+            first.ContactID.Hex(), first.Version, first.Stamp.Site, len(g.Writes)-1)
+    }
+    return nil
+}
+
+// listReplicationConflicts handles GET /admin/replication/conflicts[?tenant=&limit=50&before=],
+// the detected conflicts newest first. Conflicts are kept in the region of
+// their tenant, so without ?tenant= every region is read and the lists merged.
+// Conflicts detected at the same time are ordered by ID, and the page cursor
+// next, "<detected_at>|<id>", names the last conflict listed.
+func listReplicationConflicts(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    limit, ok := queryInt(r, "limit", defaultReplicationListed, maxReplicationListed)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "limit must be a positive number")
+        return
+    }
+    filter := bson.M{}
+    eachRegion := forEachRegion
+    if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+        filter["tenant"] = tenantFilter(tenant)["tenant"]
+        region := regionOf(tenant)
+        eachRegion = func(ctx context.Context, fn func(ctx context.Context) error) error {
+            return fn(withRegion(ctx, region))
+        }
+    }
+    if before := r.URL.Query().Get("before"); before != "" {
+        at, id, _ := strings.Cut(before, "|")
+        t, err := time.Parse(time.RFC3339Nano, at)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "before must be the next of a previous page or an RFC 3339 time")
+            return
+        }
+        filter["$or"] = bson.A{
+            bson.M{"detected_at": bson.M{"$lt": t}},
+            bson.M{"detected_at": t, "_id": bson.M{"$lt": id}},
+        }
+    }
+
+    opts := options.Find().SetSort(bson.D{{Key: "detected_at", Value: -1}, {Key: "_id", Value: -1}}).SetLimit(int64(limit) + 1)
+    conflicts := []ReplicationConflict{}
+    err := eachRegion(r.Context(), func(ctx context.Context) error {
+        cursor, err := replicationConflictsCollection().Find(ctx, filter, opts)
+        if err != nil {
+            return err
+        }
+        var found []ReplicationConflict
+        if err := cursor.All(ctx, &found); err != nil {
+            return err
+        }
+        conflicts = append(conflicts, found...)
+        return nil
+    })
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve conflicts")
+        return
+    }
+    sort.Slice(conflicts, func(i, j int) bool {
+        a, b := conflicts[i], conflicts[j]
+        if !a.DetectedAt.Equal(b.DetectedAt) {
+            return a.DetectedAt.After(b.DetectedAt)
+        }
+        return a.ID > b.ID
+    })
+
+    body := bson.M{"site": replicationSite, "conflicts": conflicts}
+    if len(conflicts) > limit {
+        last := conflicts[limit-1]
+        body["conflicts"] = conflicts[:limit]
+        body["next"] = last.DetectedAt.Format(time.RFC3339Nano) + "|" + last.ID
+    }
+    json.NewEncoder(w).Encode(body)
+}
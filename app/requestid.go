@@ -0,0 +1,35 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "regexp"
+)
+
+// requestIDPattern bounds the request IDs accepted from callers
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDFrom returns the ID RequestID assigned to the request in ctx
+func requestIDFrom(ctx context.Context) string {
+    id, _ := ctx.Value(requestIDKey).(string)
+    return id
+}
+
+// RequestID middleware keeps a well-formed X-Request-ID from the caller or
+// assigns one, echoes it in the response and stores it, with the caller's
+// trace context, in the request context for logs and database operations
+func RequestID(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        id := r.Header.Get("X-Request-ID")
+        if !requestIDPattern.MatchString(id) {
+            id = randomHex(8)
+        }
+        w.Header().Set("X-Request-ID", id)
+
+        ctx := context.WithValue(r.Context(), requestIDKey, id)
+        if tc, ok := traceFrom(r); ok {
+            ctx = context.WithValue(ctx, traceKey, tc)
+        }
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
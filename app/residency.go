@@ -0,0 +1,143 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "os"
+    "sort"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// A tenant's data can be kept in a region of its own, such as the EU, in a
+// MongoDB cluster of that region. MONGO_URI is the cluster of MONGO_REGION,
+// home to the tenants without a region and to what the replicas share, such
+// as leases; MONGO_REGIONS lists the other regions, each with its cluster in
+// MONGO_URI_<REGION>, and TENANT_REGIONS assigns tenants to regions, e.g.
+// "acme=eu,globex=us". Every operation of a collection goes to the cluster of
+// the region in its context, which is that of the caller's tenant, so a
+// tenant's documents are only ever read from and written to its region.
+// Moving a tenant to another region means moving its data there first.
+
+// defaultRegion names the MONGO_URI cluster if MONGO_REGION doesn't
+const defaultRegion = "default"
+
+var (
+    homeRegion = defaultRegion
+    // regionDatabases are the service databases by region
+    regionDatabases = map[string]*mongo.Database{}
+    tenantRegions   = map[string]string{}
+)
+
+// connectRegions connects to the clusters of MONGO_REGIONS, home being the
+// MONGO_URI database, and reads TENANT_REGIONS
+func connectRegions(ctx context.Context, home *mongo.Database) error {
+    if region := strings.ToLower(os.Getenv("MONGO_REGION")); region != "" {
+        homeRegion = region
+    }
+    regionDatabases[homeRegion] = home
+    for _, region := range strings.Split(strings.ToLower(os.Getenv("MONGO_REGIONS")), ",") {
+        region = strings.TrimSpace(region)
+        if region == "" || region == homeRegion {
+            continue
+        }
+        name := "MONGO_URI_" + strings.ToUpper(region)
+        uri, err := envSecret(name)
+        if err != nil {
+            return fmt.Errorf("region %s: %w", region, err)
+        }
+        if uri == "" {
+            return fmt.Errorf("region %s needs %s", region, name)
+        }
+        client, err := connectMongo(ctx, uri)
+        if err != nil {
+            return fmt.Errorf("region %s: %w", region, err)
+        }
+        regionDatabases[region] = client.Database(home.Name())
+    }
+    for _, pair := range strings.Split(os.Getenv("TENANT_REGIONS"), ",") {
+        if strings.TrimSpace(pair) == "" {
+            continue
+        }
+        tenant, region, ok := strings.Cut(pair, "=")
+        tenant, region = strings.TrimSpace(tenant), strings.ToLower(strings.TrimSpace(region))
+        if !ok || tenant == "" {
+            return fmt.Errorf("TENANT_REGIONS must be a list of tenant=region, not %q", pair)
+        }
+        if regionDatabases[region] == nil {
+            return fmt.Errorf("tenant %s is assigned to region %q, which is neither MONGO_REGION nor in MONGO_REGIONS", tenant, region)
+        }
+        tenantRegions[tenant] = region
+    }
+    if len(regionDatabases) > 1 {
+        logInfo("keeping tenant data in regions %s, %s being home", strings.Join(dataRegions(), ", "), homeRegion)
+    }
+    return nil
+}
+
+// regionOf returns the region holding a tenant's data
+func regionOf(tenant string) string {
+    if region, ok := tenantRegions[tenant]; ok {
+        return region
+    }
+    return homeRegion
+}
+
+// withRegion makes the operations under ctx go to region's cluster, whoever
+// the caller is
+func withRegion(ctx context.Context, region string) context.Context {
+    return context.WithValue(ctx, regionKey, region)
+}
+
+// regionFrom returns the region the operations under ctx go to: one set with
+// withRegion, else that of the caller's tenant, else home
+func regionFrom(ctx context.Context) string {
+    if region, ok := ctx.Value(regionKey).(string); ok {
+        return region
+    }
+    if p, ok := ctx.Value(principalKey).(Principal); ok && p.Tenant != "" {
+        return regionOf(p.Tenant)
+    }
+    return homeRegion
+}
+
+// databaseFor returns the service database of the region of ctx
+func databaseFor(ctx context.Context) *mongo.Database {
+    if db, ok := regionDatabases[regionFrom(ctx)]; ok {
+        return db
+    }
+    return mongoDB
+}
+
+// dataRegions returns the regions, home first
+func dataRegions() []string {
+    regions := make([]string, 0, len(regionDatabases))
+    for region := range regionDatabases {
+        if region != homeRegion {
+            regions = append(regions, region)
+        }
+    }
+    sort.Strings(regions)
+    return append([]string{homeRegion}, regions...)
+}
+
+// forEachRegion runs fn for every region, with ctx set to the region, as
+// background work scanning collections must. It goes on past failing regions
+// and returns their errors.
+func forEachRegion(ctx context.Context, fn func(ctx context.Context) error) error {
+    if len(regionDatabases) <= 1 {
+        return fn(ctx)
+    }
+    var errs []error
+    for _, region := range dataRegions() {
+        if err := fn(withRegion(ctx, region)); err != nil {
+            errs = append(errs, fmt.Errorf("region %s: %w", region, err))
+        }
+        if ctx.Err() != nil {
+            break
+        }
+    }
+    return errors.Join(errs...)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    // retentionSampleSize caps the number of IDs listed in a dry-run report
+    retentionSampleSize = 20
+    // retentionBatchSize is how many contacts a purge deletes at a time
+    retentionBatchSize = 500
+)
+
+// retentionTargets maps a rule target to its collection and age field
+var retentionTargets = map[string]string{
+    "contacts":  "updated_at",
+    "audit_log": "at",
+}
+
+// RetentionRule purges documents of one tenant older than MaxAgeDays.
+// Rules start in dry-run mode, where runs only report what they would delete.
+type RetentionRule struct {
+    ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    Tenant     string             `bson:"tenant" json:"tenant"`
+    Target     string             `bson:"target" json:"target"`
+    MaxAgeDays int                `bson:"max_age_days" json:"max_age_days"`
+    DryRun     bool               `bson:"dry_run" json:"dry_run"`
+    CreatedAt  time.Time          `bson:"created_at" json:"created_at"`
+    UpdatedAt  time.Time          `bson:"updated_at" json:"updated_at"`
+    LastRun    *RetentionReport   `bson:"last_run,omitempty" json:"last_run,omitempty"`
+}
+
+// RetentionReport describes one evaluation of a rule
+type RetentionReport struct {
+    At        time.Time `bson:"at" json:"at"`
+    DryRun    bool      `bson:"dry_run" json:"dry_run"`
+    Cutoff    time.Time `bson:"cutoff" json:"cutoff"`
+    Matched   int64     `bson:"matched" json:"matched"`
+    Deleted   int64     `bson:"deleted" json:"deleted"`
+    SampleIDs []string  `bson:"sample_ids,omitempty" json:"sample_ids,omitempty"`
+}
+
+func retentionRulesCollection() collection {
+    return sharedCollectionOf("retention_rules")
+}
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:      "retention",
+        Schedule:  "0 3 * * *",
+        Timeout:   30 * time.Minute,
+        Singleton: true,
+        Global:    true,
+        Run:       enforceRetention,
+    })
+}
+
+// retentionFilter matches the rule's documents last touched before cutoff.
+// Documents without the age field fall back to the creation time in their ObjectID.
+func retentionFilter(rule RetentionRule, cutoff time.Time) bson.M {
+    field := retentionTargets[rule.Target]
+    return bson.M{"$and": bson.A{
+        tenantFilter(rule.Tenant),
+        bson.M{"$or": bson.A{
+            bson.M{field: bson.M{"$lt": cutoff}},
+            bson.M{field: bson.M{"$exists": false}, "_id": bson.M{"$lt": primitive.NewObjectIDFromTimestamp(cutoff)}},
+        }},
+    }}
+}
+
+// evaluateRule counts (and unless dryRun, deletes) the documents a rule
+// matches, in the region of its tenant
+func evaluateRule(ctx context.Context, rule RetentionRule, dryRun bool) (*RetentionReport, error) {
+    ctx = withRegion(ctx, regionOf(rule.Tenant))
+    now := utcNow()
+    report := &RetentionReport{At: now, DryRun: dryRun, Cutoff: now.AddDate(0, 0, -rule.MaxAgeDays)}
+    filter := retentionFilter(rule, report.Cutoff)
+    coll := collectionOf(rule.Target)
+
+    matched, err := coll.CountDocuments(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    report.Matched = matched
+
+    if dryRun {
+        cursor, err := coll.Find(ctx, filter, options.Find().SetLimit(retentionSampleSize).SetProjection(bson.M{"_id": 1}))
+        if err != nil {
+            return nil, err
+        }
+        var docs []struct {
+            ID primitive.ObjectID `bson:"_id"`
+        }
+        if err := cursor.All(ctx, &docs); err != nil {
+            return nil, err
+        }
+        for _, d := range docs {
+            report.SampleIDs = append(report.SampleIDs, d.ID.Hex())
+        }
+        return report, nil
+    }
+
+    if rule.Target == "contacts" {
+        report.Deleted, err = purgeContacts(ctx, rule, filter)
+        return report, err
+    }
+    result, err := coll.DeleteMany(ctx, filter)
+    if err != nil {
+        return nil, err
+    }
+    report.Deleted = result.DeletedCount
+    return report, nil
+}
+
+// purgeContacts deletes the contacts filter matches in batches, each as
+// DELETE /contacts/bulk would: their last state is stored as a "delete"
+// version, which sync clients receive as a tombstone, and what hangs off
+// them is cleaned up
+func purgeContacts(ctx context.Context, rule RetentionRule, filter bson.M) (int64, error) {
+    r, _ := http.NewRequestWithContext(context.WithValue(ctx, principalKey, Principal{KeyID: "retention", Tenant: rule.Tenant}),
+        http.MethodDelete, "/contacts/bulk", nil)
+    var deleted int64
+    for {
+        var contacts []Contact
+        cursor, err := contactsCollection.Find(r.Context(), filter, options.Find().SetLimit(retentionBatchSize))
+        if err == nil {
+            err = cursor.All(r.Context(), &contacts)
+        }
+        if err != nil || len(contacts) == 0 {
+            return deleted, err
+        }
+        ids := make([]primitive.ObjectID, len(contacts))
+        for i, c := range contacts {
+            ids[i] = c.ID
+        }
+        result, err := contactsCollection.DeleteMany(r.Context(), bson.M{"$and": bson.A{filter, bson.M{"_id": bson.M{"$in": ids}}}})
+        if err != nil {
+            return deleted, err
+        }
+        deleted += result.DeletedCount
+        for _, id := range ids {
+            contactCache.Delete(tenantOf(r) + "/" + id.Hex())
+        }
+        recordDeleted(r, contacts...)
+        cleanUpDeleted(r, ids...)
+        if len(contacts) < retentionBatchSize {
+            return deleted, nil
+        }
+    }
+}
+
+// enforceRetention is the scheduled job that evaluates every rule
+func enforceRetention(ctx context.Context) error {
+    cursor, err := retentionRulesCollection().Find(ctx, bson.D{})
+    if err != nil {
+        return err
+    }
+    var rules []RetentionRule
+    if err := cursor.All(ctx, &rules); err != nil {
+        return err
+    }
+
+    var failed []string
+    for _, rule := range rules {
+        report, err := evaluateRule(ctx, rule, rule.DryRun)
+        if err != nil {
+            failed = append(failed, rule.ID.Hex())
+            logError("retention rule %s failed: %v", rule.ID.Hex(), err)
+            continue
+        }
+
+        retentionRulesCollection().UpdateOne(ctx, bson.M{"_id": rule.ID}, bson.M{"$set": bson.M{"last_run": report}})
+        if report.Deleted > 0 {
+            recordAudit(nil, "retention.purge", rule.ID.Hex(), bson.M{
+                "tenant": rule.Tenant, "target": rule.Target, "deleted": report.Deleted,
+            })
+            emitSecurityEvent(nil, "erasure", "retention.purge", "success", rule.ID.Hex(), map[string]any{
+                "tenant": rule.Tenant, "target": rule.Target, "deleted": report.Deleted,
+            })
+        }
+        logInfo("retention rule %s (%s/%s, dry_run=%t): matched %d, deleted %d",
+            rule.ID.Hex(), rule.Tenant, rule.Target, report.DryRun, report.Matched, report.Deleted)
+    }
+
+    if len(failed) > 0 {
+        return fmt.Errorf("rules failed: %s", strings.Join(failed, ", "))
+    }
+    return nil
+}
+
+// retentionRuleInput is the body of POST and PUT /admin/retention/rules
+type retentionRuleInput struct {
+    Tenant     *string `json:"tenant"`
+    Target     *string `json:"target"`
+    MaxAgeDays *int    `json:"max_age_days"`
+    DryRun     *bool   `json:"dry_run"`
+}
+
+func (in retentionRuleInput) applyTo(rule *RetentionRule) string {
+    if in.Tenant != nil {
+        rule.Tenant = *in.Tenant
+    }
+    if in.Target != nil {
+        rule.Target = *in.Target
+    }
+    if in.MaxAgeDays != nil {
+        rule.MaxAgeDays = *in.MaxAgeDays
+    }
+    if in.DryRun != nil {
+        rule.DryRun = *in.DryRun
+    }
+
+    if _, ok := retentionTargets[rule.Target]; !ok {
+        return "target must be contacts or audit_log"
+    }
+    if rule.MaxAgeDays < 1 {
+        return "max_age_days must be at least 1"
+    }
+    return ""
+}
+
+// listRetentionRules handles GET /admin/retention/rules
+func listRetentionRules(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    cursor, err := retentionRulesCollection().Find(r.Context(), bson.D{})
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve retention rules")
+        return
+    }
+    rules := []RetentionRule{}
+    if err := cursor.All(r.Context(), &rules); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    json.NewEncoder(w).Encode(rules)
+}
+
+// createRetentionRule handles POST /admin/retention/rules
+func createRetentionRule(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var in retentionRuleInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+
+    now := utcNow()
+    rule := RetentionRule{DryRun: true, CreatedAt: now, UpdatedAt: now}
+    if msg := in.applyTo(&rule); msg != "" {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, msg)
+        return
+    }
+
+    result, err := retentionRulesCollection().InsertOne(r.Context(), rule)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create retention rule")
+        return
+    }
+    rule.ID = result.InsertedID.(primitive.ObjectID)
+    recordAudit(r, "retention.rule.create", rule.ID.Hex(), bson.M{"rule": rule})
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(rule)
+}
+
+// retentionRuleByID loads the rule named in /admin/retention/rules/{id}[/dry-run]
+func retentionRuleByID(w http.ResponseWriter, r *http.Request) (RetentionRule, bool) {
+    var rule RetentionRule
+
+    id := strings.TrimSuffix(r.URL.Path[len("/admin/retention/rules/"):], "/dry-run")
+    objID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid rule ID")
+        return rule, false
+    }
+
+    err = retentionRulesCollection().FindOne(r.Context(), bson.M{"_id": objID}).Decode(&rule)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeRetentionNotFound, "Retention rule not found")
+        return rule, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return rule, false
+    }
+    return rule, true
+}
+
+// updateRetentionRule handles PUT /admin/retention/rules/{id}
+func updateRetentionRule(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    rule, ok := retentionRuleByID(w, r)
+    if !ok {
+        return
+    }
+
+    var in retentionRuleInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    if msg := in.applyTo(&rule); msg != "" {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, msg)
+        return
+    }
+    rule.UpdatedAt = utcNow()
+
+    _, err := retentionRulesCollection().ReplaceOne(r.Context(), bson.M{"_id": rule.ID}, rule)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to update retention rule")
+        return
+    }
+    recordAudit(r, "retention.rule.update", rule.ID.Hex(), bson.M{"rule": rule})
+
+    json.NewEncoder(w).Encode(rule)
+}
+
+// deleteRetentionRule handles DELETE /admin/retention/rules/{id}
+func deleteRetentionRule(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    rule, ok := retentionRuleByID(w, r)
+    if !ok {
+        return
+    }
+
+    if _, err := retentionRulesCollection().DeleteOne(r.Context(), bson.M{"_id": rule.ID}); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete retention rule")
+        return
+    }
+    recordAudit(r, "retention.rule.delete", rule.ID.Hex(), nil)
+
+    json.NewEncoder(w).Encode(bson.M{"message": "Retention rule deleted successfully"})
+}
+
+// dryRunRetentionRule handles GET /admin/retention/rules/{id}/dry-run
+func dryRunRetentionRule(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    rule, ok := retentionRuleByID(w, r)
+    if !ok {
+        return
+    }
+
+    report, err := evaluateRule(r.Context(), rule, true)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to evaluate retention rule")
+        return
+    }
+
+    json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+    "net/http"
+    "sort"
+    "strings"
+)
+
+// methods routes a request to the handler for its method. HEAD is served by
+// the GET handler (the server drops the body); any other method gets a JSON
+// 405 whose Allow header lists the supported ones.
+type methods map[string]http.HandlerFunc
+
+// allowed lists the methods m serves, HEAD included wherever GET is
+func (m methods) allowed() []string {
+    var allow []string
+    for method := range m {
+        allow = append(allow, method)
+    }
+    if _, ok := m["GET"]; ok {
+        if _, ok := m["HEAD"]; !ok {
+            allow = append(allow, "HEAD")
+        }
+    }
+    sort.Strings(allow)
+    return allow
+}
+
+func (m methods) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    handler, ok := m[r.Method]
+    if !ok && r.Method == "HEAD" {
+        handler, ok = m["GET"]
+    }
+    if !ok {
+        methodNotAllowed(w, m.allowed())
+        return
+    }
+    handler(w, r)
+}
+
+// methodNotAllowed answers 405 with the methods the route does support
+func methodNotAllowed(w http.ResponseWriter, allow []string) {
+    w.Header().Set("Allow", strings.Join(allow, ", "))
+    writeErrorWith(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "Method Not Allowed", map[string]any{"allow": allow})
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+    "fmt"
+    "regexp"
+    "slices"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+    maxFilterLength      = 2048
+    maxFilterComparisons = 32
+    maxFilterDepth       = 8
+    maxFilterWildcards   = 3
+)
+
+// filterField is how ?filter= may use a contact field: which operators apply
+// and how arguments are read. Only these fields can be filtered on.
+type filterField struct {
+    ops   []string
+    value func(string) (any, error)
+}
+
+var (
+    stringOps = []string{"==", "!=", "=in=", "=out="}
+    rangeOps  = []string{"=lt=", "=le=", "=gt=", "=ge="}
+
+    rangeOperators = map[string]string{"=lt=": "$lt", "=le=": "$lte", "=gt=": "$gt", "=ge=": "$gte"}
+)
+
+var filterFields = map[string]filterField{
+    "name":            {ops: stringOps, value: filterName},
+    "phone":           {ops: stringOps, value: filterString},
+    "owner":           {ops: stringOps, value: filterString},
+    "tags":            {ops: stringOps, value: filterTag},
+    "company":         {ops: stringOps, value: filterString},
+    "job_title":       {ops: stringOps, value: filterString},
+    "website":         {ops: stringOps, value: filterString},
+    "social.linkedin": {ops: stringOps, value: filterHandle},
+    "social.x":        {ops: stringOps, value: filterHandle},
+    "social.github":   {ops: stringOps, value: filterHandle},
+    "do_not_contact":  {ops: []string{"=="}, value: filterFlag},
+    "created_at":      {ops: rangeOps, value: filterTime},
+    "updated_at":      {ops: rangeOps, value: filterTime},
+}
+
+// filterString matches exactly, or as a whole-value pattern if the argument
+// has "*" wildcards; the rest of the argument is matched literally
+func filterString(s string) (any, error) {
+    if !strings.Contains(s, "*") {
+        return s, nil
+    }
+    if strings.Count(s, "*") > maxFilterWildcards {
+        return nil, fmt.Errorf("at most %d wildcards per value", maxFilterWildcards)
+    }
+    parts := strings.Split(s, "*")
+    for i, p := range parts {
+        parts[i] = regexp.QuoteMeta(p)
+    }
+    return primitive.Regex{Pattern: "^" + strings.Join(parts, ".*") + "$"}, nil
+}
+
+// filterName matches like filterString, with the argument normalized like
+// stored names
+func filterName(s string) (any, error) {
+    return filterString(normalizeName(s))
+}
+
+func filterTag(s string) (any, error) {
+    if tags := normalizeTags([]string{s}); len(tags) == 1 {
+        return filterString(tags[0])
+    }
+    return nil, fmt.Errorf("empty tag")
+}
+
+// filterFlag reads true or false; false also matches contacts without the
+// flag
+func filterFlag(s string) (any, error) {
+    switch s {
+    case "true":
+        return true, nil
+    case "false":
+        return bson.M{"$ne": true}, nil
+    }
+    return nil, fmt.Errorf("expected true or false")
+}
+
+// filterTime reads an RFC 3339 timestamp or a date
+func filterTime(s string) (any, error) {
+    if t, err := parseTimestamp(s); err == nil {
+        return t, nil
+    }
+    if t, err := time.Parse(time.DateOnly, s); err == nil {
+        return t, nil
+    }
+    return nil, fmt.Errorf("expected an RFC 3339 time or a date")
+}
+
+// filterParser compiles RSQL, e.g. name==J*;(tags==vip,owner=in=(a,b)), where
+// ";" is and, "," is or and parentheses group. Arguments with reserved
+// characters are quoted with ' or ".
+type filterParser struct {
+    in          string
+    pos         int
+    depth       int
+    comparisons int
+}
+
+// compileFilter turns an RSQL expression into a MongoDB query. Errors never
+// quote the input, so they can be embedded in a JSON error body.
+func compileFilter(expr string) (bson.M, error) {
+    if len(expr) > maxFilterLength {
+        return nil, fmt.Errorf("filter must not be longer than %d characters", maxFilterLength)
+    }
+    p := &filterParser{in: expr}
+    query, err := p.or()
+    if err != nil {
+        return nil, err
+    }
+    if p.pos < len(p.in) {
+        return nil, p.errorf("unexpected character")
+    }
+    return query, nil
+}
+
+func (p *filterParser) errorf(format string, args ...any) error {
+    return fmt.Errorf("at position %d: %s", p.pos+1, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) or() (bson.M, error) {
+    return p.list(',', "$or", p.and)
+}
+
+func (p *filterParser) and() (bson.M, error) {
+    return p.list(';', "$and", p.term)
+}
+
+// list parses operands separated by sep, combining two or more with op
+func (p *filterParser) list(sep byte, op string, operand func() (bson.M, error)) (bson.M, error) {
+    var all bson.A
+    for {
+        q, err := operand()
+        if err != nil {
+            return nil, err
+        }
+        all = append(all, q)
+        if p.pos >= len(p.in) || p.in[p.pos] != sep {
+            break
+        }
+        p.pos++
+    }
+    if len(all) == 1 {
+        return all[0].(bson.M), nil
+    }
+    return bson.M{op: all}, nil
+}
+
+func (p *filterParser) term() (bson.M, error) {
+    if p.pos < len(p.in) && p.in[p.pos] == '(' {
+        if p.depth++; p.depth > maxFilterDepth {
+            return nil, p.errorf("groups must not nest deeper than %d", maxFilterDepth)
+        }
+        p.pos++
+        q, err := p.or()
+        if err != nil {
+            return nil, err
+        }
+        if p.pos >= len(p.in) || p.in[p.pos] != ')' {
+            return nil, p.errorf("missing )")
+        }
+        p.pos++
+        p.depth--
+        return q, nil
+    }
+    return p.comparison()
+}
+
+func (p *filterParser) comparison() (bson.M, error) {
+    if p.comparisons++; p.comparisons > maxFilterComparisons {
+        return nil, p.errorf("filter must not have more than %d comparisons", maxFilterComparisons)
+    }
+
+    start := p.pos
+    for p.pos < len(p.in) && (isLetter(p.in[p.pos]) || p.in[p.pos] == '_' || p.in[p.pos] == '.') {
+        p.pos++
+    }
+    name := p.in[start:p.pos]
+    if name == "" {
+        return nil, p.errorf("expected a field name")
+    }
+    field, ok := filterFields[name]
+    if !ok {
+        p.pos = start
+        return nil, p.errorf("can't filter on %s", name)
+    }
+
+    start = p.pos
+    op := ""
+    switch {
+    case strings.HasPrefix(p.in[p.pos:], "=="), strings.HasPrefix(p.in[p.pos:], "!="):
+        op = p.in[p.pos : p.pos+2]
+    case strings.HasPrefix(p.in[p.pos:], "="):
+        if end := strings.IndexByte(p.in[p.pos+1:], '='); end >= 0 {
+            op = p.in[p.pos : p.pos+end+2]
+        }
+    }
+    if op == "" {
+        return nil, p.errorf("expected an operator after %s", name)
+    }
+    if !slices.Contains(field.ops, op) {
+        return nil, p.errorf("%s supports %s", name, strings.Join(field.ops, " "))
+    }
+    p.pos += len(op)
+
+    var args []string
+    if op == "=in=" || op == "=out=" {
+        if p.pos >= len(p.in) || p.in[p.pos] != '(' {
+            return nil, p.errorf("%s takes a list such as (a,b)", op)
+        }
+        p.pos++
+        for {
+            arg, err := p.argument()
+            if err != nil {
+                return nil, err
+            }
+            args = append(args, arg)
+            if p.pos < len(p.in) && p.in[p.pos] == ',' {
+                p.pos++
+                continue
+            }
+            break
+        }
+        if p.pos >= len(p.in) || p.in[p.pos] != ')' {
+            return nil, p.errorf("missing )")
+        }
+        p.pos++
+    } else {
+        arg, err := p.argument()
+        if err != nil {
+            return nil, err
+        }
+        args = []string{arg}
+    }
+
+    values := make(bson.A, 0, len(args))
+    for _, a := range args {
+        v, err := field.value(a)
+        if err != nil {
+            p.pos = start
+            return nil, p.errorf("%s: %v", name, err)
+        }
+        values = append(values, v)
+    }
+
+    switch op {
+    case "==":
+        return bson.M{name: values[0]}, nil
+    case "!=":
+        if re, ok := values[0].(primitive.Regex); ok {
+            return bson.M{name: bson.M{"$not": re}}, nil
+        }
+        return bson.M{name: bson.M{"$ne": values[0]}}, nil
+    case "=in=":
+        return bson.M{name: bson.M{"$in": values}}, nil
+    case "=out=":
+        return bson.M{name: bson.M{"$nin": values}}, nil
+    default:
+        return bson.M{name: bson.M{rangeOperators[op]: values[0]}}, nil
+    }
+}
+
+// argument reads a quoted or bare value
+func (p *filterParser) argument() (string, error) {
+    if p.pos < len(p.in) && (p.in[p.pos] == '\'' || p.in[p.pos] == '"') {
+        quote := p.in[p.pos]
+        p.pos++
+        var b strings.Builder
+        for p.pos < len(p.in) {
+            c := p.in[p.pos]
+            p.pos++
+            switch {
+            case c == '\\' && p.pos < len(p.in):
+                b.WriteByte(p.in[p.pos])
+                p.pos++
+            case c == quote:
+                return b.String(), nil
+            default:
+                b.WriteByte(c)
+            }
+        }
+        return "", p.errorf("unterminated string")
+    }
+
+    start := p.pos
+    for p.pos < len(p.in) && !strings.ContainsRune(`"'();,=!~<> `, rune(p.in[p.pos])) {
+        p.pos++
+    }
+    if p.pos == start {
+        return "", p.errorf("expected a value")
+    }
+    return p.in[start:p.pos], nil
+}
+
+func isLetter(c byte) bool {
+    return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
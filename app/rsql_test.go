@@ -0,0 +1,88 @@
+package main
+
+import (
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestCompileFilter(t *testing.T) {
+    tests := []struct {
+        expr string
+        want bson.M
+    }{
+        {`name==John`, bson.M{"name": "John"}},
+        {`name=='Jane Doe'`, bson.M{"name": "Jane Doe"}},
+        {`name=="say \"hi\""`, bson.M{"name": `say "hi"`}},
+        {`name==J*`, bson.M{"name": primitive.Regex{Pattern: `^J.*$`}}},
+        {`website==*.example.com`, bson.M{"website": primitive.Regex{Pattern: `^.*\.example\.com$`}}},
+        {`name!=J*`, bson.M{"name": bson.M{"$not": primitive.Regex{Pattern: `^J.*$`}}}},
+        {`company!=Acme`, bson.M{"company": bson.M{"$ne": "Acme"}}},
+        {`tags==VIP`, bson.M{"tags": "vip"}},
+        {`owner=in=(a,b)`, bson.M{"owner": bson.M{"$in": bson.A{"a", "b"}}}},
+        {`phone=out=('+1 555',2)`, bson.M{"phone": bson.M{"$nin": bson.A{"+1 555", "2"}}}},
+        {`do_not_contact==true`, bson.M{"do_not_contact": true}},
+        {`do_not_contact==false`, bson.M{"do_not_contact": bson.M{"$ne": true}}},
+        {`created_at=ge=2024-01-02`, bson.M{"created_at": bson.M{"$gte": time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)}}},
+        {`updated_at=lt=2024-01-02T03:04:05+01:00`, bson.M{"updated_at": bson.M{"$lt": time.Date(2024, 1, 2, 2, 4, 5, 0, time.UTC)}}},
+        {`name==a;tags==b`, bson.M{"$and": bson.A{bson.M{"name": "a"}, bson.M{"tags": "b"}}}},
+        {`name==a,tags==b`, bson.M{"$or": bson.A{bson.M{"name": "a"}, bson.M{"tags": "b"}}}},
+        // ";" binds tighter than ","
+        {`name==a;tags==b,owner==c`, bson.M{"$or": bson.A{
+            bson.M{"$and": bson.A{bson.M{"name": "a"}, bson.M{"tags": "b"}}},
+            bson.M{"owner": "c"},
+        }}},
+        {`name==a;(tags==b,owner==c)`, bson.M{"$and": bson.A{
+            bson.M{"name": "a"},
+            bson.M{"$or": bson.A{bson.M{"tags": "b"}, bson.M{"owner": "c"}}},
+        }}},
+        {`((name==a))`, bson.M{"name": "a"}},
+    }
+    for _, tt := range tests {
+        got, err := compileFilter(tt.expr)
+        if err != nil {
+            t.Errorf("compileFilter(%q): %v", tt.expr, err)
+            continue
+        }
+        if !reflect.DeepEqual(got, tt.want) {
+            t.Errorf("compileFilter(%q) = %v, want %v", tt.expr, got, tt.want)
+        }
+    }
+}
+
+func TestCompileFilterErrors(t *testing.T) {
+    tests := []struct {
+        expr string
+        want string
+    }{
+        {``, "at position 1: expected a field name"},
+        {`email==x`, "at position 1: can't filter on email"},
+        {`name==a;secret==b`, "at position 9: can't filter on secret"},
+        {`name`, "at position 5: expected an operator after name"},
+        {`name=lt=a`, "at position 5: name supports == != =in= =out="},
+        {`created_at==2024-01-01`, "at position 11: created_at supports =lt= =le= =gt= =ge="},
+        {`name==`, "at position 7: expected a value"},
+        {`name=='open`, "at position 12: unterminated string"},
+        {`owner=in=a`, "at position 10: =in= takes a list such as (a,b)"},
+        {`owner=in=(a,b`, "at position 14: missing )"},
+        {`(name==a`, "at position 9: missing )"},
+        {`name==a)`, "at position 8: unexpected character"},
+        {`name==*a*b*c*`, "at position 5: name: at most 3 wildcards per value"},
+        {`tags==' '`, "at position 5: tags: empty tag"},
+        {`do_not_contact==yes`, "at position 15: do_not_contact: expected true or false"},
+        {`created_at=gt=yesterday`, "at position 11: created_at: expected an RFC 3339 time or a date"},
+        {strings.Repeat("(", 9) + "name==a" + strings.Repeat(")", 9), "at position 9: groups must not nest deeper than 8"},
+        {strings.Repeat("name==a;", 32) + "name==a", "at position 257: filter must not have more than 32 comparisons"},
+        {"name==" + strings.Repeat("a", maxFilterLength), "filter must not be longer than 2048 characters"},
+    }
+    for _, tt := range tests {
+        _, err := compileFilter(tt.expr)
+        if err == nil || err.Error() != tt.want {
+            t.Errorf("compileFilter(%q) error = %v, want %q", tt.expr, err, tt.want)
+        }
+    }
+}
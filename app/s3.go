@@ -0,0 +1,108 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "fmt"
+    "io"
+    "net/http"
+    "net/url"
+    "os"
+    "sort"
+    "strings"
+    "time"
+)
+
+// s3Client uploads objects to S3, or an S3-compatible store such as MinIO when
+// S3_ENDPOINT is set, with the credentials in AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and, for temporary credentials, AWS_SESSION_TOKEN
+var s3Client = newTracedClient("s3", 10*time.Minute)
+
+func hmacSHA256(key []byte, data string) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte(data))
+    return mac.Sum(nil)
+}
+
+// s3ObjectURL is the virtual-hosted URL of an object, or the path-style URL
+// under S3_ENDPOINT
+func s3ObjectURL(bucket, region, key string) string {
+    escaped := (&url.URL{Path: "/" + key}).EscapedPath()
+    if endpoint := os.Getenv("S3_ENDPOINT"); endpoint != "" {
+        return strings.TrimSuffix(endpoint, "/") + "/" + bucket + escaped
+    }
+    return fmt.Sprintf("https://%s.s3.%s.amazonaws.com%s", bucket, region, escaped)
+}
+
+// putS3Object uploads size bytes from body, signed with AWS Signature Version 4.
+// The payload is sent unsigned so it can be streamed from disk.
+func putS3Object(req *http.Request, region string, size int64) error {
+    accessKey := os.Getenv("AWS_ACCESS_KEY_ID")
+    secretKey, err := envSecret("AWS_SECRET_ACCESS_KEY")
+    if err != nil {
+        return err
+    }
+    if accessKey == "" || secretKey == "" {
+        return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set for s3 destinations")
+    }
+
+    now := utcNow()
+    amzDate := now.Format("20060102T150405Z")
+    day := now.Format("20060102")
+
+    req.ContentLength = size
+    req.Header.Set("Host", req.URL.Host)
+    req.Header.Set("X-Amz-Date", amzDate)
+    req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+    token, err := envSecret("AWS_SESSION_TOKEN")
+    if err != nil {
+        return err
+    }
+    if token != "" {
+        req.Header.Set("X-Amz-Security-Token", token)
+    }
+
+    var names []string
+    for name := range req.Header {
+        names = append(names, strings.ToLower(name))
+    }
+    sort.Strings(names)
+    var canonicalHeaders strings.Builder
+    for _, name := range names {
+        fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, strings.TrimSpace(req.Header.Get(name)))
+    }
+    signedHeaders := strings.Join(names, ";")
+
+    canonicalRequest := strings.Join([]string{
+        req.Method,
+        req.URL.EscapedPath(),
+        req.URL.RawQuery,
+        canonicalHeaders.String(),
+        signedHeaders,
+        "UNSIGNED-PAYLOAD",
+    }, "\n")
+    scope := day + "/" + region + "/s3/aws4_request"
+    hashed := sha256.Sum256([]byte(canonicalRequest))
+    stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+    key := hmacSHA256([]byte("AWS4"+secretKey), day)
+    key = hmacSHA256(key, region)
+    key = hmacSHA256(key, "s3")
+    key = hmacSHA256(key, "aws4_request")
+    signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+    req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+        accessKey, scope, signedHeaders, signature))
+
+    resp, err := s3Client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+        return fmt.Errorf("s3 responded %s: %s", resp.Status, msg)
+    }
+    return nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    // maxSavedSearches caps the searches one API key can save
+    maxSavedSearches = 100
+    // maxSavedSearchName caps the length of a saved search's name
+    maxSavedSearchName = 100
+)
+
+// SavedSearch is a contact query and sort order saved under a name by one API
+// key (Owner), to be run again with GET /saved-searches/{id}/results
+type SavedSearch struct {
+    ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    Tenant    string             `bson:"tenant" json:"-"`
+    Owner     string             `bson:"owner" json:"owner,omitempty"`
+    Name      string             `bson:"name" json:"name"`
+    Query     ContactQuery       `bson:"query" json:"query"`
+    Sort      string             `bson:"sort,omitempty" json:"sort,omitempty"`
+    CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+    UpdatedAt time.Time          `bson:"updated_at" json:"updated_at"`
+}
+
+func savedSearchesCollection() collection {
+    return collectionOf("saved_searches")
+}
+
+// ownerFilter scopes filter to the caller's tenant and API key
+func ownerFilter(r *http.Request, filter bson.M) bson.M {
+    filter = scopeFilter(r, filter)
+    filter["owner"] = principalFrom(r).KeyID
+    return filter
+}
+
+// savedSearchInput is the body of POST and PUT /saved-searches
+type savedSearchInput struct {
+    Name  *string       `json:"name"`
+    Query *ContactQuery `json:"query"`
+    Sort  *string       `json:"sort"`
+}
+
+func (in savedSearchInput) applyTo(s *SavedSearch, limits QueryLimits) (code, msg string) {
+    if in.Name != nil {
+        s.Name = strings.TrimSpace(*in.Name)
+    }
+    if in.Query != nil {
+        s.Query = *in.Query
+    }
+    if in.Sort != nil {
+        s.Sort = *in.Sort
+    }
+
+    if s.Name == "" {
+        return codeValidationFailed, "name is required"
+    }
+    if len(s.Name) > maxSavedSearchName {
+        return codeValidationFailed, "name must not be longer than 100 characters"
+    }
+    if !validSort(s.Sort) {
+        return codeValidationFailed, sortMessage
+    }
+    if _, msg := s.Query.filter(limits); msg != "" {
+        return codeInvalidFilter, msg
+    }
+    return "", ""
+}
+
+// listSavedSearches handles GET /saved-searches, the caller's searches by name
+func listSavedSearches(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    cursor, err := savedSearchesCollection().Find(r.Context(), ownerFilter(r, bson.M{}),
+        options.Find().SetSort(bson.D{{Key: "name", Value: 1}}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve saved searches")
+        return
+    }
+    searches := []SavedSearch{}
+    if err := cursor.All(r.Context(), &searches); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    json.NewEncoder(w).Encode(searches)
+}
+
+// createSavedSearch handles POST /saved-searches
+func createSavedSearch(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var in savedSearchInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    now := utcNow()
+    s := SavedSearch{Tenant: tenantOf(r), Owner: principalFrom(r).KeyID, CreatedAt: now, UpdatedAt: now}
+    if code, msg := in.applyTo(&s, queryLimitsFor(r)); msg != "" {
+        writeError(w, http.StatusBadRequest, code, msg)
+        return
+    }
+
+    count, err := savedSearchesCollection().CountDocuments(r.Context(), ownerFilter(r, bson.M{}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create saved search")
+        return
+    }
+    if count >= maxSavedSearches {
+        writeErrorWith(w, http.StatusForbidden, codeQuotaExceeded, "Too many saved searches, delete some first",
+            map[string]any{"max_saved_searches": maxSavedSearches})
+        return
+    }
+
+    result, err := savedSearchesCollection().InsertOne(r.Context(), s)
+    if mongo.IsDuplicateKeyError(err) {
+        writeError(w, http.StatusConflict, codeSavedSearchExists, "A saved search with this name already exists")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create saved search")
+        return
+    }
+    s.ID = result.InsertedID.(primitive.ObjectID)
+
+    w.Header().Set("Location", "/saved-searches/"+s.ID.Hex())
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(s)
+}
+
+// savedSearchByID loads the caller's search named in /saved-searches/{id}[/results]
+func savedSearchByID(w http.ResponseWriter, r *http.Request) (SavedSearch, bool) {
+    var s SavedSearch
+
+    id := strings.TrimSuffix(r.URL.Path[len("/saved-searches/"):], "/results")
+    objID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid saved search ID")
+        return s, false
+    }
+
+    err = savedSearchesCollection().FindOne(r.Context(), ownerFilter(r, bson.M{"_id": objID})).Decode(&s)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeSavedSearchNotFound, "Saved search not found")
+        return s, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return s, false
+    }
+    return s, true
+}
+
+// getSavedSearch handles GET /saved-searches/{id}
+func getSavedSearch(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if s, ok := savedSearchByID(w, r); ok {
+        json.NewEncoder(w).Encode(s)
+    }
+}
+
+// updateSavedSearch handles PUT /saved-searches/{id}; fields left out of the
+// body are kept
+func updateSavedSearch(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    s, ok := savedSearchByID(w, r)
+    if !ok {
+        return
+    }
+    var in savedSearchInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    if code, msg := in.applyTo(&s, queryLimitsFor(r)); msg != "" {
+        writeError(w, http.StatusBadRequest, code, msg)
+        return
+    }
+    s.UpdatedAt = utcNow()
+
+    _, err := savedSearchesCollection().ReplaceOne(r.Context(), bson.M{"_id": s.ID}, s)
+    if mongo.IsDuplicateKeyError(err) {
+        writeError(w, http.StatusConflict, codeSavedSearchExists, "A saved search with this name already exists")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to update saved search")
+        return
+    }
+
+    json.NewEncoder(w).Encode(s)
+}
+
+// deleteSavedSearch handles DELETE /saved-searches/{id}
+func deleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    s, ok := savedSearchByID(w, r)
+    if !ok {
+        return
+    }
+    if _, err := savedSearchesCollection().DeleteOne(r.Context(), bson.M{"_id": s.ID}); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete saved search")
+        return
+    }
+
+    json.NewEncoder(w).Encode(bson.M{"message": "Saved search deleted successfully"})
+}
+
+// getSavedSearchResults handles GET /saved-searches/{id}/results, answered
+// by listContactsMatching
+func getSavedSearchResults(w http.ResponseWriter, r *http.Request) {
+    if s, ok := savedSearchByID(w, r); ok {
+        listContactsMatching(w, r, s.Query, s.Sort)
+    }
+}
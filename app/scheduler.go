@@ -0,0 +1,321 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "net/http"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// defaultJobTimeout applies to jobs registered without a timeout
+const defaultJobTimeout = 5 * time.Minute
+
+// Job is a unit of recurring background work
+type Job struct {
+    Name      string
+    Schedule  string // see parseSchedule
+    Timeout   time.Duration
+    Singleton bool // only run on the replica holding the leader lease
+    Global    bool // run once rather than once per data region, see forEachRegion
+    Run       func(ctx context.Context) error
+}
+
+// JobStatus is the last-run report returned by GET /admin/jobs
+type JobStatus struct {
+    Name           string     `json:"name"`
+    Schedule       string     `json:"schedule"`
+    Singleton      bool       `json:"singleton"`
+    Running        bool       `json:"running"`
+    NextRun        *time.Time `json:"next_run,omitempty"`
+    LastStartedAt  *time.Time `json:"last_started_at,omitempty"`
+    LastFinishedAt *time.Time `json:"last_finished_at,omitempty"`
+    LastStatus     string     `json:"last_status,omitempty"`
+    LastError      string     `json:"last_error,omitempty"`
+    LastDurationMs int64      `json:"last_duration_ms"`
+}
+
+type scheduledJob struct {
+    job      Job
+    schedule Schedule
+    trigger  chan struct{}
+    cancel   context.CancelFunc
+
+    mu     sync.Mutex
+    status JobStatus
+}
+
+// Scheduler runs registered jobs on their schedules, one goroutine per job
+type Scheduler struct {
+    mu   sync.Mutex
+    ctx  context.Context
+    jobs map[string]*scheduledJob
+}
+
+var scheduler = &Scheduler{jobs: map[string]*scheduledJob{}}
+
+var (
+    jobRunsTotal   = newCounter("job_runs_total", "Background job runs by outcome.", "job", "status")
+    jobDuration    = newHistogram("job_duration_seconds", "Background job run duration.", defaultBuckets, "job")
+    jobLastSuccess = newGauge("job_last_success_timestamp_seconds", "Unix time of the last successful run.", "job")
+)
+
+func init() {
+    gaugeFunc("background_jobs_leader", "1 if this replica runs singleton jobs.", func() float64 {
+        if leader.IsLeader() {
+            return 1
+        }
+        return 0
+    })
+}
+
+// Register adds a job; it starts immediately if the scheduler is already running
+func (s *Scheduler) Register(job Job) error {
+    sched, err := parseSchedule(job.Schedule)
+    if err != nil {
+        return fmt.Errorf("job %s: %w", job.Name, err)
+    }
+    if job.Timeout <= 0 {
+        job.Timeout = defaultJobTimeout
+    }
+
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if _, exists := s.jobs[job.Name]; exists {
+        return fmt.Errorf("job %s is already registered", job.Name)
+    }
+    sj := &scheduledJob{
+        job:      job,
+        schedule: sched,
+        trigger:  make(chan struct{}, 1),
+        status:   JobStatus{Name: job.Name, Schedule: job.Schedule, Singleton: job.Singleton},
+    }
+    s.jobs[job.Name] = sj
+    if s.ctx != nil {
+        s.startLocked(sj)
+    }
+    return nil
+}
+
+// MustRegister registers a built-in job whose definition is known to be valid
+func (s *Scheduler) MustRegister(job Job) {
+    if err := s.Register(job); err != nil {
+        log.Fatalf("Failed to register job: %v", err)
+    }
+}
+
+// Unregister stops a job and forgets its status
+func (s *Scheduler) Unregister(name string) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    if sj, ok := s.jobs[name]; ok {
+        if sj.cancel != nil {
+            sj.cancel()
+        }
+        delete(s.jobs, name)
+    }
+}
+
+// Start runs every registered job until ctx is cancelled
+func (s *Scheduler) Start(ctx context.Context) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    s.ctx = ctx
+    for _, sj := range s.jobs {
+        s.startLocked(sj)
+    }
+}
+
+func (s *Scheduler) startLocked(sj *scheduledJob) {
+    ctx, cancel := context.WithCancel(s.ctx)
+    sj.cancel = cancel
+    go sj.loop(ctx)
+}
+
+// Job returns the registered job name
+func (s *Scheduler) Job(name string) (Job, bool) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    sj, ok := s.jobs[name]
+    if !ok {
+        return Job{}, false
+    }
+    return sj.job, true
+}
+
+// Trigger runs a job now, outside its schedule; singleton jobs only run if
+// this replica is the leader
+func (s *Scheduler) Trigger(name string) error {
+    s.mu.Lock()
+    sj, ok := s.jobs[name]
+    s.mu.Unlock()
+
+    if !ok {
+        return errors.New("job not found")
+    }
+    select {
+    case sj.trigger <- struct{}{}:
+    default:
+    }
+    return nil
+}
+
+// Statuses reports every job, sorted by name
+func (s *Scheduler) Statuses() []JobStatus {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    statuses := make([]JobStatus, 0, len(s.jobs))
+    for _, sj := range s.jobs {
+        sj.mu.Lock()
+        statuses = append(statuses, sj.status)
+        sj.mu.Unlock()
+    }
+    sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+    return statuses
+}
+
+func (sj *scheduledJob) loop(ctx context.Context) {
+    for {
+        next := sj.schedule.Next(time.Now())
+        if next.IsZero() {
+            logWarn("job %s: schedule %q never fires, stopping", sj.job.Name, sj.job.Schedule)
+            return
+        }
+        nextRun := next.UTC()
+        sj.mu.Lock()
+        sj.status.NextRun = &nextRun
+        sj.mu.Unlock()
+
+        timer := time.NewTimer(time.Until(next))
+        select {
+        case <-ctx.Done():
+            timer.Stop()
+            return
+        case <-timer.C:
+        case <-sj.trigger:
+            timer.Stop()
+        }
+        sj.run(ctx)
+    }
+}
+
+func (sj *scheduledJob) run(ctx context.Context) {
+    start := time.Now()
+    startedAt := start.UTC()
+    sj.mu.Lock()
+    sj.status.LastStartedAt = &startedAt
+    sj.mu.Unlock()
+
+    if sj.job.Singleton && !leader.IsLeader() {
+        sj.finish(start, "skipped", nil)
+        return
+    }
+
+    sj.mu.Lock()
+    sj.status.Running = true
+    sj.mu.Unlock()
+
+    jobCtx, cancel := context.WithTimeout(ctx, sj.job.Timeout)
+    defer cancel()
+
+    var err error
+    if sj.job.Global {
+        err = runJobSafely(jobCtx, sj.job.Run)
+    } else {
+        err = forEachRegion(jobCtx, func(ctx context.Context) error { return runJobSafely(ctx, sj.job.Run) })
+    }
+    status := "success"
+    switch {
+    case errors.Is(jobCtx.Err(), context.DeadlineExceeded):
+        status = "timeout"
+    case err != nil:
+        status = "failed"
+    }
+
+    duration := time.Since(start)
+    jobDuration.Observe(duration.Seconds(), sj.job.Name)
+    if status == "success" {
+        jobLastSuccess.Set(float64(time.Now().Unix()), sj.job.Name)
+        logDebug("job %s finished in %s", sj.job.Name, duration)
+    } else {
+        logWarn("job %s %s after %s: %v", sj.job.Name, status, duration, err)
+    }
+    sj.finish(start, status, err)
+}
+
+func (sj *scheduledJob) finish(start time.Time, status string, err error) {
+    jobRunsTotal.Inc(sj.job.Name, status)
+
+    end := time.Now().UTC()
+    sj.mu.Lock()
+    defer sj.mu.Unlock()
+
+    sj.status.Running = false
+    sj.status.LastFinishedAt = &end
+    sj.status.LastStatus = status
+    sj.status.LastDurationMs = end.Sub(start).Milliseconds()
+    sj.status.LastError = ""
+    if err != nil {
+        sj.status.LastError = err.Error()
+    }
+}
+
+// runJobSafely turns a panicking job into a failed run
+func runJobSafely(ctx context.Context, run func(context.Context) error) (err error) {
+    defer func() {
+        if p := recover(); p != nil {
+            err = fmt.Errorf("panic: %v", p)
+        }
+    }()
+    return run(ctx)
+}
+
+// listJobs handles GET /admin/jobs
+func listJobs(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(scheduler.Statuses())
+}
+
+// runJob handles POST /admin/jobs/{name}/run. A singleton job can only be
+// triggered on the leader replica; other replicas answer 503 naming it.
+func runJob(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    name, ok := strings.CutSuffix(r.URL.Path[len("/admin/jobs/"):], "/run")
+    if !ok || name == "" {
+        writeError(w, http.StatusNotFound, codeRouteNotFound, "Not found")
+        return
+    }
+
+    job, ok := scheduler.Job(name)
+    if !ok {
+        writeError(w, http.StatusNotFound, codeJobNotFound, "Job not found")
+        return
+    }
+    if job.Singleton && !leader.IsLeader() {
+        holder, err := leader.Holder(r.Context())
+        if err != nil {
+            logWarn("failed to look up the leader: %v", err)
+        }
+        writeErrorWith(w, http.StatusServiceUnavailable, codeNotLeader, "Singleton jobs run on the leader replica; trigger it there",
+            map[string]any{"leader": holder})
+        return
+    }
+    if err := scheduler.Trigger(name); err != nil {
+        writeError(w, http.StatusNotFound, codeJobNotFound, "Job not found")
+        return
+    }
+
+    w.WriteHeader(http.StatusAccepted)
+    json.NewEncoder(w).Encode(map[string]string{"message": "Job triggered"})
+}
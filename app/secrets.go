@@ -0,0 +1,143 @@
+package main
+
+import (
+    "fmt"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// defaultSecretsRefresh is used when SECRETS_REFRESH_INTERVAL is not set
+const defaultSecretsRefresh = time.Minute
+
+// secretStore caches resolved secret references so file reads and Vault calls
+// happen on refresh rather than on every request
+type secretStore struct {
+    mu     sync.RWMutex
+    values map[string]string
+}
+
+var secrets = &secretStore{values: map[string]string{}}
+
+// resolveSecret turns a value into a secret:
+//   - "file:/path" reads the file (e.g. a mounted Kubernetes secret)
+//   - "vault:<path>#<field>" reads a field from Vault
+//   - anything else is returned unchanged
+func resolveSecret(ref string) (string, error) {
+    switch {
+    case strings.HasPrefix(ref, "file:"):
+        data, err := os.ReadFile(strings.TrimPrefix(ref, "file:"))
+        if err != nil {
+            return "", err
+        }
+        return strings.TrimRight(string(data), "\r\n"), nil
+    case strings.HasPrefix(ref, "vault:"):
+        path, field, ok := strings.Cut(strings.TrimPrefix(ref, "vault:"), "#")
+        if !ok || path == "" || field == "" {
+            return "", fmt.Errorf("vault reference must look like vault:<path>#<field>")
+        }
+        v, err := getVault()
+        if err != nil {
+            return "", err
+        }
+        return v.read(path, field)
+    default:
+        return ref, nil
+    }
+}
+
+// cachedSecret resolves ref once and then serves it from the cache
+func (s *secretStore) cachedSecret(ref string) (string, error) {
+    s.mu.RLock()
+    v, ok := s.values[ref]
+    s.mu.RUnlock()
+    if ok {
+        return v, nil
+    }
+
+    v, err := resolveSecret(ref)
+    if err != nil {
+        return "", err
+    }
+    s.mu.Lock()
+    s.values[ref] = v
+    s.mu.Unlock()
+    return v, nil
+}
+
+// envSecret reads the secret for an environment variable: NAME_FILE names a file
+// holding it, otherwise NAME holds the value or a file:/vault: reference. It is
+// "" when neither is set, and an error when the reference can't be resolved,
+// which callers at startup treat as fatal rather than as the secret being unset.
+func envSecret(name string) (string, error) {
+    ref := os.Getenv(name)
+    if path := os.Getenv(name + "_FILE"); path != "" {
+        ref = "file:" + path
+    }
+    if ref == "" {
+        return "", nil
+    }
+
+    v, err := secrets.cachedSecret(ref)
+    if err != nil {
+        return "", fmt.Errorf("secret %s: %w", name, err)
+    }
+    return v, nil
+}
+
+// refresh re-resolves every cached reference and reports whether any value changed
+func (s *secretStore) refresh() bool {
+    s.mu.RLock()
+    refs := make([]string, 0, len(s.values))
+    for ref := range s.values {
+        refs = append(refs, ref)
+    }
+    s.mu.RUnlock()
+
+    changed := false
+    for _, ref := range refs {
+        v, err := resolveSecret(ref)
+        if err != nil {
+            logWarn("failed to refresh secret %s: %v", secretLabel(ref), err)
+            continue
+        }
+
+        s.mu.Lock()
+        if s.values[ref] != v {
+            s.values[ref] = v
+            changed = true
+            logInfo("secret %s was rotated", secretLabel(ref))
+        }
+        s.mu.Unlock()
+    }
+    return changed
+}
+
+// refreshLoop picks up rotated secrets and reloads the config when any changed,
+// so API keys resolved from references take effect without a restart
+func (s *secretStore) refreshLoop(configPath string) {
+    interval := defaultSecretsRefresh
+    if v := os.Getenv("SECRETS_REFRESH_INTERVAL"); v != "" {
+        if d, err := time.ParseDuration(v); err == nil && d > 0 {
+            interval = d
+        }
+    }
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for range ticker.C {
+        if s.refresh() {
+            reloadConfig(configPath, "secret rotation")
+        }
+    }
+}
+
+// secretLabel describes a reference without revealing literal values
+func secretLabel(ref string) string {
+    if strings.HasPrefix(ref, "file:") || strings.HasPrefix(ref, "vault:") {
+        return ref
+    }
+    return "(literal)"
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tenantSettingsTTL is how long a tenant's settings are cached; changes made
+// through another replica apply within it
+const tenantSettingsTTL = 30 * time.Second
+
+// TenantSettings are the per-tenant defaults tenants' admins can change at
+// runtime. The zero value is what a tenant without settings gets.
+type TenantSettings struct {
+    Tenant      string    `bson:"_id" json:"tenant"`
+    PhoneRegion string    `bson:"phone_region,omitempty" json:"phone_region,omitempty"`
+    Locale      string    `bson:"locale,omitempty" json:"locale,omitempty"`
+    Uniqueness  string    `bson:"uniqueness,omitempty" json:"uniqueness,omitempty"`
+    UpdatedAt   time.Time `bson:"updated_at,omitempty" json:"updated_at,omitempty"`
+}
+
+// uniquenessModes are the values of the uniqueness setting: which contact
+// fields no two contacts of the tenant may share. "phone" is the default.
+var uniquenessModes = []string{"phone", "none"}
+
+var tenantSettingsCache = newTTLCache[TenantSettings]()
+
+func tenantSettingsCollection() collection {
+    return sharedCollectionOf("tenant_settings")
+}
+
+// settingsFor returns the settings of tenant, or its defaults if it has none
+func settingsFor(ctx context.Context, tenant string) (TenantSettings, error) {
+    if s, ok := tenantSettingsCache.Get(tenant); ok {
+        return s, nil
+    }
+
+    s := TenantSettings{Tenant: tenant}
+    err := tenantSettingsCollection().FindOne(ctx, bson.M{"_id": tenant}).Decode(&s)
+    if err != nil && err != mongo.ErrNoDocuments {
+        return s, err
+    }
+    tenantSettingsCache.Set(tenant, s, tenantSettingsTTL)
+    return s, nil
+}
+
+// uniquePhones reports whether the tenant's contacts must have distinct phones
+func (s TenantSettings) uniquePhones() bool {
+    return s.Uniqueness != "none"
+}
+
+// callerSettings returns the settings of the caller's tenant
+func callerSettings(r *http.Request) (TenantSettings, error) {
+    return settingsFor(r.Context(), tenantOf(r))
+}
+
+// tenantFromSettingsPath extracts {tenant} from /admin/tenants/{tenant}/settings
+func tenantFromSettingsPath(w http.ResponseWriter, r *http.Request) (string, bool) {
+    tenant := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/tenants/"), "/settings")
+    if tenant == "" || strings.Contains(tenant, "/") {
+        writeError(w, http.StatusBadRequest, codeInvalidPath, "Settings path must be /admin/tenants/{tenant}/settings")
+        return "", false
+    }
+    return tenant, true
+}
+
+// getTenantSettings handles GET /admin/tenants/{tenant}/settings
+func getTenantSettings(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    tenant, ok := tenantFromSettingsPath(w, r)
+    if !ok {
+        return
+    }
+
+    s, err := settingsFor(r.Context(), tenant)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve settings")
+        return
+    }
+
+    json.NewEncoder(w).Encode(s)
+}
+
+// setTenantSettings handles PUT /admin/tenants/{tenant}/settings, replacing
+// all of the tenant's settings; fields left out go back to their defaults
+func setTenantSettings(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    tenant, ok := tenantFromSettingsPath(w, r)
+    if !ok {
+        return
+    }
+
+    var s TenantSettings
+    dec := json.NewDecoder(r.Body)
+    dec.DisallowUnknownFields()
+    if err := dec.Decode(&s); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    s.PhoneRegion = strings.ToUpper(s.PhoneRegion)
+    if s.PhoneRegion != "" && phoneRegions[s.PhoneRegion] == nil {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "phone_region must be one of "+strings.Join(phoneRegionNames(), ", "))
+        return
+    }
+    switch s.Uniqueness {
+    case "", "phone", "none":
+    case "email", "both":
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "contacts have no email, uniqueness must be phone or none")
+        return
+    default:
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "uniqueness must be one of "+strings.Join(uniquenessModes, ", "))
+        return
+    }
+    if s.Locale != "" {
+        if s.Locale = collationLocale(s.Locale); s.Locale == "" {
+            writeError(w, http.StatusBadRequest, codeValidationFailed, "locale is not supported for sorting")
+            return
+        }
+    }
+
+    s.Tenant = tenant
+    s.UpdatedAt = utcNow()
+    _, err := tenantSettingsCollection().ReplaceOne(r.Context(), bson.M{"_id": tenant}, s, options.Replace().SetUpsert(true))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to save settings")
+        return
+    }
+    tenantSettingsCache.Delete(tenant)
+    recordAudit(r, "settings.set", tenant, bson.M{"phone_region": s.PhoneRegion, "locale": s.Locale, "uniqueness": s.Uniqueness})
+
+    // the unique index only covers contacts with a normalized phone, so
+    // dropping them lifts the constraint and the backfill restores it
+    if s.uniquePhones() {
+        scheduler.Trigger("phone-key-backfill")
+    } else {
+        filter := tenantFilter(tenant)
+        filter["phone_normalized"] = bson.M{"$exists": true}
+        if _, err := contactsCollection.UpdateMany(r.Context(), filter, bson.M{"$unset": bson.M{"phone_normalized": ""}}); err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Settings saved, but failed to lift phone uniqueness; save them again")
+            return
+        }
+    }
+
+    json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+    "context"
+    "crypto/rand"
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    // shortIDAlphabet is base58: no 0/O or I/l to misread, nothing to URL-escape
+    shortIDAlphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+    shortIDLength   = 10
+    shortIDBackfill = 1000
+)
+
+var errInvalidContactID = errors.New("invalid contact ID")
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:      "short-id-backfill",
+        Schedule:  "@hourly",
+        Timeout:   30 * time.Minute,
+        Singleton: true,
+        Run:       backfillShortIDs,
+    })
+}
+
+// newShortID is a random short ID; 58^10 values make collisions negligible,
+// and the unique index catches the rest
+func newShortID() string {
+    const limit = 256 - 256%len(shortIDAlphabet) // unbiased rejection sampling
+    id := make([]byte, 0, shortIDLength)
+    buf := make([]byte, shortIDLength*2)
+    for len(id) < shortIDLength {
+        rand.Read(buf)
+        for _, b := range buf {
+            if int(b) < limit && len(id) < shortIDLength {
+                id = append(id, shortIDAlphabet[int(b)%len(shortIDAlphabet)])
+            }
+        }
+    }
+    return string(id)
+}
+
+func isShortID(s string) bool {
+    if len(s) != shortIDLength {
+        return false
+    }
+    for i := 0; i < len(s); i++ {
+        if strings.IndexByte(shortIDAlphabet, s[i]) < 0 {
+            return false
+        }
+    }
+    return true
+}
+
+// isShortIDConflict reports whether err is a collision on the short ID index
+func isShortIDConflict(err error) bool {
+    return mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), "short_id")
+}
+
+// resolveContactID turns an ObjectID or a short ID into the contact's
+// ObjectID; short IDs are looked up in the caller's tenant
+func resolveContactID(r *http.Request, id string) (primitive.ObjectID, error) {
+    if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+        return objID, nil
+    }
+    if !isShortID(id) {
+        return primitive.NilObjectID, errInvalidContactID
+    }
+    var c Contact
+    err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"short_id": id}),
+        options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&c)
+    return c.ID, err
+}
+
+// contactIDFromPath reads the ID in /contacts/{id}[/...], answering the
+// request itself if it's missing, malformed or an unknown short ID
+func contactIDFromPath(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+    id, _, _ := strings.Cut(r.URL.Path[len("/contacts/"):], "/")
+    if id == "" {
+        writeError(w, http.StatusBadRequest, codeInvalidContactID, "Missing contact ID")
+        return primitive.NilObjectID, false
+    }
+    objID, err := resolveContactID(r, id)
+    switch {
+    case err == errInvalidContactID:
+        writeError(w, http.StatusBadRequest, codeInvalidContactID, "Invalid contact ID")
+    case err == mongo.ErrNoDocuments:
+        writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+    case err != nil:
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+    default:
+        return objID, true
+    }
+    return primitive.NilObjectID, false
+}
+
+// backfillShortIDs gives contacts created before short IDs existed one
+func backfillShortIDs(ctx context.Context) error {
+    for {
+        cursor, err := contactsCollection.Find(ctx, bson.M{"short_id": bson.M{"$exists": false}},
+            options.Find().SetProjection(bson.M{"_id": 1}).SetLimit(shortIDBackfill))
+        if err != nil {
+            return err
+        }
+        var docs []struct {
+            ID primitive.ObjectID `bson:"_id"`
+        }
+        if err := cursor.All(ctx, &docs); err != nil {
+            return err
+        }
+        if len(docs) == 0 {
+            return nil
+        }
+
+        models := make([]mongo.WriteModel, len(docs))
+        for i, d := range docs {
+            models[i] = mongo.NewUpdateOneModel().
+                SetFilter(bson.M{"_id": d.ID, "short_id": bson.M{"$exists": false}}).
+                SetUpdate(bson.M{"$set": bson.M{"short_id": newShortID()}})
+        }
+        // unordered, so a rare collision only skips that contact until the next run
+        result, err := contactsCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+        if err != nil && !isShortIDConflict(err) {
+            return err
+        }
+        if result != nil {
+            logInfo("short-id-backfill: assigned %d short IDs", result.ModifiedCount)
+        }
+        if len(docs) < shortIDBackfill {
+            return nil
+        }
+    }
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestNewShortID(t *testing.T) {
+    seen := map[string]bool{}
+    for i := 0; i < 10000; i++ {
+        id := newShortID()
+        if !isShortID(id) {
+            t.Fatalf("newShortID() = %q, which isShortID rejects", id)
+        }
+        if strings.ContainsAny(id, "0OIl") {
+            t.Fatalf("newShortID() = %q, which has a digit base58 leaves out", id)
+        }
+        if seen[id] {
+            t.Fatalf("newShortID() repeated %q", id)
+        }
+        seen[id] = true
+    }
+}
+
+func TestIsShortID(t *testing.T) {
+    tests := []struct {
+        id   string
+        want bool
+    }{
+        {"a1B2c3D4e5", true},
+        {"1111111111", true},
+        {"zzzzzzzzzz", true},
+        {"", false},
+        {"a1B2c3D4e", false},
+        {"a1B2c3D4e5f", false},
+        {"a1B2c3D4e0", false},
+        {"a1B2c3D4eO", false},
+        {"a1B2c3D4eI", false},
+        {"a1B2c3D4el", false},
+        {"a1B2c3D4e-", false},
+        {"a1B2c3D4é", false},
+        {"65a1b2c3d4e5f6a7b8c9d0e1", false},
+    }
+    for _, tt := range tests {
+        if got := isShortID(tt.id); got != tt.want {
+            t.Errorf("isShortID(%q) = %v, want %v", tt.id, got, tt.want)
+        }
+    }
+}
+
+// Only IDs that are neither ObjectIDs nor short IDs are resolved here: a
+// short ID is looked up in the database
+func TestResolveContactID(t *testing.T) {
+    r := httptest.NewRequest("GET", "/contacts/x", nil)
+    objID := primitive.NewObjectID()
+
+    got, err := resolveContactID(r, objID.Hex())
+    if err != nil || got != objID {
+        t.Errorf("resolveContactID(%q) = %v, %v, want %v", objID.Hex(), got, err, objID)
+    }
+    for _, id := range []string{"", "search", "a1B2c3D4e0", objID.Hex() + "0"} {
+        if _, err := resolveContactID(r, id); err != errInvalidContactID {
+            t.Errorf("resolveContactID(%q) error = %v, want %v", id, err, errInvalidContactID)
+        }
+    }
+}
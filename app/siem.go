@@ -0,0 +1,223 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "net"
+    "net/http"
+    "net/url"
+    "os"
+    "strings"
+    "time"
+)
+
+const (
+    siemQueueSize     = 10000
+    siemBatchSize     = 100
+    siemFlushInterval = 2 * time.Second
+    siemMaxAttempts   = 3
+)
+
+// SecurityEvent is one security-relevant event shipped to the SIEM
+type SecurityEvent struct {
+    Time     time.Time      `json:"time"`
+    Service  string         `json:"service"`
+    Type     string         `json:"type"`
+    Action   string         `json:"action"`
+    Outcome  string         `json:"outcome"`
+    Actor    string         `json:"actor"`
+    ClientIP string         `json:"client_ip,omitempty"`
+    Target   string         `json:"target,omitempty"`
+    Details  map[string]any `json:"details,omitempty"`
+}
+
+type siemSink interface {
+    name() string
+    send(batch []SecurityEvent) error
+}
+
+// siemShipper decouples request handling from the SIEM: events go into a bounded
+// queue and are dropped (and counted) rather than blocking when it is full
+type siemShipper struct {
+    queue chan SecurityEvent
+    sinks []siemSink
+}
+
+var siem *siemShipper
+
+var (
+    siemEventsDropped = newCounter("siem_events_dropped_total", "Security events dropped because the queue was full.")
+    siemEventsFailed  = newCounter("siem_events_failed_total", "Security events that could not be delivered.", "sink")
+    siemEventsSent    = newCounter("siem_events_sent_total", "Security events delivered.", "sink")
+)
+
+// startSIEMShipper configures sinks from SIEM_SYSLOG_ADDR ("udp://host:514" or
+// "tcp://host:601") and SIEM_HTTP_URL (with optional SIEM_HTTP_TOKEN)
+func startSIEMShipper() error {
+    var sinks []siemSink
+
+    if addr := os.Getenv("SIEM_SYSLOG_ADDR"); addr != "" {
+        u, err := url.Parse(addr)
+        if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+            return fmt.Errorf("SIEM_SYSLOG_ADDR must look like udp://host:514 or tcp://host:601")
+        }
+        sinks = append(sinks, &syslogSink{network: u.Scheme, addr: u.Host})
+    }
+    if endpoint := os.Getenv("SIEM_HTTP_URL"); endpoint != "" {
+        sinks = append(sinks, &httpSink{
+            url:    endpoint,
+            client: newTracedClient("siem", 10*time.Second),
+        })
+    }
+    if len(sinks) == 0 {
+        return nil
+    }
+
+    siem = &siemShipper{queue: make(chan SecurityEvent, siemQueueSize), sinks: sinks}
+    go siem.run()
+    return nil
+}
+
+// emitSecurityEvent queues an event for the SIEM; r may be nil for background jobs
+func emitSecurityEvent(r *http.Request, eventType, action, outcome, target string, details map[string]any) {
+    if siem == nil {
+        return
+    }
+
+    ev := SecurityEvent{
+        Time:    utcNow(),
+        Service: "user-service",
+        Type:    eventType,
+        Action:  action,
+        Outcome: outcome,
+        Actor:   "system",
+        Target:  target,
+        Details: details,
+    }
+    if r != nil {
+        ev.Actor = clientKey(r)
+        ev.ClientIP = clientIP(r)
+    }
+
+    select {
+    case siem.queue <- ev:
+    default:
+        siemEventsDropped.Inc()
+    }
+}
+
+func (s *siemShipper) run() {
+    ticker := time.NewTicker(siemFlushInterval)
+    defer ticker.Stop()
+
+    batch := make([]SecurityEvent, 0, siemBatchSize)
+    for {
+        select {
+        case ev := <-s.queue:
+            batch = append(batch, ev)
+            if len(batch) < siemBatchSize {
+                continue
+            }
+        case <-ticker.C:
+            if len(batch) == 0 {
+                continue
+            }
+        }
+        s.flush(batch)
+        batch = batch[:0]
+    }
+}
+
+// flush retries each sink with a growing delay; while it waits the queue
+// absorbs new events up to its capacity
+func (s *siemShipper) flush(batch []SecurityEvent) {
+    for _, sink := range s.sinks {
+        var err error
+        for attempt := 1; attempt <= siemMaxAttempts; attempt++ {
+            if err = sink.send(batch); err == nil {
+                break
+            }
+            time.Sleep(time.Duration(attempt) * time.Second)
+        }
+        if err != nil {
+            siemEventsFailed.Add(float64(len(batch)), sink.name())
+            logError("failed to ship %d security events to %s: %v", len(batch), sink.name(), err)
+            continue
+        }
+        siemEventsSent.Add(float64(len(batch)), sink.name())
+    }
+}
+
+// syslogSink writes RFC 5424 messages with the event JSON as the message body
+type syslogSink struct {
+    network string
+    addr    string
+    conn    net.Conn
+}
+
+func (s *syslogSink) name() string { return "syslog" }
+
+func (s *syslogSink) send(batch []SecurityEvent) error {
+    if s.conn == nil {
+        conn, err := net.DialTimeout(s.network, s.addr, 5*time.Second)
+        if err != nil {
+            return err
+        }
+        s.conn = conn
+    }
+
+    host, _ := os.Hostname()
+    for _, ev := range batch {
+        body, _ := json.Marshal(ev)
+        // facility 13 (log audit), severity 5 (notice)
+        msg := fmt.Sprintf("<109>1 %s %s user-service - %s - %s\n",
+            ev.Time.Format(time.RFC3339Nano), host, strings.ReplaceAll(ev.Type, " ", "_"), body)
+
+        s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+        if _, err := s.conn.Write([]byte(msg)); err != nil {
+            s.conn.Close()
+            s.conn = nil
+            return err
+        }
+    }
+    return nil
+}
+
+// httpSink POSTs each batch as a JSON array
+type httpSink struct {
+    url    string
+    client *http.Client
+}
+
+func (s *httpSink) name() string { return "http" }
+
+func (s *httpSink) send(batch []SecurityEvent) error {
+    body, err := json.Marshal(batch)
+    if err != nil {
+        return err
+    }
+
+    req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    token, err := envSecret("SIEM_HTTP_TOKEN")
+    if err != nil {
+        return err
+    }
+    if token != "" {
+        req.Header.Set("Authorization", "Bearer "+token)
+    }
+
+    resp, err := s.client.Do(req)
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("SIEM responded %s", resp.Status)
+    }
+    return nil
+}
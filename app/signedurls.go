@@ -0,0 +1,77 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "net/http"
+    "net/url"
+    "strconv"
+    "time"
+)
+
+// defaultSignedURLTTL is how long signed URLs stay valid unless
+// SIGNED_URL_TTL says otherwise
+const defaultSignedURLTTL = time.Hour
+
+// Signed URLs let whoever holds them fetch one resource, such as a finished
+// export, without an API key until they expire: the path carries ?expires=
+// (Unix seconds) and ?signature=, the hex HMAC-SHA256 with URL_SIGNING_SECRET
+// of "<path>\n<expires>". They are only issued when the secret is set, and it
+// must be the same on every replica.
+
+func signedURLMAC(secret, path, expires string) []byte {
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write([]byte(path + "\n" + expires))
+    return mac.Sum(nil)
+}
+
+// signURL returns path signed for SIGNED_URL_TTL and when it expires, or
+// ok=false if no signing secret is configured
+func signURL(path string) (signed string, expires time.Time, ok bool) {
+    return signURLUntil(path, utcNow().Add(durationFromEnv("SIGNED_URL_TTL", defaultSignedURLTTL)))
+}
+
+// signStableURL is signURL for URLs that caches key on: every signing within
+// the same SIGNED_URL_TTL-long window gives the same URL, valid for one to two
+// TTLs, so browsers and CDNs find what they cached under it
+func signStableURL(path string) (signed string, expires time.Time, ok bool) {
+    ttl := durationFromEnv("SIGNED_URL_TTL", defaultSignedURLTTL)
+    return signURLUntil(path, utcNow().Truncate(ttl).Add(2*ttl))
+}
+
+func signURLUntil(path string, expires time.Time) (string, time.Time, bool) {
+    secret, err := envSecret("URL_SIGNING_SECRET")
+    if err != nil {
+        logError("%v", err)
+    }
+    if secret == "" {
+        return "", time.Time{}, false
+    }
+    expires = expires.Truncate(time.Second)
+    exp := strconv.FormatInt(expires.Unix(), 10)
+    q := url.Values{"expires": {exp}, "signature": {hex.EncodeToString(signedURLMAC(secret, path, exp))}}
+    return path + "?" + q.Encode(), expires, true
+}
+
+// validSignedURL reports whether r is for a signed URL that hasn't expired
+func validSignedURL(r *http.Request) bool {
+    q := r.URL.Query()
+    exp, signature := q.Get("expires"), q.Get("signature")
+    if exp == "" || signature == "" {
+        return false
+    }
+    secret, err := envSecret("URL_SIGNING_SECRET")
+    if err != nil {
+        logError("%v", err)
+    }
+    if secret == "" {
+        return false
+    }
+    expires, err := strconv.ParseInt(exp, 10, 64)
+    if err != nil || time.Now().Unix() > expires {
+        return false
+    }
+    presented, err := hex.DecodeString(signature)
+    return err == nil && hmac.Equal(presented, signedURLMAC(secret, r.URL.Path, exp))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// maxSignedBodyBytes bounds the body buffered for signature verification
+const maxSignedBodyBytes = 10 << 20
+
+// SigningConfig controls HMAC request signing
+type SigningConfig struct {
+    MaxSkew Duration `json:"max_skew"`
+}
+
+// usedSignature is a signature accepted within the replay window. Signatures
+// are kept in used_signatures, shared by the replicas, so a signed request
+// can't be replayed at another replica; the unique _id refuses a second use,
+// and the TTL index drops them once their timestamp is out of the window.
+type usedSignature struct {
+    ID        string    `bson:"_id"`
+    ExpiresAt time.Time `bson:"expires_at"`
+}
+
+func usedSignaturesCollection() collection {
+    return sharedCollectionOf("used_signatures")
+}
+
+// isWriteMethod reports whether method changes data
+func isWriteMethod(method string) bool {
+    return method == "POST" || method == "PUT" || method == "PATCH" || method == "DELETE"
+}
+
+// signingPayload is what the client signs:
+// "<timestamp>\n<METHOD>\n<path and query>\n<body>"
+func signingPayload(timestamp string, r *http.Request, body []byte) []byte {
+    var b bytes.Buffer
+    b.WriteString(timestamp + "\n" + r.Method + "\n" + r.URL.RequestURI() + "\n")
+    b.Write(body)
+    return b.Bytes()
+}
+
+// verifySignature checks X-Key-Id, X-Signature-Timestamp and X-Signature
+// ("sha256=<hex>") and returns the signing key, or an error message for the client.
+// The body is buffered and restored so handlers can still read it. Whether the
+// signature was used before is up to claimSignature.
+func verifySignature(r *http.Request) (APIKeyConfig, string) {
+    keyID := r.Header.Get("X-Key-Id")
+    timestamp := r.Header.Get("X-Signature-Timestamp")
+    signature, ok := strings.CutPrefix(r.Header.Get("X-Signature"), "sha256=")
+    if keyID == "" || timestamp == "" || !ok {
+        return APIKeyConfig{}, "Incomplete signature headers"
+    }
+
+    var key APIKeyConfig
+    found := false
+    for _, k := range currentConfig().APIKeys {
+        if k.ID == keyID && k.SigningSecret != "" {
+            key, found = k, true
+            break
+        }
+    }
+    if !found {
+        return APIKeyConfig{}, "Unknown signing key"
+    }
+
+    unix, err := strconv.ParseInt(timestamp, 10, 64)
+    if err != nil {
+        return APIKeyConfig{}, "Invalid signature timestamp"
+    }
+    skew := time.Duration(currentConfig().Signing.MaxSkew)
+    age := time.Since(time.Unix(unix, 0))
+    if age > skew || age < -skew {
+        return APIKeyConfig{}, "Signature timestamp outside replay window"
+    }
+
+    body, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBodyBytes+1))
+    if err != nil || len(body) > maxSignedBodyBytes {
+        return APIKeyConfig{}, "Request body too large to verify"
+    }
+    r.Body.Close()
+    r.Body = io.NopCloser(bytes.NewReader(body))
+
+    mac := hmac.New(sha256.New, []byte(key.SigningSecret))
+    mac.Write(signingPayload(timestamp, r, body))
+    expected := hex.EncodeToString(mac.Sum(nil))
+    if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(expected)) {
+        return APIKeyConfig{}, "Invalid signature"
+    }
+    return key, ""
+}
+
+// replayID names the signature of r in used_signatures
+func replayID(r *http.Request) string {
+    signature, _ := strings.CutPrefix(r.Header.Get("X-Signature"), "sha256=")
+    return r.Header.Get("X-Key-Id") + ":" + strings.ToLower(signature)
+}
+
+// claimSignature records the verified signature of r as used and reports
+// whether it was already, by any replica. It is kept until its timestamp is
+// out of the replay window.
+func claimSignature(r *http.Request) (replayed bool, err error) {
+    unix, _ := strconv.ParseInt(r.Header.Get("X-Signature-Timestamp"), 10, 64)
+    used := usedSignature{
+        ID:        replayID(r),
+        ExpiresAt: time.Unix(unix, 0).Add(time.Duration(currentConfig().Signing.MaxSkew)).UTC(),
+    }
+    _, err = usedSignaturesCollection().InsertOne(r.Context(), used)
+    if mongo.IsDuplicateKeyError(err) {
+        return true, nil
+    }
+    return false, err
+}
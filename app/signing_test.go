@@ -0,0 +1,140 @@
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+// withSigningKeys runs a test with the signing keys k1 (secret "s3cret") and
+// k2 (no secret) and a five-minute replay window
+func withSigningKeys(t *testing.T) {
+    cfg := defaultConfig()
+    cfg.APIKeys = []APIKeyConfig{
+        {ID: "k1", Key: "key-1", SigningSecret: "s3cret", Tenant: "acme"},
+        {ID: "k2", Key: "key-2"},
+    }
+    cfg.Signing.MaxSkew = Duration(5 * time.Minute)
+    old := runtimeConfig.Swap(cfg)
+    t.Cleanup(func() { runtimeConfig.Store(old) })
+}
+
+// signedRequest builds a request signed as a client would sign it
+func signedRequest(method, target, body, keyID, secret string, at time.Time) *http.Request {
+    r := httptest.NewRequest(method, target, strings.NewReader(body))
+    timestamp := strconv.FormatInt(at.Unix(), 10)
+    mac := hmac.New(sha256.New, []byte(secret))
+    mac.Write(signingPayload(timestamp, r, []byte(body)))
+    r.Header.Set("X-Key-Id", keyID)
+    r.Header.Set("X-Signature-Timestamp", timestamp)
+    r.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+    return r
+}
+
+func TestVerifySignature(t *testing.T) {
+    withSigningKeys(t)
+    now := time.Now()
+
+    tests := []struct {
+        name   string
+        req    *http.Request
+        change func(r *http.Request)
+        want   string
+    }{
+        {name: "valid", req: signedRequest("POST", "/contacts", `{"name":"a"}`, "k1", "s3cret", now)},
+        {name: "valid, upper-case hex", req: signedRequest("POST", "/contacts", `{"name":"b"}`, "k1", "s3cret", now),
+            change: func(r *http.Request) {
+                r.Header.Set("X-Signature", "sha256="+strings.ToUpper(strings.TrimPrefix(r.Header.Get("X-Signature"), "sha256=")))
+            }},
+        {name: "valid, within skew ahead", req: signedRequest("DELETE", "/contacts/1", "", "k1", "s3cret", now.Add(4*time.Minute))},
+        {name: "valid, within skew behind", req: signedRequest("DELETE", "/contacts/2", "", "k1", "s3cret", now.Add(-4*time.Minute))},
+
+        {name: "no key ID", req: signedRequest("POST", "/contacts", `{"name":"c"}`, "k1", "s3cret", now),
+            change: func(r *http.Request) { r.Header.Del("X-Key-Id") }, want: "Incomplete signature headers"},
+        {name: "no timestamp", req: signedRequest("POST", "/contacts", `{"name":"c"}`, "k1", "s3cret", now),
+            change: func(r *http.Request) { r.Header.Del("X-Signature-Timestamp") }, want: "Incomplete signature headers"},
+        {name: "no scheme", req: signedRequest("POST", "/contacts", `{"name":"c"}`, "k1", "s3cret", now),
+            change: func(r *http.Request) {
+                r.Header.Set("X-Signature", strings.TrimPrefix(r.Header.Get("X-Signature"), "sha256="))
+            }, want: "Incomplete signature headers"},
+        {name: "unknown key", req: signedRequest("POST", "/contacts", `{"name":"c"}`, "k9", "s3cret", now), want: "Unknown signing key"},
+        {name: "key without a secret", req: signedRequest("POST", "/contacts", `{"name":"c"}`, "k2", "", now), want: "Unknown signing key"},
+        {name: "malformed timestamp", req: signedRequest("POST", "/contacts", `{"name":"c"}`, "k1", "s3cret", now),
+            change: func(r *http.Request) { r.Header.Set("X-Signature-Timestamp", "yesterday") }, want: "Invalid signature timestamp"},
+        {name: "too old", req: signedRequest("POST", "/contacts", `{"name":"c"}`, "k1", "s3cret", now.Add(-6*time.Minute)),
+            want: "Signature timestamp outside replay window"},
+        {name: "too far ahead", req: signedRequest("POST", "/contacts", `{"name":"c"}`, "k1", "s3cret", now.Add(6*time.Minute)),
+            want: "Signature timestamp outside replay window"},
+        {name: "wrong secret", req: signedRequest("POST", "/contacts", `{"name":"c"}`, "k1", "guess", now), want: "Invalid signature"},
+        {name: "timestamp moved", req: signedRequest("POST", "/contacts", `{"name":"c"}`, "k1", "s3cret", now),
+            change: func(r *http.Request) { r.Header.Set("X-Signature-Timestamp", strconv.FormatInt(now.Unix()+1, 10)) },
+            want:   "Invalid signature"},
+        {name: "method changed", req: signedRequest("POST", "/contacts/3", `{"name":"c"}`, "k1", "s3cret", now),
+            change: func(r *http.Request) { r.Method = "PUT" }, want: "Invalid signature"},
+        {name: "query changed", req: signedRequest("POST", "/contacts?upsert=false", `{"name":"c"}`, "k1", "s3cret", now),
+            change: func(r *http.Request) { r.URL.RawQuery = "upsert=true" }, want: "Invalid signature"},
+        {name: "body changed", req: signedRequest("POST", "/contacts", `{"name":"c"}`, "k1", "s3cret", now),
+            change: func(r *http.Request) { r.Body = io.NopCloser(strings.NewReader(`{"name":"d"}`)) }, want: "Invalid signature"},
+        {name: "body too large", req: signedRequest("POST", "/contacts", strings.Repeat("x", maxSignedBodyBytes+1), "k1", "s3cret", now),
+            want: "Request body too large to verify"},
+    }
+    for _, tt := range tests {
+        if tt.change != nil {
+            tt.change(tt.req)
+        }
+        key, msg := verifySignature(tt.req)
+        if msg != tt.want {
+            t.Errorf("%s: verifySignature = %q, want %q", tt.name, msg, tt.want)
+            continue
+        }
+        if tt.want == "" && key.ID != "k1" {
+            t.Errorf("%s: verifySignature key = %q, want k1", tt.name, key.ID)
+        }
+    }
+}
+
+func TestVerifySignatureRestoresBody(t *testing.T) {
+    withSigningKeys(t)
+
+    r := signedRequest("POST", "/contacts", `{"name":"restored"}`, "k1", "s3cret", time.Now())
+    if _, msg := verifySignature(r); msg != "" {
+        t.Fatalf("verifySignature = %q", msg)
+    }
+    if body, _ := io.ReadAll(r.Body); string(body) != `{"name":"restored"}` {
+        t.Errorf("body after verifySignature = %q", body)
+    }
+}
+
+// Replays verify like the first use; claimSignature refuses them by replayID
+func TestReplayID(t *testing.T) {
+    withSigningKeys(t)
+
+    at := time.Now()
+    first := signedRequest("PATCH", "/contacts/4", `{"phone":"1"}`, "k1", "s3cret", at)
+    replay := signedRequest("PATCH", "/contacts/4", `{"phone":"1"}`, "k1", "s3cret", at)
+    for _, r := range []*http.Request{first, replay} {
+        if _, msg := verifySignature(r); msg != "" {
+            t.Fatalf("verifySignature = %q", msg)
+        }
+    }
+    if replayID(first) != replayID(replay) {
+        t.Errorf("replayID of a replay = %q, want %q", replayID(replay), replayID(first))
+    }
+    upper := signedRequest("PATCH", "/contacts/4", `{"phone":"1"}`, "k1", "s3cret", at)
+    upper.Header.Set("X-Signature", "sha256="+strings.ToUpper(strings.TrimPrefix(upper.Header.Get("X-Signature"), "sha256=")))
+    if replayID(upper) != replayID(first) {
+        t.Errorf("replayID of a replay in upper-case hex = %q, want %q", replayID(upper), replayID(first))
+    }
+    // the same change signed again, a second later, is a new request
+    again := signedRequest("PATCH", "/contacts/4", `{"phone":"1"}`, "k1", "s3cret", at.Add(time.Second))
+    if replayID(again) == replayID(first) {
+        t.Errorf("replayID of a request signed again = %q, the same as the first", replayID(again))
+    }
+}
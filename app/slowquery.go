@@ -0,0 +1,131 @@
+package main
+
+import (
+    "context"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/event"
+)
+
+var mongoSlowQueries = newCounter("mongo_slow_queries_total", "MongoDB operations slower than slow_query_threshold.", "command", "collection")
+
+// startedCommand is what the monitor keeps of a command until it finishes
+type startedCommand struct {
+    name       string
+    collection string
+    command    []byte
+    route      string
+    requestID  string
+}
+
+// slowQueryMonitor watches every command the driver sends and logs the ones
+// that take longer than slow_query_threshold, with the filter values redacted
+type slowQueryMonitor struct {
+    inflight sync.Map // request ID -> startedCommand
+}
+
+func newSlowQueryMonitor() *event.CommandMonitor {
+    m := &slowQueryMonitor{}
+    return &event.CommandMonitor{
+        Started: m.started,
+        Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+            m.finished(e.CommandFinishedEvent)
+        },
+        Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+            m.finished(e.CommandFinishedEvent)
+        },
+    }
+}
+
+func (m *slowQueryMonitor) started(ctx context.Context, e *event.CommandStartedEvent) {
+    if currentConfig().SlowQueryThreshold <= 0 {
+        return
+    }
+    collection, _ := e.Command.Lookup(e.CommandName).StringValueOK()
+    route, _ := ctx.Value(routeKey).(string)
+    m.inflight.Store(e.RequestID, startedCommand{
+        name:       e.CommandName,
+        collection: collection,
+        command:    append([]byte(nil), e.Command...),
+        route:      route,
+        requestID:  requestIDFrom(ctx),
+    })
+}
+
+func (m *slowQueryMonitor) finished(e event.CommandFinishedEvent) {
+    v, ok := m.inflight.LoadAndDelete(e.RequestID)
+    if !ok {
+        return
+    }
+    cmd := v.(startedCommand)
+
+    threshold := time.Duration(currentConfig().SlowQueryThreshold)
+    if threshold <= 0 || e.Duration < threshold {
+        return
+    }
+
+    route := cmd.route
+    if route == "" {
+        route = "-"
+    }
+    requestID := cmd.requestID
+    if requestID == "" {
+        requestID = "-"
+    }
+    mongoSlowQueries.Inc(cmd.name, cmd.collection)
+    logWarn("slow mongo %s on %s took %s (route %s, request %s): %s",
+        cmd.name, cmd.collection, e.Duration.Round(time.Millisecond), route, requestID, commandShape(cmd.command))
+}
+
+// commandShape renders the query part of a command with every value replaced
+// by "?", keeping field names and operators so a missing index is recognisable
+func commandShape(command bson.Raw) string {
+    var shape bson.D
+    for _, field := range []string{"filter", "query", "pipeline"} {
+        if v, err := command.LookupErr(field); err == nil {
+            shape = append(shape, bson.E{Key: field, Value: redactValue(v)})
+        }
+    }
+    // sort holds only field names and directions
+    if v, err := command.LookupErr("sort"); err == nil {
+        shape = append(shape, bson.E{Key: "sort", Value: v})
+    }
+    for _, field := range []string{"updates", "deletes"} {
+        if v, err := command.LookupErr(field, "0", "q"); err == nil {
+            shape = append(shape, bson.E{Key: field + ".q", Value: redactValue(v)})
+        }
+    }
+    if len(shape) == 0 {
+        return "{}"
+    }
+
+    out, err := bson.MarshalExtJSON(shape, false, false)
+    if err != nil {
+        return "{}"
+    }
+    return string(out)
+}
+
+// redactValue keeps the structure of documents and arrays and hides scalars
+func redactValue(v bson.RawValue) any {
+    switch v.Type {
+    case bson.TypeEmbeddedDocument:
+        elems, _ := v.Document().Elements()
+        doc := bson.D{}
+        for _, e := range elems {
+            doc = append(doc, bson.E{Key: e.Key(), Value: redactValue(e.Value())})
+        }
+        return doc
+    case bson.TypeArray:
+        values, _ := v.Array().Values()
+        arr := bson.A{}
+        for _, e := range values {
+            arr = append(arr, redactValue(e))
+        }
+        return arr
+    default:
+        return "?"
+    }
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+    "fmt"
+    "net/url"
+    "regexp"
+    "slices"
+    "strings"
+)
+
+// SocialProfiles are a contact's handles on social networks. Handles are
+// stored lowercased, without "@" or the profile URL around them; the
+// networks treat them case-insensitively.
+type SocialProfiles struct {
+    LinkedIn string `bson:"linkedin,omitempty" json:"linkedin,omitempty"`
+    X        string `bson:"x,omitempty" json:"x,omitempty"`
+    GitHub   string `bson:"github,omitempty" json:"github,omitempty"`
+}
+
+// socialNetwork is how handles on a network look, and where its profiles are
+type socialNetwork struct {
+    // key is the network's field in SocialProfiles, and its vCard type
+    key  string
+    name string
+    // hosts are the hosts of its profile URLs, without "www."
+    hosts []string
+    // path is what profile paths start with before the handle
+    path    string
+    handle  *regexp.Regexp
+    profile string
+}
+
+var (
+    linkedInNetwork = socialNetwork{
+        key:     "linkedin",
+        name:    "LinkedIn",
+        hosts:   []string{"linkedin.com"},
+        path:    "/in/",
+        handle:  regexp.MustCompile(`^[a-z0-9-]{3,100}$`),
+        profile: "https://www.linkedin.com/in/%s",
+    }
+    xNetwork = socialNetwork{
+        key:     "x",
+        name:    "X",
+        hosts:   []string{"x.com", "twitter.com", "mobile.twitter.com"},
+        path:    "/",
+        handle:  regexp.MustCompile(`^[a-z0-9_]{1,15}$`),
+        profile: "https://x.com/%s",
+    }
+    gitHubNetwork = socialNetwork{
+        key:     "github",
+        name:    "GitHub",
+        hosts:   []string{"github.com"},
+        path:    "/",
+        handle:  regexp.MustCompile(`^[a-z0-9](?:-?[a-z0-9]){0,38}$`),
+        profile: "https://github.com/%s",
+    }
+)
+
+// normalize reads a handle given as such, with "@", or as a profile URL,
+// and returns it as stored
+func (n socialNetwork) normalize(v string) (string, error) {
+    v = strings.TrimSpace(v)
+    if v == "" {
+        return "", nil
+    }
+    invalid := fmt.Errorf("social.%s must be a %s handle or profile URL", n.key, n.name)
+    if strings.ContainsAny(v, "/.") {
+        if !strings.Contains(v, "://") {
+            v = "https://" + v
+        }
+        u, err := url.Parse(v)
+        if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+            return "", invalid
+        }
+        host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+        if !strings.HasPrefix(u.Path, n.path) || !slices.Contains(n.hosts, host) {
+            return "", invalid
+        }
+        v, _, _ = strings.Cut(strings.TrimPrefix(u.Path, n.path), "/")
+    }
+    v = strings.ToLower(strings.TrimPrefix(v, "@"))
+    if !n.handle.MatchString(v) {
+        return "", invalid
+    }
+    return v, nil
+}
+
+// normalizeSocial checks and normalizes each handle of p, returning nil for
+// profiles without any
+func normalizeSocial(p *SocialProfiles) (*SocialProfiles, error) {
+    if p == nil {
+        return nil, nil
+    }
+    var out SocialProfiles
+    var err error
+    if out.LinkedIn, err = linkedInNetwork.normalize(p.LinkedIn); err != nil {
+        return nil, err
+    }
+    if out.X, err = xNetwork.normalize(p.X); err != nil {
+        return nil, err
+    }
+    if out.GitHub, err = gitHubNetwork.normalize(p.GitHub); err != nil {
+        return nil, err
+    }
+    if out == (SocialProfiles{}) {
+        return nil, nil
+    }
+    return &out, nil
+}
+
+// socialHandle is a handle on a network
+type socialHandle struct {
+    network socialNetwork
+    handle  string
+}
+
+// URL is the handle's profile URL
+func (h socialHandle) URL() string {
+    return fmt.Sprintf(h.network.profile, h.handle)
+}
+
+// handles are p's handles, by network
+func (p *SocialProfiles) handles() []socialHandle {
+    var handles []socialHandle
+    for _, h := range []socialHandle{{linkedInNetwork, p.LinkedIn}, {xNetwork, p.X}, {gitHubNetwork, p.GitHub}} {
+        if h.handle != "" {
+            handles = append(handles, h)
+        }
+    }
+    return handles
+}
+
+// orNil is p, or nil if it has no profiles
+func (p *SocialProfiles) orNil() *SocialProfiles {
+    if p == nil || *p == (SocialProfiles{}) {
+        return nil
+    }
+    return p
+}
+
+// normalizeSocial normalizes the profiles the changes set, returning why
+// they are invalid if they are
+func (ch *contactChanges) normalizeSocial() string {
+    if ch.Social == nil {
+        return ""
+    }
+    p, err := normalizeSocial(ch.Social)
+    if err != nil {
+        return err.Error()
+    }
+    if p == nil {
+        p = &SocialProfiles{}
+    }
+    ch.Social = p
+    return ""
+}
+
+// filterHandle matches like filterString, with the argument lowercased like
+// stored handles
+func filterHandle(s string) (any, error) {
+    return filterString(strings.ToLower(strings.TrimPrefix(s, "@")))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+    "context"
+
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// collection wraps a *mongo.Collection so that every operation carries the
+// originating request and trace ID as its $comment, which shows up in the
+// database profiler, currentOp and the server's slow query log. Operations
+// go to the cluster of the region in their context (see residency.go), but
+// those on a shared collection always go to the home region's. Reads marked
+// with withReadOperation may go to secondaries (see readrouting.go), and
+// writes take the write concern of their endpoint (see durability.go).
+// Operations on a tagScoped collection are limited to the caller's key tags
+// (see keyTags).
+type collection struct {
+    *mongo.Collection
+    tagScoped bool
+    shared    bool
+}
+
+// collectionOf returns the named collection of the service database
+func collectionOf(name string) collection {
+    return collection{Collection: mongoDB.Collection(name)}
+}
+
+// sharedCollectionOf returns a collection of the home region holding what
+// operators configure for all tenants, such as quotas, rather than tenant data
+func sharedCollectionOf(name string) collection {
+    return collection{Collection: mongoDB.Collection(name), shared: true}
+}
+
+// in returns the collection in the region of ctx, with the read preference of
+// its read operation and the write concern of its endpoint
+func (c collection) in(ctx context.Context) *mongo.Collection {
+    coll := c.Collection
+    opts := options.Collection()
+    if !c.shared {
+        if db := databaseFor(ctx); db != c.Database() {
+            coll = db.Collection(c.Name())
+        }
+        if rp := readPreferenceFor(ctx); rp != nil {
+            opts.SetReadPreference(rp)
+        }
+    }
+    if wc := writeConcernFor(ctx); wc != nil {
+        opts.SetWriteConcern(wc)
+    }
+    if opts.ReadPreference == nil && opts.WriteConcern == nil {
+        return coll
+    }
+    coll, _ = coll.Clone(opts)
+    return coll
+}
+
+// at returns the collection in the region of ctx, as in does, and ctx with
+// the request's causally consistent session on its cluster, if any (see
+// causal.go)
+func (c collection) at(ctx context.Context) (*mongo.Collection, context.Context) {
+    coll := c.in(ctx)
+    region := homeRegion
+    if !c.shared {
+        region = regionFrom(ctx)
+    }
+    return coll, withCausalSession(ctx, region, coll)
+}
+
+// opComment describes where an operation came from; "" when it did not come
+// from a request, e.g. a background job
+func opComment(ctx context.Context) string {
+    id := requestIDFrom(ctx)
+    if id == "" {
+        return ""
+    }
+    comment := "request_id:" + id
+    if tc, ok := ctx.Value(traceKey).(traceContext); ok {
+        comment += " trace_id:" + tc.TraceID
+    }
+    return comment
+}
+
+func (c collection) Find(ctx context.Context, filter any, opts ...*options.FindOptions) (*mongo.Cursor, error) {
+    filter = c.restrict(ctx, filter)
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.Find().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.Find(ctx, filter, opts...)
+}
+
+func (c collection) FindOne(ctx context.Context, filter any, opts ...*options.FindOneOptions) *mongo.SingleResult {
+    filter = c.restrict(ctx, filter)
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.FindOne().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.FindOne(ctx, filter, opts...)
+}
+
+func (c collection) InsertOne(ctx context.Context, doc any, opts ...*options.InsertOneOptions) (*mongo.InsertOneResult, error) {
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.InsertOne().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.InsertOne(ctx, doc, opts...)
+}
+
+func (c collection) InsertMany(ctx context.Context, docs []any, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.InsertMany().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.InsertMany(ctx, docs, opts...)
+}
+
+func (c collection) UpdateOne(ctx context.Context, filter, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+    filter = c.restrict(ctx, filter)
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.Update().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.UpdateOne(ctx, filter, update, opts...)
+}
+
+func (c collection) UpdateMany(ctx context.Context, filter, update any, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+    filter = c.restrict(ctx, filter)
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.Update().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.UpdateMany(ctx, filter, update, opts...)
+}
+
+func (c collection) ReplaceOne(ctx context.Context, filter, replacement any, opts ...*options.ReplaceOptions) (*mongo.UpdateResult, error) {
+    filter = c.restrict(ctx, filter)
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.Replace().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.ReplaceOne(ctx, filter, replacement, opts...)
+}
+
+func (c collection) DeleteOne(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+    filter = c.restrict(ctx, filter)
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.Delete().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.DeleteOne(ctx, filter, opts...)
+}
+
+func (c collection) DeleteMany(ctx context.Context, filter any, opts ...*options.DeleteOptions) (*mongo.DeleteResult, error) {
+    filter = c.restrict(ctx, filter)
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.Delete().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.DeleteMany(ctx, filter, opts...)
+}
+
+func (c collection) CountDocuments(ctx context.Context, filter any, opts ...*options.CountOptions) (int64, error) {
+    filter = c.restrict(ctx, filter)
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.Count().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.CountDocuments(ctx, filter, opts...)
+}
+
+func (c collection) Aggregate(ctx context.Context, pipeline any, opts ...*options.AggregateOptions) (*mongo.Cursor, error) {
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.Aggregate().SetComment(comment))
+    }
+    pipeline, err := c.restrictPipeline(ctx, pipeline)
+    if err != nil {
+        return nil, err
+    }
+    coll, ctx := c.at(ctx)
+    return coll.Aggregate(ctx, pipeline, opts...)
+}
+
+func (c collection) BulkWrite(ctx context.Context, models []mongo.WriteModel, opts ...*options.BulkWriteOptions) (*mongo.BulkWriteResult, error) {
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.BulkWrite().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.BulkWrite(ctx, c.restrictModels(ctx, models), opts...)
+}
+
+func (c collection) FindOneAndUpdate(ctx context.Context, filter, update any, opts ...*options.FindOneAndUpdateOptions) *mongo.SingleResult {
+    filter = c.restrict(ctx, filter)
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.FindOneAndUpdate().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.FindOneAndUpdate(ctx, filter, update, opts...)
+}
+
+func (c collection) FindOneAndDelete(ctx context.Context, filter any, opts ...*options.FindOneAndDeleteOptions) *mongo.SingleResult {
+    filter = c.restrict(ctx, filter)
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.FindOneAndDelete().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.FindOneAndDelete(ctx, filter, opts...)
+}
+
+func (c collection) Distinct(ctx context.Context, field string, filter any, opts ...*options.DistinctOptions) ([]any, error) {
+    filter = c.restrict(ctx, filter)
+    if comment := opComment(ctx); comment != "" {
+        opts = append(opts, options.Distinct().SetComment(comment))
+    }
+    coll, ctx := c.at(ctx)
+    return coll.Distinct(ctx, field, filter, opts...)
+}
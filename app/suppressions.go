@@ -0,0 +1,391 @@
+package main
+
+import (
+    "encoding/csv"
+    "encoding/json"
+    "io"
+    "mime"
+    "net/http"
+    "net/mail"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// A tenant's suppression list holds the phone numbers and email addresses it
+// must not contact, such as those of people who opted out. Contacts created
+// with a suppressed phone, or changed to one, are flagged do_not_contact;
+// campaign tooling asks POST /suppressions/check before reaching out.
+
+const (
+    // maxSuppressionImport caps the entries of one POST /suppressions
+    maxSuppressionImport = 10000
+    // maxSuppressionCheck caps the values of one check
+    maxSuppressionCheck     = 1000
+    maxSuppressionReason    = 200
+    defaultSuppressionLimit = 100
+    maxSuppressionLimit     = 1000
+
+    suppressPhone = "phone"
+    suppressEmail = "email"
+)
+
+// Suppression is a phone number or email address on the tenant's
+// suppression list. Phones are stored normalized like phone_normalized,
+// emails lowercased.
+type Suppression struct {
+    ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    Tenant    string             `bson:"tenant" json:"-"`
+    Type      string             `bson:"type" json:"type"`
+    Value     string             `bson:"value" json:"value"`
+    Reason    string             `bson:"reason,omitempty" json:"reason,omitempty"`
+    AddedBy   string             `bson:"added_by" json:"added_by"`
+    CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+}
+
+func suppressionsCollection() collection {
+    return collectionOf("suppressions")
+}
+
+// suppressionValue normalizes a phone or email as the suppression list
+// stores it, returning "" for values that are neither
+func suppressionValue(kind, value string, settings TenantSettings) string {
+    value = strings.TrimSpace(value)
+    if kind == suppressEmail {
+        addr, err := mail.ParseAddress(value)
+        if err != nil || addr.Name != "" {
+            return ""
+        }
+        return strings.ToLower(addr.Address)
+    }
+    return phoneKey(value, settings.PhoneRegion)
+}
+
+// suppressedPhones returns which of phones are on the caller's suppression
+// list
+func suppressedPhones(r *http.Request, settings TenantSettings, phones ...string) (map[string]bool, error) {
+    byKey := map[string][]string{}
+    keys := bson.A{}
+    for _, p := range phones {
+        if key := phoneKey(p, settings.PhoneRegion); key != "" {
+            byKey[key] = append(byKey[key], p)
+            keys = append(keys, key)
+        }
+    }
+    suppressed := map[string]bool{}
+    if len(keys) == 0 {
+        return suppressed, nil
+    }
+    found, err := suppressionsCollection().Distinct(r.Context(), "value",
+        scopeFilter(r, bson.M{"type": suppressPhone, "value": bson.M{"$in": keys}}))
+    if err != nil {
+        return nil, err
+    }
+    for _, key := range found {
+        k, _ := key.(string)
+        for _, p := range byKey[k] {
+            suppressed[p] = true
+        }
+    }
+    return suppressed, nil
+}
+
+// flagSuppressed makes changes setting a suppressed phone flag the contact
+// do_not_contact
+func (ch *contactChanges) flagSuppressed(r *http.Request, settings TenantSettings) error {
+    if ch.Phone == nil {
+        return nil
+    }
+    suppressed, err := suppressedPhones(r, settings, *ch.Phone)
+    if suppressed[*ch.Phone] {
+        flag := true
+        ch.DoNotContact = &flag
+    }
+    return err
+}
+
+// listSuppressions handles GET /suppressions[?type=phone|email&limit=100&before=],
+// newest first; before is the next cursor of the previous page
+func listSuppressions(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    limit, ok := queryInt(r, "limit", defaultSuppressionLimit, maxSuppressionLimit)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "limit must be a positive number")
+        return
+    }
+    filter := scopeFilter(r, bson.M{})
+    switch kind := r.URL.Query().Get("type"); kind {
+    case "":
+    case suppressPhone, suppressEmail:
+        filter["type"] = kind
+    default:
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "type must be phone or email")
+        return
+    }
+    if before := r.URL.Query().Get("before"); before != "" {
+        cursorID, err := primitive.ObjectIDFromHex(before)
+        if err != nil {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "Invalid before cursor")
+            return
+        }
+        filter["_id"] = bson.M{"$lt": cursorID}
+    }
+
+    opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(int64(limit) + 1)
+    cursor, err := suppressionsCollection().Find(r.Context(), filter, opts)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve suppressions")
+        return
+    }
+    suppressions := []Suppression{}
+    if err := cursor.All(r.Context(), &suppressions); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    body := bson.M{"suppressions": suppressions}
+    if len(suppressions) > limit {
+        body["suppressions"] = suppressions[:limit]
+        body["next"] = suppressions[limit-1].ID.Hex()
+    }
+    json.NewEncoder(w).Encode(body)
+}
+
+// suppressionInput is the JSON body of POST /suppressions and of checks
+type suppressionInput struct {
+    Phones []string `json:"phones"`
+    Emails []string `json:"emails"`
+    Reason string   `json:"reason"`
+}
+
+// readSuppressionInput reads a JSON body, or a CSV one (text/csv) with a
+// phone or email in the first column of each line
+func readSuppressionInput(r *http.Request) (suppressionInput, error) {
+    var in suppressionInput
+    defer r.Body.Close()
+    if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != "text/csv" {
+        err := json.NewDecoder(r.Body).Decode(&in)
+        return in, err
+    }
+    rd := csv.NewReader(r.Body)
+    rd.FieldsPerRecord = -1
+    for {
+        record, err := rd.Read()
+        if err == io.EOF {
+            return in, nil
+        }
+        if err != nil {
+            return in, err
+        }
+        if v := strings.TrimSpace(record[0]); strings.Contains(v, "@") {
+            in.Emails = append(in.Emails, v)
+        } else if v != "" {
+            in.Phones = append(in.Phones, v)
+        }
+    }
+}
+
+// addSuppressions handles POST /suppressions with {"phones", "emails",
+// "reason"}, or a CSV of phones and emails, adding them to the caller's
+// suppression list. Values already on it are kept as they are.
+func addSuppressions(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    in, err := readSuppressionInput(r)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    in.Reason = strings.TrimSpace(in.Reason)
+    if len([]rune(in.Reason)) > maxSuppressionReason {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "reason must not be longer than 200 characters")
+        return
+    }
+    if len(in.Phones)+len(in.Emails) == 0 {
+        writeError(w, http.StatusBadRequest, codeMissingField, "phones or emails are required")
+        return
+    }
+    if len(in.Phones)+len(in.Emails) > maxSuppressionImport {
+        writeErrorWith(w, http.StatusBadRequest, codeValidationFailed, "Too many entries in one request",
+            map[string]any{"max_entries": maxSuppressionImport})
+        return
+    }
+    settings, err := callerSettings(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve settings")
+        return
+    }
+
+    now := utcNow()
+    invalid := []string{}
+    var models []mongo.WriteModel
+    for _, list := range []struct {
+        kind   string
+        values []string
+    }{{suppressPhone, in.Phones}, {suppressEmail, in.Emails}} {
+        for _, raw := range list.values {
+            value := suppressionValue(list.kind, raw, settings)
+            if value == "" {
+                invalid = append(invalid, raw)
+                continue
+            }
+            s := Suppression{Tenant: tenantOf(r), Type: list.kind, Value: value, Reason: in.Reason, AddedBy: clientKey(r), CreatedAt: now}
+            models = append(models, mongo.NewUpdateOneModel().
+                SetFilter(bson.M{"tenant": s.Tenant, "type": s.Type, "value": s.Value}).
+                SetUpdate(bson.M{"$setOnInsert": s}).
+                SetUpsert(true))
+        }
+    }
+    var added int64
+    if len(models) > 0 {
+        result, err := suppressionsCollection().BulkWrite(r.Context(), models, options.BulkWrite().SetOrdered(false))
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to add suppressions")
+            return
+        }
+        added = result.UpsertedCount
+    }
+    recordAudit(r, "suppression.add", tenantOf(r), bson.M{"added": added, "reason": in.Reason})
+    json.NewEncoder(w).Encode(bson.M{
+        "added":   added,
+        "present": int64(len(models)) - added,
+        "invalid": invalid,
+    })
+}
+
+// deleteSuppression handles DELETE /suppressions/{id}. Contacts flagged
+// do_not_contact because of it stay flagged.
+func deleteSuppression(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    id, err := primitive.ObjectIDFromHex(strings.TrimPrefix(r.URL.Path, "/suppressions/"))
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid suppression ID")
+        return
+    }
+    var s Suppression
+    err = suppressionsCollection().FindOneAndDelete(r.Context(), scopeFilter(r, bson.M{"_id": id})).Decode(&s)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeSuppressionNotFound, "Suppression not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete suppression")
+        return
+    }
+    recordAudit(r, "suppression.delete", id.Hex(), bson.M{"type": s.Type})
+    json.NewEncoder(w).Encode(bson.M{"message": "Suppression deleted successfully"})
+}
+
+// SuppressionCheck is whether a phone or email may be contacted. Reasons are
+// "suppression_list" and, for phones, "do_not_contact" when one of the
+// tenant's contacts with the phone is flagged; Contacts are those contacts.
+type SuppressionCheck struct {
+    Value      string   `json:"value"`
+    Type       string   `json:"type"`
+    Suppressed bool     `json:"suppressed"`
+    Reasons    []string `json:"reasons"`
+    Contacts   []string `json:"contacts,omitempty"`
+}
+
+// checkSuppressions handles POST /suppressions/check with {"phones",
+// "emails"}, answering for each whether it must not be contacted
+func checkSuppressions(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    var in suppressionInput
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    defer r.Body.Close()
+    if len(in.Phones)+len(in.Emails) == 0 {
+        writeError(w, http.StatusBadRequest, codeMissingField, "phones or emails are required")
+        return
+    }
+    if len(in.Phones)+len(in.Emails) > maxSuppressionCheck {
+        writeErrorWith(w, http.StatusBadRequest, codeValidationFailed, "Too many values to check in one request",
+            map[string]any{"max_values": maxSuppressionCheck})
+        return
+    }
+    settings, err := callerSettings(r)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve settings")
+        return
+    }
+
+    results := make([]SuppressionCheck, 0, len(in.Phones)+len(in.Emails))
+    keys := []string{}
+    for _, list := range []struct {
+        kind   string
+        values []string
+    }{{suppressPhone, in.Phones}, {suppressEmail, in.Emails}} {
+        for _, raw := range list.values {
+            results = append(results, SuppressionCheck{Value: raw, Type: list.kind, Reasons: []string{}})
+            keys = append(keys, suppressionValue(list.kind, raw, settings))
+        }
+    }
+    listed, flagged, err := suppressionMatches(r, settings, keys, in.Phones)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to check suppressions")
+        return
+    }
+    for i := range results {
+        key := results[i].Type + ":" + keys[i]
+        if keys[i] != "" && listed[key] {
+            results[i].Reasons = append(results[i].Reasons, "suppression_list")
+        }
+        if ids := flagged[key]; keys[i] != "" && len(ids) > 0 {
+            results[i].Reasons = append(results[i].Reasons, "do_not_contact")
+            results[i].Contacts = ids
+        }
+        results[i].Suppressed = len(results[i].Reasons) > 0
+    }
+    json.NewEncoder(w).Encode(bson.M{"results": results})
+}
+
+// suppressionMatches finds which of keys are on the caller's suppression
+// list, and the contacts flagged do_not_contact with any of phones, both by
+// "type:key"
+func suppressionMatches(r *http.Request, settings TenantSettings, keys, phones []string) (listed map[string]bool, flagged map[string][]string, err error) {
+    listed, flagged = map[string]bool{}, map[string][]string{}
+    cursor, err := suppressionsCollection().Find(r.Context(), scopeFilter(r, bson.M{"value": bson.M{"$in": keys}}),
+        options.Find().SetProjection(bson.M{"type": 1, "value": 1}))
+    if err != nil {
+        return nil, nil, err
+    }
+    var found []Suppression
+    if err := cursor.All(r.Context(), &found); err != nil {
+        return nil, nil, err
+    }
+    for _, s := range found {
+        listed[s.Type+":"+s.Value] = true
+    }
+    if len(phones) == 0 {
+        return listed, flagged, nil
+    }
+
+    phoneKeys := keys[:len(phones)]
+    cursor, err = contactsCollection.Find(r.Context(), scopeFilter(r, bson.M{
+        "do_not_contact": true,
+        "$or":            bson.A{bson.M{"phone": bson.M{"$in": phones}}, bson.M{"phone_normalized": bson.M{"$in": phoneKeys}}},
+    }), options.Find().SetProjection(bson.M{"phone": 1}))
+    if err != nil {
+        return nil, nil, err
+    }
+    var contacts []Contact
+    if err := cursor.All(r.Context(), &contacts); err != nil {
+        return nil, nil, err
+    }
+    for _, c := range contacts {
+        if key := phoneKey(c.Phone, settings.PhoneRegion); key != "" {
+            flagged[suppressPhone+":"+key] = append(flagged[suppressPhone+":"+key], c.ID.Hex())
+        }
+    }
+    return listed, flagged, nil
+}
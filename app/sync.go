@@ -0,0 +1,114 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// GET /contacts/sync reads contact_versions as the log of contact writes: a
+// sync token is the ID of the last version a client has seen, and the next
+// sync returns the contacts written after it, with "delete" versions as
+// tombstones. Version IDs come from the instance that made the write, so the
+// newest few seconds are held back until writes racing them, possibly from
+// instances with a slightly different clock, have landed.
+
+const (
+    defaultSyncLimit = 500
+    maxSyncLimit     = 1000
+    // syncSettle holds back versions younger than this from syncs
+    syncSettle = 5 * time.Second
+)
+
+// ContactSync is the response of GET /contacts/sync: the contacts written
+// since the token as their last write left them, the IDs of those deleted,
+// and the token to sync from next. More is set while further changes are
+// waiting.
+type ContactSync struct {
+    Contacts []Contact `json:"contacts"`
+    Deleted  []string  `json:"deleted"`
+    Token    string    `json:"token"`
+    More     bool      `json:"more"`
+}
+
+// syncContacts handles GET /contacts/sync[?token=&limit=500]. Without a token
+// it only returns one for the present, to be taken before loading the
+// contacts with GET /contacts; syncing from it later brings whatever changed
+// meanwhile. limit caps the versions read, so a page may hold fewer contacts.
+func syncContacts(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    limit, ok := queryInt(r, "limit", defaultSyncLimit, maxSyncLimit)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "limit must be a positive number")
+        return
+    }
+    settled := primitive.NewObjectIDFromTimestamp(utcNow().Add(-syncSettle))
+    res := ContactSync{Contacts: []Contact{}, Deleted: []string{}, Token: settled.Hex()}
+    token := r.URL.Query().Get("token")
+    if token == "" {
+        json.NewEncoder(w).Encode(res)
+        return
+    }
+    after, err := primitive.ObjectIDFromHex(token)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "Invalid sync token")
+        return
+    }
+    if after.Timestamp().After(settled.Timestamp()) {
+        res.Token = after.Hex()
+        json.NewEncoder(w).Encode(res)
+        return
+    }
+
+    filter := scopeFilter(r, bson.M{"_id": bson.M{"$gt": after, "$lt": settled}})
+    if tags := keyTags(r.Context()); len(tags) > 0 {
+        filter["contact.tags"] = bson.M{"$in": tags}
+    }
+    opts := options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetLimit(int64(limit) + 1)
+    cursor, err := contactVersionsCollection().Find(r.Context(), filter, opts)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve changes")
+        return
+    }
+    var versions []ContactVersion
+    if err := cursor.All(r.Context(), &versions); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    if len(versions) > limit {
+        versions, res.More = versions[:limit], true
+        res.Token = versions[limit-1].ID.Hex()
+    }
+
+    // a contact written several times in the page is returned once, as its
+    // last version left it
+    last := map[primitive.ObjectID]int{}
+    for i, v := range versions {
+        last[v.ContactID] = i
+    }
+    for i, v := range versions {
+        switch {
+        case last[v.ContactID] != i:
+        case v.Action == versionDelete:
+            res.Deleted = append(res.Deleted, v.ContactID.Hex())
+        default:
+            res.Contacts = append(res.Contacts, v.Contact)
+        }
+    }
+
+    f, ok := phoneFormatFor(w, r)
+    if !ok {
+        return
+    }
+    for i := range res.Contacts {
+        f.apply(&res.Contacts[i])
+        res.Contacts[i].setAvatarURL()
+    }
+    recordsServed(r, len(res.Contacts))
+    json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "slices"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// bulkTagsRequest is the body of POST /contacts/tags/bulk: tags to add or to
+// remove, and the contacts to change, named by IDs or matched by a query
+type bulkTagsRequest struct {
+    Add    []string      `json:"add"`
+    Remove []string      `json:"remove"`
+    IDs    []string      `json:"ids"`
+    Query  *ContactQuery `json:"query"`
+}
+
+// bulkTagContacts handles POST /contacts/tags/bulk. The tags change in one
+// UpdateMany; the result has an element per contact, in the order of ids or,
+// for a query, of the contacts it matched. A query may match at most
+// max_export_size contacts.
+func bulkTagContacts(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if refuseUnreviewed(w, r) {
+        return
+    }
+    var in bulkTagsRequest
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    add, remove := normalizeTags(in.Add), normalizeTags(in.Remove)
+    switch {
+    case len(add) == 0 && len(remove) == 0:
+        writeError(w, http.StatusBadRequest, codeMissingField, "add or remove is required")
+        return
+    case len(add) > 0 && len(remove) > 0:
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "give either add or remove, not both")
+        return
+    case len(in.IDs) > 0 && in.Query != nil:
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "give either ids or query, not both")
+        return
+    case len(in.IDs) == 0 && in.Query == nil:
+        writeError(w, http.StatusBadRequest, codeMissingField, "ids or query is required")
+        return
+    }
+
+    var res BulkResult
+    var ids []primitive.ObjectID
+    if in.Query != nil {
+        var ok bool
+        if ids, ok = queryContactIDs(w, r, *in.Query); !ok {
+            return
+        }
+        res = newBulkResult(len(ids))
+        for i, id := range ids {
+            res.Results[i].ID = id.Hex()
+        }
+    } else {
+        if !bulkLimit(w, r, len(in.IDs)) {
+            return
+        }
+        res = newBulkResult(len(in.IDs))
+        var err error
+        if ids, err = resolveBulkIDs(r, &res, in.IDs); err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
+            return
+        }
+    }
+
+    var targets []primitive.ObjectID
+    for i, id := range ids {
+        if res.pending(i) {
+            targets = append(targets, id)
+        }
+    }
+    set := bson.M{"updated_at": utcNow()}
+    update := withNextVersion(bson.M{"$set": set})
+    changes := bson.M{}
+    if len(add) > 0 {
+        update["$addToSet"] = bson.M{"tags": bson.M{"$each": add}}
+        changes["tags_added"] = add
+    } else {
+        update["$pull"] = bson.M{"tags": bson.M{"$in": remove}}
+        changes["tags_removed"] = remove
+    }
+    var later []primitive.ObjectID
+    if len(targets) > 0 {
+        var err error
+        _, later, err = updateContactsAsLastWriter(r.Context(), targets, scopeFilter(r, bson.M{}), set, update)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to update contacts")
+            return
+        }
+    }
+
+    var updated []primitive.ObjectID
+    for i, id := range ids {
+        if !res.pending(i) {
+            continue
+        }
+        if slices.Contains(later, id) {
+            res.fail(i, http.StatusConflict, codeVersionConflict, "The contact keeps changing; try again")
+            continue
+        }
+        updated = append(updated, id)
+        hex := id.Hex()
+        contactCache.Delete(tenantOf(r) + "/" + hex)
+        res.succeed(i, outcomeUpdated, http.StatusOK, hex)
+        recordAudit(r, "contact.update", hex, bson.M{"bulk": true, "changes": changes})
+        publishContactEvent(r, "contact.updated", bson.M{"id": hex, "changes": changes})
+    }
+    recordVersions(r, versionUpdate, updated...)
+    writeBulkResult(w, res)
+}
+
+// queryContactIDs finds the IDs of the caller's contacts matching cq, oldest
+// first, answering the request itself if the query is invalid or matches
+// more than max_export_size contacts
+func queryContactIDs(w http.ResponseWriter, r *http.Request, cq ContactQuery) ([]primitive.ObjectID, bool) {
+    limits := queryLimitsFor(r)
+    filter, msg := cq.filter(limits)
+    if msg != "" {
+        writeError(w, http.StatusBadRequest, codeInvalidFilter, msg)
+        return nil, false
+    }
+    var limit int64
+    if limits.MaxExportSize > 0 {
+        limit = int64(limits.MaxExportSize) + 1
+    }
+    ids, err := matchingContactIDs(r, scopeFilter(r, filter), limit)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
+        return nil, false
+    }
+    if limits.MaxExportSize > 0 && len(ids) > limits.MaxExportSize {
+        writeErrorWith(w, http.StatusRequestEntityTooLarge, codeExportTooLarge,
+            "The query matches too many contacts, narrow it down", map[string]any{"max_export_size": limits.MaxExportSize})
+        return nil, false
+    }
+    return ids, true
+}
+
+// TagCount is a tag and how many of the tenant's contacts have it
+type TagCount struct {
+    Tag   string `bson:"_id" json:"tag"`
+    Count int64  `bson:"count" json:"count"`
+}
+
+// listTags handles GET /tags[?sort=count], the tags in use in the caller's
+// tenant with their contact counts, by name or most used first
+func listTags(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    order := bson.D{{Key: "_id", Value: 1}}
+    switch r.URL.Query().Get("sort") {
+    case "", "name":
+    case "count":
+        order = bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}
+    default:
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "sort must be name or count")
+        return
+    }
+
+    cursor, err := contactsCollection.Aggregate(r.Context(), mongo.Pipeline{
+        {{Key: "$match", Value: scopeFilter(r, bson.M{"tags.0": bson.M{"$exists": true}})}},
+        {{Key: "$unwind", Value: "$tags"}},
+        {{Key: "$group", Value: bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}}},
+        {{Key: "$sort", Value: order}},
+    })
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve tags")
+        return
+    }
+    tags := []TagCount{}
+    if err := cursor.All(r.Context(), &tags); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    json.NewEncoder(w).Encode(tags)
+}
+
+// renameTag handles PUT /tags/{tag} with {"name": "new"}. A tag can't be
+// renamed to one in use, since that would merge them; mergeTags does that.
+func renameTag(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if refuseUnreviewed(w, r) {
+        return
+    }
+    var in struct {
+        Name string `json:"name"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    from := normalizeTags([]string{r.URL.Path[len("/tags/"):]})
+    to := normalizeTags([]string{in.Name})
+    switch {
+    case len(from) == 0:
+        writeError(w, http.StatusNotFound, codeTagNotFound, "Tag not found")
+        return
+    case len(to) == 0:
+        writeError(w, http.StatusBadRequest, codeMissingField, "name is required")
+        return
+    case to[0] == from[0]:
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "name is the tag's current name")
+        return
+    }
+
+    err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"tags": to[0]}),
+        options.FindOne().SetProjection(bson.M{"_id": 1})).Err()
+    if err == nil {
+        writeError(w, http.StatusConflict, codeTagExists, "The tag "+to[0]+" is in use, merge the tags instead")
+        return
+    }
+    if err != mongo.ErrNoDocuments {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return
+    }
+
+    if n, ok := retag(w, r, from, to[0]); ok {
+        recordAudit(r, "tag.rename", to[0], bson.M{"from": from[0], "contacts": n})
+        json.NewEncoder(w).Encode(bson.M{"tag": to[0], "contacts": n})
+    }
+}
+
+// mergeTags handles POST /tags/merge with {"tags": [...], "into": "tag"}:
+// the contacts with any of tags get into in their place, once
+func mergeTags(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if refuseUnreviewed(w, r) {
+        return
+    }
+    var in struct {
+        Tags []string `json:"tags"`
+        Into string   `json:"into"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    into := normalizeTags([]string{in.Into})
+    if len(into) == 0 {
+        writeError(w, http.StatusBadRequest, codeMissingField, "into is required")
+        return
+    }
+    var from []string
+    for _, t := range normalizeTags(in.Tags) {
+        if t != into[0] {
+            from = append(from, t)
+        }
+    }
+    if len(from) == 0 {
+        writeError(w, http.StatusBadRequest, codeMissingField, "tags to merge into "+into[0]+" are required")
+        return
+    }
+
+    if n, ok := retag(w, r, from, into[0]); ok {
+        recordAudit(r, "tag.merge", into[0], bson.M{"from": from, "contacts": n})
+        json.NewEncoder(w).Encode(bson.M{"tag": into[0], "contacts": n})
+    }
+}
+
+// retag replaces the tags from with to on every contact of the caller's
+// tenant that has any of them, and in the tag lists of the tenant's groups and
+// saved searches. It answers with a 404 if no contact has them, and otherwise
+// returns how many contacts changed.
+//
+// The contacts are listed first and the update runs on exactly those IDs, so
+// the versions, cache evictions and events cover the contacts it changed; one
+// tagged in between keeps the old tag, as does one another site keeps
+// writing later (see updateContactsAsLastWriter). It is not atomic: the
+// update can fail part way, and the stored queries are updated after the
+// contacts. Retagging is idempotent, so a partial rename or merge is finished
+// by merging from into to again (POST /tags/merge), which also picks up
+// contacts tagged since.
+func retag(w http.ResponseWriter, r *http.Request, from []string, to string) (int64, bool) {
+    filter := scopeFilter(r, bson.M{"tags": bson.M{"$in": from}})
+    ids, err := matchingContactIDs(r, filter, 0)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve contacts")
+        return 0, false
+    }
+    if len(ids) == 0 {
+        writeError(w, http.StatusNotFound, codeTagNotFound, "Tag not found")
+        return 0, false
+    }
+
+    set := withWriteStamp(bson.M{
+        "tags":       replaceTags("$tags", from, to),
+        "updated_at": utcNow(),
+        "version":    nextVersionExpr,
+    })
+    matched, later, err := updateContactsAsLastWriter(r.Context(), ids, bson.M{"tags": bson.M{"$in": from}}, set,
+        mongo.Pipeline{{{Key: "$set", Value: set}}})
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to update contacts")
+        return 0, false
+    }
+    if len(later) > 0 {
+        logWarn("retagging %v as %s skipped %d contacts that keep changing", from, to, len(later))
+        ids = slices.DeleteFunc(ids, func(id primitive.ObjectID) bool { return slices.Contains(later, id) })
+    }
+    for _, coll := range []collection{groupsCollection(), savedSearchesCollection()} {
+        _, err := coll.UpdateMany(r.Context(), scopeFilter(r, bson.M{"query.tags": bson.M{"$in": from}}),
+            mongo.Pipeline{{{Key: "$set", Value: bson.M{"query.tags": replaceTags("$query.tags", from, to)}}}})
+        if err != nil {
+            logError("failed to retag %v as %s in stored queries: %v", from, to, err)
+        }
+    }
+
+    recordVersions(r, versionUpdate, ids...)
+    changes := bson.M{"tags_added": []string{to}, "tags_removed": from}
+    for _, id := range ids {
+        contactCache.Delete(tenantOf(r) + "/" + id.Hex())
+        publishContactEvent(r, "contact.updated", bson.M{"id": id.Hex(), "changes": changes})
+    }
+    return matched, true
+}
+
+// matchingContactIDs lists the IDs of the contacts matching filter, oldest
+// first, at most limit of them unless limit is 0
+func matchingContactIDs(r *http.Request, filter bson.M, limit int64) ([]primitive.ObjectID, error) {
+    opts := options.Find().SetProjection(bson.M{"_id": 1}).SetSort(bson.D{{Key: "_id", Value: 1}})
+    if limit > 0 {
+        opts.SetLimit(limit)
+    }
+    cursor, err := contactsCollection.Find(r.Context(), filter, opts)
+    if err != nil {
+        return nil, err
+    }
+    var found []struct {
+        ID primitive.ObjectID `bson:"_id"`
+    }
+    if err := cursor.All(r.Context(), &found); err != nil {
+        return nil, err
+    }
+    ids := make([]primitive.ObjectID, len(found))
+    for i, f := range found {
+        ids[i] = f.ID
+    }
+    return ids, nil
+}
+
+// replaceTags is an aggregation expression for the tag list at path with the
+// tags from replaced by to, keeping the order and dropping repeats. Tags are
+// passed as literals, so one starting with "$" isn't read as a field path.
+func replaceTags(path string, from []string, to string) bson.M {
+    return bson.M{"$reduce": bson.M{
+        "input": bson.M{"$map": bson.M{
+            "input": path,
+            "in":    bson.M{"$cond": bson.A{bson.M{"$in": bson.A{"$$this", bson.M{"$literal": from}}}, bson.M{"$literal": to}, "$$this"}},
+        }},
+        "initialValue": bson.A{},
+        "in": bson.M{"$cond": bson.A{
+            bson.M{"$in": bson.A{"$$this", "$$value"}},
+            "$$value",
+            bson.M{"$concatArrays": bson.A{"$$value", bson.A{"$$this"}}},
+        }},
+    }}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+    "net/http"
+
+    "go.mongodb.org/mongo-driver/bson"
+)
+
+// defaultTenant owns contacts created by anonymous callers and keys without a
+// tenant, as well as every contact written before tenants existed
+const defaultTenant = "default"
+
+// tenantOf returns the tenant the caller acts for
+func tenantOf(r *http.Request) string {
+    if t := principalFrom(r).Tenant; t != "" {
+        return t
+    }
+    return defaultTenant
+}
+
+// tenantFilter matches documents of a tenant; the default tenant also matches
+// documents stored without a tenant
+func tenantFilter(tenant string) bson.M {
+    if tenant == "" || tenant == defaultTenant {
+        return bson.M{"tenant": bson.M{"$in": bson.A{nil, "", defaultTenant}}}
+    }
+    return bson.M{"tenant": tenant}
+}
+
+// scopeFilter restricts filter to the caller's tenant
+func scopeFilter(r *http.Request, filter bson.M) bson.M {
+    scoped := bson.M{}
+    for k, v := range filter {
+        scoped[k] = v
+    }
+    scoped["tenant"] = tenantFilter(tenantOf(r))["tenant"]
+    return scoped
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "fmt"
+    "net/http"
+    "slices"
+    "strings"
+    "sync"
+    "time"
+)
+
+// TimeoutConfig bounds how long a request may take: Default for every request,
+// Routes per route class (read, write, export). 0 means no deadline.
+type TimeoutConfig struct {
+    Default Duration            `json:"default"`
+    Routes  map[string]Duration `json:"routes"`
+}
+
+var requestTimeouts = newCounter("http_request_timeouts_total", "Requests answered with 504 because their deadline passed.", "class")
+
+func (c TimeoutConfig) validate() error {
+    if c.Default < 0 {
+        return fmt.Errorf("timeouts.default must not be negative")
+    }
+    for class, d := range c.Routes {
+        if !slices.Contains(routeClasses, class) {
+            return fmt.Errorf("timeouts.routes: unknown route class %q (want one of %s)", class, strings.Join(routeClasses, ", "))
+        }
+        if d < 0 {
+            return fmt.Errorf("timeouts.routes.%s must not be negative", class)
+        }
+    }
+    return nil
+}
+
+// timeoutFor returns the deadline budget of a route class
+func (c TimeoutConfig) timeoutFor(class string) time.Duration {
+    if d, ok := c.Routes[class]; ok {
+        return time.Duration(d)
+    }
+    return time.Duration(c.Default)
+}
+
+// timeoutWriter buffers the handler's response so that it can be replaced by a
+// 504 if the deadline passes before the handler returns. A handler that flushes,
+// such as a streaming export, commits to its response: what it has written is
+// sent and later writes go straight to the client.
+type timeoutWriter struct {
+    w         http.ResponseWriter
+    mu        sync.Mutex
+    header    http.Header
+    buf       bytes.Buffer
+    status    int
+    timedOut  bool
+    streaming bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+    return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+    tw.mu.Lock()
+    defer tw.mu.Unlock()
+    if tw.status == 0 {
+        tw.status = status
+    }
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+    tw.mu.Lock()
+    defer tw.mu.Unlock()
+    if tw.timedOut {
+        return 0, http.ErrHandlerTimeout
+    }
+    if tw.status == 0 {
+        tw.status = http.StatusOK
+    }
+    if tw.streaming {
+        return tw.w.Write(b)
+    }
+    return tw.buf.Write(b)
+}
+
+// FlushError lets http.ResponseController flush a streaming handler
+func (tw *timeoutWriter) FlushError() error {
+    tw.mu.Lock()
+    defer tw.mu.Unlock()
+    if tw.timedOut {
+        return http.ErrHandlerTimeout
+    }
+    if !tw.streaming {
+        tw.writeBuffered()
+        tw.streaming = true
+    }
+    return http.NewResponseController(tw.w).Flush()
+}
+
+// writeBuffered sends the headers and body buffered so far; callers hold mu
+func (tw *timeoutWriter) writeBuffered() {
+    for k, v := range tw.header {
+        tw.w.Header()[k] = v
+    }
+    if tw.status == 0 {
+        tw.status = http.StatusOK
+    }
+    tw.w.WriteHeader(tw.status)
+    tw.w.Write(tw.buf.Bytes())
+    tw.buf.Reset()
+}
+
+// RequestTimeout middleware gives each request the deadline of its route class.
+// Database calls made with the request context only get the remaining budget;
+// if the deadline passes first the caller gets a 504 and whatever the handler
+// writes afterwards is discarded.
+func RequestTimeout(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        class := routeClass(r)
+        timeout := currentConfig().Timeouts.timeoutFor(class)
+        if timeout <= 0 {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        ctx, cancel := context.WithTimeout(r.Context(), timeout)
+        defer cancel()
+
+        tw := &timeoutWriter{w: w, header: w.Header().Clone()}
+        done := make(chan struct{})
+        panicked := make(chan any, 1)
+        go func() {
+            defer func() {
+                if p := recover(); p != nil {
+                    panicked <- p
+                }
+            }()
+            next.ServeHTTP(tw, r.WithContext(ctx))
+            close(done)
+        }()
+
+        select {
+        case p := <-panicked:
+            panic(p)
+        case <-done:
+            tw.mu.Lock()
+            defer tw.mu.Unlock()
+            if !tw.streaming {
+                tw.writeBuffered()
+            }
+        case <-ctx.Done():
+            tw.mu.Lock()
+            defer tw.mu.Unlock()
+            tw.timedOut = true
+            requestTimeouts.Inc(class)
+            logWarn("%s %s exceeded its %s deadline (request %s)", r.Method, r.URL.Path, timeout, requestIDFrom(r.Context()))
+            if tw.streaming {
+                // too late for a 504; the client sees a truncated response
+                return
+            }
+
+            writeErrorWith(w, http.StatusGatewayTimeout, codeRequestTimeout, "Request timed out", map[string]any{
+                "route_class": class,
+                "timeout":     timeout.String(),
+            })
+        }
+    })
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+    "fmt"
+    "net/http"
+    "strings"
+    "time"
+    // the runtime image has no zoneinfo, so time zone hints need the embedded copy
+    _ "time/tzdata"
+)
+
+// Timestamps are stored and served in UTC and serialized as RFC 3339 (which
+// encoding/json and the BSON codec do for time.Time). Local time only exists
+// at the edges: a caller may send a time zone hint for features that work in
+// calendar days, such as time series buckets.
+
+// utcNow is the current time as stored: in UTC, at the millisecond precision
+// of BSON dates, so a document served right after a write matches the one
+// read back later
+func utcNow() time.Time {
+    return time.Now().UTC().Truncate(time.Millisecond)
+}
+
+// parseTimestamp reads an RFC 3339 time sent by a client, with or without
+// fractional seconds, and returns it in UTC
+func parseTimestamp(s string) (time.Time, error) {
+    t, err := time.Parse(time.RFC3339Nano, s)
+    if err != nil {
+        return time.Time{}, err
+    }
+    return t.UTC(), nil
+}
+
+// requestLocation returns the caller's time zone hint: ?tz=, else the
+// Time-Zone header, as an IANA name like Europe/Berlin. Without a hint it is
+// UTC. The server's own zone ("Local") is never used.
+func requestLocation(r *http.Request) (*time.Location, error) {
+    tz := r.URL.Query().Get("tz")
+    if tz == "" {
+        tz = strings.TrimSpace(r.Header.Get("Time-Zone"))
+    }
+    if tz == "" {
+        return time.UTC, nil
+    }
+    loc, err := time.LoadLocation(tz)
+    if err != nil || tz == "Local" {
+        return nil, fmt.Errorf("tz must be an IANA time zone such as Europe/Berlin")
+    }
+    return loc, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "fmt"
+    "net/http"
+    "os"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    spanQueueSize     = 2048
+    spanBatchSize     = 256
+    spanFlushInterval = 5 * time.Second
+)
+
+// traceparentPattern is the W3C Trace Context header, version 00
+var traceparentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// traceContext is the trace a request belongs to, as sent by the caller or the
+// OpenTelemetry-instrumented proxy in front of the service
+type traceContext struct {
+    TraceID string
+    SpanID  string
+    Flags   string
+}
+
+// traceFrom parses the request's traceparent header; all-zero IDs are invalid
+func traceFrom(r *http.Request) (traceContext, bool) {
+    m := traceparentPattern.FindStringSubmatch(r.Header.Get("traceparent"))
+    if m == nil || m[1] == "00000000000000000000000000000000" || m[2] == "0000000000000000" {
+        return traceContext{}, false
+    }
+    return traceContext{TraceID: m[1], SpanID: m[2], Flags: m[3]}, true
+}
+
+func (tc traceContext) sampled() bool {
+    flags, _ := strconv.ParseUint(tc.Flags, 16, 8)
+    return flags&1 == 1
+}
+
+func (tc traceContext) header() string {
+    return "00-" + tc.TraceID + "-" + tc.SpanID + "-" + tc.Flags
+}
+
+func randomHex(n int) string {
+    b := make([]byte, n)
+    rand.Read(b)
+    return hex.EncodeToString(b)
+}
+
+// clientSpan is an outgoing call recorded as an OpenTelemetry client span
+type clientSpan struct {
+    TraceID    string
+    SpanID     string
+    ParentID   string
+    Name       string
+    Start      time.Time
+    End        time.Time
+    Attributes map[string]any
+    Failed     bool
+}
+
+// spanExporter sends finished spans to the OTLP/HTTP endpoint in
+// OTEL_EXPORTER_OTLP_ENDPOINT; without one, spans are only propagated
+type spanExporter struct {
+    url     string
+    service string
+    queue   chan clientSpan
+    client  *http.Client
+}
+
+var spans *spanExporter
+
+var spansDropped = newCounter("trace_spans_dropped_total", "Client spans dropped because the export queue was full.")
+
+// startSpanExporter starts exporting when OTEL_EXPORTER_OTLP_ENDPOINT is set
+func startSpanExporter() {
+    endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+    if endpoint == "" {
+        return
+    }
+    service := os.Getenv("OTEL_SERVICE_NAME")
+    if service == "" {
+        service = "user-service"
+    }
+
+    spans = &spanExporter{
+        url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+        service: service,
+        queue:   make(chan clientSpan, spanQueueSize),
+        // not traced itself, or every export would produce another span
+        client: &http.Client{Timeout: 10 * time.Second},
+    }
+    go spans.run()
+}
+
+func recordSpan(s clientSpan) {
+    if spans == nil {
+        return
+    }
+    select {
+    case spans.queue <- s:
+    default:
+        spansDropped.Inc()
+    }
+}
+
+func (e *spanExporter) run() {
+    ticker := time.NewTicker(spanFlushInterval)
+    defer ticker.Stop()
+
+    batch := make([]clientSpan, 0, spanBatchSize)
+    for {
+        select {
+        case s := <-e.queue:
+            batch = append(batch, s)
+            if len(batch) < spanBatchSize {
+                continue
+            }
+        case <-ticker.C:
+            if len(batch) == 0 {
+                continue
+            }
+        }
+        if err := e.export(batch); err != nil {
+            logWarn("failed to export %d spans: %v", len(batch), err)
+        }
+        batch = batch[:0]
+    }
+}
+
+// otlpValue encodes an attribute value in the OTLP/JSON AnyValue form
+func otlpValue(v any) map[string]any {
+    switch v := v.(type) {
+    case int:
+        return map[string]any{"intValue": strconv.Itoa(v)}
+    default:
+        return map[string]any{"stringValue": fmt.Sprint(v)}
+    }
+}
+
+func (e *spanExporter) export(batch []clientSpan) error {
+    var out []map[string]any
+    for _, s := range batch {
+        var attrs []map[string]any
+        for k, v := range s.Attributes {
+            attrs = append(attrs, map[string]any{"key": k, "value": otlpValue(v)})
+        }
+        status := 1 // OK
+        if s.Failed {
+            status = 2 // ERROR
+        }
+        out = append(out, map[string]any{
+            "traceId":           s.TraceID,
+            "spanId":            s.SpanID,
+            "parentSpanId":      s.ParentID,
+            "name":              s.Name,
+            "kind":              3, // CLIENT
+            "startTimeUnixNano": strconv.FormatInt(s.Start.UnixNano(), 10),
+            "endTimeUnixNano":   strconv.FormatInt(s.End.UnixNano(), 10),
+            "attributes":        attrs,
+            "status":            map[string]any{"code": status},
+        })
+    }
+
+    body, err := json.Marshal(map[string]any{
+        "resourceSpans": []any{map[string]any{
+            "resource": map[string]any{"attributes": []any{
+                map[string]any{"key": "service.name", "value": otlpValue(e.service)},
+            }},
+            "scopeSpans": []any{map[string]any{
+                "scope": map[string]any{"name": "user-service"},
+                "spans": out,
+            }},
+        }},
+    })
+    if err != nil {
+        return err
+    }
+
+    resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("collector responded %s", resp.Status)
+    }
+    return nil
+}
+
+// tracingTransport continues the trace in the request context (or starts one)
+// on every outgoing request: it sends a traceparent naming a new client span
+// and records that span once the response arrives
+type tracingTransport struct {
+    base   http.RoundTripper
+    target string
+}
+
+// newTracedClient is the HTTP client for calls to external systems; target
+// names the system in the recorded spans
+func newTracedClient(target string, timeout time.Duration) *http.Client {
+    return &http.Client{
+        Timeout:   timeout,
+        Transport: &tracingTransport{base: http.DefaultTransport, target: target},
+    }
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    span := clientSpan{
+        SpanID: randomHex(8),
+        Name:   req.Method + " " + t.target,
+        Start:  time.Now(),
+        Attributes: map[string]any{
+            "http.request.method": req.Method,
+            "server.address":      req.URL.Hostname(),
+            "url.path":            req.URL.Path,
+            "peer.service":        t.target,
+        },
+    }
+    tc, ok := req.Context().Value(traceKey).(traceContext)
+    if ok {
+        span.TraceID, span.ParentID = tc.TraceID, tc.SpanID
+    } else {
+        tc = traceContext{TraceID: randomHex(16), Flags: "01"}
+        span.TraceID = tc.TraceID
+    }
+    if id := requestIDFrom(req.Context()); id != "" {
+        span.Attributes["request_id"] = id
+    }
+
+    out := req.Clone(req.Context())
+    out.Header.Set("traceparent", traceContext{TraceID: tc.TraceID, SpanID: span.SpanID, Flags: tc.Flags}.header())
+
+    resp, err := t.base.RoundTrip(out)
+
+    span.End = time.Now()
+    if err != nil {
+        span.Failed = true
+        span.Attributes["error.type"] = err.Error()
+    } else {
+        span.Attributes["http.response.status_code"] = resp.StatusCode
+        span.Failed = resp.StatusCode >= 500
+    }
+    if tc.sampled() {
+        recordSpan(span)
+    }
+    return resp, err
+}
+
+// withTrace carries the trace and request ID of parent into ctx, for work such
+// as webhook deliveries that finishes after the response was sent, and the
+// region its operations go to
+func withTrace(parent, ctx context.Context) context.Context {
+    ctx = withRegion(ctx, regionFrom(parent))
+    if tc, ok := parent.Value(traceKey).(traceContext); ok {
+        ctx = context.WithValue(ctx, traceKey, tc)
+    }
+    if id := requestIDFrom(parent); id != "" {
+        ctx = context.WithValue(ctx, requestIDKey, id)
+    }
+    return ctx
+}
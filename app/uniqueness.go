@@ -0,0 +1,176 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net/http"
+    "strings"
+    "time"
+    "unicode"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// phoneKeyBackfill is how many contacts one backfill round updates
+const phoneKeyBackfill = 1000
+
+// internalContactFields are stored with contacts for indexing, searching and
+// replication; they are never part of a response, event or export
+var internalContactFields = []string{"name_search", "phone_normalized", "replication"}
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:      "phone-key-backfill",
+        Schedule:  "@hourly",
+        Timeout:   30 * time.Minute,
+        Singleton: true,
+        Run:       backfillPhoneKeys,
+    })
+}
+
+// phoneKey is the phone_normalized a contact is stored with, unique per
+// tenant: the E.164 form of phones that are numbers (national ones read as
+// numbers of the tenant's region), else the phone lowercased with everything
+// but letters and digits dropped. Phones without either get no key.
+func phoneKey(phone, region string) string {
+    if n, ok := parsePhone(phone, region); ok {
+        return n.E164()
+    }
+    var b strings.Builder
+    for _, c := range strings.ToLower(phone) {
+        if unicode.IsLetter(c) || unicode.IsDigit(c) {
+            b.WriteRune(c)
+        }
+    }
+    return b.String()
+}
+
+// isPhoneConflict reports whether err is a collision on the phone index
+func isPhoneConflict(err error) bool {
+    return mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), "phone_normalized")
+}
+
+// contactWithPhone finds the caller's contact with phone, written the same or
+// (in tenants with unique phones) normalized the same
+func contactWithPhone(r *http.Request, phone string) (primitive.ObjectID, error) {
+    settings, err := callerSettings(r)
+    if err != nil {
+        return primitive.NilObjectID, err
+    }
+    match := bson.A{bson.M{"phone": phone}}
+    if key := phoneKey(phone, settings.PhoneRegion); key != "" {
+        match = append(match, bson.M{"phone_normalized": key})
+    }
+    var c struct {
+        ID primitive.ObjectID `bson:"_id"`
+    }
+    err = contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"$or": match}),
+        options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&c)
+    return c.ID, err
+}
+
+// writePhoneConflict answers 409 with the ID of the caller's contact that
+// already has the phone
+func writePhoneConflict(w http.ResponseWriter, r *http.Request, key string) {
+    var c struct {
+        ID primitive.ObjectID `bson:"_id"`
+    }
+    extra := map[string]any{}
+    err := contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"phone_normalized": key}),
+        options.FindOne().SetProjection(bson.M{"_id": 1})).Decode(&c)
+    if err == nil {
+        extra["conflicting_id"] = c.ID.Hex()
+    }
+    writeErrorWith(w, http.StatusConflict, codeDuplicatePhone, "Another contact already has this phone number", extra)
+}
+
+// backfillPhoneKeys gives contacts stored before phones were unique, and
+// synthetic ones, their phone_normalized, except in tenants that opted out of
+// unique phones. A contact whose phone another
+// contact of its tenant already has is left without one, and so out of the
+// uniqueness check, until one of the two changes.
+func backfillPhoneKeys(ctx context.Context) error {
+    var exempt []TenantSettings
+    cursor, err := tenantSettingsCollection().Find(ctx, bson.M{"uniqueness": "none"})
+    if err != nil {
+        return err
+    }
+    if err := cursor.All(ctx, &exempt); err != nil {
+        return err
+    }
+    exemptTenants := bson.A{}
+    for _, s := range exempt {
+        exemptTenants = append(exemptTenants, tenantFilter(s.Tenant))
+    }
+
+    skip := bson.A{}
+    for {
+        filter := bson.M{"phone_normalized": bson.M{"$exists": false}, "phone": bson.M{"$type": "string"}, "_id": bson.M{"$nin": skip}}
+        if len(exemptTenants) > 0 {
+            filter["$nor"] = exemptTenants
+        }
+        cursor, err := contactsCollection.Find(ctx, filter,
+            options.Find().SetProjection(bson.M{"_id": 1, "phone": 1, "tenant": 1}).SetLimit(phoneKeyBackfill))
+        if err != nil {
+            return err
+        }
+        var docs []struct {
+            ID     primitive.ObjectID `bson:"_id"`
+            Phone  string             `bson:"phone"`
+            Tenant string             `bson:"tenant"`
+        }
+        if err := cursor.All(ctx, &docs); err != nil {
+            return err
+        }
+        if len(docs) == 0 {
+            return nil
+        }
+
+        var models []mongo.WriteModel
+        var modelIDs []primitive.ObjectID
+        for _, d := range docs {
+            if d.Tenant == "" {
+                d.Tenant = defaultTenant
+            }
+            settings, err := settingsFor(ctx, d.Tenant)
+            if err != nil {
+                return err
+            }
+            key := phoneKey(d.Phone, settings.PhoneRegion)
+            if key == "" {
+                skip = append(skip, d.ID)
+                continue
+            }
+            models = append(models, mongo.NewUpdateOneModel().
+                SetFilter(bson.M{"_id": d.ID, "phone": d.Phone, "phone_normalized": bson.M{"$exists": false}}).
+                SetUpdate(bson.M{"$set": bson.M{"phone_normalized": key}}))
+            modelIDs = append(modelIDs, d.ID)
+        }
+        if len(models) == 0 {
+            continue
+        }
+        // unordered, so a duplicate only skips that contact
+        result, err := contactsCollection.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+        var bulkErr mongo.BulkWriteException
+        if errors.As(err, &bulkErr) {
+            for _, we := range bulkErr.WriteErrors {
+                if !isPhoneConflict(we) {
+                    return err
+                }
+                skip = append(skip, modelIDs[we.Index])
+            }
+            logWarn("phone-key-backfill: %d contacts share a phone with another contact", len(bulkErr.WriteErrors))
+        } else if err != nil {
+            return err
+        }
+        if result != nil {
+            logInfo("phone-key-backfill: updated %d contacts", result.ModifiedCount)
+        }
+        if len(docs) < phoneKeyBackfill {
+            return nil
+        }
+    }
+}
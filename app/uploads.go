@@ -0,0 +1,332 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/gridfs"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    // maxUploadLength caps the Upload-Length of a resumable upload
+    maxUploadLength = 20 << 30
+    // uploadExpiry is how long an unfinished upload is kept after its last chunk
+    uploadExpiry = 24 * time.Hour
+)
+
+// Upload is a file sent in chunks that can be resumed after the connection
+// drops. Each chunk is stored as a GridFS file of its own, since GridFS files
+// can't be appended to; they are read back one after another as one file.
+type Upload struct {
+    ID        primitive.ObjectID   `bson:"_id" json:"id"`
+    Tenant    string               `bson:"tenant" json:"-"`
+    Length    int64                `bson:"length" json:"length"`
+    Offset    int64                `bson:"offset" json:"offset"`
+    Parts     []primitive.ObjectID `bson:"parts" json:"-"`
+    CreatedAt time.Time            `bson:"created_at" json:"created_at"`
+    ExpiresAt time.Time            `bson:"expires_at" json:"expires_at"`
+}
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:      "upload-sweep",
+        Schedule:  "@hourly",
+        Singleton: true,
+        Run:       sweepUploads,
+    })
+}
+
+func uploadsCollection() collection {
+    return collectionOf("uploads")
+}
+
+// complete reports whether every byte of the upload has arrived
+func (u Upload) complete() bool {
+    return u.Offset == u.Length
+}
+
+// writeUploadHeaders sets the headers clients resume an upload by
+func writeUploadHeaders(w http.ResponseWriter, u Upload) {
+    w.Header().Set("Upload-Offset", strconv.FormatInt(u.Offset, 10))
+    w.Header().Set("Upload-Length", strconv.FormatInt(u.Length, 10))
+    w.Header().Set("Upload-Expires", u.ExpiresAt.UTC().Format(http.TimeFormat))
+    w.Header().Set("Cache-Control", "no-store")
+}
+
+// uploadByID loads the caller's upload with id, answering the request itself
+// if there is none
+func uploadByID(w http.ResponseWriter, r *http.Request, id string) (Upload, bool) {
+    var u Upload
+    objID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid upload ID")
+        return u, false
+    }
+    err = uploadsCollection().FindOne(r.Context(), bson.M{"_id": objID, "tenant": tenantOf(r)}).Decode(&u)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeUploadNotFound, "Upload not found")
+        return u, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve upload")
+        return u, false
+    }
+    return u, true
+}
+
+// createUpload handles POST /uploads; the Upload-Length header gives the size
+// of the whole file in bytes
+func createUpload(w http.ResponseWriter, r *http.Request) {
+    length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+    if err != nil || length <= 0 {
+        writeError(w, http.StatusBadRequest, codeInvalidHeader, "Upload-Length must be the size of the file in bytes")
+        return
+    }
+    if length > maxUploadLength {
+        writeErrorWith(w, http.StatusBadRequest, codeValidationFailed, "The file is too large to upload",
+            map[string]any{"max_length": int64(maxUploadLength)})
+        return
+    }
+
+    now := utcNow()
+    u := Upload{
+        ID:        primitive.NewObjectID(),
+        Tenant:    tenantOf(r),
+        Length:    length,
+        Parts:     []primitive.ObjectID{},
+        CreatedAt: now,
+        ExpiresAt: now.Add(uploadExpiry),
+    }
+    if _, err := uploadsCollection().InsertOne(r.Context(), u); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create upload")
+        return
+    }
+
+    writeUploadHeaders(w, u)
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("Location", "/uploads/"+u.ID.Hex())
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(u)
+}
+
+// getUpload handles GET and HEAD /uploads/{id}; Upload-Offset tells a client
+// where to resume
+func getUpload(w http.ResponseWriter, r *http.Request) {
+    u, ok := uploadByID(w, r, strings.TrimPrefix(r.URL.Path, "/uploads/"))
+    if !ok {
+        return
+    }
+    writeUploadHeaders(w, u)
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(u)
+}
+
+// appendUpload handles PATCH /uploads/{id}: the body is the next chunk, at the
+// Upload-Offset the client sends. A chunk cut off by a dropped connection is
+// kept as far as it arrived, so the client resumes from there rather than
+// from the start of the chunk.
+func appendUpload(w http.ResponseWriter, r *http.Request) {
+    u, ok := uploadByID(w, r, strings.TrimPrefix(r.URL.Path, "/uploads/"))
+    if !ok {
+        return
+    }
+    offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidHeader, "Upload-Offset must be the offset of the chunk in bytes")
+        return
+    }
+    if offset != u.Offset {
+        writeUploadHeaders(w, u)
+        writeErrorWith(w, http.StatusConflict, codeUploadOffsetMismatch, "Upload-Offset is not where the upload stopped",
+            map[string]any{"offset": u.Offset})
+        return
+    }
+    if u.complete() {
+        writeUploadHeaders(w, u)
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+
+    bucket, err := jobFiles(r.Context())
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to store chunk")
+        return
+    }
+    part, err := bucket.OpenUploadStream(u.ID.Hex() + "-" + strconv.FormatInt(offset, 10))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to store chunk")
+        return
+    }
+    n, readErr := io.Copy(part, io.LimitReader(r.Body, u.Length-u.Offset))
+    if readErr == nil {
+        if extra, _ := io.CopyN(io.Discard, r.Body, 1); extra > 0 {
+            part.Abort()
+            writeError(w, http.StatusBadRequest, codeValidationFailed, "The chunk goes past Upload-Length")
+            return
+        }
+    }
+    if n == 0 {
+        part.Abort()
+        writeUploadHeaders(w, u)
+        w.WriteHeader(http.StatusNoContent)
+        return
+    }
+    if err := part.Close(); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to store chunk")
+        return
+    }
+    partID := part.FileID.(primitive.ObjectID)
+
+    // recorded even if the client has gone; a concurrent chunk at the same
+    // offset may have got in first
+    ctx := context.WithoutCancel(r.Context())
+    u.Offset += n
+    u.ExpiresAt = utcNow().Add(uploadExpiry)
+    res, err := uploadsCollection().UpdateOne(ctx, bson.M{"_id": u.ID, "offset": offset},
+        bson.M{"$set": bson.M{"offset": u.Offset, "expires_at": u.ExpiresAt}, "$push": bson.M{"parts": partID}})
+    if err != nil || res.MatchedCount == 0 {
+        deleteJobFiles(ctx, partID)
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Failed to store chunk")
+        } else {
+            writeError(w, http.StatusConflict, codeUploadOffsetMismatch, "Another chunk was stored at this offset first")
+        }
+        return
+    }
+    if readErr != nil {
+        logInfo("upload %s: chunk cut off after %d bytes: %v", u.ID.Hex(), n, readErr)
+        return
+    }
+    writeUploadHeaders(w, u)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUpload handles DELETE /uploads/{id}, abandoning the upload
+func deleteUpload(w http.ResponseWriter, r *http.Request) {
+    u, ok := uploadByID(w, r, strings.TrimPrefix(r.URL.Path, "/uploads/"))
+    if !ok {
+        return
+    }
+    var deleted Upload
+    err := uploadsCollection().FindOneAndDelete(r.Context(), bson.M{"_id": u.ID}).Decode(&deleted)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeUploadNotFound, "Upload not found")
+        return
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete upload")
+        return
+    }
+    deleteJobFiles(r.Context(), deleted.Parts...)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// takeUpload hands the caller's complete upload with id over to a job: the
+// upload is deleted and its parts become the job's input
+func takeUpload(w http.ResponseWriter, r *http.Request, id string, job *AsyncJob) bool {
+    u, ok := uploadByID(w, r, id)
+    if !ok {
+        return false
+    }
+    if !u.complete() {
+        writeErrorWith(w, http.StatusConflict, codeUploadIncomplete, "The upload hasn't finished",
+            map[string]any{"offset": u.Offset, "length": u.Length})
+        return false
+    }
+    err := uploadsCollection().FindOneAndDelete(r.Context(), bson.M{"_id": u.ID, "offset": u.Offset}).Err()
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeUploadNotFound, "Upload not found")
+        return false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve upload")
+        return false
+    }
+    job.InputParts, job.InputSize = u.Parts, u.Length
+    return true
+}
+
+// partsReader reads GridFS files one after another, as if they were one
+type partsReader struct {
+    bucket  *gridfs.Bucket
+    parts   []primitive.ObjectID
+    current *gridfs.DownloadStream
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+    for {
+        if p.current == nil {
+            if len(p.parts) == 0 {
+                return 0, io.EOF
+            }
+            stream, err := p.bucket.OpenDownloadStream(p.parts[0])
+            if err != nil {
+                return 0, err
+            }
+            p.current, p.parts = stream, p.parts[1:]
+        }
+        n, err := p.current.Read(b)
+        if errors.Is(err, io.EOF) {
+            p.current.Close()
+            p.current = nil
+            if n == 0 {
+                continue
+            }
+            err = nil
+        }
+        return n, err
+    }
+}
+
+func (p *partsReader) Close() error {
+    if p.current == nil {
+        return nil
+    }
+    return p.current.Close()
+}
+
+// openJobInput opens the file a job was started with, whether uploaded in one
+// request or in chunks
+func openJobInput(bucket *gridfs.Bucket, job *AsyncJob) (io.ReadCloser, error) {
+    if len(job.InputParts) > 0 {
+        return &partsReader{bucket: bucket, parts: job.InputParts}, nil
+    }
+    return bucket.OpenDownloadStream(job.InputFile)
+}
+
+// sweepUploads deletes uploads that weren't finished and used in time
+func sweepUploads(ctx context.Context) error {
+    var expired []Upload
+    cursor, err := uploadsCollection().Find(ctx, bson.M{"expires_at": bson.M{"$lt": utcNow()}},
+        options.Find().SetProjection(bson.M{"_id": 1, "parts": 1}))
+    if err != nil {
+        return err
+    }
+    if err := cursor.All(ctx, &expired); err != nil {
+        return err
+    }
+    for _, u := range expired {
+        // unless a job took it in the meantime
+        res, err := uploadsCollection().DeleteOne(ctx, bson.M{"_id": u.ID, "expires_at": bson.M{"$lt": utcNow()}})
+        if err != nil {
+            return err
+        }
+        if res.DeletedCount > 0 {
+            deleteJobFiles(ctx, u.Parts...)
+        }
+    }
+    if len(expired) > 0 {
+        logInfo("upload-sweep: deleted %d expired uploads", len(expired))
+    }
+    return nil
+}
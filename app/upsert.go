@@ -0,0 +1,68 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+// upsertRequested reports whether the caller opted into PUT creating the
+// contact if it doesn't exist, with ?upsert=true
+func upsertRequested(r *http.Request) bool {
+    upsert, _ := strconv.ParseBool(r.URL.Query().Get("upsert"))
+    return upsert
+}
+
+// isIDConflict reports whether err is a collision on the contact ID
+func isIDConflict(err error) bool {
+    return mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), "index: _id_ ")
+}
+
+// createContactAt creates the contact a PUT ?upsert=true named but didn't
+// find, under the ID from the path, so systems that assign IDs themselves can
+// replay their writes. Creating needs a name and a phone, like POST.
+func createContactAt(w http.ResponseWriter, r *http.Request, id primitive.ObjectID, changes contactChanges) {
+    if changes.Name == nil || *changes.Name == "" || changes.Phone == nil || *changes.Phone == "" {
+        writeError(w, http.StatusBadRequest, codeMissingField, "Missing name or phone, both are needed to create the contact")
+        return
+    }
+
+    c := Contact{ID: id, Name: *changes.Name, Phone: *changes.Phone}
+    if changes.Tags != nil {
+        c.Tags = *changes.Tags
+    }
+    if changes.Company != nil {
+        c.Company = *changes.Company
+    }
+    if changes.JobTitle != nil {
+        c.JobTitle = *changes.JobTitle
+    }
+    if changes.Website != nil {
+        c.Website = *changes.Website
+    }
+    c.Social = changes.Social.orNil()
+    if changes.Dates != nil {
+        c.Dates = *changes.Dates
+    }
+    if changes.DoNotContact != nil {
+        c.DoNotContact = *changes.DoNotContact
+    }
+    c.ReportsTo = changes.manager
+    if !insertContact(w, r, &c) {
+        return
+    }
+    recordAudit(r, "contact.create", c.ID.Hex(), bson.M{"upsert": true})
+    publishContactEvent(r, "contact.created", c)
+
+    w.Header().Set("Location", "/contacts/"+c.ID.Hex())
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(bson.M{
+        "message": "Contact created successfully",
+        "contact": c,
+    })
+}
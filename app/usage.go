@@ -0,0 +1,263 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "io"
+    "net/http"
+    "regexp"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// usagePeriodPattern accepts a month (2026-10) or a day (2026-10-15)
+var usagePeriodPattern = regexp.MustCompile(`^\d{4}-\d{2}(-\d{2})?$`)
+
+// usageKey identifies one metering row: a day, a tenant and the API key
+// ("" for anonymous callers)
+type usageKey struct {
+    Day    string
+    Tenant string
+    Key    string
+}
+
+// UsageTotals are the metered amounts for one usage key
+type UsageTotals struct {
+    Requests int64 `bson:"requests" json:"requests"`
+    BytesIn  int64 `bson:"bytes_in" json:"bytes_in"`
+    BytesOut int64 `bson:"bytes_out" json:"bytes_out"`
+    Records  int64 `bson:"records" json:"records"`
+}
+
+// usageMeter accumulates usage in memory; the usage-flush job adds it to the
+// usage collection, so each replica writes only its own counts
+type usageMeter struct {
+    mu      sync.Mutex
+    pending map[usageKey]*UsageTotals
+    // unflushed are batches whose write failed, retried before newer ones
+    unflushed []usageBatch
+}
+
+// usageBatch is the usage taken out of pending by one flush. Its ID is
+// recorded on every row it is added to, so retrying it after a write that
+// failed part way, or failed only on the way back, doesn't count it twice.
+type usageBatch struct {
+    id   string
+    rows map[usageKey]*UsageTotals
+}
+
+const (
+    // usageBatchMemory is how many batch IDs a usage row remembers: retries
+    // come within a few runs, while the replicas each flush once a minute
+    usageBatchMemory = 100
+    // maxUnflushedBatches bounds the batches kept while MongoDB is
+    // unreachable, a day of runs; older ones are dropped
+    maxUnflushedBatches = 1440
+)
+
+var meter = &usageMeter{pending: map[usageKey]*UsageTotals{}}
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:     "usage-flush",
+        Schedule: "@every 1m",
+        Timeout:  time.Minute,
+        Global:   true,
+        Run:      meter.flush,
+    })
+}
+
+func usageCollection() collection {
+    return sharedCollectionOf("usage")
+}
+
+func (m *usageMeter) add(k usageKey, t UsageTotals) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+
+    p, ok := m.pending[k]
+    if !ok {
+        p = &UsageTotals{}
+        m.pending[k] = p
+    }
+    p.Requests += t.Requests
+    p.BytesIn += t.BytesIn
+    p.BytesOut += t.BytesOut
+    p.Records += t.Records
+}
+
+// flush writes pending usage with $inc upserts, first retrying the batches
+// earlier runs failed to write. A batch that fails is kept whole and retried
+// under the same ID.
+func (m *usageMeter) flush(ctx context.Context) error {
+    m.mu.Lock()
+    if len(m.pending) > 0 {
+        m.unflushed = append(m.unflushed, usageBatch{id: primitive.NewObjectID().Hex(), rows: m.pending})
+        m.pending = map[usageKey]*UsageTotals{}
+    }
+    if n := len(m.unflushed) - maxUnflushedBatches; n > 0 {
+        logError("dropping %d batches of usage counts that could not be written", n)
+        m.unflushed = m.unflushed[n:]
+    }
+    batches := m.unflushed
+    m.mu.Unlock()
+
+    var err error
+    done := 0
+    for _, b := range batches {
+        if err = b.write(ctx); err != nil {
+            break
+        }
+        done++
+    }
+
+    m.mu.Lock()
+    m.unflushed = m.unflushed[done:]
+    m.mu.Unlock()
+    return err
+}
+
+// write adds the batch's rows to the usage collection. A row that already
+// lists the batch doesn't match the filter, and its upsert fails on the _id
+// instead. So does a row another replica created meanwhile, so rows failing
+// that way are tried once more: failing again, they were written before.
+func (b usageBatch) write(ctx context.Context) error {
+    var models []mongo.WriteModel
+    for k, t := range b.rows {
+        models = append(models, mongo.NewUpdateOneModel().
+            SetFilter(bson.M{"_id": k.Day + "|" + k.Tenant + "|" + k.Key, "batches": bson.M{"$ne": b.id}}).
+            SetUpdate(bson.M{
+                "$set":  bson.M{"day": k.Day, "tenant": k.Tenant, "key": k.Key},
+                "$inc":  bson.M{"requests": t.Requests, "bytes_in": t.BytesIn, "bytes_out": t.BytesOut, "records": t.Records},
+                "$push": bson.M{"batches": bson.M{"$each": bson.A{b.id}, "$slice": -usageBatchMemory}},
+            }).
+            SetUpsert(true))
+    }
+
+    for retried := false; ; retried = true {
+        _, err := usageCollection().BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+        bwe, ok := err.(mongo.BulkWriteException)
+        if !ok || bwe.WriteConcernError != nil {
+            return err
+        }
+        var again []mongo.WriteModel
+        for _, we := range bwe.WriteErrors {
+            if !mongo.IsDuplicateKeyError(we.WriteError) {
+                return err
+            }
+            again = append(again, models[we.Index])
+        }
+        if retried || len(again) == 0 {
+            return nil
+        }
+        models = again
+    }
+}
+
+// countingReader counts the bytes read through it, such as the request body
+// bytes read by the handler
+type countingReader struct {
+    io.ReadCloser
+    n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.ReadCloser.Read(p)
+    c.n += int64(n)
+    return n, err
+}
+
+// MeterUsage middleware records requests, body sizes and contacts served per
+// tenant and API key for chargeback. Operator routes are not metered.
+func MeterUsage(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if isInfraPath(r.URL.Path) || r.Method == "OPTIONS" {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        body := &countingReader{ReadCloser: r.Body}
+        r.Body = body
+        stats := &requestStats{}
+        rec := newStatusRecorder(w)
+        next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestStatsKey, stats)))
+
+        meter.add(usageKey{
+            Day:    utcNow().Format("2006-01-02"),
+            Tenant: tenantOf(r),
+            Key:    principalFrom(r).KeyID,
+        }, UsageTotals{
+            Requests: 1,
+            BytesIn:  body.n,
+            BytesOut: int64(rec.bytes),
+            Records:  int64(stats.records),
+        })
+    })
+}
+
+// getUsage handles GET /admin/usage?period=2026-10[&tenant=acme], summing the
+// period's usage per tenant and API key; period defaults to the current month
+func getUsage(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    period := r.URL.Query().Get("period")
+    if period == "" {
+        period = utcNow().Format("2006-01")
+    }
+    if !usagePeriodPattern.MatchString(period) {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "period must be YYYY-MM or YYYY-MM-DD")
+        return
+    }
+
+    match := bson.M{"day": bson.M{"$regex": "^" + period}}
+    if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+        match["tenant"] = tenant
+    }
+
+    cursor, err := usageCollection().Aggregate(r.Context(), mongo.Pipeline{
+        {{Key: "$match", Value: match}},
+        {{Key: "$group", Value: bson.M{
+            "_id":       bson.M{"tenant": "$tenant", "key": "$key"},
+            "requests":  bson.M{"$sum": "$requests"},
+            "bytes_in":  bson.M{"$sum": "$bytes_in"},
+            "bytes_out": bson.M{"$sum": "$bytes_out"},
+            "records":   bson.M{"$sum": "$records"},
+        }}},
+        {{Key: "$sort", Value: bson.D{{Key: "_id.tenant", Value: 1}, {Key: "_id.key", Value: 1}}}},
+    })
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve usage")
+        return
+    }
+
+    var rows []struct {
+        ID struct {
+            Tenant string `bson:"tenant"`
+            Key    string `bson:"key"`
+        } `bson:"_id"`
+        UsageTotals `bson:",inline"`
+    }
+    if err := cursor.All(r.Context(), &rows); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+
+    usage := []bson.M{}
+    for _, row := range rows {
+        usage = append(usage, bson.M{
+            "tenant":    row.ID.Tenant,
+            "key":       row.ID.Key,
+            "requests":  row.Requests,
+            "bytes_in":  row.BytesIn,
+            "bytes_out": row.BytesOut,
+            "records":   row.Records,
+        })
+    }
+
+    json.NewEncoder(w).Encode(bson.M{"period": period, "usage": usage})
+}
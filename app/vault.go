@@ -0,0 +1,202 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+)
+
+// k8sServiceAccountToken is where Kubernetes mounts the pod's service account JWT
+const k8sServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultClient reads KV secrets from HashiCorp Vault. It authenticates with
+// VAULT_TOKEN / VAULT_TOKEN_FILE, or with the Kubernetes auth method when
+// VAULT_K8S_ROLE is set, and keeps its token renewed in the background.
+type vaultClient struct {
+    addr   string
+    role   string
+    mount  string
+    client *http.Client
+
+    mu    sync.RWMutex
+    token string
+    ttl   time.Duration
+}
+
+var (
+    vaultOnce sync.Once
+    vault     *vaultClient
+    vaultErr  error
+)
+
+// getVault creates the client on first use of a vault: reference
+func getVault() (*vaultClient, error) {
+    vaultOnce.Do(func() {
+        addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+        if addr == "" {
+            vaultErr = errors.New("VAULT_ADDR is not set")
+            return
+        }
+
+        v := &vaultClient{
+            addr:   addr,
+            role:   os.Getenv("VAULT_K8S_ROLE"),
+            mount:  os.Getenv("VAULT_K8S_MOUNT"),
+            client: newTracedClient("vault", 10*time.Second),
+        }
+        if v.mount == "" {
+            v.mount = "kubernetes"
+        }
+        if err := v.login(); err != nil {
+            vaultErr = err
+            return
+        }
+
+        vault = v
+        go v.renewLoop()
+    })
+    return vault, vaultErr
+}
+
+func (v *vaultClient) login() error {
+    if v.role == "" {
+        token := os.Getenv("VAULT_TOKEN")
+        if path := os.Getenv("VAULT_TOKEN_FILE"); path != "" {
+            data, err := os.ReadFile(path)
+            if err != nil {
+                return err
+            }
+            token = strings.TrimSpace(string(data))
+        }
+        if token == "" {
+            return errors.New("set VAULT_TOKEN, VAULT_TOKEN_FILE or VAULT_K8S_ROLE")
+        }
+        v.mu.Lock()
+        v.token = token
+        v.mu.Unlock()
+        if err := v.renew(); err != nil {
+            logDebug("vault token is not renewable: %v", err)
+        }
+        return nil
+    }
+
+    jwt, err := os.ReadFile(k8sServiceAccountToken)
+    if err != nil {
+        return err
+    }
+    var resp struct {
+        Auth struct {
+            ClientToken   string `json:"client_token"`
+            LeaseDuration int    `json:"lease_duration"`
+        } `json:"auth"`
+    }
+    body := map[string]string{"role": v.role, "jwt": strings.TrimSpace(string(jwt))}
+    if err := v.do("POST", "/v1/auth/"+v.mount+"/login", body, &resp); err != nil {
+        return fmt.Errorf("vault kubernetes login: %w", err)
+    }
+
+    v.mu.Lock()
+    v.token = resp.Auth.ClientToken
+    v.ttl = time.Duration(resp.Auth.LeaseDuration) * time.Second
+    v.mu.Unlock()
+    return nil
+}
+
+// renew extends the current token's lease
+func (v *vaultClient) renew() error {
+    var resp struct {
+        Auth struct {
+            LeaseDuration int `json:"lease_duration"`
+        } `json:"auth"`
+    }
+    if err := v.do("POST", "/v1/auth/token/renew-self", map[string]string{}, &resp); err != nil {
+        return fmt.Errorf("vault token renewal: %w", err)
+    }
+
+    v.mu.Lock()
+    v.ttl = time.Duration(resp.Auth.LeaseDuration) * time.Second
+    v.mu.Unlock()
+    return nil
+}
+
+// renewLoop renews the token at half its TTL and logs in again if renewal fails
+func (v *vaultClient) renewLoop() {
+    for {
+        v.mu.RLock()
+        wait := v.ttl / 2
+        v.mu.RUnlock()
+        if wait <= 0 {
+            // non-expiring token, e.g. a root token in development
+            wait = time.Hour
+        }
+        time.Sleep(wait)
+
+        if err := v.renew(); err != nil {
+            logWarn("%v; logging in again", err)
+            if err := v.login(); err != nil {
+                logError("vault login failed: %v", err)
+            }
+        }
+    }
+}
+
+// read returns one field of the secret at path. KV v2 paths (".../data/...")
+// nest the fields one level deeper than KV v1.
+func (v *vaultClient) read(path, field string) (string, error) {
+    var resp struct {
+        Data map[string]any `json:"data"`
+    }
+    if err := v.do("GET", "/v1/"+strings.TrimLeft(path, "/"), nil, &resp); err != nil {
+        return "", err
+    }
+
+    data := resp.Data
+    if nested, ok := data["data"].(map[string]any); ok {
+        data = nested
+    }
+    value, ok := data[field].(string)
+    if !ok {
+        return "", fmt.Errorf("vault secret %s has no string field %q", path, field)
+    }
+    return value, nil
+}
+
+func (v *vaultClient) do(method, path string, body any, out any) error {
+    var reader *bytes.Reader
+    if body != nil {
+        data, err := json.Marshal(body)
+        if err != nil {
+            return err
+        }
+        reader = bytes.NewReader(data)
+    } else {
+        reader = bytes.NewReader(nil)
+    }
+
+    req, err := http.NewRequest(method, v.addr+path, reader)
+    if err != nil {
+        return err
+    }
+    v.mu.RLock()
+    if v.token != "" {
+        req.Header.Set("X-Vault-Token", v.token)
+    }
+    v.mu.RUnlock()
+
+    resp, err := v.client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+
+    if resp.StatusCode >= 300 {
+        return fmt.Errorf("vault %s %s: %s", method, path, resp.Status)
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
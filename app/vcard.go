@@ -0,0 +1,114 @@
+package main
+
+import (
+    "net/http"
+    "strings"
+)
+
+// vCardEscaper escapes text values of vCard 3.0 (RFC 2426)
+var vCardEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`)
+
+// contactVCard is c as a vCard 3.0, with the phone in E.164 where it reads as
+// a number. The name's last word is taken for the family name.
+func contactVCard(c Contact) string {
+    given, family := c.Name, ""
+    if i := strings.LastIndexByte(c.Name, ' '); i > 0 {
+        given, family = c.Name[:i], c.Name[i+1:]
+    }
+    phone := c.Phone
+    if c.PhoneE164 != "" {
+        phone = c.PhoneE164
+    }
+
+    var b strings.Builder
+    line := func(s ...string) {
+        b.WriteString(strings.Join(s, ""))
+        b.WriteString("\r\n")
+    }
+    line("BEGIN:VCARD")
+    line("VERSION:3.0")
+    line("N:", vCardEscaper.Replace(family), ";", vCardEscaper.Replace(given), ";;;")
+    line("FN:", vCardEscaper.Replace(c.Name))
+    line("TEL;TYPE=VOICE:", vCardEscaper.Replace(phone))
+    if c.Company != "" {
+        line("ORG:", vCardEscaper.Replace(c.Company))
+    }
+    if c.JobTitle != "" {
+        line("TITLE:", vCardEscaper.Replace(c.JobTitle))
+    }
+    if c.Website != "" {
+        line("URL:", c.Website)
+    }
+    if c.Social != nil {
+        for _, h := range c.Social.handles() {
+            line("X-SOCIALPROFILE;TYPE=", h.network.key, ":", h.URL())
+        }
+    }
+    for _, d := range c.Dates {
+        switch d.Label {
+        case "birthday":
+            line("BDAY:", d.Date)
+        case "anniversary":
+            line("X-ANNIVERSARY:", d.Date)
+        }
+    }
+    if len(c.Tags) > 0 {
+        tags := make([]string, len(c.Tags))
+        for i, t := range c.Tags {
+            tags[i] = vCardEscaper.Replace(t)
+        }
+        line("CATEGORIES:", strings.Join(tags, ","))
+    }
+    if rev := contactLastModified(c); !rev.IsZero() {
+        line("REV:", rev.UTC().Format("20060102T150405Z"))
+    }
+    line("END:VCARD")
+    return b.String()
+}
+
+// getContactQRCode handles GET /contacts/{id}/qrcode[?format=png|svg&scale=],
+// a QR code of the contact's vCard that phones add to their contacts when
+// scanned. PNGs have scale pixels per module (8 by default).
+func getContactQRCode(w http.ResponseWriter, r *http.Request) {
+    format := r.URL.Query().Get("format")
+    if format != "" && format != "png" && format != "svg" {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "format must be png or svg")
+        return
+    }
+    scale, ok := queryInt(r, "scale", 8, 32)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "scale must be a positive number")
+        return
+    }
+    c, ok := contactByID(w, r)
+    if !ok {
+        return
+    }
+    f, ok := phoneFormatFor(w, r)
+    if !ok {
+        return
+    }
+    f.apply(&c)
+
+    code, err := encodeQR([]byte(contactVCard(c)))
+    if err == errQRTooLong {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "The contact has too much data for a QR code")
+        return
+    }
+    w.Header().Set("Cache-Control", "private, no-cache")
+    if notModified(w, r, contactLastModified(c)) {
+        return
+    }
+    if format == "svg" {
+        w.Header().Set("Content-Type", "image/svg+xml")
+        w.Write(code.svg())
+        return
+    }
+    image, err := code.png(scale)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to render QR code")
+        return
+    }
+    w.Header().Set("Content-Type", "image/png")
+    w.Write(image)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "runtime"
+    "runtime/debug"
+)
+
+// Build information, injected at build time:
+//
+//    go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+    version   = "dev"
+    commit    = ""
+    buildDate = ""
+)
+
+func init() {
+    // builds without ldflags still know their commit when built from a checkout
+    info, ok := debug.ReadBuildInfo()
+    if !ok {
+        return
+    }
+    for _, s := range info.Settings {
+        switch {
+        case s.Key == "vcs.revision" && commit == "":
+            commit = s.Value
+        case s.Key == "vcs.time" && buildDate == "":
+            buildDate = s.Value
+        }
+    }
+}
+
+// versionHandler handles GET /version
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]string{
+        "version":    version,
+        "commit":     commit,
+        "build_date": buildDate,
+        "go_version": runtime.Version(),
+    })
+}
+
+// ServiceVersion middleware names the serving build in every response
+func ServiceVersion(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("X-Service-Version", version)
+        next.ServeHTTP(w, r)
+    })
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "reflect"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Every write of a contact through the API counts up its version and stores
+// the contact as it is afterwards in contact_versions, so its history can be
+// listed and compared. Deleting a contact stores its last state once more as
+// a "delete" version, which keeps the history after the contact is gone.
+// Retention purges store "delete" versions too, so sync clients learn of
+// purged contacts; other maintenance, such as backfills, doesn't make versions.
+
+// contactVersionsListed caps GET /contacts/{id}/versions
+const contactVersionsListed = 100
+
+// actions of a contact version
+const (
+    versionCreate  = "create"
+    versionUpdate  = "update"
+    versionDelete  = "delete"
+    versionRestore = "restore"
+)
+
+// versionFieldsSkipped change with every write, so diffs leave them out
+var versionFieldsSkipped = []string{"version", "updated_at"}
+
+// ContactVersion is a contact as one of its writes left it
+type ContactVersion struct {
+    ID        primitive.ObjectID `bson:"_id,omitempty" json:"-"`
+    Tenant    string             `bson:"tenant" json:"-"`
+    ContactID primitive.ObjectID `bson:"contact_id" json:"-"`
+    Version   int                `bson:"version" json:"version"`
+    Action    string             `bson:"action" json:"action"`
+    Actor     string             `bson:"actor" json:"actor"`
+    At        time.Time          `bson:"at" json:"at"`
+    Contact   Contact            `bson:"contact" json:"contact"`
+}
+
+func contactVersionsCollection() collection {
+    return collectionOf("contact_versions")
+}
+
+// withNextVersion adds counting up the contact's version to update, and its
+// write stamp
+func withNextVersion(update bson.M) bson.M {
+    update["$inc"] = bson.M{"version": 1}
+    return stampWrite(update)
+}
+
+// nextVersionExpr is the contact's next version in a pipeline update
+var nextVersionExpr = bson.M{"$add": bson.A{bson.M{"$ifNull": bson.A{"$version", 0}}, 1}}
+
+// saveVersions stores versions; one a concurrent write stored already is
+// skipped, and failures are logged since the write itself succeeded
+func saveVersions(r *http.Request, versions []ContactVersion) {
+    if len(versions) == 0 {
+        return
+    }
+    docs := make([]any, len(versions))
+    for i, v := range versions {
+        v.Tenant, v.Actor, v.At = tenantOf(r), clientKey(r), utcNow()
+        docs[i] = v
+    }
+    _, err := contactVersionsCollection().InsertMany(r.Context(), docs, options.InsertMany().SetOrdered(false))
+    if err != nil && !mongo.IsDuplicateKeyError(err) {
+        logError("failed to record %d contact versions: %v", len(versions), err)
+    }
+    logReplicatedWrites(r, versions)
+}
+
+// recordVersions stores the contacts ids as action left them, including
+// those the change took out of reach of the caller's key tags
+func recordVersions(r *http.Request, action string, ids ...primitive.ObjectID) {
+    if len(ids) == 0 {
+        return
+    }
+    cursor, err := contactsCollection.Find(unscoped(r.Context()), scopeFilter(r, bson.M{"_id": bson.M{"$in": ids}}))
+    var contacts []Contact
+    if err == nil {
+        err = cursor.All(r.Context(), &contacts)
+    }
+    if err != nil {
+        logError("failed to read contacts to record their versions: %v", err)
+        return
+    }
+    versions := make([]ContactVersion, 0, len(contacts))
+    for _, c := range contacts {
+        if c.Version > 0 {
+            versions = append(versions, ContactVersion{ContactID: c.ID, Version: c.Version, Action: action, Contact: c})
+        }
+    }
+    saveVersions(r, versions)
+}
+
+// recordCreated stores the versions of contacts inserted as docs by action
+func recordCreated(r *http.Request, action string, docs ...bson.M) {
+    versions := make([]ContactVersion, 0, len(docs))
+    for _, doc := range docs {
+        var c Contact
+        raw, err := bson.Marshal(doc)
+        if err == nil {
+            err = bson.Unmarshal(raw, &c)
+        }
+        if err != nil {
+            logError("failed to record the first version of a contact: %v", err)
+            continue
+        }
+        versions = append(versions, ContactVersion{ContactID: c.ID, Version: c.Version, Action: action, Contact: c})
+    }
+    saveVersions(r, versions)
+}
+
+// recordDeleted stores the last state of deleted contacts as their final
+// versions
+func recordDeleted(r *http.Request, contacts ...Contact) {
+    versions := make([]ContactVersion, len(contacts))
+    for i, c := range contacts {
+        versions[i] = ContactVersion{ContactID: c.ID, Version: c.Version + 1, Action: versionDelete, Contact: c}
+    }
+    saveVersions(r, versions)
+}
+
+// contactsByID reads the contacts ids, before they are deleted
+func contactsByID(r *http.Request, ids []primitive.ObjectID) ([]Contact, error) {
+    cursor, err := contactsCollection.Find(r.Context(), scopeFilter(r, bson.M{"_id": bson.M{"$in": ids}}))
+    if err != nil {
+        return nil, err
+    }
+    var contacts []Contact
+    err = cursor.All(r.Context(), &contacts)
+    return contacts, err
+}
+
+// versionsContactID reads the contact ID of /contacts/{id}/versions[/{n}/...].
+// The contact may be deleted, so a short ID is only resolved while it exists.
+func versionsContactID(w http.ResponseWriter, r *http.Request) (primitive.ObjectID, bool) {
+    id, _, _ := strings.Cut(r.URL.Path[len("/contacts/"):], "/")
+    if objID, err := primitive.ObjectIDFromHex(id); err == nil {
+        return objID, true
+    }
+    return contactIDFromPath(w, r)
+}
+
+// versionsFilter selects the versions of the contact objID the caller may see:
+// all of them if its key may see the contact as it is now or was last
+func versionsFilter(w http.ResponseWriter, r *http.Request, objID primitive.ObjectID) (bson.M, bool) {
+    filter := scopeFilter(r, bson.M{"contact_id": objID})
+    var latest ContactVersion
+    err := contactVersionsCollection().FindOne(r.Context(), filter,
+        options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})).Decode(&latest)
+    if err == mongo.ErrNoDocuments || (err == nil && !maySee(r, latest.Contact.Tags)) {
+        writeError(w, http.StatusNotFound, codeContactNotFound, "No versions of this contact")
+        return nil, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return nil, false
+    }
+    return filter, true
+}
+
+// getContactVersions handles GET /contacts/{id}/versions[?limit=100], the
+// contact's versions newest first
+func getContactVersions(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    limit, ok := queryInt(r, "limit", contactVersionsListed, contactVersionsListed)
+    if !ok {
+        writeError(w, http.StatusBadRequest, codeInvalidParameter, "limit must be a positive number")
+        return
+    }
+    objID, ok := versionsContactID(w, r)
+    if !ok {
+        return
+    }
+    filter, ok := versionsFilter(w, r, objID)
+    if !ok {
+        return
+    }
+
+    cursor, err := contactVersionsCollection().Find(r.Context(), filter,
+        options.Find().SetSort(bson.D{{Key: "version", Value: -1}}).SetLimit(int64(limit)))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve versions")
+        return
+    }
+    versions := []ContactVersion{}
+    if err := cursor.All(r.Context(), &versions); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    for i := range versions {
+        versions[i].Contact.setAvatarURL()
+    }
+
+    json.NewEncoder(w).Encode(bson.M{"id": objID.Hex(), "versions": versions})
+}
+
+// contactVersion loads version n of the contact from /contacts/{id}/versions/{n}/...
+func contactVersion(w http.ResponseWriter, r *http.Request) (ContactVersion, bson.M, bool) {
+    var v ContactVersion
+    objID, ok := versionsContactID(w, r)
+    if !ok {
+        return v, nil, false
+    }
+    parts := strings.Split(r.URL.Path, "/")
+    n, err := strconv.Atoi(parts[4])
+    if err != nil || n < 1 {
+        writeError(w, http.StatusBadRequest, codeInvalidPath, "The version must be a positive number")
+        return v, nil, false
+    }
+    filter, ok := versionsFilter(w, r, objID)
+    if !ok {
+        return v, nil, false
+    }
+    filter["version"] = n
+    err = contactVersionsCollection().FindOne(r.Context(), filter).Decode(&v)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeVersionNotFound, "No such version of this contact")
+        return v, nil, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return v, nil, false
+    }
+    delete(filter, "version")
+    return v, filter, true
+}
+
+// FieldChange is a field that differs between two versions; From or To is
+// left out where the field isn't set
+type FieldChange struct {
+    Field string `json:"field"`
+    From  any    `json:"from,omitempty"`
+    To    any    `json:"to,omitempty"`
+}
+
+// contactFields are the fields of c as the API returns them; a nil c has none
+func contactFields(c *Contact) map[string]any {
+    m := map[string]any{}
+    if c != nil {
+        b, _ := json.Marshal(c)
+        json.Unmarshal(b, &m)
+    }
+    return m
+}
+
+// diffContacts compares the fields of two contacts as the API returns them;
+// a nil from is a contact without any fields
+func diffContacts(from *Contact, to Contact) []FieldChange {
+    a, b := contactFields(from), contactFields(&to)
+    names := []string{}
+    for name := range a {
+        names = append(names, name)
+    }
+    for name := range b {
+        if _, ok := a[name]; !ok {
+            names = append(names, name)
+        }
+    }
+    slices.Sort(names)
+
+    changes := []FieldChange{}
+    for _, name := range names {
+        if slices.Contains(versionFieldsSkipped, name) || reflect.DeepEqual(a[name], b[name]) {
+            continue
+        }
+        changes = append(changes, FieldChange{Field: name, From: a[name], To: b[name]})
+    }
+    return changes
+}
+
+// getContactVersionDiff handles GET /contacts/{id}/versions/{n}/diff[?against=m],
+// the fields version n changed from version m, by default the version before
+// it. The first version is compared with an empty contact.
+func getContactVersionDiff(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    v, filter, ok := contactVersion(w, r)
+    if !ok {
+        return
+    }
+
+    var base ContactVersion
+    var err error
+    if against := r.URL.Query().Get("against"); against != "" {
+        m, convErr := strconv.Atoi(against)
+        if convErr != nil || m < 1 {
+            writeError(w, http.StatusBadRequest, codeInvalidParameter, "against must be a positive number")
+            return
+        }
+        filter["version"] = m
+        err = contactVersionsCollection().FindOne(r.Context(), filter).Decode(&base)
+        if err == mongo.ErrNoDocuments {
+            writeError(w, http.StatusNotFound, codeVersionNotFound, "No such version of this contact")
+            return
+        }
+    } else {
+        filter["version"] = bson.M{"$lt": v.Version}
+        err = contactVersionsCollection().FindOne(r.Context(), filter,
+            options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})).Decode(&base)
+        if err == mongo.ErrNoDocuments {
+            err = nil
+        }
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return
+    }
+
+    body := bson.M{"id": v.ContactID.Hex(), "version": v.Version}
+    if base.Version > 0 {
+        body["against"] = base.Version
+        body["changes"] = diffContacts(&base.Contact, v.Contact)
+    } else {
+        body["changes"] = diffContacts(nil, v.Contact)
+    }
+    json.NewEncoder(w).Encode(body)
+}
+
+// restoreContactVersion handles POST /contacts/{id}/versions/{n}/restore,
+// which gives the contact the fields of version n again as a new "restore"
+// version, keeping the versions in between. A deleted contact is created
+// again under its ID; its avatar isn't brought back.
+func restoreContactVersion(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if refuseUnreviewed(w, r) {
+        return
+    }
+    v, filter, ok := contactVersion(w, r)
+    if !ok {
+        return
+    }
+    details := bson.M{"restored_from": v.Version}
+
+    var latest ContactVersion
+    err := contactVersionsCollection().FindOne(r.Context(), filter,
+        options.FindOne().SetSort(bson.D{{Key: "version", Value: -1}})).Decode(&latest)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return
+    }
+    if latest.Action != versionDelete {
+        old := v.Contact
+        reportsTo := ""
+        if old.ReportsTo != nil {
+            reportsTo = old.ReportsTo.Hex()
+        }
+        tags := old.Tags
+        if tags == nil {
+            tags = []string{}
+        }
+        social := old.Social
+        if social == nil {
+            social = &SocialProfiles{}
+        }
+        dates := old.Dates
+        if dates == nil {
+            dates = []ContactDate{}
+        }
+        changes := contactChanges{Name: &old.Name, Phone: &old.Phone, Tags: &tags, Company: &old.Company,
+            JobTitle: &old.JobTitle, Website: &old.Website, Social: social, Dates: &dates, DoNotContact: &old.DoNotContact,
+            ReportsTo: &reportsTo}
+        if status, code, msg := changes.resolveReportsTo(r, v.ContactID); status != 0 {
+            writeError(w, status, code, msg)
+            return
+        }
+        found, ok := saveContactChanges(w, r, v.ContactID, changes, versionRestore, details)
+        if !ok {
+            return
+        }
+        var c Contact
+        if found {
+            err = contactsCollection.FindOne(r.Context(), scopeFilter(r, bson.M{"_id": v.ContactID})).Decode(&c)
+        }
+        if !found || err == mongo.ErrNoDocuments {
+            writeError(w, http.StatusNotFound, codeContactNotFound, "Contact not found")
+            return
+        }
+        if err != nil {
+            writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+            return
+        }
+        c.setAvatarURL()
+        json.NewEncoder(w).Encode(bson.M{
+            "message": "Contact restored successfully",
+            "contact": c,
+        })
+        return
+    }
+
+    old := v.Contact
+    c := Contact{ID: v.ContactID, Name: old.Name, Phone: old.Phone, Tags: old.Tags,
+        Company: old.Company, JobTitle: old.JobTitle, Website: old.Website, Social: old.Social, Dates: old.Dates, DoNotContact: old.DoNotContact, Draft: old.Draft, Version: latest.Version + 1}
+    if old.ReportsTo != nil {
+        if status, code, msg := checkManager(r, c.ID, *old.ReportsTo); status != 0 {
+            writeError(w, status, code, msg)
+            return
+        }
+        c.ReportsTo = old.ReportsTo
+    }
+    if !insertContact(w, r, &c) {
+        return
+    }
+    recordAudit(r, "contact.create", c.ID.Hex(), details)
+    publishContactEvent(r, "contact.created", c)
+
+    w.Header().Set("Location", "/contacts/"+c.ID.Hex())
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(bson.M{
+        "message": "Contact restored successfully",
+        "contact": c,
+    })
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    // warmupConnections is how many pooled connections are opened before ready
+    warmupConnections = 10
+    // warmupCachedContacts is how many recently updated contacts are cached
+    warmupCachedContacts = 500
+    warmupRetryInterval  = 5 * time.Second
+)
+
+// warmedUp is set once warmup has finished; until then /startupz and /readyz fail
+var warmedUp atomic.Bool
+
+// startupCheck handles the /startupz route for the startup probe
+func startupCheck(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+    if !warmedUp.Load() {
+        w.WriteHeader(http.StatusServiceUnavailable)
+        json.NewEncoder(w).Encode(map[string]string{"status": "starting"})
+        return
+    }
+    json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// warmup retries warmupOnce until it succeeds or ctx is cancelled. A pod that
+// never warms up is restarted once the startup probe gives up.
+func warmup(ctx context.Context) {
+    start := time.Now()
+    for {
+        err := warmupOnce(ctx)
+        if err == nil {
+            break
+        }
+        logWarn("warmup failed, retrying in %s: %v", warmupRetryInterval, err)
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(warmupRetryInterval):
+        }
+    }
+    warmedUp.Store(true)
+    logInfo("warmup finished in %s", time.Since(start).Round(time.Millisecond))
+}
+
+// warmupOnce fills the connection pool, makes sure the required indexes exist
+// and primes the contact cache, so the first requests after a deploy are served
+// at normal latency. Index builds are not bounded, as they can take a while on
+// large collections.
+func warmupOnce(ctx context.Context) error {
+    if err := fillConnectionPool(ctx); err != nil {
+        return err
+    }
+    if err := bootstrapIndexes(ctx); err != nil {
+        return err
+    }
+    return forEachRegion(ctx, primeContactCache)
+}
+
+// fillConnectionPool pings every region's cluster concurrently, each ping
+// checking out a connection
+func fillConnectionPool(ctx context.Context) error {
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+
+    var wg sync.WaitGroup
+    errs := make(chan error, warmupConnections*len(regionDatabases))
+    for _, db := range regionDatabases {
+        for i := 0; i < warmupConnections; i++ {
+            wg.Add(1)
+            go func() {
+                defer wg.Done()
+                errs <- db.Client().Ping(ctx, nil)
+            }()
+        }
+    }
+    wg.Wait()
+    close(errs)
+    for err := range errs {
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// primeContactCache loads the most recently updated contacts into contactCache
+func primeContactCache(ctx context.Context) error {
+    ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+
+    ttl := time.Duration(currentConfig().Cache.ContactTTL)
+    if ttl <= 0 {
+        return nil
+    }
+
+    cursor, err := contactsCollection.Find(ctx, bson.D{}, options.Find().
+        SetSort(bson.D{{Key: "updated_at", Value: -1}}).
+        SetLimit(warmupCachedContacts))
+    if err != nil {
+        return err
+    }
+    var contacts []Contact
+    if err := cursor.All(ctx, &contacts); err != nil {
+        return err
+    }
+    for _, c := range contacts {
+        tenant := c.Tenant
+        if tenant == "" {
+            tenant = defaultTenant
+        }
+        contactCache.Set(tenant+"/"+c.ID.Hex(), c, ttl)
+    }
+    return nil
+}
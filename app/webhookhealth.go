@@ -0,0 +1,191 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "net/http"
+    "sync"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+    "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+    // webhookUnhealthyAfter is how many consecutive failures mark an endpoint unhealthy
+    webhookUnhealthyAfter = 3
+    // webhookPingers is how many endpoints are pinged at once
+    webhookPingers = 8
+    // webhookPingReserve is the part of the job's time kept for recording
+    // the last results
+    webhookPingReserve = 5 * time.Second
+    // minWebhookPing is the least time a ping is started with
+    minWebhookPing = 2 * time.Second
+)
+
+// WebhookHealth is the state of a subscriber's endpoint, updated by health
+// pings and by real deliveries. Status is unknown, healthy, degraded (failing,
+// fewer than webhookUnhealthyAfter times in a row) or unhealthy. LastSkippedAt
+// is when a health run last ran out of time before reaching the endpoint.
+type WebhookHealth struct {
+    Status              string     `bson:"status" json:"status"`
+    LastCheckedAt       *time.Time `bson:"last_checked_at,omitempty" json:"last_checked_at,omitempty"`
+    LastSkippedAt       *time.Time `bson:"last_skipped_at,omitempty" json:"last_skipped_at,omitempty"`
+    LastSuccessAt       *time.Time `bson:"last_success_at,omitempty" json:"last_success_at,omitempty"`
+    LastStatusCode      int        `bson:"last_status_code,omitempty" json:"last_status_code,omitempty"`
+    LastError           string     `bson:"last_error,omitempty" json:"last_error,omitempty"`
+    LastLatencyMs       int64      `bson:"last_latency_ms" json:"last_latency_ms"`
+    ConsecutiveFailures int        `bson:"consecutive_failures" json:"consecutive_failures"`
+}
+
+var (
+    webhookUp           = newGauge("webhook_endpoint_up", "1 if the webhook endpoint answered its last ping or delivery.", "webhook")
+    webhookHealthChecks = newCounter("webhook_health_checks_total", "Webhook health pings by result.", "result")
+)
+
+func init() {
+    scheduler.MustRegister(Job{
+        Name:      "webhook-health",
+        Schedule:  "@every 1m",
+        Timeout:   time.Minute,
+        Singleton: true,
+        Run:       pingWebhooks,
+    })
+}
+
+// pingWebhooks sends a signed "ping" event to every subscription,
+// webhookPingers at a time. Each ping gets webhookTimeout, or less when the
+// job's deadline is nearer; once there isn't time for another ping the
+// remaining subscriptions are recorded as skipped rather than checked.
+func pingWebhooks(ctx context.Context) error {
+    cursor, err := webhooksCollection().Find(ctx, bson.D{})
+    if err != nil {
+        return err
+    }
+    var hooks []Webhook
+    if err := cursor.All(ctx, &hooks); err != nil {
+        return err
+    }
+
+    var wg sync.WaitGroup
+    pingers := make(chan struct{}, webhookPingers)
+    for i, h := range hooks {
+        pingers <- struct{}{}
+        budget := webhookTimeout
+        if deadline, ok := ctx.Deadline(); ok {
+            budget = min(budget, time.Until(deadline)-webhookPingReserve)
+        }
+        if budget < minWebhookPing {
+            <-pingers
+            skipWebhookPings(ctx, hooks[i:])
+            break
+        }
+        wg.Add(1)
+        go func() {
+            defer func() {
+                <-pingers
+                wg.Done()
+            }()
+            pingCtx, cancel := context.WithTimeout(ctx, budget)
+            defer cancel()
+
+            event := WebhookEvent{ID: randomHex(12), Type: "ping", OccurredAt: utcNow()}
+            status, latency, err := postWebhook(pingCtx, h, event)
+            if err != nil {
+                webhookHealthChecks.Inc("failure")
+            } else {
+                webhookHealthChecks.Inc("success")
+            }
+            recordWebhookResult(pingCtx, h.ID, status, latency, err)
+        }()
+    }
+    wg.Wait()
+    return nil
+}
+
+// skipWebhookPings records that hooks weren't pinged this run. Their health
+// is left as it was, with last_skipped_at telling it is getting old.
+func skipWebhookPings(ctx context.Context, hooks []Webhook) {
+    ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+    defer cancel()
+
+    ids := make([]primitive.ObjectID, len(hooks))
+    for i, h := range hooks {
+        ids[i] = h.ID
+    }
+    webhookHealthChecks.Add(float64(len(ids)), "skipped")
+    logWarn("webhook health: ran out of time, skipped %d of the endpoints", len(ids))
+    if _, err := webhooksCollection().UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}},
+        bson.M{"$set": bson.M{"health.last_skipped_at": utcNow()}}); err != nil {
+        logError("failed to record skipped webhook pings: %v", err)
+    }
+}
+
+// recordWebhookResult folds one ping or delivery outcome into the stored health
+func recordWebhookResult(ctx context.Context, id primitive.ObjectID, status int, latency time.Duration, err error) {
+    ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+    defer cancel()
+
+    now := utcNow()
+    set := bson.M{
+        "health.last_checked_at":  now,
+        "health.last_status_code": status,
+        "health.last_latency_ms":  latency.Milliseconds(),
+    }
+    var update bson.M
+    if err == nil {
+        set["health.status"] = "healthy"
+        set["health.last_success_at"] = now
+        set["health.last_error"] = ""
+        set["health.consecutive_failures"] = 0
+        update = bson.M{"$set": set}
+        webhookUp.Set(1, id.Hex())
+    } else {
+        set["health.last_error"] = webhookErrorClass(status, err)
+        update = bson.M{"$set": set, "$inc": bson.M{"health.consecutive_failures": 1}}
+        webhookUp.Set(0, id.Hex())
+    }
+
+    var h Webhook
+    err = webhooksCollection().FindOneAndUpdate(ctx, bson.M{"_id": id}, update,
+        options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&h)
+    if err == mongo.ErrNoDocuments {
+        // deleted while the ping or delivery was in flight
+        webhookUp.Delete(id.Hex())
+        return
+    }
+    if err != nil {
+        logError("failed to record health of webhook %s: %v", id.Hex(), err)
+        return
+    }
+    if h.Health.ConsecutiveFailures == 0 {
+        return
+    }
+
+    state := "degraded"
+    if h.Health.ConsecutiveFailures >= webhookUnhealthyAfter {
+        state = "unhealthy"
+    }
+    if state != h.Health.Status {
+        webhooksCollection().UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"health.status": state}})
+        logWarn("webhook %s is %s after %d failures: %s", id.Hex(), state, h.Health.ConsecutiveFailures, h.Health.LastError)
+    }
+}
+
+// getWebhookHealth handles GET /webhooks/{id}/health
+func getWebhookHealth(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    h, ok := webhookByID(w, r)
+    if !ok {
+        return
+    }
+
+    json.NewEncoder(w).Encode(bson.M{
+        "id":     h.ID,
+        "url":    h.URL,
+        "health": h.Health,
+    })
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "fmt"
+    "slices"
+    "strings"
+    "text/template"
+)
+
+// maxWebhookTemplate bounds the size of a subscription's payload template
+const maxWebhookTemplate = 4096
+
+// webhookFields are the contact fields a subscription can select; "id" is always sent
+var webhookFields = []string{"id", "name", "phone", "tags", "company", "job_title", "website", "social", "dates", "do_not_contact", "reports_to", "draft", "owner", "created_at", "updated_at"}
+
+var webhookTemplateFuncs = template.FuncMap{
+    // json renders a value as a JSON literal, quoting and escaping strings
+    "json": func(v any) (string, error) {
+        b, err := json.Marshal(v)
+        return string(b), err
+    },
+}
+
+// parseWebhookTemplate checks a payload template by rendering a sample event;
+// the result has to be JSON
+func parseWebhookTemplate(text string) (*template.Template, error) {
+    if len(text) > maxWebhookTemplate {
+        return nil, fmt.Errorf("template must not be longer than %d bytes", maxWebhookTemplate)
+    }
+    tmpl, err := template.New("payload").Funcs(webhookTemplateFuncs).Option("missingkey=zero").Parse(text)
+    if err != nil {
+        return nil, err
+    }
+
+    sample := WebhookEvent{ID: "sample", Type: "contact.created", OccurredAt: utcNow(), Data: Contact{Name: "Jane Doe", Phone: "+1-234-567-8900", Tags: []string{"vip"}}}
+    var h Webhook
+    out, err := renderWebhookPayload(tmpl, h, sample)
+    if err != nil {
+        return nil, err
+    }
+    if !json.Valid(out) {
+        return nil, fmt.Errorf("template must produce JSON, got %q", out)
+    }
+    return tmpl, nil
+}
+
+// selectFields keeps "id", "reminder" and the chosen fields of an event's data,
+// and of the "changes" of an update
+func selectFields(data map[string]any, fields []string) map[string]any {
+    out := map[string]any{}
+    for k, v := range data {
+        switch {
+        case k == "id" || k == "reminder" || slices.Contains(fields, k):
+            out[k] = v
+        case k == "changes":
+            if changes, ok := v.(map[string]any); ok {
+                out[k] = selectFields(changes, fields)
+            }
+        }
+    }
+    return out
+}
+
+// eventMap is the event as templates and field selection see it: the JSON
+// document subscribers would otherwise receive
+func eventMap(h Webhook, event WebhookEvent) (map[string]any, error) {
+    raw, err := json.Marshal(event)
+    if err != nil {
+        return nil, err
+    }
+    var m map[string]any
+    if err := json.Unmarshal(raw, &m); err != nil {
+        return nil, err
+    }
+    if data, ok := m["data"].(map[string]any); ok && len(h.Fields) > 0 {
+        m["data"] = selectFields(data, h.Fields)
+    }
+    return m, nil
+}
+
+func renderWebhookPayload(tmpl *template.Template, h Webhook, event WebhookEvent) ([]byte, error) {
+    m, err := eventMap(h, event)
+    if err != nil {
+        return nil, err
+    }
+    var buf bytes.Buffer
+    if err := tmpl.Execute(&buf, m); err != nil {
+        return nil, err
+    }
+    return bytes.TrimSpace(buf.Bytes()), nil
+}
+
+// webhookPayload is the body delivered to h: the event with the subscription's
+// fields, as a ContactEvent protobuf or rendered through its template if the
+// subscription asks for it
+func webhookPayload(h Webhook, event WebhookEvent) ([]byte, error) {
+    if h.Format == "protobuf" {
+        m, err := eventMap(h, event)
+        if err != nil {
+            return nil, err
+        }
+        return protoEvent(m)
+    }
+    if strings.TrimSpace(h.Template) != "" {
+        tmpl, err := template.New("payload").Funcs(webhookTemplateFuncs).Option("missingkey=zero").Parse(h.Template)
+        if err != nil {
+            return nil, err
+        }
+        return renderWebhookPayload(tmpl, h, event)
+    }
+    if len(h.Fields) == 0 {
+        return json.Marshal(event)
+    }
+    m, err := eventMap(h, event)
+    if err != nil {
+        return nil, err
+    }
+    return json.Marshal(m)
+}
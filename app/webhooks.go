@@ -0,0 +1,394 @@
+package main
+
+import (
+    "bytes"
+    "context"
+    "crypto/hmac"
+    "crypto/sha256"
+    "crypto/tls"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "net"
+    "net/http"
+    "net/netip"
+    "net/url"
+    "slices"
+    "strconv"
+    "strings"
+    "time"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+    "go.mongodb.org/mongo-driver/mongo"
+)
+
+const (
+    webhookQueueSize   = 1000
+    webhookWorkers     = 4
+    webhookMaxAttempts = 3
+    webhookTimeout     = 10 * time.Second
+)
+
+// webhookEvents are the event types a subscription can ask for; "*" means all
+var webhookEvents = []string{"contact.created", "contact.updated", "contact.deleted", "contact.reminder"}
+
+// Webhook is a subscription of one tenant to contact events. Fields limits the
+// contact fields sent; Template, if set, renders the body and Format
+// "protobuf" sends it in binary (see webhookPayload).
+type Webhook struct {
+    ID        primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+    Tenant    string             `bson:"tenant" json:"-"`
+    Owner     string             `bson:"owner,omitempty" json:"owner,omitempty"`
+    URL       string             `bson:"url" json:"url"`
+    Events    []string           `bson:"events" json:"events"`
+    Fields    []string           `bson:"fields,omitempty" json:"fields,omitempty"`
+    Template  string             `bson:"template,omitempty" json:"template,omitempty"`
+    Format    string             `bson:"format,omitempty" json:"format,omitempty"`
+    Secret    string             `bson:"secret" json:"secret,omitempty"`
+    CreatedAt time.Time          `bson:"created_at" json:"created_at"`
+    Health    WebhookHealth      `bson:"health" json:"health"`
+}
+
+// WebhookEvent is the JSON body POSTed to subscribers
+type WebhookEvent struct {
+    ID         string    `json:"id"`
+    Type       string    `json:"type"`
+    OccurredAt time.Time `json:"occurred_at"`
+    Data       any       `json:"data,omitempty"`
+}
+
+type webhookDelivery struct {
+    ctx     context.Context
+    webhook Webhook
+    event   WebhookEvent
+}
+
+var (
+    webhookDeliveries = make(chan webhookDelivery, webhookQueueSize)
+
+    webhookDeliveriesTotal = newCounter("webhook_deliveries_total", "Webhook deliveries by outcome.", "result")
+)
+
+// webhookClient delivers events. Like websiteClient it only connects to
+// public addresses on ports 80 and 443, checked as it dials and so after DNS
+// and on every redirect: subscribers can't point it at the service's network.
+var webhookClient = &http.Client{
+    Timeout: webhookTimeout,
+    Transport: &tracingTransport{target: "webhook", base: &http.Transport{
+        DialContext: (&net.Dialer{
+            Timeout: 5 * time.Second,
+            Control: publicAddressOnly,
+        }).DialContext,
+        TLSHandshakeTimeout:   5 * time.Second,
+        ResponseHeaderTimeout: webhookTimeout,
+        MaxIdleConns:          100,
+        IdleConnTimeout:       90 * time.Second,
+    }},
+    CheckRedirect: limitRedirects,
+}
+
+func webhooksCollection() collection {
+    return collectionOf("webhooks")
+}
+
+// startWebhookWorkers starts the goroutines that deliver queued events
+func startWebhookWorkers() {
+    for i := 0; i < webhookWorkers; i++ {
+        go func() {
+            for d := range webhookDeliveries {
+                deliverWebhook(d)
+            }
+        }()
+    }
+}
+
+// publishContactEvent queues eventType for every subscription of the caller's
+// tenant. Delivery happens after the response, but keeps the request's trace.
+func publishContactEvent(r *http.Request, eventType string, data any) {
+    notifyWatchers(r, eventType, data)
+    queueWebsiteFetch(r, eventType, data)
+    cursor, err := webhooksCollection().Find(r.Context(), scopeFilter(r, bson.M{
+        "events": bson.M{"$in": bson.A{eventType, "*"}},
+    }))
+    if err != nil {
+        logError("failed to load webhooks for %s: %v", eventType, err)
+        return
+    }
+    var hooks []Webhook
+    if err := cursor.All(r.Context(), &hooks); err != nil {
+        logError("failed to load webhooks for %s: %v", eventType, err)
+        return
+    }
+
+    event := WebhookEvent{ID: randomHex(12), Type: eventType, OccurredAt: utcNow(), Data: data}
+    ctx := withTrace(r.Context(), context.Background())
+    for _, h := range hooks {
+        select {
+        case webhookDeliveries <- webhookDelivery{ctx: ctx, webhook: h, event: event}:
+        default:
+            webhookDeliveriesTotal.Inc("dropped")
+            logWarn("webhook queue full, dropped %s for %s", eventType, h.ID.Hex())
+        }
+    }
+}
+
+// deliverWebhook retries with a growing delay and records the final outcome
+// in the subscription's health
+func deliverWebhook(d webhookDelivery) {
+    var status int
+    var latency time.Duration
+    var err error
+    for attempt := 1; attempt <= webhookMaxAttempts; attempt++ {
+        status, latency, err = postWebhook(d.ctx, d.webhook, d.event)
+        if err == nil {
+            break
+        }
+        time.Sleep(time.Duration(attempt) * 2 * time.Second)
+    }
+
+    if err != nil {
+        webhookDeliveriesTotal.Inc("failed")
+        logWarn("webhook %s: delivery of %s failed: %v", d.webhook.ID.Hex(), d.event.Type, err)
+    } else {
+        webhookDeliveriesTotal.Inc("delivered")
+    }
+    recordWebhookResult(d.ctx, d.webhook.ID, status, latency, err)
+}
+
+// postWebhook sends one signed event. Subscribers verify X-Webhook-Signature,
+// "sha256=" + hex HMAC-SHA256 of "<X-Webhook-Timestamp>.<body>" with their secret.
+func postWebhook(ctx context.Context, h Webhook, event WebhookEvent) (int, time.Duration, error) {
+    body, err := webhookPayload(h, event)
+    if err != nil {
+        return 0, 0, err
+    }
+    ts := strconv.FormatInt(time.Now().Unix(), 10)
+    mac := hmac.New(sha256.New, []byte(h.Secret))
+    mac.Write([]byte(ts + "." + string(body)))
+
+    req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(body))
+    if err != nil {
+        return 0, 0, err
+    }
+    if h.Format == "protobuf" {
+        req.Header.Set("Content-Type", `application/x-protobuf; messageType="`+contactEventMessage+`"`)
+    } else {
+        req.Header.Set("Content-Type", "application/json")
+    }
+    req.Header.Set("X-Webhook-Id", h.ID.Hex())
+    req.Header.Set("X-Webhook-Event", event.Type)
+    req.Header.Set("X-Webhook-Timestamp", ts)
+    req.Header.Set("X-Webhook-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+    start := time.Now()
+    resp, err := webhookClient.Do(req)
+    latency := time.Since(start)
+    if err != nil {
+        return 0, latency, err
+    }
+    resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        return resp.StatusCode, latency, fmt.Errorf("endpoint responded %s", resp.Status)
+    }
+    return resp.StatusCode, latency, nil
+}
+
+// absoluteHTTPURL accepts absolute http and https URLs
+func absoluteHTTPURL(raw string) bool {
+    u, err := url.Parse(raw)
+    return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Hostname() != ""
+}
+
+// validWebhookURL accepts absolute http and https URLs on the ports
+// webhookClient connects to. Hosts given as an address must be public; names
+// are checked when they are dialed.
+func validWebhookURL(raw string) error {
+    if !absoluteHTTPURL(raw) {
+        return errors.New("url must be an absolute http or https URL")
+    }
+    u, _ := url.Parse(raw)
+    if port := u.Port(); port != "" && port != "80" && port != "443" {
+        return errors.New("url must use port 80 or 443")
+    }
+    host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+    if addr, err := netip.ParseAddr(host); (err == nil && !isPublicAddress(addr)) || host == "localhost" || strings.HasSuffix(host, ".localhost") {
+        return errors.New("url must not point to a private or reserved address")
+    }
+    return nil
+}
+
+// webhookErrorClass describes a failed ping or delivery for the stored
+// health. Only the class is kept, never the error itself, so health doesn't
+// tell a subscriber what lies behind an address it can't reach.
+func webhookErrorClass(status int, err error) string {
+    var netErr net.Error
+    var certErr *tls.CertificateVerificationError
+    var recordErr tls.RecordHeaderError
+    switch {
+    case status != 0:
+        return fmt.Sprintf("endpoint responded %d %s", status, http.StatusText(status))
+    case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+        return "timed out"
+    case errors.As(err, &certErr), errors.As(err, &recordErr):
+        return "TLS handshake failed"
+    default:
+        return "connection failed"
+    }
+}
+
+// listWebhooks handles GET /webhooks
+func listWebhooks(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    cursor, err := webhooksCollection().Find(r.Context(), scopeFilter(r, bson.M{}))
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to retrieve webhooks")
+        return
+    }
+    hooks := []Webhook{}
+    if err := cursor.All(r.Context(), &hooks); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Cursor error")
+        return
+    }
+    for i := range hooks {
+        hooks[i].Secret = ""
+    }
+
+    json.NewEncoder(w).Encode(hooks)
+}
+
+// createWebhook handles POST /webhooks; the signing secret is only returned here
+func createWebhook(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if len(keyTags(r.Context())) > 0 {
+        writeError(w, http.StatusForbidden, codeForbidden, "Keys limited to tags can't subscribe to webhooks, which report on all of the tenant's contacts")
+        return
+    }
+
+    var in struct {
+        URL      string   `json:"url"`
+        Events   []string `json:"events"`
+        Fields   []string `json:"fields"`
+        Template string   `json:"template"`
+        Format   string   `json:"format"`
+    }
+    if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidRequestBody, "Invalid request body")
+        return
+    }
+    if err := validWebhookURL(in.URL); err != nil {
+        writeError(w, http.StatusBadRequest, codeValidationFailed, err.Error())
+        return
+    }
+    if len(in.Events) == 0 {
+        in.Events = []string{"*"}
+    }
+    for _, e := range in.Events {
+        if e != "*" && !slices.Contains(webhookEvents, e) {
+            writeError(w, http.StatusBadRequest, codeValidationFailed, "events must be * or one of "+strings.Join(webhookEvents, ", "))
+            return
+        }
+    }
+
+    for _, f := range in.Fields {
+        if !slices.Contains(webhookFields, f) {
+            writeError(w, http.StatusBadRequest, codeValidationFailed, "fields must be among "+strings.Join(webhookFields, ", "))
+            return
+        }
+    }
+    switch in.Format {
+    case "", "json":
+        in.Format = ""
+    case "protobuf":
+        if in.Template != "" {
+            writeError(w, http.StatusBadRequest, codeValidationFailed, "template can't be combined with the protobuf format")
+            return
+        }
+    default:
+        writeError(w, http.StatusBadRequest, codeValidationFailed, "format must be json or protobuf")
+        return
+    }
+    if in.Template != "" {
+        if _, err := parseWebhookTemplate(in.Template); err != nil {
+            writeError(w, http.StatusBadRequest, codeValidationFailed, "invalid template: "+err.Error())
+            return
+        }
+    }
+
+    h := Webhook{
+        Tenant:    tenantOf(r),
+        Owner:     principalFrom(r).KeyID,
+        URL:       in.URL,
+        Events:    in.Events,
+        Fields:    in.Fields,
+        Template:  in.Template,
+        Format:    in.Format,
+        Secret:    randomHex(32),
+        CreatedAt: utcNow(),
+        Health:    WebhookHealth{Status: "unknown"},
+    }
+    result, err := webhooksCollection().InsertOne(r.Context(), h)
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to create webhook")
+        return
+    }
+    h.ID = result.InsertedID.(primitive.ObjectID)
+    recordAudit(r, "webhook.create", h.ID.Hex(), bson.M{"url": h.URL, "events": h.Events, "fields": h.Fields})
+
+    w.WriteHeader(http.StatusCreated)
+    json.NewEncoder(w).Encode(h)
+}
+
+// webhookByID loads the caller's webhook named in /webhooks/{id}[/health]
+func webhookByID(w http.ResponseWriter, r *http.Request) (Webhook, bool) {
+    var h Webhook
+
+    id := strings.TrimSuffix(r.URL.Path[len("/webhooks/"):], "/health")
+    objID, err := primitive.ObjectIDFromHex(id)
+    if err != nil {
+        writeError(w, http.StatusBadRequest, codeInvalidID, "Invalid webhook ID")
+        return h, false
+    }
+
+    err = webhooksCollection().FindOne(r.Context(), scopeFilter(r, bson.M{"_id": objID})).Decode(&h)
+    if err == mongo.ErrNoDocuments {
+        writeError(w, http.StatusNotFound, codeWebhookNotFound, "Webhook not found")
+        return h, false
+    }
+    if err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Database error")
+        return h, false
+    }
+    h.Secret = ""
+    return h, true
+}
+
+// getWebhook handles GET /webhooks/{id}
+func getWebhook(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    if h, ok := webhookByID(w, r); ok {
+        json.NewEncoder(w).Encode(h)
+    }
+}
+
+// deleteWebhook handles DELETE /webhooks/{id}
+func deleteWebhook(w http.ResponseWriter, r *http.Request) {
+    w.Header().Set("Content-Type", "application/json")
+
+    h, ok := webhookByID(w, r)
+    if !ok {
+        return
+    }
+    if _, err := webhooksCollection().DeleteOne(r.Context(), bson.M{"_id": h.ID}); err != nil {
+        writeError(w, http.StatusInternalServerError, codeInternal, "Failed to delete webhook")
+        return
+    }
+    webhookUp.Delete(h.ID.Hex())
+    recordAudit(r, "webhook.delete", h.ID.Hex(), nil)
+
+    json.NewEncoder(w).Encode(bson.M{"message": "Webhook deleted successfully"})
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "fmt"
+    "net"
+    "net/url"
+    "testing"
+)
+
+func TestValidWebhookURL(t *testing.T) {
+    tests := []struct {
+        url  string
+        want string
+    }{
+        {"https://crm.example.com/hooks", ""},
+        {"http://crm.example.com:80/hooks", ""},
+        {"https://crm.example.com:443/hooks", ""},
+        {"https://93.184.215.14/hooks", ""},
+        {"https://[2606:4700::6810:84e5]/hooks", ""},
+
+        {"", "url must be an absolute http or https URL"},
+        {"/hooks", "url must be an absolute http or https URL"},
+        {"ftp://crm.example.com/hooks", "url must be an absolute http or https URL"},
+        {"https://:443/hooks", "url must be an absolute http or https URL"},
+        {"https://crm.example.com:8443/hooks", "url must use port 80 or 443"},
+        {"http://crm.example.com:22/", "url must use port 80 or 443"},
+        {"http://127.0.0.1/hooks", "url must not point to a private or reserved address"},
+        {"http://10.0.0.5/hooks", "url must not point to a private or reserved address"},
+        {"http://169.254.169.254/latest/meta-data/", "url must not point to a private or reserved address"},
+        {"http://[::1]/hooks", "url must not point to a private or reserved address"},
+        {"http://[::ffff:192.168.1.1]/hooks", "url must not point to a private or reserved address"},
+        {"http://[fe80::1%25eth0]/hooks", "url must not point to a private or reserved address"},
+        {"http://localhost/hooks", "url must not point to a private or reserved address"},
+        {"http://LocalHost./hooks", "url must not point to a private or reserved address"},
+        {"http://admin.localhost/hooks", "url must not point to a private or reserved address"},
+    }
+    for _, tt := range tests {
+        got := ""
+        if err := validWebhookURL(tt.url); err != nil {
+            got = err.Error()
+        }
+        if got != tt.want {
+            t.Errorf("validWebhookURL(%q) = %q, want %q", tt.url, got, tt.want)
+        }
+    }
+}
+
+func TestWebhookErrorClass(t *testing.T) {
+    dialErr := &url.Error{Op: "Post", URL: "http://10.0.0.5:8080/", Err: &net.OpError{
+        Op: "dial", Net: "tcp", Err: fmt.Errorf("connect: %w", errors.New("connection refused")),
+    }}
+    timeoutErr := &url.Error{Op: "Post", URL: "http://crm.example.com/", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}
+
+    tests := []struct {
+        name   string
+        status int
+        err    error
+        want   string
+    }{
+        {"status", 503, errors.New("endpoint responded 503 Service Unavailable"), "endpoint responded 503 Service Unavailable"},
+        {"dial", 0, dialErr, "connection failed"},
+        {"refused address", 0, &url.Error{Op: "Post", Err: &net.OpError{Op: "dial", Err: errWebsiteAddress}}, "connection failed"},
+        {"dns", 0, &url.Error{Op: "Post", Err: &net.DNSError{Err: "no such host", Name: "db.internal"}}, "connection failed"},
+        {"timeout", 0, timeoutErr, "timed out"},
+        {"deadline", 0, &url.Error{Op: "Post", Err: context.DeadlineExceeded}, "timed out"},
+    }
+    for _, tt := range tests {
+        if got := webhookErrorClass(tt.status, tt.err); got != tt.want {
+            t.Errorf("%s: webhookErrorClass = %q, want %q", tt.name, got, tt.want)
+        }
+    }
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "html"
+    "io"
+    "mime"
+    "net"
+    "net/http"
+    "net/netip"
+    "net/url"
+    "regexp"
+    "strings"
+    "syscall"
+    "time"
+    "unicode/utf8"
+
+    "go.mongodb.org/mongo-driver/bson"
+    "go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Contacts may have a website. When the websites.enrich config setting is on,
+// the page is fetched in the background after the website is set, and its
+// title and favicon are kept in the contact's website_preview for UIs to show.
+// The fetch only reaches public addresses on the standard ports, so a website
+// can't be used to probe the service's network.
+
+const (
+    // maxWebsiteLength caps the length of a website URL
+    maxWebsiteLength = 2048
+    websiteQueueSize = 1000
+    websiteFetchers  = 2
+    // websiteFetchTimeout bounds one fetch, redirects included
+    websiteFetchTimeout = 10 * time.Second
+    // maxWebsiteRedirects caps the redirects a fetch follows
+    maxWebsiteRedirects = 3
+    // maxWebsiteRead is how much of a page is read looking for its title
+    maxWebsiteRead = 256 << 10
+    // maxWebsiteTitle caps the characters of a preview's title
+    maxWebsiteTitle = 300
+)
+
+// WebsitePreview is what was found on a contact's website
+type WebsitePreview struct {
+    Title     string    `bson:"title,omitempty" json:"title,omitempty"`
+    Favicon   string    `bson:"favicon,omitempty" json:"favicon,omitempty"`
+    FetchedAt time.Time `bson:"fetched_at" json:"fetched_at"`
+}
+
+// WebsiteConfig controls website enrichment
+type WebsiteConfig struct {
+    Enrich bool `json:"enrich"`
+}
+
+type websiteFetch struct {
+    ctx     context.Context
+    tenant  string
+    id      primitive.ObjectID
+    website string
+}
+
+var (
+    websiteQueue       = make(chan websiteFetch, websiteQueueSize)
+    websiteEnrichments = newCounter("website_enrichments_total", "Website preview fetches by outcome.", "result")
+
+    websiteTitlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+    websiteLinkPattern  = regexp.MustCompile(`(?is)<link\b[^>]*>`)
+    websiteAttrPattern  = regexp.MustCompile(`(?is)\b(rel|href)\s*=\s*("[^"]*"|'[^']*'|[^\s"'>]+)`)
+)
+
+// errWebsiteAddress is returned for connections to addresses websites may not
+// have
+var errWebsiteAddress = errors.New("not a public address")
+
+// websiteClient fetches websites, refusing private, loopback and other
+// non-public addresses. The address is checked as it is dialed, after DNS,
+// so names resolving to such addresses are refused as well.
+var websiteClient = &http.Client{
+    Timeout: websiteFetchTimeout,
+    Transport: &tracingTransport{target: "website", base: &http.Transport{
+        DialContext: (&net.Dialer{
+            Timeout: 5 * time.Second,
+            Control: publicAddressOnly,
+        }).DialContext,
+        TLSHandshakeTimeout:   5 * time.Second,
+        ResponseHeaderTimeout: 5 * time.Second,
+        MaxIdleConns:          10,
+        IdleConnTimeout:       30 * time.Second,
+    }},
+    CheckRedirect: limitRedirects,
+}
+
+// limitRedirects is the redirect policy of clients dialing with
+// publicAddressOnly: at most maxWebsiteRedirects redirects, all to HTTP URLs
+func limitRedirects(req *http.Request, via []*http.Request) error {
+    if len(via) > maxWebsiteRedirects {
+        return errors.New("too many redirects")
+    }
+    if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+        return errors.New("redirect to a non-HTTP URL")
+    }
+    return nil
+}
+
+// nat64Prefix is the well-known NAT64 prefix: its addresses carry an IPv4
+// address in their last 32 bits, which a NAT64 gateway connects to
+var nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+// nonPublicPrefixes are the special-purpose ranges of the IANA IPv4 and IPv6
+// registries that a website may not resolve to: private, shared, loopback,
+// link-local, documentation, benchmarking, multicast and reserved space, and
+// the transition prefixes (other than NAT64, which is unwrapped) that could
+// tunnel to any of them.
+var nonPublicPrefixes = []netip.Prefix{
+    netip.MustParsePrefix("0.0.0.0/8"),       // "this network"
+    netip.MustParsePrefix("10.0.0.0/8"),      // private
+    netip.MustParsePrefix("100.64.0.0/10"),   // carrier-grade NAT
+    netip.MustParsePrefix("127.0.0.0/8"),     // loopback
+    netip.MustParsePrefix("169.254.0.0/16"),  // link-local, cloud metadata
+    netip.MustParsePrefix("172.16.0.0/12"),   // private
+    netip.MustParsePrefix("192.0.0.0/24"),    // IETF protocol assignments
+    netip.MustParsePrefix("192.0.2.0/24"),    // documentation
+    netip.MustParsePrefix("192.88.99.0/24"),  // 6to4 relay anycast
+    netip.MustParsePrefix("192.168.0.0/16"),  // private
+    netip.MustParsePrefix("198.18.0.0/15"),   // benchmarking
+    netip.MustParsePrefix("198.51.100.0/24"), // documentation
+    netip.MustParsePrefix("203.0.113.0/24"),  // documentation
+    netip.MustParsePrefix("224.0.0.0/4"),     // multicast
+    netip.MustParsePrefix("240.0.0.0/4"),     // reserved, broadcast
+
+    netip.MustParsePrefix("::/128"),         // unspecified
+    netip.MustParsePrefix("::1/128"),        // loopback
+    netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+    netip.MustParsePrefix("100::/64"),       // discard
+    netip.MustParsePrefix("2001::/23"),      // IETF protocol assignments, Teredo
+    netip.MustParsePrefix("2001:db8::/32"),  // documentation
+    netip.MustParsePrefix("2002::/16"),      // 6to4
+    netip.MustParsePrefix("3fff::/20"),      // documentation
+    netip.MustParsePrefix("fc00::/7"),       // unique local
+    netip.MustParsePrefix("fe80::/10"),      // link-local
+    netip.MustParsePrefix("fec0::/10"),      // site-local
+    netip.MustParsePrefix("ff00::/8"),       // multicast
+}
+
+// publicAddressOnly is the dialer control refusing connections to anything
+// but public addresses on ports 80 and 443
+func publicAddressOnly(network, address string, _ syscall.RawConn) error {
+    addrPort, err := netip.ParseAddrPort(address)
+    if err != nil {
+        return err
+    }
+    if port := addrPort.Port(); port != 80 && port != 443 {
+        return errWebsiteAddress
+    }
+    if !isPublicAddress(addrPort.Addr()) {
+        return errWebsiteAddress
+    }
+    return nil
+}
+
+// isPublicAddress reports whether addr is outside nonPublicPrefixes. IPv4
+// addresses mapped into IPv6 or behind the NAT64 prefix are checked as the
+// IPv4 address they reach.
+func isPublicAddress(addr netip.Addr) bool {
+    addr = addr.Unmap().WithZone("")
+    if nat64Prefix.Contains(addr) {
+        a := addr.As16()
+        addr = netip.AddrFrom4([4]byte(a[12:]))
+    }
+    if !addr.IsValid() {
+        return false
+    }
+    for _, p := range nonPublicPrefixes {
+        if p.Contains(addr) {
+            return false
+        }
+    }
+    return true
+}
+
+// normalizeWebsite checks a website URL and returns it as stored: scheme and
+// host lowercased, https:// put before bare host names. "" stays "".
+func normalizeWebsite(website string) (string, error) {
+    website = strings.TrimSpace(website)
+    if website == "" {
+        return "", nil
+    }
+    if len(website) > maxWebsiteLength {
+        return "", errors.New("website must not be longer than 2048 characters")
+    }
+    if !strings.Contains(website, "://") {
+        website = "https://" + website
+    }
+    u, err := url.Parse(website)
+    if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" || u.User != nil {
+        return "", errors.New("website must be an http(s) URL")
+    }
+    u.Scheme, u.Host = strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+    u.Fragment = ""
+    return u.String(), nil
+}
+
+// normalizeWebsite normalizes the website the changes set, returning why it
+// is invalid if it is
+func (ch *contactChanges) normalizeWebsite() string {
+    if ch.Website == nil {
+        return ""
+    }
+    website, err := normalizeWebsite(*ch.Website)
+    if err != nil {
+        return err.Error()
+    }
+    ch.Website = &website
+    return ""
+}
+
+// startWebsiteFetchers starts the goroutines that fetch queued websites
+func startWebsiteFetchers() {
+    for i := 0; i < websiteFetchers; i++ {
+        go func() {
+            for f := range websiteQueue {
+                enrichWebsite(f)
+            }
+        }()
+    }
+}
+
+// queueWebsiteFetch queues fetching the website a contact event set, if
+// enrichment is on. Created contacts come as Contact, updates as their
+// changes.
+func queueWebsiteFetch(r *http.Request, eventType string, data any) {
+    if !currentConfig().Websites.Enrich {
+        return
+    }
+    var id, website string
+    switch d := data.(type) {
+    case Contact:
+        id, website = d.ID.Hex(), d.Website
+    case bson.M:
+        id, _ = d["id"].(string)
+        changes, _ := d["changes"].(bson.M)
+        website, _ = changes["website"].(string)
+    }
+    objID, err := primitive.ObjectIDFromHex(id)
+    if eventType == "contact.deleted" || website == "" || err != nil {
+        return
+    }
+    f := websiteFetch{ctx: withTrace(r.Context(), context.Background()), tenant: tenantOf(r), id: objID, website: website}
+    select {
+    case websiteQueue <- f:
+    default:
+        websiteEnrichments.Inc("dropped")
+        logWarn("website queue full, dropped the preview of contact %s", id)
+    }
+}
+
+// enrichWebsite fetches f's website and stores what it found on the contact,
+// unless the website was changed in the meantime. Previews aren't changes to
+// the contact: they don't count as a version, and reach sync clients with the
+// contact's next change.
+func enrichWebsite(f websiteFetch) {
+    ctx, cancel := context.WithTimeout(f.ctx, websiteFetchTimeout+5*time.Second)
+    defer cancel()
+
+    preview, err := fetchWebsitePreview(ctx, f.website)
+    if err != nil {
+        websiteEnrichments.Inc("failed")
+        logInfo("contact %s: no preview of %s: %v", f.id.Hex(), f.website, err)
+        return
+    }
+    filter := tenantFilter(f.tenant)
+    filter["_id"], filter["website"] = f.id, f.website
+    if _, err := contactsCollection.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"website_preview": preview}}); err != nil {
+        websiteEnrichments.Inc("failed")
+        logError("contact %s: failed to store its website preview: %v", f.id.Hex(), err)
+        return
+    }
+    contactCache.Delete(f.tenant + "/" + f.id.Hex())
+    websiteEnrichments.Inc("fetched")
+}
+
+// fetchWebsitePreview reads the title and favicon of the HTML page at
+// website. Pages without a favicon link get the /favicon.ico of their host.
+func fetchWebsitePreview(ctx context.Context, website string) (WebsitePreview, error) {
+    var preview WebsitePreview
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, website, nil)
+    if err != nil {
+        return preview, err
+    }
+    req.Header.Set("Accept", "text/html")
+    req.Header.Set("User-Agent", "user-service-preview/"+version)
+    resp, err := websiteClient.Do(req)
+    if err != nil {
+        return preview, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return preview, errors.New(resp.Status)
+    }
+    if mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mt != "text/html" && mt != "application/xhtml+xml" {
+        return preview, errors.New("not an HTML page")
+    }
+    body, err := io.ReadAll(io.LimitReader(resp.Body, maxWebsiteRead))
+    if err != nil {
+        return preview, err
+    }
+    page := strings.ToValidUTF8(string(body), "\uFFFD")
+    base := resp.Request.URL
+
+    if m := websiteTitlePattern.FindStringSubmatch(page); m != nil {
+        title := strings.Join(strings.Fields(html.UnescapeString(m[1])), " ")
+        if utf8.RuneCountInString(title) > maxWebsiteTitle {
+            title = string([]rune(title)[:maxWebsiteTitle])
+        }
+        preview.Title = title
+    }
+    preview.Favicon = base.ResolveReference(&url.URL{Path: "/favicon.ico"}).String()
+    for _, link := range websiteLinkPattern.FindAllString(page, -1) {
+        var rel, href string
+        for _, attr := range websiteAttrPattern.FindAllStringSubmatch(link, -1) {
+            value := html.UnescapeString(strings.Trim(attr[2], `"'`))
+            if strings.EqualFold(attr[1], "rel") {
+                rel = value
+            } else {
+                href = value
+            }
+        }
+        isIcon := false
+        for _, r := range strings.Fields(strings.ToLower(rel)) {
+            isIcon = isIcon || r == "icon"
+        }
+        if !isIcon || href == "" {
+            continue
+        }
+        if u, err := base.Parse(strings.TrimSpace(href)); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+            preview.Favicon = u.String()
+            break
+        }
+    }
+    preview.FetchedAt = utcNow()
+    return preview, nil
+}
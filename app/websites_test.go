@@ -0,0 +1,80 @@
+package main
+
+import (
+    "net/netip"
+    "testing"
+)
+
+func TestIsPublicAddress(t *testing.T) {
+    tests := []struct {
+        addr string
+        want bool
+    }{
+        {"93.184.215.14", true},
+        {"8.8.8.8", true},
+        {"2606:4700::6810:84e5", true},
+        {"::ffff:93.184.215.14", true},
+        {"64:ff9b::5db8:d70e", true}, // NAT64 of 93.184.215.14
+
+        {"0.0.0.0", false},
+        {"0.1.2.3", false},
+        {"10.1.2.3", false},
+        {"100.64.0.1", false},
+        {"127.0.0.1", false},
+        {"169.254.169.254", false},
+        {"172.16.0.1", false},
+        {"192.0.0.8", false},
+        {"192.0.2.1", false},
+        {"192.168.1.1", false},
+        {"198.18.0.1", false},
+        {"198.19.255.255", false},
+        {"198.51.100.1", false},
+        {"203.0.113.1", false},
+        {"224.0.0.1", false},
+        {"240.0.0.1", false},
+        {"255.255.255.255", false},
+
+        {"::", false},
+        {"::1", false},
+        {"::ffff:127.0.0.1", false},
+        {"::ffff:169.254.169.254", false},
+        {"64:ff9b::7f00:1", false},    // NAT64 of 127.0.0.1
+        {"64:ff9b::a9fe:a9fe", false}, // NAT64 of 169.254.169.254
+        {"64:ff9b:1::1", false},
+        {"100::1", false},
+        {"2001::1", false},
+        {"2001:db8::1", false},
+        {"2002:7f00:1::1", false},
+        {"3fff::1", false},
+        {"fc00::1", false},
+        {"fd12:3456::1", false},
+        {"fe80::1", false},
+        {"fe80::1%eth0", false},
+        {"fec0::1", false},
+        {"ff02::1", false},
+    }
+    for _, tt := range tests {
+        if got := isPublicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+            t.Errorf("isPublicAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+        }
+    }
+}
+
+func TestPublicAddressOnly(t *testing.T) {
+    tests := []struct {
+        address string
+        ok      bool
+    }{
+        {"93.184.215.14:443", true},
+        {"93.184.215.14:80", true},
+        {"[2606:4700::6810:84e5]:443", true},
+        {"93.184.215.14:8080", false},
+        {"127.0.0.1:443", false},
+        {"[64:ff9b::a9fe:a9fe]:80", false},
+    }
+    for _, tt := range tests {
+        if err := publicAddressOnly("tcp", tt.address, nil); (err == nil) != tt.ok {
+            t.Errorf("publicAddressOnly(%s) = %v, want ok %v", tt.address, err, tt.ok)
+        }
+    }
+}